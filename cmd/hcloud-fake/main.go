@@ -0,0 +1,63 @@
+// Command hcloud-fake serves the in-memory fake Hetzner Cloud API from
+// internal/hcloud/hcloudtest so the mage targets can be exercised without a
+// real Hetzner account.
+//
+// Usage:
+//
+//	go run ./cmd/hcloud-fake -listen 127.0.0.1:8089 -network k3s-net -placement-group k3s-placement-group -ssh-key admin
+//	HCLOUD_ENDPOINT=http://127.0.0.1:8089/v1 HCLOUD_TOKEN=fake mage recreateServer cpx21-control-1
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"k3s-nixos-configs/internal/hcloud/hcloudtest"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8089", "address to serve the fake API on")
+	network := flag.String("network", "k3s-net", "name of a private network to pre-create (empty to skip)")
+	placementGroup := flag.String("placement-group", "k3s-placement-group", "name of a placement group to pre-create (empty to skip)")
+	sshKey := flag.String("ssh-key", "", "name of an SSH key to pre-register (empty to skip)")
+	actionPolls := flag.Int("action-polls", 1, "number of polls before an action reports success")
+	floatingIP := flag.String("floating-ip", "", "name of an unassigned floating IP to pre-create (empty to skip)")
+	failActions := flag.String("fail-actions", "", "comma-separated action commands to end in the error state, e.g. create_server")
+	unavailable := flag.String("unavailable", "", "comma-separated <server type>@<location> pairs to report as out of stock, e.g. cpx31@ash")
+	flag.Parse()
+
+	fake := hcloudtest.NewHandler()
+	fake.ActionPolls = *actionPolls
+	if *network != "" {
+		fake.AddNetwork(*network, "10.0.0.0/16")
+	}
+	if *placementGroup != "" {
+		fake.AddPlacementGroup(*placementGroup)
+	}
+	if *sshKey != "" {
+		fake.AddSSHKey(*sshKey)
+	}
+	if *floatingIP != "" {
+		fake.AddFloatingIP(*floatingIP, "")
+	}
+	for _, command := range strings.Split(*failActions, ",") {
+		if command != "" {
+			fake.FailActions(command, "failed by hcloud-fake -fail-actions")
+		}
+	}
+	for _, pair := range strings.Split(*unavailable, ",") {
+		if pair == "" {
+			continue
+		}
+		serverType, location, ok := strings.Cut(pair, "@")
+		if !ok {
+			log.Fatalf("invalid -unavailable entry %q, expected <server type>@<location>", pair)
+		}
+		fake.SetServerTypeUnavailable(serverType, location)
+	}
+
+	log.Printf("fake Hetzner Cloud API listening on http://%s/v1", *listen)
+	log.Fatal(http.ListenAndServe(*listen, fake))
+}
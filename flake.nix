@@ -66,6 +66,14 @@
           value = builtins.getEnv name;
         in
         if value == "" then defaultValue else value;
+      # MAGE_CLUSTER selects a named cluster (e.g. staging) with its own machines and sops
+      # files: machines.<cluster>.nix and sops.secrets.<cluster>.yaml. Unset means the
+      # default machines.nix and sops.secrets.yaml. Requires --impure, like getEnv above.
+      cluster = builtins.getEnv "MAGE_CLUSTER";
+      clusterFile =
+        base: ext: if cluster == "" then ./. + "/${base}${ext}" else ./. + "/${base}.${cluster}${ext}";
+      sopsSecretsPath = clusterFile "sops.secrets" ".yaml";
+
       stateVersionModule =
         version:
         { ... }:
@@ -91,12 +99,12 @@
           sops.secrets.TAILSCALE_PROVISION_KEY = { };
           sops.defaultSopsFile = "/etc/nixos/secrets.sops.yaml";
           system.activationScripts.deploySopsFile =
-            lib.mkIf (config.sops.defaultSopsFile != null && builtins.pathExists ./sops.secrets.yaml)
+            lib.mkIf (config.sops.defaultSopsFile != null && builtins.pathExists sopsSecretsPath)
               {
                 text = ''
                   echo "Copying encrypted sops file to target system..."
                   mkdir -p "$(dirname "${config.sops.defaultSopsFile}")"
-                  cp ${./sops.secrets.yaml} "${config.sops.defaultSopsFile}"
+                  cp ${sopsSecretsPath} "${config.sops.defaultSopsFile}"
                   chmod 0400 "${config.sops.defaultSopsFile}"
                   echo "Encrypted sops file deployed to ${config.sops.defaultSopsFile}"
                 '';
@@ -112,6 +120,8 @@
         nixosStateVersion = getEnv "NIXOS_STATE_VERSION" "25.05";
         hetznerPublicInterface = getEnv "HETZNER_PUBLIC_INTERFACE" "eth0";
         hetznerPrivateInterface = getEnv "HETZNER_PRIVATE_INTERFACE" "ens10";
+        # The control plane IP from `mage allocateControlPlaneIP floating` must be configured on the node.
+        hetznerControlPlaneFloatingIP = getEnv "HETZNER_CONTROL_PLANE_FLOATING_IP" "false" == "true";
       };
 
       rolePathMappings = {
@@ -159,9 +169,11 @@
           specialArgs = specialArgsResolved;
         };
 
-      privateMachinesPath = ./machines.nix;
+      privateMachinesPath = clusterFile "machines" ".nix";
       allMachinesData =
-        if builtins.pathExists privateMachinesPath then
+        if cluster != "" && !builtins.pathExists privateMachinesPath then
+          throw "MAGE_CLUSTER is set to '${cluster}' but machines.${cluster}.nix does not exist"
+        else if builtins.pathExists privateMachinesPath then
           (import privateMachinesPath {
             inherit
               lib
@@ -243,6 +255,21 @@
           }
       ) (lib.filterAttrs (name: data: data != null && data ? deploy) allMachinesData);
 
+      # Machine metadata for tooling (`mage inventory` and the other mage targets).
+      # This mirrors the fields used by deploy.nodes and nixosConfigurations above but is
+      # cheap to evaluate, since it does not instantiate any NixOS system.
+      inventory = lib.mapAttrs (name: machineData: {
+        inherit (machineData) location nodeType;
+        protected = machineData.protected or false;
+        sshHostname = machineData.deploy.sshHostname or "";
+        sshUser = machineData.deploy.sshUser or "";
+        # Bastion (a node name or user@host[:port]) the mage targets reach this machine through.
+        sshJumpHost = machineData.deploy.sshJumpHost or "";
+        # Hetzner Cloud server parameters (serverType, location, image, ipv4, ipv6, labels,
+        # volumes) used by `mage recreateServer`; unset fields fall back to .env defaults.
+        hetzner = machineData.hetzner or null;
+      }) allMachinesData;
+
       packages.${system} =
         let
           mageEnvPath = lib.makeBinPath [
@@ -348,6 +375,7 @@
           echo "Ensure required environment variables are set (e.g., K3S_CONTROL_PLANE_ADDR, ADMIN_SSH_PUBLIC_KEY)."
           echo "Ensure ./sops.secrets.yaml is created and encrypted."
           echo "Ensure ./machines.nix exists and is populated (this file is gitignored)."
+          echo "For another cluster, set MAGE_CLUSTER=<name> and create .env.<name>, machines.<name>.nix and sops.secrets.<name>.yaml."
           echo "Ensure Disko layouts exist (e.g., ./disko-configs/hetzner-disko-layout.nix)."
           echo "Ensure ./dummy-hardware-config.nix exists for local pure flake checks."
           echo "Hardware configs for actual deployments will use /etc/nixos/hardware-configuration.nix (Option A)."
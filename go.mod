@@ -5,4 +5,8 @@ go 1.21
 require (
 	github.com/joho/godotenv v1.5.1
 	github.com/magefile/mage v1.15.0
+	golang.org/x/crypto v0.33.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.30.0 // indirect
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// DefaultClusterName is reported for the cluster used when MAGE_CLUSTER is unset.
+const DefaultClusterName = "default"
+
+// clusterNamePattern restricts cluster names to what is safe in file names.
+var clusterNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Cluster is a named environment selected with MAGE_CLUSTER. Each cluster has
+// its own dotenv, machines and sops files, so staging and production can live
+// side by side in one checkout:
+//
+//	MAGE_CLUSTER unset:   .env          machines.nix          sops.secrets.yaml
+//	MAGE_CLUSTER=staging: .env.staging  machines.staging.nix  sops.secrets.staging.yaml
+//
+// flake.nix reads MAGE_CLUSTER as well to pick the machines and sops files.
+type Cluster struct {
+	// Name is the value of MAGE_CLUSTER, or "" for the default cluster.
+	Name string
+}
+
+// ParseCluster validates a MAGE_CLUSTER value. An empty name selects the default cluster.
+func ParseCluster(name string) (Cluster, error) {
+	if name != "" && !clusterNamePattern.MatchString(name) {
+		return Cluster{}, fmt.Errorf("config: invalid MAGE_CLUSTER '%s' (use lowercase letters, digits, '-' and '_')", name)
+	}
+	return Cluster{Name: name}, nil
+}
+
+// String returns the cluster name, or DefaultClusterName.
+func (c Cluster) String() string {
+	if c.Name == "" {
+		return DefaultClusterName
+	}
+	return c.Name
+}
+
+// EnvFile returns the dotenv file of the cluster.
+func (c Cluster) EnvFile() string {
+	return c.file(".env", "")
+}
+
+// MachinesFile returns the machines file of the cluster, imported by flake.nix.
+func (c Cluster) MachinesFile() string {
+	return c.file("machines", ".nix")
+}
+
+// SopsFile returns the sops-encrypted secrets file of the cluster.
+func (c Cluster) SopsFile() string {
+	return c.file("sops.secrets", ".yaml")
+}
+
+// KnownHostsFile returns the known_hosts file pinning the SSH host keys of the cluster's
+// nodes, unless MAGE_SSH_KNOWN_HOSTS points elsewhere.
+func (c Cluster) KnownHostsFile() string {
+	return c.file("known_hosts", "")
+}
+
+// Describe returns a one-line summary of the cluster and its files.
+func (c Cluster) Describe() string {
+	return fmt.Sprintf("cluster '%s' (%s, %s, %s)", c, c.EnvFile(), c.MachinesFile(), c.SopsFile())
+}
+
+func (c Cluster) file(base, ext string) string {
+	if c.Name == "" {
+		return base + ext
+	}
+	return base + "." + c.Name + ext
+}
+
+// LoadCluster loads the configuration of cluster from its dotenv file (see
+// Load). The default cluster may run on the environment alone, but a named
+// cluster must have its own file: falling back to the default cluster's
+// settings would point the targets at the wrong machines.
+func LoadCluster(cluster Cluster) (*Config, error) {
+	if cluster.Name != "" {
+		if _, err := os.Stat(cluster.EnvFile()); err != nil {
+			return nil, fmt.Errorf("config: MAGE_CLUSTER is set to '%s' but %s does not exist", cluster, cluster.EnvFile())
+		}
+	}
+	return Load(cluster.EnvFile())
+}
+
+// Cluster returns the cluster selected with MAGE_CLUSTER.
+func (c *Config) Cluster() Cluster {
+	return Cluster{Name: c.ClusterName}
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCluster(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: ""},
+		{name: "staging"},
+		{name: "prod-eu_2"},
+		{name: "1st"},
+		{name: "../prod", wantErr: true},
+		{name: "prod/eu", wantErr: true},
+		{name: `prod\eu`, wantErr: true},
+		{name: "/etc/passwd", wantErr: true},
+		{name: "..", wantErr: true},
+		{name: "prod.eu", wantErr: true},
+		{name: "Staging", wantErr: true},
+		{name: "-staging", wantErr: true},
+		{name: "_staging", wantErr: true},
+		{name: "staging ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster, err := ParseCluster(tt.name)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "invalid MAGE_CLUSTER") {
+					t.Errorf("ParseCluster(%q) = %+v, %v, want an invalid MAGE_CLUSTER error", tt.name, cluster, err)
+				}
+				return
+			}
+			if err != nil || cluster.Name != tt.name {
+				t.Errorf("ParseCluster(%q) = %+v, %v", tt.name, cluster, err)
+			}
+		})
+	}
+}
+
+func TestClusterFiles(t *testing.T) {
+	tests := []struct {
+		cluster                               Cluster
+		name, env, machines, sops, knownHosts string
+	}{
+		{Cluster{}, "default", ".env", "machines.nix", "sops.secrets.yaml", "known_hosts"},
+		{Cluster{Name: "staging"}, "staging", ".env.staging", "machines.staging.nix", "sops.secrets.staging.yaml", "known_hosts.staging"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.cluster
+			if c.String() != tt.name || c.EnvFile() != tt.env || c.MachinesFile() != tt.machines || c.SopsFile() != tt.sops || c.KnownHostsFile() != tt.knownHosts {
+				t.Errorf("%+v: got %s %s %s %s %s, want %s %s %s %s %s", c,
+					c.String(), c.EnvFile(), c.MachinesFile(), c.SopsFile(), c.KnownHostsFile(),
+					tt.name, tt.env, tt.machines, tt.sops, tt.knownHosts)
+			}
+		})
+	}
+}
+
+// inDir runs the rest of the test in dir, where the cluster files are looked up.
+func inDir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// unsetEnv unsets the variables for the rest of the test, so values loaded from
+// a dotenv file are not left behind for other tests.
+func unsetEnv(t *testing.T, envs ...string) {
+	t.Helper()
+	for _, env := range envs {
+		t.Setenv(env, "")
+		os.Unsetenv(env)
+	}
+}
+
+func TestLoadCluster(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		".env":         "HETZNER_LOCATION=fsn1\n",
+		".env.staging": "HETZNER_LOCATION=hel1\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inDir(t, dir)
+
+	tests := []struct {
+		name         string
+		cluster      string
+		wantEnvFile  string
+		wantLocation string
+		wantErr      string
+	}{
+		{name: "default cluster", cluster: "", wantEnvFile: ".env", wantLocation: "fsn1"},
+		{name: "named cluster", cluster: "staging", wantEnvFile: ".env.staging", wantLocation: "hel1"},
+		{name: "named cluster without env file", cluster: "production", wantErr: "MAGE_CLUSTER is set to 'production' but .env.production does not exist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unsetEnv(t, "HETZNER_LOCATION")
+			cluster, err := ParseCluster(tt.cluster)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadCluster(cluster)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadCluster(%s) = %v, want an error containing %q", cluster, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadCluster(%s): %v", cluster, err)
+			}
+			if cfg.EnvFile() != tt.wantEnvFile {
+				t.Errorf("EnvFile() = %q, want %q", cfg.EnvFile(), tt.wantEnvFile)
+			}
+			if cfg.HetznerLocation != tt.wantLocation {
+				t.Errorf("HETZNER_LOCATION = %q, want %q from %s", cfg.HetznerLocation, tt.wantLocation, tt.wantEnvFile)
+			}
+			if cfg.Source("HETZNER_LOCATION") != tt.wantEnvFile {
+				t.Errorf("Source(HETZNER_LOCATION) = %q, want %q", cfg.Source("HETZNER_LOCATION"), tt.wantEnvFile)
+			}
+		})
+	}
+}
+
+func TestLoadClusterDefaultWithoutEnvFile(t *testing.T) {
+	inDir(t, t.TempDir())
+	unsetEnv(t, "HETZNER_LOCATION")
+	cfg, err := LoadCluster(Cluster{})
+	if err != nil {
+		t.Fatalf("LoadCluster without .env: %v", err)
+	}
+	if cfg.EnvFile() != "" {
+		t.Errorf("EnvFile() = %q, want none", cfg.EnvFile())
+	}
+	if cfg.Source("HETZNER_LOCATION") != SourceDefault {
+		t.Errorf("Source(HETZNER_LOCATION) = %q, want the default", cfg.Source("HETZNER_LOCATION"))
+	}
+}
@@ -0,0 +1,328 @@
+// Package config loads the mage configuration from .env and the process
+// environment into a single typed struct.
+//
+// Every setting is a field of Config tagged with the environment variable it
+// is read from (`env`), an optional default (`default`) and whether it is a
+// secret that must be masked when printed (`secret`), and whether mage warns
+// at startup when it is unset (`critical`). Values already present
+// in the process environment take precedence over .env, matching the
+// behaviour of godotenv.Load and direnv.
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Config is the effective mage configuration.
+type Config struct {
+	// Hetzner Cloud
+	HcloudToken            string `env:"HCLOUD_TOKEN" secret:"true" critical:"true"`
+	HcloudEndpoint         string `env:"HCLOUD_ENDPOINT"`
+	HetznerSSHKeyName      string `env:"HETZNER_SSH_KEY_NAME"`
+	PrivateNetworkName     string `env:"PRIVATE_NETWORK_NAME" default:"k3s-net"`
+	PlacementGroupName     string `env:"PLACEMENT_GROUP_NAME" default:"k3s-placement-group"`
+	FirewallName           string `env:"FIREWALL_NAME"`
+	PrivateNetworkIPRange  string `env:"PRIVATE_NETWORK_IP_RANGE" default:"10.0.0.0/16"`
+	PrivateSubnetIPRange   string `env:"PRIVATE_SUBNET_IP_RANGE" default:"10.0.1.0/24"`
+	AdminPublicIP          string `env:"ADMIN_PUBLIC_IP"`
+	HetznerLocation        string `env:"HETZNER_LOCATION" default:"ash"`
+	HetznerImageName       string `env:"HETZNER_IMAGE_NAME" default:"debian-12"`
+	ControlPlaneVMType     string `env:"CONTROL_PLANE_VM_TYPE" default:"cpx21"`
+	WorkerVMType           string `env:"WORKER_VM_TYPE" default:"cpx11"`
+	DefaultEnableIPv4      bool   `env:"HETZNER_DEFAULT_ENABLE_IPV4" default:"false"`
+	HcloudServerLimit      int    `env:"HCLOUD_SERVER_LIMIT"`
+	ControlPlaneIPName     string `env:"HETZNER_CONTROL_PLANE_IP_NAME" default:"k3s-control-plane"`
+	ControlPlaneFloatingIP bool   `env:"HETZNER_CONTROL_PLANE_FLOATING_IP" default:"false"`
+	LoadBalancerName       string `env:"LOAD_BALANCER_NAME" default:"k3s-api"`
+	LoadBalancerType       string `env:"LOAD_BALANCER_TYPE" default:"lb11"`
+	LoadBalancerPublic     bool   `env:"LOAD_BALANCER_PUBLIC" default:"false"`
+
+	// Cluster
+	K3sControlPlaneAddr string `env:"K3S_CONTROL_PLANE_ADDR"`
+	K3sClusterName      string `env:"K3S_CLUSTER_NAME" default:"k3s-cluster"`
+	K3sToken            string `env:"K3S_TOKEN" secret:"true" critical:"true"`
+	TailscaleAuthKey    string `env:"TAILSCALE_AUTH_KEY" secret:"true" critical:"true"`
+	AdminSSHPublicKey   string `env:"ADMIN_SSH_PUBLIC_KEY"`
+
+	// Secrets
+	AgePrivateKey string `env:"AGE_PRIVATE_KEY" secret:"true" critical:"true"`
+	GithubToken   string `env:"GITHUB_TOKEN" secret:"true" critical:"true"`
+
+	// Local tooling
+	SSHKey          string `env:"MAGE_SSH_KEY" default:"~/.ssh/id_rsa"`
+	SSHKnownHosts   string `env:"MAGE_SSH_KNOWN_HOSTS"`
+	SSHAddressOrder string `env:"MAGE_SSH_ADDRESS_ORDER" default:"tailscale,machines,hetzner"`
+	SSHJumpHost     string `env:"MAGE_SSH_JUMP_HOST"`
+	Kubeconfig      string `env:"KUBECONFIG"`
+	// KubeconfigUseContext makes fetchKubeconfig switch the current context to the fetched cluster.
+	KubeconfigUseContext bool `env:"MAGE_KUBECONFIG_USE_CONTEXT" default:"true"`
+
+	// Mage behaviour
+	ClusterName    string `env:"MAGE_CLUSTER"`
+	DryRun         bool   `env:"MAGE_DRY_RUN" default:"false"`
+	Yes            bool   `env:"MAGE_YES" default:"false"`
+	ProtectedNodes string `env:"MAGE_PROTECTED_NODES"`
+	AllowProtected string `env:"MAGE_ALLOW_PROTECTED"`
+	AdoptServers   string `env:"MAGE_ADOPT_SERVERS"`
+
+	// Snapshots
+	SnapshotBeforeDelete bool `env:"MAGE_SNAPSHOT_BEFORE_DELETE" default:"false"`
+	SnapshotRetention    int  `env:"MAGE_SNAPSHOT_RETENTION" default:"3"`
+
+	// Remote commands (mage exec)
+	ExecConcurrency int           `env:"MAGE_EXEC_CONCURRENCY" default:"5"`
+	ExecTimeout     time.Duration `env:"MAGE_EXEC_TIMEOUT" default:"5m"`
+
+	// Rebuilds (mage rebuild)
+	RebuildMode      string `env:"MAGE_REBUILD_MODE" default:"switch"`
+	RebuildBuilders  string `env:"MAGE_REBUILD_BUILDERS"`
+	RebuildFlakePath string `env:"MAGE_REBUILD_FLAKE_PATH"`
+
+	// Readiness checks
+	WaitSSHPortTimeout      time.Duration `env:"MAGE_WAIT_SSH_PORT_TIMEOUT" default:"5m"`
+	WaitSSHHandshakeTimeout time.Duration `env:"MAGE_WAIT_SSH_HANDSHAKE_TIMEOUT" default:"2m"`
+	WaitNixOSSystemTimeout  time.Duration `env:"MAGE_WAIT_NIXOS_SYSTEM_TIMEOUT" default:"10m"`
+	WaitK3sAPITimeout       time.Duration `env:"MAGE_WAIT_K3S_API_TIMEOUT" default:"10m"`
+	WaitK3sReadyzTimeout    time.Duration `env:"MAGE_WAIT_K3S_READYZ_TIMEOUT" default:"10m"`
+	WaitK3sNodeReadyTimeout time.Duration `env:"MAGE_WAIT_K3S_NODE_READY_TIMEOUT" default:"10m"`
+	WaitBackoff             time.Duration `env:"MAGE_WAIT_BACKOFF" default:"2s"`
+	WaitMaxBackoff          time.Duration `env:"MAGE_WAIT_MAX_BACKOFF" default:"15s"`
+
+	// sources maps an environment variable name to where its value came from.
+	sources map[string]string
+	// envFile is the dotenv file that was loaded, or "" if none was found.
+	envFile string
+}
+
+// Value sources reported by Source.
+const (
+	SourceEnvironment = "environment"
+	SourceDefault     = "default"
+	SourceUnset       = "unset"
+)
+
+// Load reads envFile (if it exists) into the process environment without
+// overriding variables that are already set, then populates a Config from the
+// environment. Subprocesses such as `nix eval --impure` therefore see the same
+// values. It returns an error if a value cannot be parsed.
+func Load(envFile string) (*Config, error) {
+	// Remember what was set before loading the file, to report where values came from.
+	preset := map[string]bool{}
+	for _, f := range fields() {
+		if _, ok := os.LookupEnv(f.env); ok {
+			preset[f.env] = true
+		}
+	}
+
+	if _, err := os.Stat(envFile); err == nil {
+		if err := godotenv.Load(envFile); err != nil {
+			return nil, fmt.Errorf("config: failed to load %s: %w", envFile, err)
+		}
+	} else {
+		envFile = ""
+	}
+
+	cfg := &Config{sources: map[string]string{}, envFile: envFile}
+	v := reflect.ValueOf(cfg).Elem()
+	for _, f := range fields() {
+		raw := os.Getenv(f.env)
+		source := SourceEnvironment
+		if !preset[f.env] {
+			source = envFile
+		}
+		if raw == "" {
+			raw = f.def
+			source = SourceDefault
+			if raw == "" {
+				source = SourceUnset
+			}
+		}
+		cfg.sources[f.env] = source
+		if raw == "" {
+			continue
+		}
+		if err := setField(v.Field(f.index), raw); err != nil {
+			return nil, fmt.Errorf("config: invalid value for %s: %w", f.env, err)
+		}
+	}
+	return cfg, nil
+}
+
+// EnvFile returns the dotenv file that was loaded, or "" if none was found.
+func (c *Config) EnvFile() string {
+	return c.envFile
+}
+
+// Source reports where the value of the environment variable came from: the
+// dotenv file name, SourceEnvironment, SourceDefault or SourceUnset.
+func (c *Config) Source(env string) string {
+	if source, ok := c.sources[env]; ok {
+		return source
+	}
+	return SourceUnset
+}
+
+// IsSet reports whether the environment variable has a non-default value.
+func (c *Config) IsSet(env string) bool {
+	source := c.Source(env)
+	return source != SourceDefault && source != SourceUnset
+}
+
+// Missing returns the given environment variables that have no value.
+func (c *Config) Missing(envs ...string) []string {
+	var missing []string
+	for _, env := range envs {
+		if c.Source(env) == SourceUnset {
+			missing = append(missing, env)
+		}
+	}
+	return missing
+}
+
+// MissingCritical returns the critical environment variables (tagged critical)
+// that have no value. Most targets need them, so mage warns about them at startup;
+// each target still checks the variables it actually needs with Require.
+func (c *Config) MissingCritical() []string {
+	var critical []string
+	for _, f := range fields() {
+		if f.critical {
+			critical = append(critical, f.env)
+		}
+	}
+	return c.Missing(critical...)
+}
+
+// Require returns an error naming every given environment variable that has
+// no value. purpose describes what needs them, e.g. "recreateServer".
+func (c *Config) Require(purpose string, envs ...string) error {
+	if missing := c.Missing(envs...); len(missing) > 0 {
+		return fmt.Errorf("ERROR: %s requires these environment variables to be set (in .env or the environment): %s", purpose, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Print writes the effective configuration as a table with secrets masked.
+func (c *Config) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VARIABLE\tVALUE\tSOURCE")
+	v := reflect.ValueOf(c).Elem()
+	for _, f := range fields() {
+		value := formatField(v.Field(f.index))
+		if c.Source(f.env) == SourceUnset {
+			value = "-"
+		} else if f.secret {
+			value = Mask(value)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", f.env, value, c.Source(f.env))
+	}
+	return tw.Flush()
+}
+
+// Secrets returns the values of the secret settings that are set, e.g. to remove them
+// from output collected from the nodes.
+func (c *Config) Secrets() []string {
+	var secrets []string
+	v := reflect.ValueOf(c).Elem()
+	for _, f := range fields() {
+		if value := formatField(v.Field(f.index)); f.secret && value != "" {
+			secrets = append(secrets, value)
+		}
+	}
+	return secrets
+}
+
+// Mask hides a secret, keeping only enough of it to recognise which one is set.
+func Mask(secret string) string {
+	if len(secret) <= 8 {
+		return "********"
+	}
+	return secret[:4] + "********" + fmt.Sprintf(" (%d chars)", len(secret))
+}
+
+// Vars returns the names of all environment variables read into Config.
+func Vars() []string {
+	var names []string
+	for _, f := range fields() {
+		names = append(names, f.env)
+	}
+	return names
+}
+
+// field describes a tagged Config field.
+type field struct {
+	index  int
+	env    string
+	def    string
+	secret bool
+	// critical variables are reported by MissingCritical.
+	critical bool
+}
+
+// fields returns the tagged fields of Config in declaration order.
+func fields() []field {
+	t := reflect.TypeOf(Config{})
+	var out []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		env := sf.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+		out = append(out, field{
+			index:    i,
+			env:      env,
+			def:      sf.Tag.Get("default"),
+			secret:   sf.Tag.Get("secret") == "true",
+			critical: sf.Tag.Get("critical") == "true",
+		})
+	}
+	return out
+}
+
+// setField parses raw into the field according to its type.
+func setField(v reflect.Value, raw string) error {
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(raw)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean (use true/false or 1/0)", raw)
+		}
+		v.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", raw)
+		}
+		v.SetInt(int64(n))
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration (e.g. 90s, 5m)", raw)
+		}
+		v.SetInt(int64(d))
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
+
+// formatField renders a field value for printing.
+func formatField(v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case time.Duration:
+		return x.String()
+	default:
+		return fmt.Sprint(x)
+	}
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+)
+
+// hcloudTokenLength is the length of a Hetzner Cloud API token.
+const hcloudTokenLength = 64
+
+// agePrivateKeyPrefix starts every age X25519 identity (`age-keygen` output).
+const agePrivateKeyPrefix = "AGE-SECRET-KEY-1"
+
+// sshPublicKeyTypes are the key types accepted in authorized_keys by NixOS' OpenSSH.
+var sshPublicKeyTypes = map[string]bool{
+	"ssh-ed25519":                        true,
+	"ssh-rsa":                            true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"sk-ssh-ed25519@openssh.com":         true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+// formatCheckers validate the format of individual variables, on top of the
+// placeholder check that applies to every variable.
+var formatCheckers = map[string]func(string) error{
+	"HCLOUD_TOKEN":           checkHcloudToken,
+	"AGE_PRIVATE_KEY":        checkAgePrivateKey,
+	"ADMIN_SSH_PUBLIC_KEY":   checkSSHPublicKey,
+	"K3S_CONTROL_PLANE_ADDR": checkHost,
+}
+
+// Validate checks the values of the given environment variables and returns
+// an error listing every problem found. Each set variable must not be a
+// placeholder copied from .env.example (see IsPlaceholder), and HCLOUD_TOKEN,
+// AGE_PRIVATE_KEY, ADMIN_SSH_PUBLIC_KEY and K3S_CONTROL_PLANE_ADDR (a bare
+// host) must be well-formed. Unset variables are skipped; use Require for those.
+func (c *Config) Validate(envs ...string) error {
+	values := map[string]string{}
+	v := reflect.ValueOf(c).Elem()
+	for _, f := range fields() {
+		values[f.env] = formatField(v.Field(f.index))
+	}
+
+	var problems []string
+	for _, env := range envs {
+		if !c.IsSet(env) {
+			continue
+		}
+		value := values[env]
+		if IsPlaceholder(value) {
+			problems = append(problems, fmt.Sprintf("%s still has the placeholder value from .env.example", env))
+			continue
+		}
+		if check, ok := formatCheckers[env]; ok {
+			if err := check(value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s %v", env, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("ERROR: invalid configuration (fix these in .env or the environment):\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// IsPlaceholder reports whether value looks like a placeholder from
+// .env.example or a flake.nix default, e.g. REPLACE_ME_WITH_YOUR_K3S_TOKEN,
+// https_REPLACE_ME_K3S_API_ENDPOINT_6443 or your_ssh_key_name_in_hetzner.
+func IsPlaceholder(value string) bool {
+	lower := strings.ToLower(value)
+	return strings.Contains(lower, "replace_me") ||
+		strings.HasPrefix(lower, "your_") ||
+		strings.HasPrefix(lower, "your-")
+}
+
+func checkHcloudToken(value string) error {
+	if len(value) != hcloudTokenLength {
+		return fmt.Errorf("must be a %d character Hetzner Cloud API token, got %d characters", hcloudTokenLength, len(value))
+	}
+	return nil
+}
+
+func checkAgePrivateKey(value string) error {
+	if !strings.HasPrefix(strings.TrimSpace(value), agePrivateKeyPrefix) {
+		return fmt.Errorf("must be an age private key starting with %s (the content of the key file, not its path)", agePrivateKeyPrefix)
+	}
+	return nil
+}
+
+// checkSSHPublicKey checks for an authorized_keys line: "<type> <base64 blob> [comment]",
+// where the blob decodes and names the same key type.
+func checkSSHPublicKey(value string) error {
+	parts := strings.Fields(value)
+	if len(parts) < 2 {
+		return fmt.Errorf("must be an SSH public key like 'ssh-ed25519 AAAA... user@host'")
+	}
+	keyType := parts[0]
+	if !sshPublicKeyTypes[keyType] {
+		return fmt.Errorf("has unsupported SSH key type '%s'", keyType)
+	}
+	blob, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(blob) < 4 {
+		return fmt.Errorf("does not contain a valid base64 encoded SSH public key")
+	}
+	n := binary.BigEndian.Uint32(blob)
+	if uint64(len(blob)) < 4+uint64(n) || string(blob[4:4+n]) != keyType {
+		return fmt.Errorf("is not a valid %s public key (the key data does not match its type)", keyType)
+	}
+	return nil
+}
+
+// checkHost accepts a bare hostname or IPv4 address. The NixOS roles build
+// https://<host>:6443 and <host>/32 from it themselves, so neither a scheme nor a
+// port is allowed, and an IPv6 address would need brackets they do not add.
+func checkHost(value string) error {
+	if strings.Contains(value, "://") {
+		return fmt.Errorf("must be a hostname or IPv4 address without a scheme, got '%s'", value)
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		if ip.To4() == nil {
+			return fmt.Errorf("must be a hostname or IPv4 address, IPv6 addresses are not supported by the NixOS roles, got '%s'", value)
+		}
+		return nil
+	}
+	if strings.Contains(value, ":") {
+		return fmt.Errorf("must be a hostname or IPv4 address without a port (the k3s API port 6443 is implied), got '%s'", value)
+	}
+	if !isHostname(value) {
+		return fmt.Errorf("must be a hostname or IPv4 address, '%s' is neither", value)
+	}
+	return nil
+}
+
+// isHostname reports whether host is a valid DNS name (letters, digits and
+// hyphens in dot-separated labels).
+func isHostname(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadEnv returns the Config for the given environment, without a .env file.
+func loadEnv(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := Load(filepath.Join(t.TempDir(), "missing.env"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return cfg
+}
+
+// sshPublicKey returns a fresh ed25519 key in authorized_keys format.
+func sshPublicKey(t *testing.T) string {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blob []byte
+	for _, field := range [][]byte{[]byte("ssh-ed25519"), pub} {
+		blob = binary.BigEndian.AppendUint32(blob, uint32(len(field)))
+		blob = append(blob, field...)
+	}
+	return "ssh-ed25519 " + base64.StdEncoding.EncodeToString(blob) + " admin@laptop"
+}
+
+func TestValidate(t *testing.T) {
+	validKey := sshPublicKey(t)
+	keyType, keyBlob, _ := strings.Cut(validKey, " ")
+	tests := []struct {
+		name    string
+		env     string
+		value   string
+		wantErr string // substring of the error, "" for valid values
+	}{
+		{"hcloud token", "HCLOUD_TOKEN", strings.Repeat("a", 64), ""},
+		{"short hcloud token", "HCLOUD_TOKEN", "abc", "must be a 64 character Hetzner Cloud API token, got 3"},
+		{"hcloud token placeholder", "HCLOUD_TOKEN", "REPLACE_ME_WITH_YOUR_HCLOUD_TOKEN", "placeholder"},
+		{"age key", "AGE_PRIVATE_KEY", "AGE-SECRET-KEY-1QQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQQ", ""},
+		{"age key file path", "AGE_PRIVATE_KEY", "~/.config/sops/age/keys.txt", "must be an age private key"},
+		{"ssh public key", "ADMIN_SSH_PUBLIC_KEY", validKey, ""},
+		{"ssh public key without comment", "ADMIN_SSH_PUBLIC_KEY", keyType + " " + strings.Fields(keyBlob)[0], ""},
+		{"ssh private key path", "ADMIN_SSH_PUBLIC_KEY", "~/.ssh/id_ed25519.pub", "must be an SSH public key"},
+		{"unsupported ssh key type", "ADMIN_SSH_PUBLIC_KEY", "ssh-dss AAAAB3NzaC1kc3M=", "unsupported SSH key type 'ssh-dss'"},
+		{"ssh key blob not base64", "ADMIN_SSH_PUBLIC_KEY", "ssh-ed25519 not-base64!", "valid base64"},
+		{"ssh key blob of another type", "ADMIN_SSH_PUBLIC_KEY", "ssh-rsa " + strings.Fields(keyBlob)[0], "not a valid ssh-rsa public key"},
+		{"ssh key placeholder", "ADMIN_SSH_PUBLIC_KEY", "your_ssh_public_key", "placeholder"},
+		{"control plane IPv4", "K3S_CONTROL_PLANE_ADDR", "203.0.113.10", ""},
+		{"control plane hostname", "K3S_CONTROL_PLANE_ADDR", "k3s.example.com", ""},
+		{"control plane with port", "K3S_CONTROL_PLANE_ADDR", "203.0.113.10:6443", "without a port"},
+		{"control plane hostname with port", "K3S_CONTROL_PLANE_ADDR", "k3s.example.com:6443", "without a port"},
+		{"control plane URL", "K3S_CONTROL_PLANE_ADDR", "https://203.0.113.10:6443", "without a scheme"},
+		{"control plane IPv6", "K3S_CONTROL_PLANE_ADDR", "2001:db8::1", "IPv6 addresses are not supported"},
+		{"control plane invalid hostname", "K3S_CONTROL_PLANE_ADDR", "k3s_api.example.com", "neither"},
+		{"control plane hostname with leading hyphen", "K3S_CONTROL_PLANE_ADDR", "-k3s.example.com", "neither"},
+		{"control plane flake default", "K3S_CONTROL_PLANE_ADDR", "https_REPLACE_ME_K3S_API_ENDPOINT_6443", "placeholder"},
+		{"other placeholder", "K3S_TOKEN", "REPLACE_ME_WITH_YOUR_K3S_TOKEN", "placeholder"},
+		{"variable without format check", "K3S_TOKEN", "K10abc::server:secret", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadEnv(t, map[string]string{tt.env: tt.value})
+			err := cfg.Validate(tt.env)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate(%s=%q) = %v, want no error", tt.env, tt.value, err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("Validate(%s=%q) succeeded, want an error containing %q", tt.env, tt.value, tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("Validate(%s=%q) = %v, want an error containing %q", tt.env, tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := loadEnv(t, map[string]string{
+		"HCLOUD_TOKEN":           "short",
+		"K3S_CONTROL_PLANE_ADDR": "10.0.0.1:99999",
+		"K3S_TOKEN":              "REPLACE_ME",
+	})
+	err := cfg.Validate("HCLOUD_TOKEN", "K3S_CONTROL_PLANE_ADDR", "K3S_TOKEN")
+	if err == nil {
+		t.Fatal("Validate succeeded, want an error")
+	}
+	for _, env := range []string{"HCLOUD_TOKEN", "K3S_CONTROL_PLANE_ADDR", "K3S_TOKEN"} {
+		if !strings.Contains(err.Error(), env) {
+			t.Errorf("error does not mention %s:\n%v", env, err)
+		}
+	}
+}
+
+func TestValidateSkipsUnset(t *testing.T) {
+	t.Setenv("K3S_CONTROL_PLANE_ADDR", "")
+	cfg := loadEnv(t, nil)
+	if err := cfg.Validate("K3S_CONTROL_PLANE_ADDR"); err != nil {
+		t.Errorf("Validate of an unset variable = %v, want no error", err)
+	}
+}
+
+func TestIsPlaceholder(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"REPLACE_ME_WITH_YOUR_K3S_TOKEN", true},
+		{"https_REPLACE_ME_K3S_API_ENDPOINT_6443", true},
+		{"replace_me", true},
+		{"your_ssh_key_name_in_hetzner", true},
+		{"your-hetzner-token", true},
+		{"YOUR_GITHUB_TOKEN", true},
+		{"", false},
+		{"203.0.113.10", false},
+		{"admin-key", false},
+		{"k3s-cluster-for-your_team", false},
+	}
+	for _, tt := range tests {
+		if got := IsPlaceholder(tt.value); got != tt.want {
+			t.Errorf("IsPlaceholder(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestMissingCritical(t *testing.T) {
+	cfg := loadEnv(t, map[string]string{
+		"HCLOUD_TOKEN":       strings.Repeat("a", 64),
+		"K3S_TOKEN":          "",
+		"TAILSCALE_AUTH_KEY": "",
+		"AGE_PRIVATE_KEY":    "AGE-SECRET-KEY-1X",
+		"GITHUB_TOKEN":       "",
+	})
+	got := strings.Join(cfg.MissingCritical(), ",")
+	if want := "K3S_TOKEN,TAILSCALE_AUTH_KEY,GITHUB_TOKEN"; got != want {
+		t.Errorf("MissingCritical() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,138 @@
+// Package diagnose builds the diagnostic bundle of a node for `mage diagnose`:
+// the commands collected over SSH, the redaction of secrets in their output,
+// the detection of common failures and the tarball.
+package diagnose
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Secret files the nodes read their k3s token and Tailscale key from: rendered by
+// infisical-agent on workers and decrypted by sops-nix on control planes.
+const (
+	InfisicalTokenFile = "/run/infisical-secrets/k3s_token"
+	InfisicalTSKeyFile = "/run/infisical-secrets/tailscale_join_key"
+	SopsTokenFile      = "/run/secrets/k3s_token"
+	SopsTSKeyFile      = "/run/secrets/tailscale_auth_key"
+)
+
+// Item is a file of the bundle and the command run on the node to produce it.
+type Item struct {
+	File    string
+	Command string
+}
+
+// Units are the systemd units whose journals are collected.
+var Units = []string{"k3s", "k3s-agent", "infisical-agent", "sops-nix", "tailscaled"}
+
+// Items returns what is collected from a node. controlPlaneHost and
+// controlPlanePort are where the node joins the cluster, or "" to skip the
+// reachability check.
+func Items(controlPlaneHost, controlPlanePort string) []Item {
+	var items []Item
+	for _, unit := range Units {
+		items = append(items, Item{
+			File:    "journal-" + unit + ".log",
+			Command: fmt.Sprintf("sudo journalctl -u %s -b --no-pager -n 2000 -o short-iso", unit),
+		})
+	}
+	items = append(items,
+		Item{"system.txt", "nixos-version; uname -a; uptime; cat /proc/sys/kernel/hostname"},
+		Item{"units.txt", "systemctl status --no-pager --lines=0 " + strings.Join(Units, " ") + "; systemctl --failed --no-pager"},
+		Item{"tailscale.txt", "sudo tailscale status; sudo tailscale ip"},
+		Item{"network.txt", "networkctl list --no-pager; networkctl status --no-pager; ip addr; ip route; cat /etc/resolv.conf"},
+		Item{"disks.txt", "lsblk -f; df -h; findmnt --real"},
+		// Only whether the secret files exist, never their content.
+		Item{"secrets.txt", fmt.Sprintf(`for f in %s %s %s %s; do if sudo test -s "$f"; then echo "present $f"; elif sudo test -e "$f"; then echo "empty $f"; else echo "missing $f"; fi; done`,
+			InfisicalTokenFile, InfisicalTSKeyFile, SopsTokenFile, SopsTSKeyFile)},
+	)
+	if controlPlaneHost != "" {
+		addr := net.JoinHostPort(controlPlaneHost, controlPlanePort)
+		items = append(items, Item{"control-plane.txt", fmt.Sprintf(
+			`if timeout 5 bash -c 'exec 3<>/dev/tcp/%s/%s'; then echo "reachable %s"; else echo "unreachable %s"; fi`,
+			controlPlaneHost, controlPlanePort, addr, addr)})
+	}
+	return items
+}
+
+// Redactor removes secrets from collected output: values known to the caller
+// (e.g. K3S_TOKEN from .env) and anything shaped like a k3s token, Tailscale
+// auth key, AGE key, bearer token or a token=/secret=/password= assignment.
+type Redactor struct {
+	literals []string
+}
+
+// NewRedactor returns a Redactor that also removes the given secret values.
+func NewRedactor(secrets ...string) *Redactor {
+	r := &Redactor{}
+	for _, s := range secrets {
+		// Short values would redact unrelated text.
+		if len(s) >= 8 {
+			r.literals = append(r.literals, s)
+		}
+	}
+	// Replace longer values first, in case one contains another.
+	sort.Slice(r.literals, func(i, j int) bool { return len(r.literals[i]) > len(r.literals[j]) })
+	return r
+}
+
+// Redacted replaces a secret in the bundle.
+const Redacted = "[REDACTED]"
+
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`K10[0-9a-f]{20,}::[^\s:]+:[^\s"']+`),                                                                 // k3s secure token
+	regexp.MustCompile(`tskey-[A-Za-z0-9-]+`),                                                                                // Tailscale auth key
+	regexp.MustCompile(`AGE-SECRET-KEY-1[0-9A-Z]+`),                                                                          // AGE private key
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`),                                                                 // HTTP authorization
+	regexp.MustCompile(`(?i)((?:token|secret|password|passwd|auth[_-]?key|client[_-]?secret)["']?\s*[:=]\s*["']?)[^\s"',]+`), // key=value
+	regexp.MustCompile(`(?i)(--(?:token|vpn-auth|agent-token)[= ])\S+`),                                                      // command line flags
+}
+
+// Redact returns s without secrets.
+func (r *Redactor) Redact(s string) string {
+	for _, literal := range r.literals {
+		s = strings.ReplaceAll(s, literal, Redacted)
+	}
+	for _, re := range secretPatterns {
+		if re.NumSubexp() > 0 {
+			s = re.ReplaceAllString(s, "${1}"+Redacted)
+		} else {
+			s = re.ReplaceAllString(s, Redacted)
+		}
+	}
+	return s
+}
+
+// File is a file of the bundle.
+type File struct {
+	Name string
+	Data []byte
+}
+
+// WriteTarball writes files as a gzipped tarball with every file below dir/.
+func WriteTarball(w io.Writer, dir string, modTime time.Time, files []File) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		hdr := &tar.Header{Name: path.Join(dir, f.Name), Mode: 0600, Size: int64(len(f.Data)), ModTime: modTime, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("diagnose: failed to write %s: %w", f.Name, err)
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			return fmt.Errorf("diagnose: failed to write %s: %w", f.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("diagnose: failed to write the tarball: %w", err)
+	}
+	return gz.Close()
+}
@@ -0,0 +1,127 @@
+package diagnose
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Finding is a common failure detected in the collected output.
+type Finding struct {
+	// Problem says what is wrong, Hint what to check or do about it.
+	Problem string
+	Hint    string
+	// File is the bundle file showing it.
+	File string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s (see %s). %s", f.Problem, f.File, f.Hint)
+}
+
+// Analyze looks for common reasons a node fails to join in the collected
+// output, keyed by bundle file name. controlPlane selects the secret files the
+// node's k3s reads: sops-nix on control planes, infisical-agent on workers.
+func Analyze(outputs map[string]string, controlPlane bool) []Finding {
+	var findings []Finding
+	add := func(file, problem, hint string) {
+		findings = append(findings, Finding{Problem: problem, Hint: hint, File: file})
+	}
+
+	// Secrets
+	tokenFile, tsKeyFile, secretsUnit := InfisicalTokenFile, InfisicalTSKeyFile, "infisical-agent"
+	if controlPlane {
+		tokenFile, tsKeyFile, secretsUnit = SopsTokenFile, SopsTSKeyFile, "sops-nix"
+	}
+	for _, secret := range []struct{ file, consequence string }{
+		{tokenFile, "k3s cannot join the cluster"},
+		{tsKeyFile, "Tailscale cannot log in"},
+	} {
+		for _, state := range []string{"missing", "empty"} {
+			if hasLine(outputs["secrets.txt"], state+" "+secret.file) {
+				add("secrets.txt", fmt.Sprintf("%s is %s", secret.file, state),
+					fmt.Sprintf("%s without it; check journal-%s.log and that the secret exists", secret.consequence, secretsUnit))
+			}
+		}
+	}
+
+	// Control plane
+	if line := firstLineWithPrefix(outputs["control-plane.txt"], "unreachable "); line != "" {
+		add("control-plane.txt", fmt.Sprintf("the control plane at %s is unreachable from the node", strings.TrimPrefix(line, "unreachable ")),
+			"check K3S_CONTROL_PLANE_ADDR, the Hetzner firewall and that k3s runs on a control plane node")
+	}
+	for _, unit := range []string{"k3s", "k3s-agent"} {
+		journal := outputs["journal-"+unit+".log"]
+		file := "journal-" + unit + ".log"
+		switch {
+		case strings.Contains(journal, "Node password rejected"):
+			add(file, "k3s rejected the node password",
+				"another machine registered this node name before; delete the secret <node>.node-password.k3s in kube-system")
+		case strings.Contains(journal, "401 Unauthorized") || strings.Contains(journal, "token is not valid"):
+			add(file, "the control plane rejected the k3s join token", "check that K3S_TOKEN matches the cluster's token")
+		case strings.Contains(journal, ":6443: connect: connection refused") || strings.Contains(journal, ":6443: i/o timeout") || strings.Contains(journal, ":6443: connect: no route to host"):
+			add(file, fmt.Sprintf("%s cannot connect to the k3s API", unit), "check that the control plane is up and reachable over the network k3s uses")
+		}
+	}
+
+	// Units
+	for _, unit := range Units {
+		if matchLine(outputs["units.txt"], regexp.MustCompile(`^\W*`+regexp.QuoteMeta(unit)+`\.service\s+\S+\s+\S+\s+failed\b`)) {
+			add("units.txt", fmt.Sprintf("%s.service has failed", unit), fmt.Sprintf("see journal-%s.log", unit))
+		}
+	}
+
+	// Tailscale
+	tailscale := outputs["tailscale.txt"]
+	switch {
+	case strings.Contains(tailscale, "Logged out") || strings.Contains(tailscale, "NeedsLogin"):
+		add("tailscale.txt", "Tailscale is not logged in", "check the Tailscale auth key and journal-tailscaled.log")
+	case strings.Contains(tailscale, "Tailscale is stopped") || strings.Contains(tailscale, "failed to connect to local tailscaled"):
+		add("tailscale.txt", "Tailscale is not running", "see journal-tailscaled.log")
+	}
+
+	// Network
+	if network := outputs["network.txt"]; network != "" && !strings.Contains(network, "default via") {
+		add("network.txt", "the node has no default route", "check the network configuration (networkd state)")
+	}
+
+	// Disks
+	for _, line := range strings.Split(outputs["disks.txt"], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || !strings.HasSuffix(fields[4], "%") || !strings.HasPrefix(fields[5], "/") {
+			continue
+		}
+		if used, err := strconv.Atoi(strings.TrimSuffix(fields[4], "%")); err == nil && used >= 95 {
+			add("disks.txt", fmt.Sprintf("%s is %d%% full", fields[5], used), "k3s evicts pods and fails to pull images on full disks")
+		}
+	}
+	return findings
+}
+
+func hasLine(s, line string) bool {
+	for _, l := range strings.Split(s, "\n") {
+		if strings.TrimSpace(l) == line {
+			return true
+		}
+	}
+	return false
+}
+
+func firstLineWithPrefix(s, prefix string) string {
+	for _, l := range strings.Split(s, "\n") {
+		if strings.HasPrefix(l, prefix) {
+			return strings.TrimSpace(l)
+		}
+	}
+	return ""
+}
+
+func matchLine(s string, re *regexp.Regexp) bool {
+	for _, l := range strings.Split(s, "\n") {
+		if re.MatchString(l) {
+			return true
+		}
+	}
+	return false
+}
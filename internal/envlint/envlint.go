@@ -0,0 +1,287 @@
+// Package envlint finds drift between the environment variables the project
+// reads and the ones documented in .env.example or set in .env.
+//
+// Variables are collected statically: from the Go sources (os.Getenv and
+// os.LookupEnv calls with a literal name, and `env:"NAME"` struct tags such as
+// those of config.Config) and from every getEnv "NAME" call in the Nix files
+// (flake.nix, machines.nix, or machines.nix.example if it does not exist, and
+// the modules).
+package envlint
+
+import (
+	"bufio"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Ambient lists variables provided by the shell or the user's tooling rather
+// than by .env. They are never reported.
+var Ambient = map[string]bool{
+	"HOME":          true,
+	"PATH":          true,
+	"USER":          true,
+	"KUBECONFIG":    true,
+	"SSH_AUTH_SOCK": true,
+}
+
+var (
+	// nixGetEnv matches `getEnv "NAME"` and `builtins.getEnv "NAME"` in Nix files.
+	nixGetEnv = regexp.MustCompile(`getEnv\s+"([A-Za-z_][A-Za-z0-9_]*)"`)
+	// envLine matches NAME=... in a dotenv file, optionally commented out and/or exported.
+	envLine = regexp.MustCompile(`^\s*(#\s*)?(export\s+)?([A-Z_][A-Z0-9_]*)\s*=`)
+)
+
+// Report is the result of comparing referenced and documented variables.
+type Report struct {
+	// Referenced maps each variable read by the project to the files reading it.
+	Referenced map[string][]string
+	// Documented holds the variables in .env.example, active or commented out.
+	Documented map[string]bool
+	// Example holds the variables .env.example sets (not commented out).
+	Example map[string]bool
+	// Local holds the variables set in .env, or nil if it does not exist.
+	Local map[string]bool
+
+	// Undocumented are referenced but not in .env.example.
+	Undocumented []string
+	// Unused are in .env.example or .env but never referenced.
+	Unused []string
+	// Missing are set in .env.example and referenced, but not set in .env.
+	Missing []string
+}
+
+// Clean reports whether no drift was found.
+func (r *Report) Clean() bool {
+	return len(r.Undocumented) == 0 && len(r.Unused) == 0 && len(r.Missing) == 0
+}
+
+// Run scans the repository at root and compares the referenced variables with
+// exampleFile and envFile (relative to root). A missing envFile is not an error;
+// Missing is then left empty.
+func Run(root, exampleFile, envFile string) (*Report, error) {
+	referenced, err := Referenced(root)
+	if err != nil {
+		return nil, err
+	}
+	documented, example, err := readEnvFile(filepath.Join(root, exampleFile))
+	if err != nil {
+		return nil, err
+	}
+	_, local, err := readEnvFile(filepath.Join(root, envFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	r := &Report{Referenced: referenced, Documented: documented, Example: example, Local: local}
+	for name := range referenced {
+		if !documented[name] && !Ambient[name] {
+			r.Undocumented = append(r.Undocumented, name)
+		}
+		if local != nil && example[name] && !local[name] {
+			r.Missing = append(r.Missing, name)
+		}
+	}
+	unused := map[string]bool{}
+	for name := range documented {
+		if _, ok := referenced[name]; !ok {
+			unused[name] = true
+		}
+	}
+	for name := range local {
+		if _, ok := referenced[name]; !ok && !Ambient[name] {
+			unused[name] = true
+		}
+	}
+	for name := range unused {
+		r.Unused = append(r.Unused, name)
+	}
+	sort.Strings(r.Undocumented)
+	sort.Strings(r.Unused)
+	sort.Strings(r.Missing)
+	return r, nil
+}
+
+// Referenced returns every variable read by the Go and Nix sources under root,
+// mapped to the (root-relative) files reading it. Hidden directories are skipped.
+func Referenced(root string) (map[string][]string, error) {
+	refs := map[string][]string{}
+	add := func(name, path string) {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			rel = path
+		}
+		for _, existing := range refs[name] {
+			if existing == rel {
+				return
+			}
+		}
+		refs[name] = append(refs[name], rel)
+	}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := filepath.Ext(path)
+		// machines.nix is not committed; fall back to the example it is copied from.
+		if strings.HasSuffix(path, ".nix.example") {
+			if _, err := os.Stat(strings.TrimSuffix(path, ".example")); os.IsNotExist(err) {
+				ext = ".nix"
+			}
+		}
+		switch ext {
+		case ".go":
+			names, err := goEnvVars(path)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				add(name, path)
+			}
+		case ".nix":
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				// Skip commented-out examples such as the template node in machines.nix.example.
+				if strings.HasPrefix(strings.TrimSpace(line), "#") {
+					continue
+				}
+				for _, m := range nixGetEnv.FindAllStringSubmatch(line, -1) {
+					add(m[1], path)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("envlint: failed to scan %s: %w", root, err)
+	}
+	return refs, nil
+}
+
+// goEnvVars returns the variables read by a Go file.
+func goEnvVars(path string) ([]string, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, fmt.Errorf("envlint: failed to parse %s: %w", path, err)
+	}
+	var names []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CallExpr:
+			sel, ok := n.Fun.(*ast.SelectorExpr)
+			if !ok || len(n.Args) == 0 {
+				return true
+			}
+			if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "os" || (sel.Sel.Name != "Getenv" && sel.Sel.Name != "LookupEnv") {
+				return true
+			}
+			if name, ok := stringLit(n.Args[0]); ok {
+				names = append(names, name)
+			}
+		case *ast.Field:
+			if n.Tag == nil {
+				return true
+			}
+			tag, err := strconv.Unquote(n.Tag.Value)
+			if err != nil {
+				return true
+			}
+			if name := reflect.StructTag(tag).Get("env"); name != "" {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
+	return names, nil
+}
+
+// stringLit returns the value of a string literal expression.
+func stringLit(expr ast.Expr) (string, bool) {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	s, err := strconv.Unquote(lit.Value)
+	return s, err == nil
+}
+
+// readEnvFile returns the variables mentioned in a dotenv file (including
+// commented-out NAME=value lines) and the subset actually set.
+func readEnvFile(path string) (mentioned, set map[string]bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	mentioned, set = map[string]bool{}, map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := envLine.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		mentioned[m[3]] = true
+		if m[1] == "" {
+			set[m[3]] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("envlint: failed to read %s: %w", path, err)
+	}
+	return mentioned, set, nil
+}
+
+// Write prints the report: one section per kind of drift, naming the files
+// that reference each variable.
+func (r *Report) Write(w io.Writer, exampleFile, envFile string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	section := func(title string, names []string, where func(string) string) {
+		if len(names) == 0 {
+			return
+		}
+		fmt.Fprintf(tw, "%s (%d):\n", title, len(names))
+		for _, name := range names {
+			fmt.Fprintf(tw, "  %s\t%s\n", name, where(name))
+		}
+	}
+	usedIn := func(name string) string { return "used in " + strings.Join(r.Referenced[name], ", ") }
+
+	section("Undocumented (used but not in "+exampleFile+")", r.Undocumented, usedIn)
+	section("Unused (in "+exampleFile+" or "+envFile+" but never read)", r.Unused, func(name string) string {
+		var in []string
+		if r.Documented[name] {
+			in = append(in, exampleFile)
+		}
+		if r.Local[name] {
+			in = append(in, envFile)
+		}
+		return "listed in " + strings.Join(in, ", ")
+	})
+	section("Missing (set in "+exampleFile+" and used, but not in "+envFile+")", r.Missing, usedIn)
+	if r.Local == nil {
+		fmt.Fprintf(tw, "%s not found, skipped the check for missing variables.\n", envFile)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,164 @@
+package envlint
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTree creates files (path relative to the returned root -> content).
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// sources is a small project reading variables from Go and Nix.
+var sources = map[string]string{
+	"magefile.go": `package main
+
+import "os"
+
+var token = os.Getenv("HCLOUD_TOKEN")
+
+func home() (string, bool) { return os.LookupEnv("HOME") }
+
+func dynamic(name string) string { return os.Getenv(name) }
+`,
+	"internal/config/config.go": "package config\n\ntype Config struct {\n\tLocation string `env:\"HETZNER_LOCATION\" default:\"ash\"`\n\tOther    string `json:\"other\"`\n}\n",
+	"flake.nix": `{
+  k3sToken = builtins.getEnv "K3S_TOKEN";
+  # tailscale = getEnv "COMMENTED_OUT";
+}
+`,
+	"machines.nix.example": `{ getEnv }: { sshHostname = getEnv "NODE_HOST"; }
+`,
+	".direnv/hidden.nix": `{ x = getEnv "HIDDEN_VAR"; }
+`,
+}
+
+func TestReferenced(t *testing.T) {
+	root := writeTree(t, sources)
+	refs, err := Referenced(root)
+	if err != nil {
+		t.Fatalf("Referenced: %v", err)
+	}
+	want := map[string][]string{
+		"HCLOUD_TOKEN":     {"magefile.go"},
+		"HOME":             {"magefile.go"},
+		"HETZNER_LOCATION": {filepath.Join("internal", "config", "config.go")},
+		"K3S_TOKEN":        {"flake.nix"},
+		"NODE_HOST":        {"machines.nix.example"},
+	}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("Referenced() = %v, want %v", refs, want)
+	}
+}
+
+func TestReferencedPrefersMachinesNix(t *testing.T) {
+	files := map[string]string{"machines.nix": `{ getEnv }: { sshHostname = getEnv "REAL_HOST"; }`}
+	for name, content := range sources {
+		files[name] = content
+	}
+	refs, err := Referenced(writeTree(t, files))
+	if err != nil {
+		t.Fatalf("Referenced: %v", err)
+	}
+	if _, ok := refs["NODE_HOST"]; ok {
+		t.Errorf("machines.nix.example was scanned although machines.nix exists")
+	}
+	if _, ok := refs["REAL_HOST"]; !ok {
+		t.Errorf("machines.nix was not scanned")
+	}
+}
+
+func TestRun(t *testing.T) {
+	const example = `# Hetzner
+HCLOUD_TOKEN="REPLACE_ME"
+# HETZNER_LOCATION="ash" # optional
+K3S_TOKEN="REPLACE_ME"
+NODE_HOST="REPLACE_ME"
+`
+	tests := []struct {
+		name             string
+		example          string
+		env              string // "" for no .env file
+		wantUndocumented []string
+		wantUnused       []string
+		wantMissing      []string
+	}{
+		{
+			name:    "clean without .env",
+			example: example,
+		},
+		{
+			name:    "clean with .env",
+			example: example,
+			env:     "HCLOUD_TOKEN=x\nexport K3S_TOKEN=y\nNODE_HOST=z\nHOME=/root\n",
+		},
+		{
+			name:             "undocumented",
+			example:          "HCLOUD_TOKEN=\nK3S_TOKEN=\n",
+			wantUndocumented: []string{"HETZNER_LOCATION", "NODE_HOST"},
+		},
+		{
+			name:       "unused in example and .env",
+			example:    example + "# OLD_SETTING=1\n",
+			env:        "HCLOUD_TOKEN=x\nK3S_TOKEN=y\nNODE_HOST=z\nTYPO_TOKEN=1\n",
+			wantUnused: []string{"OLD_SETTING", "TYPO_TOKEN"},
+		},
+		{
+			name:        "missing in .env",
+			example:     example,
+			env:         "HCLOUD_TOKEN=x\n# K3S_TOKEN=y\n",
+			wantMissing: []string{"K3S_TOKEN", "NODE_HOST"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{".env.example": tt.example}
+			if tt.env != "" {
+				files[".env"] = tt.env
+			}
+			for name, content := range sources {
+				files[name] = content
+			}
+			r, err := Run(writeTree(t, files), ".env.example", ".env")
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if !reflect.DeepEqual(r.Undocumented, tt.wantUndocumented) {
+				t.Errorf("Undocumented = %v, want %v", r.Undocumented, tt.wantUndocumented)
+			}
+			if !reflect.DeepEqual(r.Unused, tt.wantUnused) {
+				t.Errorf("Unused = %v, want %v", r.Unused, tt.wantUnused)
+			}
+			if !reflect.DeepEqual(r.Missing, tt.wantMissing) {
+				t.Errorf("Missing = %v, want %v", r.Missing, tt.wantMissing)
+			}
+			wantClean := tt.wantUndocumented == nil && tt.wantUnused == nil && tt.wantMissing == nil
+			if r.Clean() != wantClean {
+				t.Errorf("Clean() = %v, want %v", r.Clean(), wantClean)
+			}
+			if (tt.env == "") != (r.Local == nil) {
+				t.Errorf("Local = %v with .env %q", r.Local, tt.env)
+			}
+		})
+	}
+}
+
+func TestRunWithoutExample(t *testing.T) {
+	if _, err := Run(writeTree(t, sources), ".env.example", ".env"); err == nil {
+		t.Errorf("Run without .env.example succeeded, want an error")
+	}
+}
@@ -0,0 +1,87 @@
+package hcloud
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Action statuses reported by the API.
+const (
+	ActionStatusRunning = "running"
+	ActionStatusSuccess = "success"
+	ActionStatusError   = "error"
+)
+
+// Action is an asynchronous operation triggered by an API call.
+type Action struct {
+	ID       int64        `json:"id"`
+	Command  string       `json:"command"`
+	Status   string       `json:"status"`
+	Progress int          `json:"progress"`
+	Error    *ActionError `json:"error"`
+}
+
+// ActionError describes why an action failed.
+type ActionError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ActionFailedError is returned by WaitForAction when an action ends in the error state.
+type ActionFailedError struct {
+	Action *Action
+}
+
+func (e *ActionFailedError) Error() string {
+	if e.Action.Error != nil {
+		return fmt.Sprintf("hcloud: action %d (%s) failed: %s (%s)", e.Action.ID, e.Action.Command, e.Action.Error.Message, e.Action.Error.Code)
+	}
+	return fmt.Sprintf("hcloud: action %d (%s) failed", e.Action.ID, e.Action.Command)
+}
+
+// GetAction fetches an action by ID.
+func (c *Client) GetAction(ctx context.Context, id int64) (*Action, error) {
+	var resp struct {
+		Action Action `json:"action"`
+	}
+	if err := c.do(ctx, "GET", fmt.Sprintf("/actions/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Action, nil
+}
+
+// WaitForAction polls an action until it is no longer running. It returns the
+// final action state, or an *ActionFailedError if the action failed.
+func (c *Client) WaitForAction(ctx context.Context, action *Action) (*Action, error) {
+	if action == nil {
+		return nil, nil
+	}
+	current := action
+	for current.Status == ActionStatusRunning || current.Status == "" {
+		select {
+		case <-ctx.Done():
+			return current, fmt.Errorf("hcloud: waiting for action %d (%s): %w", current.ID, current.Command, ctx.Err())
+		case <-time.After(c.pollInterval):
+		}
+		next, err := c.GetAction(ctx, current.ID)
+		if err != nil {
+			return current, err
+		}
+		current = next
+	}
+	if current.Status == ActionStatusError {
+		return current, &ActionFailedError{Action: current}
+	}
+	return current, nil
+}
+
+// WaitForActions waits for each action in turn and returns the first failure.
+func (c *Client) WaitForActions(ctx context.Context, actions ...*Action) error {
+	for _, action := range actions {
+		if _, err := c.WaitForAction(ctx, action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Package hcloud is a small, typed client for the Hetzner Cloud REST API.
+//
+// It covers only the endpoints the mage targets need (servers, actions and the
+// resources referenced when creating a server). It talks to the API directly
+// with net/http so callers get structured results (server IDs, assigned IPs,
+// action status) instead of parsing hcloud CLI output.
+package hcloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultEndpoint is the public Hetzner Cloud API base URL.
+const DefaultEndpoint = "https://api.hetzner.cloud/v1"
+
+// DefaultPollInterval is how often WaitForAction polls a running action.
+const DefaultPollInterval = 2 * time.Second
+
+// Client is a Hetzner Cloud API client authenticated with an API token.
+type Client struct {
+	token        string
+	endpoint     string
+	httpClient   *http.Client
+	pollInterval time.Duration
+	dryRun       func(method, path string, body []byte)
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithEndpoint overrides the API base URL, e.g. to point at a local fake API server.
+func WithEndpoint(endpoint string) ClientOption {
+	return func(c *Client) {
+		c.endpoint = strings.TrimRight(endpoint, "/")
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for API requests.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithPollInterval sets how often running actions are polled.
+func WithPollInterval(interval time.Duration) ClientOption {
+	return func(c *Client) {
+		c.pollInterval = interval
+	}
+}
+
+// WithDryRun makes the client report mutating requests (anything but GET) to
+// record instead of sending them. Read requests are still sent, so lookups
+// such as GetServerByName return real data. Mutating calls return zero values.
+func WithDryRun(record func(method, path string, body []byte)) ClientOption {
+	return func(c *Client) {
+		c.dryRun = record
+	}
+}
+
+// DryRun reports whether mutating requests are recorded instead of sent.
+func (c *Client) DryRun() bool {
+	return c.dryRun != nil
+}
+
+// NewClient returns a Client for the given API token.
+func NewClient(token string, opts ...ClientOption) *Client {
+	c := &Client{
+		token:        token,
+		endpoint:     DefaultEndpoint,
+		httpClient:   &http.Client{Timeout: 60 * time.Second},
+		pollInterval: DefaultPollInterval,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Error is an error response returned by the API.
+type Error struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("hcloud: %s (%s, HTTP %d)", e.Message, e.Code, e.StatusCode)
+}
+
+// IsNotFound reports whether err is an API "not_found" error.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && (apiErr.Code == "not_found" || apiErr.StatusCode == http.StatusNotFound)
+}
+
+// do performs an API request. body, if non-nil, is sent as JSON and the
+// response is decoded into out, if non-nil.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("hcloud: failed to encode request body: %w", err)
+		}
+	}
+
+	if c.dryRun != nil && method != http.MethodGet {
+		c.dryRun(method, path, data)
+		return nil
+	}
+
+	var reqBody io.Reader
+	if data != nil {
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("hcloud: failed to build request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("hcloud: %s %s failed: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("hcloud: failed to read response for %s %s: %w", method, path, err)
+	}
+
+	if resp.StatusCode >= 400 {
+		var errResp struct {
+			Error Error `json:"error"`
+		}
+		if jsonErr := json.Unmarshal(respBody, &errResp); jsonErr != nil || errResp.Error.Code == "" {
+			errResp.Error.Code = "unknown"
+			errResp.Error.Message = strings.TrimSpace(string(respBody))
+		}
+		errResp.Error.StatusCode = resp.StatusCode
+		return &errResp.Error
+	}
+
+	if out != nil && len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("hcloud: failed to decode response for %s %s: %w", method, path, err)
+		}
+	}
+	return nil
+}
+
+// nameQuery returns a query string filtering a collection by name.
+func nameQuery(name string) string {
+	return "?" + url.Values{"name": {name}}.Encode()
+}
@@ -0,0 +1,15 @@
+package hcloud
+
+// EnsureStatus is what an Ensure method did to bring a resource into the
+// desired state. With WithDryRun, it is what would have been done.
+type EnsureStatus string
+
+// Outcomes of the Ensure methods.
+const (
+	// EnsureExisted means the resource already was in the desired state.
+	EnsureExisted EnsureStatus = "existed"
+	// EnsureCreated means the resource did not exist and was created.
+	EnsureCreated EnsureStatus = "created"
+	// EnsureUpdated means the resource existed and was changed.
+	EnsureUpdated EnsureStatus = "updated"
+)
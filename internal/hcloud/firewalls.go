@@ -0,0 +1,171 @@
+package hcloud
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Firewall rule directions and protocols.
+const (
+	FirewallRuleDirectionIn  = "in"
+	FirewallRuleDirectionOut = "out"
+
+	FirewallRuleProtocolTCP  = "tcp"
+	FirewallRuleProtocolUDP  = "udp"
+	FirewallRuleProtocolICMP = "icmp"
+)
+
+// Firewall is a Hetzner Cloud firewall. It filters traffic on the public
+// interfaces of the servers it is applied to; private network traffic is not
+// affected.
+type Firewall struct {
+	ID        int64              `json:"id"`
+	Name      string             `json:"name"`
+	Labels    map[string]string  `json:"labels"`
+	Rules     []FirewallRule     `json:"rules"`
+	AppliedTo []FirewallResource `json:"applied_to"`
+}
+
+// FirewallRule allows traffic matching it. Anything not allowed by an inbound
+// rule is dropped.
+type FirewallRule struct {
+	Direction      string   `json:"direction"`
+	Protocol       string   `json:"protocol"`
+	Port           string   `json:"port,omitempty"`
+	SourceIPs      []string `json:"source_ips"`
+	DestinationIPs []string `json:"destination_ips,omitempty"`
+	Description    string   `json:"description,omitempty"`
+}
+
+// FirewallResource is a resource a firewall is applied to.
+type FirewallResource struct {
+	Type   string                  `json:"type"`
+	Server *FirewallResourceServer `json:"server,omitempty"`
+}
+
+// FirewallResourceServer identifies a server in a FirewallResource.
+type FirewallResourceServer struct {
+	ID int64 `json:"id"`
+}
+
+// FirewallCreateOpts are the parameters for creating a firewall.
+type FirewallCreateOpts struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Rules  []FirewallRule    `json:"rules"`
+}
+
+// ServerCreateFirewall applies a firewall to a server at creation time.
+type ServerCreateFirewall struct {
+	Firewall int64 `json:"firewall"`
+}
+
+// GetFirewallByName fetches a firewall by name. It returns nil and no error if
+// the firewall does not exist.
+func (c *Client) GetFirewallByName(ctx context.Context, name string) (*Firewall, error) {
+	var resp struct {
+		Firewalls []*Firewall `json:"firewalls"`
+	}
+	if err := c.do(ctx, "GET", "/firewalls"+nameQuery(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Firewalls) == 0 {
+		return nil, nil
+	}
+	return resp.Firewalls[0], nil
+}
+
+// CreateFirewall creates a firewall with the given rules and waits for the
+// resulting actions to finish.
+func (c *Client) CreateFirewall(ctx context.Context, opts FirewallCreateOpts) (*Firewall, error) {
+	var resp struct {
+		Firewall *Firewall `json:"firewall"`
+		Actions  []*Action `json:"actions"`
+	}
+	if err := c.do(ctx, "POST", "/firewalls", opts, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Firewall == nil && c.DryRun() {
+		// Nothing was created; return a placeholder so callers can continue their plan.
+		return &Firewall{Name: opts.Name, Labels: opts.Labels, Rules: opts.Rules}, nil
+	}
+	if resp.Firewall == nil {
+		return nil, fmt.Errorf("hcloud: create response for firewall %q did not include a firewall", opts.Name)
+	}
+	if err := c.WaitForActions(ctx, resp.Actions...); err != nil {
+		return nil, fmt.Errorf("hcloud: firewall %q was created but applying it failed: %w", opts.Name, err)
+	}
+	return resp.Firewall, nil
+}
+
+// SetFirewallRules replaces all rules of a firewall and waits for the change
+// to be applied to its servers.
+func (c *Client) SetFirewallRules(ctx context.Context, id int64, rules []FirewallRule) error {
+	var resp struct {
+		Actions []*Action `json:"actions"`
+	}
+	body := map[string]interface{}{"rules": rules}
+	if err := c.do(ctx, "POST", fmt.Sprintf("/firewalls/%d/actions/set_rules", id), body, &resp); err != nil {
+		return err
+	}
+	return c.WaitForActions(ctx, resp.Actions...)
+}
+
+// EnsureFirewall creates the firewall opts.Name with opts.Rules, or replaces
+// the rules of the existing firewall of that name if they differ (see
+// FirewallRulesEqual). Labels are only set when the firewall is created.
+func (c *Client) EnsureFirewall(ctx context.Context, opts FirewallCreateOpts) (*Firewall, EnsureStatus, error) {
+	firewall, err := c.GetFirewallByName(ctx, opts.Name)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to look up firewall %s: %w", opts.Name, err)
+	}
+	if firewall == nil {
+		if firewall, err = c.CreateFirewall(ctx, opts); err != nil {
+			return nil, "", fmt.Errorf("failed to create firewall %s: %w", opts.Name, err)
+		}
+		return firewall, EnsureCreated, nil
+	}
+	if FirewallRulesEqual(firewall.Rules, opts.Rules) {
+		return firewall, EnsureExisted, nil
+	}
+	if err := c.SetFirewallRules(ctx, firewall.ID, opts.Rules); err != nil {
+		return nil, "", fmt.Errorf("failed to update the rules of firewall %s: %w", firewall.Name, err)
+	}
+	firewall.Rules = opts.Rules
+	return firewall, EnsureUpdated, nil
+}
+
+// FirewallRulesEqual reports whether two rule sets allow the same traffic,
+// ignoring rule order, IP order and descriptions.
+func FirewallRulesEqual(a, b []FirewallRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	keys := func(rules []FirewallRule) []string {
+		out := make([]string, 0, len(rules))
+		for _, r := range rules {
+			out = append(out, r.key())
+		}
+		sort.Strings(out)
+		return out
+	}
+	ka, kb := keys(a), keys(b)
+	for i := range ka {
+		if ka[i] != kb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// key returns a canonical representation of the traffic a rule matches.
+func (r FirewallRule) key() string {
+	sorted := func(ips []string) string {
+		s := append([]string(nil), ips...)
+		sort.Strings(s)
+		return strings.Join(s, ",")
+	}
+	return strings.Join([]string{r.Direction, r.Protocol, r.Port, sorted(r.SourceIPs), sorted(r.DestinationIPs)}, "|")
+}
@@ -0,0 +1,154 @@
+package hcloud_test
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k3s-nixos-configs/internal/hcloud"
+	"k3s-nixos-configs/internal/hcloud/hcloudtest"
+)
+
+// newDryRunClient returns a dry-run client for fake and the requests it recorded
+// instead of sending, as "<method> <path>".
+func newDryRunClient(fake *hcloudtest.Server) (*hcloud.Client, *[]string) {
+	var recorded []string
+	client := hcloud.NewClient("fake-token",
+		hcloud.WithEndpoint(fake.URL+"/v1"),
+		hcloud.WithPollInterval(time.Millisecond),
+		hcloud.WithDryRun(func(method, path string, body []byte) { recorded = append(recorded, method+" "+path) }))
+	return client, &recorded
+}
+
+// mutatingRequests returns the requests other than GET the fake received.
+func mutatingRequests(fake *hcloudtest.Server) []string {
+	var out []string
+	for _, req := range fake.Requests() {
+		if !strings.HasPrefix(req, http.MethodGet+" ") {
+			out = append(out, req)
+		}
+	}
+	return out
+}
+
+// checkEnsure runs ensure with a dry-run client and then with client. Both must
+// report wantStatus; the dry run must record wantRecorded and send no mutating
+// request. A second run must find everything in place and change nothing.
+func checkEnsure(t *testing.T, fake *hcloudtest.Server, client *hcloud.Client, wantStatus hcloud.EnsureStatus, wantRecorded []string, ensure func(*hcloud.Client) (hcloud.EnsureStatus, error)) {
+	t.Helper()
+	sent := len(mutatingRequests(fake))
+	dryClient, recorded := newDryRunClient(fake)
+	status, err := ensure(dryClient)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if status != wantStatus {
+		t.Errorf("dry run status = %s, want %s", status, wantStatus)
+	}
+	if !reflect.DeepEqual(*recorded, wantRecorded) {
+		t.Errorf("dry run recorded %q, want %q", *recorded, wantRecorded)
+	}
+	if requests := mutatingRequests(fake)[sent:]; len(requests) != 0 {
+		t.Errorf("dry run sent %q", requests)
+	}
+
+	if status, err = ensure(client); err != nil {
+		t.Fatalf("ensure: %v", err)
+	}
+	if status != wantStatus {
+		t.Errorf("status = %s, want %s", status, wantStatus)
+	}
+
+	sent = len(mutatingRequests(fake))
+	if status, err = ensure(client); err != nil || status != hcloud.EnsureExisted {
+		t.Errorf("second run = %s, %v, want %s", status, err, hcloud.EnsureExisted)
+	}
+	if requests := mutatingRequests(fake)[sent:]; len(requests) != 0 {
+		t.Errorf("second run sent %q", requests)
+	}
+}
+
+var (
+	sshRule = hcloud.FirewallRule{
+		Direction: hcloud.FirewallRuleDirectionIn, Protocol: hcloud.FirewallRuleProtocolTCP, Port: "22",
+		SourceIPs: []string{"198.51.100.7/32"}, Description: "SSH from the admin IP",
+	}
+	k3sRule = hcloud.FirewallRule{
+		Direction: hcloud.FirewallRuleDirectionIn, Protocol: hcloud.FirewallRuleProtocolTCP, Port: "6443",
+		SourceIPs: []string{"10.0.0.0/16", "100.64.0.0/10"}, Description: "k3s API",
+	}
+)
+
+func TestEnsureFirewall(t *testing.T) {
+	desired := []hcloud.FirewallRule{sshRule, k3sRule}
+	// The same rules in another order, with other descriptions and IP order.
+	reordered := []hcloud.FirewallRule{k3sRule, sshRule}
+	reordered[0].SourceIPs = []string{"100.64.0.0/10", "10.0.0.0/16"}
+	reordered[1].Description = ""
+	// SSH open to the world instead of the admin IP.
+	drifted := []hcloud.FirewallRule{sshRule, k3sRule}
+	drifted[0].SourceIPs = []string{"0.0.0.0/0", "::/0"}
+
+	tests := []struct {
+		name         string
+		existing     []hcloud.FirewallRule // nil for no firewall
+		wantStatus   hcloud.EnsureStatus
+		wantRecorded []string // dry-run requests
+	}{
+		{name: "missing", wantStatus: hcloud.EnsureCreated, wantRecorded: []string{"POST /firewalls"}},
+		{name: "same rules", existing: reordered, wantStatus: hcloud.EnsureExisted},
+		{name: "drifted rules", existing: drifted, wantStatus: hcloud.EnsureUpdated, wantRecorded: []string{"POST /firewalls/1/actions/set_rules"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, fake := newTestClient(t)
+			if tt.existing != nil {
+				if _, err := client.CreateFirewall(ctx, hcloud.FirewallCreateOpts{Name: "k3s-firewall", Rules: tt.existing}); err != nil {
+					t.Fatalf("CreateFirewall: %v", err)
+				}
+			}
+			opts := hcloud.FirewallCreateOpts{Name: "k3s-firewall", Rules: desired}
+			checkEnsure(t, fake, client, tt.wantStatus, tt.wantRecorded, func(c *hcloud.Client) (hcloud.EnsureStatus, error) {
+				_, status, err := c.EnsureFirewall(ctx, opts)
+				return status, err
+			})
+
+			firewall, err := client.GetFirewallByName(ctx, "k3s-firewall")
+			if err != nil || firewall == nil {
+				t.Fatalf("GetFirewallByName = %v, %v", firewall, err)
+			}
+			if !hcloud.FirewallRulesEqual(firewall.Rules, desired) {
+				t.Errorf("firewall rules = %+v, want %+v", firewall.Rules, desired)
+			}
+		})
+	}
+}
+
+func TestFirewallRulesEqual(t *testing.T) {
+	udp := hcloud.FirewallRule{Direction: hcloud.FirewallRuleDirectionIn, Protocol: hcloud.FirewallRuleProtocolUDP, Port: "41641", SourceIPs: []string{"0.0.0.0/0", "::/0"}}
+	otherPort := k3sRule
+	otherPort.Port = "6444"
+	tests := []struct {
+		name string
+		a, b []hcloud.FirewallRule
+		want bool
+	}{
+		{"both empty", nil, []hcloud.FirewallRule{}, true},
+		{"same", []hcloud.FirewallRule{sshRule, udp}, []hcloud.FirewallRule{sshRule, udp}, true},
+		{"other order", []hcloud.FirewallRule{sshRule, udp}, []hcloud.FirewallRule{udp, sshRule}, true},
+		{"missing rule", []hcloud.FirewallRule{sshRule, udp}, []hcloud.FirewallRule{sshRule}, false},
+		{"other port", []hcloud.FirewallRule{k3sRule}, []hcloud.FirewallRule{otherPort}, false},
+		{"duplicate instead of other rule", []hcloud.FirewallRule{sshRule, udp}, []hcloud.FirewallRule{sshRule, sshRule}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hcloud.FirewallRulesEqual(tt.a, tt.b); got != tt.want {
+				t.Errorf("FirewallRulesEqual = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
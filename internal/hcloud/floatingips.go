@@ -0,0 +1,121 @@
+package hcloud
+
+import (
+	"context"
+	"fmt"
+)
+
+// FloatingIP is an IP address that can be moved between servers at any time,
+// independent of their primary IPs.
+type FloatingIP struct {
+	ID           int64             `json:"id"`
+	Name         string            `json:"name"`
+	Type         string            `json:"type"`
+	IP           string            `json:"ip"`
+	Server       *int64            `json:"server"`
+	HomeLocation Location          `json:"home_location"`
+	Labels       map[string]string `json:"labels"`
+}
+
+// FloatingIPCreateOpts are the parameters for creating a floating IP. Without a
+// Server, HomeLocation is required.
+type FloatingIPCreateOpts struct {
+	Type         string            `json:"type"`
+	Name         string            `json:"name"`
+	Description  string            `json:"description,omitempty"`
+	HomeLocation string            `json:"home_location,omitempty"`
+	Server       *int64            `json:"server,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+// GetFloatingIP fetches a floating IP by ID.
+func (c *Client) GetFloatingIP(ctx context.Context, id int64) (*FloatingIP, error) {
+	var resp struct {
+		FloatingIP *FloatingIP `json:"floating_ip"`
+	}
+	if err := c.do(ctx, "GET", fmt.Sprintf("/floating_ips/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.FloatingIP, nil
+}
+
+// GetFloatingIPByName fetches a floating IP by name. It returns nil and no error
+// if the floating IP does not exist.
+func (c *Client) GetFloatingIPByName(ctx context.Context, name string) (*FloatingIP, error) {
+	var resp struct {
+		FloatingIPs []*FloatingIP `json:"floating_ips"`
+	}
+	if err := c.do(ctx, "GET", "/floating_ips"+nameQuery(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.FloatingIPs) == 0 {
+		return nil, nil
+	}
+	return resp.FloatingIPs[0], nil
+}
+
+// CreateFloatingIP creates a floating IP and waits for it to be assigned if
+// opts.Server is set.
+func (c *Client) CreateFloatingIP(ctx context.Context, opts FloatingIPCreateOpts) (*FloatingIP, error) {
+	var resp struct {
+		FloatingIP *FloatingIP `json:"floating_ip"`
+		Action     *Action     `json:"action"`
+	}
+	if err := c.do(ctx, "POST", "/floating_ips", opts, &resp); err != nil {
+		return nil, err
+	}
+	if resp.FloatingIP == nil && c.DryRun() {
+		// Nothing was created; return a placeholder so callers can continue their plan.
+		return &FloatingIP{Name: opts.Name, Type: opts.Type, Server: opts.Server, HomeLocation: Location{Name: opts.HomeLocation}, Labels: opts.Labels}, nil
+	}
+	if resp.FloatingIP == nil {
+		return nil, fmt.Errorf("hcloud: create response for floating IP %q did not include a floating IP", opts.Name)
+	}
+	if _, err := c.WaitForAction(ctx, resp.Action); err != nil {
+		return nil, fmt.Errorf("hcloud: floating IP %q was created but assigning it failed: %w", opts.Name, err)
+	}
+	return resp.FloatingIP, nil
+}
+
+// DeleteFloatingIP deletes a floating IP, unassigning it first if needed.
+func (c *Client) DeleteFloatingIP(ctx context.Context, id int64) error {
+	return c.do(ctx, "DELETE", fmt.Sprintf("/floating_ips/%d", id), nil, nil)
+}
+
+// AssignFloatingIP assigns a floating IP to a server, taking it from the server
+// it is currently assigned to, and waits for it.
+func (c *Client) AssignFloatingIP(ctx context.Context, id, serverID int64) error {
+	var resp struct {
+		Action *Action `json:"action"`
+	}
+	body := map[string]interface{}{"server": serverID}
+	if err := c.do(ctx, "POST", fmt.Sprintf("/floating_ips/%d/actions/assign", id), body, &resp); err != nil {
+		return err
+	}
+	_, err := c.WaitForAction(ctx, resp.Action)
+	return err
+}
+
+// EnsureFloatingIP creates the floating IP opts.Name unless it exists. If
+// opts.Server is set, an existing floating IP that is unassigned or assigned to
+// another server is assigned to it.
+func (c *Client) EnsureFloatingIP(ctx context.Context, opts FloatingIPCreateOpts) (*FloatingIP, EnsureStatus, error) {
+	ip, err := c.GetFloatingIPByName(ctx, opts.Name)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to look up floating IP %s: %w", opts.Name, err)
+	}
+	if ip == nil {
+		if ip, err = c.CreateFloatingIP(ctx, opts); err != nil {
+			return nil, "", fmt.Errorf("failed to create floating IP %s: %w", opts.Name, err)
+		}
+		return ip, EnsureCreated, nil
+	}
+	if opts.Server == nil || (ip.Server != nil && *ip.Server == *opts.Server) {
+		return ip, EnsureExisted, nil
+	}
+	if err := c.AssignFloatingIP(ctx, ip.ID, *opts.Server); err != nil {
+		return nil, "", fmt.Errorf("failed to assign floating IP %s to server %d: %w", ip.Name, *opts.Server, err)
+	}
+	ip.Server = opts.Server
+	return ip, EnsureUpdated, nil
+}
@@ -0,0 +1,75 @@
+package hcloud_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"k3s-nixos-configs/internal/hcloud"
+)
+
+func TestEnsureFloatingIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   string // server the existing floating IP is assigned to, "-" for none
+		wantStatus hcloud.EnsureStatus
+		wantAssign bool // whether the dry run records an assign action
+	}{
+		{name: "missing", wantStatus: hcloud.EnsureCreated},
+		{name: "assigned", existing: "control-1", wantStatus: hcloud.EnsureExisted},
+		{name: "unassigned", existing: "-", wantStatus: hcloud.EnsureUpdated, wantAssign: true},
+		{name: "assigned to another server", existing: "control-2", wantStatus: hcloud.EnsureUpdated, wantAssign: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, fake := newTestClient(t)
+			var server *hcloud.Server
+			for _, name := range []string{"control-1", "control-2"} {
+				srv, err := client.CreateServerAndWait(ctx, hcloud.ServerCreateOpts{Name: name, ServerType: "cx22", Image: "debian-12", Location: "fsn1"})
+				if err != nil {
+					t.Fatalf("CreateServerAndWait: %v", err)
+				}
+				if server == nil {
+					server = srv
+				}
+			}
+			wantRecorded := []string{"POST /floating_ips"}
+			if tt.existing != "" {
+				assignee := tt.existing
+				if assignee == "-" {
+					assignee = ""
+				}
+				id := fake.AddFloatingIP("k3s-api", assignee)
+				wantRecorded = nil
+				if tt.wantAssign {
+					wantRecorded = []string{fmt.Sprintf("POST /floating_ips/%d/actions/assign", id)}
+				}
+			}
+
+			opts := hcloud.FloatingIPCreateOpts{Type: "ipv4", Name: "k3s-api", Server: &server.ID}
+			checkEnsure(t, fake, client, tt.wantStatus, wantRecorded, func(c *hcloud.Client) (hcloud.EnsureStatus, error) {
+				_, status, err := c.EnsureFloatingIP(ctx, opts)
+				return status, err
+			})
+
+			ip, err := client.GetFloatingIPByName(ctx, "k3s-api")
+			if err != nil || ip == nil || ip.Server == nil || *ip.Server != server.ID {
+				t.Errorf("GetFloatingIPByName = %+v, %v, want the floating IP assigned to server %d", ip, err, server.ID)
+			}
+		})
+	}
+}
+
+func TestEnsureFloatingIPWithoutServer(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newTestClient(t)
+	fake.AddFloatingIP("k3s-api", "")
+	ip, status, err := client.EnsureFloatingIP(ctx, hcloud.FloatingIPCreateOpts{Type: "ipv4", Name: "k3s-api", HomeLocation: "fsn1"})
+	if err != nil || status != hcloud.EnsureExisted || ip.Server != nil {
+		t.Errorf("EnsureFloatingIP = %+v, %s, %v, want the unassigned floating IP", ip, status, err)
+	}
+	if requests := mutatingRequests(fake); len(requests) != 0 {
+		t.Errorf("EnsureFloatingIP sent %q", requests)
+	}
+}
@@ -0,0 +1,309 @@
+package hcloudtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"k3s-nixos-configs/internal/hcloud"
+)
+
+// AddFloatingIP registers a floating IPv4 address, assigned to the server named
+// serverName if it is not empty, and returns its ID.
+func (s *Server) AddFloatingIP(name, serverName string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.newID()
+	ip := &hcloud.FloatingIP{ID: id, Name: name, Type: "ipv4", IP: fmt.Sprintf("198.51.100.%d", id%250+1), HomeLocation: Locations[0]}
+	for _, srv := range s.servers {
+		if srv.Name == serverName {
+			s.assignFloatingIP(ip, srv)
+		}
+	}
+	s.floatingIPs[id] = ip
+	return id
+}
+
+// serveFloatingIPs handles /floating_ips (GET by name, POST), /floating_ips/{id}
+// (GET, DELETE) and /floating_ips/{id}/actions/assign.
+func (s *Server) serveFloatingIPs(w http.ResponseWriter, r *http.Request, segments []string) {
+	if len(segments) == 0 && r.Method == http.MethodGet {
+		ips := []*hcloud.FloatingIP{}
+		for _, ip := range s.floatingIPs {
+			if name := r.URL.Query().Get("name"); name == "" || ip.Name == name {
+				ips = append(ips, ip)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"floating_ips": ips})
+		return
+	}
+	if len(segments) == 0 && r.Method == http.MethodPost {
+		s.createFloatingIP(w, r)
+		return
+	}
+	if len(segments) == 0 {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("%s %s is not implemented by the fake API", r.Method, r.URL.Path))
+		return
+	}
+	id, _ := strconv.ParseInt(segments[0], 10, 64)
+	ip, ok := s.floatingIPs[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("floating IP %s not found", segments[0]))
+		return
+	}
+	switch {
+	case len(segments) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"floating_ip": ip})
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		if ip.Server != nil {
+			if srv, ok := s.servers[*ip.Server]; ok {
+				s.unassignFloatingIP(ip, srv)
+			}
+		}
+		delete(s.floatingIPs, id)
+		w.WriteHeader(http.StatusNoContent)
+	case len(segments) == 3 && segments[1] == "actions" && segments[2] == "assign" && r.Method == http.MethodPost:
+		var body struct {
+			Server int64 `json:"server"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+			return
+		}
+		srv, ok := s.servers[body.Server]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("server %d not found", body.Server))
+			return
+		}
+		s.assignFloatingIP(ip, srv)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"action": s.newAction("assign_floating_ip")})
+	default:
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("%s %s is not implemented by the fake API", r.Method, r.URL.Path))
+	}
+}
+
+// createFloatingIP creates an IPv4 floating IP in its home location, or in the
+// location of the server it is assigned to.
+func (s *Server) createFloatingIP(w http.ResponseWriter, r *http.Request) {
+	var opts hcloud.FloatingIPCreateOpts
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	if opts.Type != "ipv4" || opts.Name == "" || (opts.HomeLocation == "" && opts.Server == nil) {
+		writeError(w, http.StatusBadRequest, "invalid_input", "name, type ipv4 and home_location or server are required")
+		return
+	}
+	for _, ip := range s.floatingIPs {
+		if ip.Name == opts.Name {
+			writeError(w, http.StatusConflict, "uniqueness_error", fmt.Sprintf("floating IP name %q is already used", opts.Name))
+			return
+		}
+	}
+	var srv *hcloud.Server
+	location, ok := locationByName(opts.HomeLocation)
+	if opts.Server != nil {
+		if srv, ok = s.servers[*opts.Server]; !ok {
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("server %d not found", *opts.Server))
+			return
+		}
+		location = srv.Datacenter.Location
+	} else if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("location %q not found", opts.HomeLocation))
+		return
+	}
+	id := s.newID()
+	ip := &hcloud.FloatingIP{ID: id, Name: opts.Name, Type: opts.Type, IP: fmt.Sprintf("198.51.100.%d", id%250+1), HomeLocation: location, Labels: opts.Labels}
+	s.floatingIPs[id] = ip
+	resp := map[string]interface{}{"floating_ip": ip}
+	if srv != nil {
+		s.assignFloatingIP(ip, srv)
+		resp["action"] = s.newAction("assign_floating_ip")
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// assignFloatingIP moves ip to srv, removing it from its previous server.
+func (s *Server) assignFloatingIP(ip *hcloud.FloatingIP, srv *hcloud.Server) {
+	if ip.Server != nil {
+		if prev, ok := s.servers[*ip.Server]; ok {
+			s.unassignFloatingIP(ip, prev)
+		}
+	}
+	serverID := srv.ID
+	ip.Server = &serverID
+	srv.PublicNet.FloatingIPs = append(srv.PublicNet.FloatingIPs, ip.ID)
+}
+
+// unassignFloatingIP removes ip from srv.
+func (s *Server) unassignFloatingIP(ip *hcloud.FloatingIP, srv *hcloud.Server) {
+	for i, fid := range srv.PublicNet.FloatingIPs {
+		if fid == ip.ID {
+			srv.PublicNet.FloatingIPs = append(srv.PublicNet.FloatingIPs[:i], srv.PublicNet.FloatingIPs[i+1:]...)
+			break
+		}
+	}
+	ip.Server = nil
+}
+
+// newPrimaryIP registers an unassigned primary IP that is deleted with its server.
+func (s *Server) newPrimaryIP(ipType, address string, datacenter hcloud.Datacenter) *hcloud.PrimaryIP {
+	id := s.newID()
+	ip := &hcloud.PrimaryIP{ID: id, Name: fmt.Sprintf("primary_ip-%d", id), Type: ipType, IP: address, AutoDelete: true, Datacenter: datacenter}
+	s.primaryIPs[id] = ip
+	return ip
+}
+
+// createPrimaryIP creates an unassigned primary IP in a datacenter. Assigning it
+// at creation time is not implemented by the fake.
+func (s *Server) createPrimaryIP(w http.ResponseWriter, r *http.Request) {
+	var opts hcloud.PrimaryIPCreateOpts
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	if opts.Name == "" || opts.Datacenter == "" || opts.AssigneeID != nil || (opts.Type != hcloud.PrimaryIPTypeIPv4 && opts.Type != hcloud.PrimaryIPTypeIPv6) {
+		writeError(w, http.StatusBadRequest, "invalid_input", "name, type and datacenter are required (assignee_id is not implemented by the fake API)")
+		return
+	}
+	for _, ip := range s.primaryIPs {
+		if ip.Name == opts.Name {
+			writeError(w, http.StatusConflict, "uniqueness_error", fmt.Sprintf("primary IP name %q is already used", opts.Name))
+			return
+		}
+	}
+	var datacenter *hcloud.Datacenter
+	for _, dc := range s.datacenters() {
+		if dc.Name == opts.Datacenter {
+			datacenter = &dc
+			break
+		}
+	}
+	if datacenter == nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("datacenter %q not found", opts.Datacenter))
+		return
+	}
+	id := s.newID()
+	address := fmt.Sprintf("192.0.2.%d", id%250+1)
+	if opts.Type == hcloud.PrimaryIPTypeIPv6 {
+		address = fmt.Sprintf("2001:db8:%x::/64", id)
+	}
+	ip := &hcloud.PrimaryIP{ID: id, Name: opts.Name, Type: opts.Type, IP: address, AutoDelete: opts.AutoDelete, Datacenter: *datacenter, Labels: opts.Labels}
+	s.primaryIPs[id] = ip
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"primary_ip": ip})
+}
+
+// servePrimaryIPs handles /primary_ips (GET by name, POST), /primary_ips/{id}
+// (GET, PUT, DELETE) and its assign and unassign actions. Like the real API,
+// moving a primary IP requires the servers involved to be powered off.
+func (s *Server) servePrimaryIPs(w http.ResponseWriter, r *http.Request, segments []string) {
+	if len(segments) == 0 && r.Method == http.MethodGet {
+		ips := []*hcloud.PrimaryIP{}
+		for _, ip := range s.primaryIPs {
+			if name := r.URL.Query().Get("name"); name == "" || ip.Name == name {
+				ips = append(ips, ip)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"primary_ips": ips})
+		return
+	}
+	if len(segments) == 0 && r.Method == http.MethodPost {
+		s.createPrimaryIP(w, r)
+		return
+	}
+	if len(segments) == 0 {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("%s %s is not implemented by the fake API", r.Method, r.URL.Path))
+		return
+	}
+	id, _ := strconv.ParseInt(segments[0], 10, 64)
+	ip, ok := s.primaryIPs[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("primary IP %s not found", segments[0]))
+		return
+	}
+	switch {
+	case len(segments) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"primary_ip": ip})
+	case len(segments) == 1 && r.Method == http.MethodPut:
+		var opts hcloud.PrimaryIPUpdateOpts
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+			return
+		}
+		if opts.Name != "" {
+			ip.Name = opts.Name
+		}
+		if opts.AutoDelete != nil {
+			ip.AutoDelete = *opts.AutoDelete
+		}
+		if opts.Labels != nil {
+			ip.Labels = opts.Labels
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"primary_ip": ip})
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		if ip.AssigneeID != nil {
+			writeError(w, http.StatusConflict, "conflict", fmt.Sprintf("primary IP %d is assigned", id))
+			return
+		}
+		delete(s.primaryIPs, id)
+		w.WriteHeader(http.StatusNoContent)
+	case len(segments) == 3 && segments[1] == "actions" && segments[2] == "unassign" && r.Method == http.MethodPost:
+		if ip.AssigneeID == nil {
+			writeError(w, http.StatusConflict, "conflict", fmt.Sprintf("primary IP %d is not assigned", id))
+			return
+		}
+		srv := s.servers[*ip.AssigneeID]
+		if srv.Status != "off" {
+			writeError(w, http.StatusConflict, "server_not_stopped", fmt.Sprintf("server %d must be powered off", srv.ID))
+			return
+		}
+		if ip.Type == hcloud.PrimaryIPTypeIPv4 {
+			srv.PublicNet.IPv4 = nil
+		} else {
+			srv.PublicNet.IPv6 = nil
+		}
+		ip.AssigneeID, ip.AssigneeType = nil, ""
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"action": s.newAction("unassign_primary_ip")})
+	case len(segments) == 3 && segments[1] == "actions" && segments[2] == "assign" && r.Method == http.MethodPost:
+		var body struct {
+			AssigneeID int64 `json:"assignee_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+			return
+		}
+		srv, ok := s.servers[body.AssigneeID]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("server %d not found", body.AssigneeID))
+			return
+		}
+		if ip.AssigneeID != nil {
+			writeError(w, http.StatusConflict, "conflict", fmt.Sprintf("primary IP %d is already assigned", id))
+			return
+		}
+		if srv.Status != "off" {
+			writeError(w, http.StatusConflict, "server_not_stopped", fmt.Sprintf("server %d must be powered off", srv.ID))
+			return
+		}
+		public := &hcloud.ServerPublicIP{ID: ip.ID, IP: ip.IP}
+		if ip.Type == hcloud.PrimaryIPTypeIPv4 {
+			if srv.PublicNet.IPv4 != nil {
+				writeError(w, http.StatusConflict, "conflict", fmt.Sprintf("server %d already has a primary IPv4", srv.ID))
+				return
+			}
+			srv.PublicNet.IPv4 = public
+		} else {
+			if srv.PublicNet.IPv6 != nil {
+				writeError(w, http.StatusConflict, "conflict", fmt.Sprintf("server %d already has a primary IPv6", srv.ID))
+				return
+			}
+			srv.PublicNet.IPv6 = public
+		}
+		assignee := srv.ID
+		ip.AssigneeID, ip.AssigneeType = &assignee, "server"
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"action": s.newAction("assign_primary_ip")})
+	default:
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("%s %s is not implemented by the fake API", r.Method, r.URL.Path))
+	}
+}
@@ -0,0 +1,204 @@
+package hcloudtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k3s-nixos-configs/internal/hcloud"
+)
+
+// serveLoadBalancers handles /load_balancers (GET by name, POST), and the
+// attach_to_network, add_service, update_service, add_target and
+// enable/disable_public_interface actions of /load_balancers/{id}.
+func (s *Server) serveLoadBalancers(w http.ResponseWriter, r *http.Request, segments []string) {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		lbs := []hcloud.LoadBalancer{}
+		for _, lb := range s.loadBalancers {
+			if name := r.URL.Query().Get("name"); name == "" || lb.Name == name {
+				lbs = append(lbs, s.resolveTargets(lb))
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"load_balancers": lbs})
+		return
+	case len(segments) == 0 && r.Method == http.MethodPost:
+		s.createLoadBalancer(w, r)
+		return
+	case len(segments) != 3 || segments[1] != "actions" || r.Method != http.MethodPost:
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("%s %s is not implemented by the fake API", r.Method, r.URL.Path))
+		return
+	}
+
+	id, _ := strconv.ParseInt(segments[0], 10, 64)
+	lb, ok := s.loadBalancers[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("load balancer %s not found", segments[0]))
+		return
+	}
+	command := segments[2]
+	switch command {
+	case "attach_to_network":
+		var body struct {
+			Network int64 `json:"network"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+			return
+		}
+		if _, ok := s.networks[body.Network]; !ok {
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("network %d not found", body.Network))
+			return
+		}
+		if lb.PrivateIP(body.Network) != "" {
+			writeError(w, http.StatusConflict, "load_balancer_already_attached", fmt.Sprintf("load balancer %d is already attached to network %d", id, body.Network))
+			return
+		}
+		lb.PrivateNet = append(lb.PrivateNet, hcloud.LoadBalancerPrivateNet{Network: body.Network, IP: fmt.Sprintf("10.0.0.%d", 200+id%50)})
+	case "add_service", "update_service":
+		var service hcloud.LoadBalancerService
+		if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+			return
+		}
+		existing := lb.Service(service.ListenPort)
+		switch {
+		case command == "add_service" && existing != nil:
+			writeError(w, http.StatusConflict, "source_port_already_used", fmt.Sprintf("port %d is already used", service.ListenPort))
+			return
+		case command == "update_service" && existing == nil:
+			writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no service listens on port %d", service.ListenPort))
+			return
+		case existing != nil:
+			*existing = service
+		default:
+			lb.Services = append(lb.Services, service)
+		}
+	case "add_target":
+		var target hcloud.LoadBalancerTarget
+		if err := json.NewDecoder(r.Body).Decode(&target); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+			return
+		}
+		if msg := s.checkTarget(lb, target); msg != "" {
+			writeError(w, http.StatusBadRequest, "invalid_input", msg)
+			return
+		}
+		lb.Targets = append(lb.Targets, target)
+	case "enable_public_interface", "disable_public_interface":
+		lb.PublicNet.Enabled = command == "enable_public_interface"
+	default:
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("%s %s is not implemented by the fake API", r.Method, r.URL.Path))
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"action": s.newAction(command)})
+}
+
+func (s *Server) createLoadBalancer(w http.ResponseWriter, r *http.Request) {
+	var opts hcloud.LoadBalancerCreateOpts
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	if opts.Name == "" || opts.LoadBalancerType == "" || opts.Location == "" {
+		writeError(w, http.StatusBadRequest, "invalid_input", "name, load_balancer_type and location are required")
+		return
+	}
+	for _, lb := range s.loadBalancers {
+		if lb.Name == opts.Name {
+			writeError(w, http.StatusConflict, "uniqueness_error", fmt.Sprintf("load balancer name %q is already used", opts.Name))
+			return
+		}
+	}
+	location, ok := locationByName(opts.Location)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("location %q not found", opts.Location))
+		return
+	}
+	id := s.newID()
+	lb := &hcloud.LoadBalancer{
+		ID:               id,
+		Name:             opts.Name,
+		LoadBalancerType: hcloud.LoadBalancerType{ID: 1, Name: opts.LoadBalancerType},
+		Location:         location,
+		PublicNet: hcloud.LoadBalancerPublicNet{
+			Enabled: opts.PublicInterface,
+			IPv4:    hcloud.LoadBalancerPublicIP{IP: fmt.Sprintf("203.0.113.%d", 200+id%50)},
+			IPv6:    hcloud.LoadBalancerPublicIP{IP: fmt.Sprintf("2001:db8:1b::%x", id)},
+		},
+		Algorithm: hcloud.LoadBalancerAlgorithm{Type: "round_robin"},
+		Services:  opts.Services,
+		Labels:    opts.Labels,
+	}
+	if opts.Algorithm != nil {
+		lb.Algorithm = *opts.Algorithm
+	}
+	if opts.Network != 0 {
+		if _, ok := s.networks[opts.Network]; !ok {
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("network %d not found", opts.Network))
+			return
+		}
+		lb.PrivateNet = append(lb.PrivateNet, hcloud.LoadBalancerPrivateNet{Network: opts.Network, IP: fmt.Sprintf("10.0.0.%d", 200+id%50)})
+	}
+	for _, target := range opts.Targets {
+		if msg := s.checkTarget(lb, target); msg != "" {
+			writeError(w, http.StatusBadRequest, "invalid_input", msg)
+			return
+		}
+		lb.Targets = append(lb.Targets, target)
+	}
+	s.loadBalancers[id] = lb
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"load_balancer": lb, "action": s.newAction("create_load_balancer")})
+}
+
+// checkTarget validates a label selector target like the real API: using
+// private IPs requires the load balancer to be attached to a network.
+func (s *Server) checkTarget(lb *hcloud.LoadBalancer, target hcloud.LoadBalancerTarget) string {
+	if target.Type != hcloud.LoadBalancerTargetTypeLabelSelector || target.LabelSelector == nil || target.LabelSelector.Selector == "" {
+		return "only label_selector targets are implemented by the fake API"
+	}
+	if target.UsePrivateIP && len(lb.PrivateNet) == 0 {
+		return "use_private_ip requires the load balancer to be attached to a network"
+	}
+	if lb.LabelSelectorTarget(target.LabelSelector.Selector) != nil {
+		return fmt.Sprintf("target %q already exists", target.LabelSelector.Selector)
+	}
+	return ""
+}
+
+// resolveTargets returns a copy of lb whose label selector targets list the
+// matching servers. Running servers are reported healthy on every service.
+func (s *Server) resolveTargets(lb *hcloud.LoadBalancer) hcloud.LoadBalancer {
+	out := *lb
+	out.Targets = nil
+	for _, target := range lb.Targets {
+		target.Targets = nil
+		var matching []*hcloud.Server
+		for _, srv := range s.servers {
+			if matchLabels(srv.Labels, strings.Split(target.LabelSelector.Selector, ",")) {
+				matching = append(matching, srv)
+			}
+		}
+		sort.Slice(matching, func(i, j int) bool { return matching[i].ID < matching[j].ID })
+		for _, srv := range matching {
+			status := hcloud.LoadBalancerHealthStatusHealthy
+			if srv.Status != "running" {
+				status = hcloud.LoadBalancerHealthStatusUnhealthy
+			}
+			resolved := hcloud.LoadBalancerTarget{
+				Type:         hcloud.LoadBalancerTargetTypeServer,
+				Server:       &hcloud.LoadBalancerTargetServer{ID: srv.ID},
+				UsePrivateIP: target.UsePrivateIP,
+			}
+			for _, service := range lb.Services {
+				resolved.HealthStatus = append(resolved.HealthStatus, hcloud.LoadBalancerTargetHealthStatus{ListenPort: service.ListenPort, Status: status})
+			}
+			target.Targets = append(target.Targets, resolved)
+		}
+		out.Targets = append(out.Targets, target)
+	}
+	return out
+}
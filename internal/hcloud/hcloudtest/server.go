@@ -0,0 +1,969 @@
+// Package hcloudtest provides an in-memory fake of the Hetzner Cloud API.
+//
+// It implements just enough of the API for the hcloud client used by the mage
+// targets, so the create/delete flow can be exercised locally or in CI by
+// pointing HCLOUD_ENDPOINT at the fake instead of api.hetzner.cloud.
+package hcloudtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k3s-nixos-configs/internal/hcloud"
+)
+
+// Server is a fake Hetzner Cloud API. The zero value is not usable; create
+// one with NewHandler or NewServer.
+type Server struct {
+	// URL is the base URL of the fake API when started with NewServer.
+	URL string
+
+	// ActionPolls is how many times an action is reported as running before
+	// it succeeds. Zero means actions complete immediately.
+	ActionPolls int
+
+	httpServer *httptest.Server
+
+	mu              sync.Mutex
+	nextID          int64
+	servers         map[int64]*hcloud.Server
+	networks        map[int64]*hcloud.Network
+	placementGroups map[int64]*hcloud.PlacementGroup
+	firewalls       map[int64]*hcloud.Firewall
+	volumes         map[int64]*hcloud.Volume
+	images          map[int64]*hcloud.Image
+	floatingIPs     map[int64]*hcloud.FloatingIP
+	primaryIPs      map[int64]*hcloud.PrimaryIP
+	loadBalancers   map[int64]*hcloud.LoadBalancer
+	sshKeys         map[int64]*hcloud.SSHKey
+	actions         map[int64]*fakeAction
+	// unavailable holds "<server type>@<location>" pairs that are out of stock.
+	unavailable map[string]bool
+	// failing maps action commands to the error they end with, see FailActions.
+	failing map[string]*hcloud.ActionError
+	// requests logs every request received, see Requests.
+	requests []string
+}
+
+// Locations are the locations known to the fake, with their network zones.
+var Locations = []hcloud.Location{
+	{ID: 1, Name: "fsn1", NetworkZone: "eu-central"},
+	{ID: 2, Name: "nbg1", NetworkZone: "eu-central"},
+	{ID: 3, Name: "hel1", NetworkZone: "eu-central"},
+	{ID: 4, Name: "ash", NetworkZone: "us-east"},
+	{ID: 5, Name: "hil", NetworkZone: "us-west"},
+	{ID: 6, Name: "sin", NetworkZone: "ap-southeast"},
+}
+
+// ServerTypes are the server types known to the fake, sold in every location.
+// All of them are available unless marked with SetServerTypeUnavailable, except
+// cx11, which is deprecated and no longer available anywhere.
+var ServerTypes = []hcloud.ServerType{
+	priced(hcloud.ServerType{ID: 1, Name: "cx11", Description: "CX11", Cores: 1, Memory: 2, Disk: 20, Architecture: "x86",
+		Deprecation: &hcloud.Deprecation{
+			Announced:        time.Date(2024, 6, 6, 0, 0, 0, 0, time.UTC),
+			UnavailableAfter: time.Date(2024, 9, 6, 0, 0, 0, 0, time.UTC),
+		}}, "3.9100"),
+	priced(hcloud.ServerType{ID: 22, Name: "cx22", Description: "CX22", Cores: 2, Memory: 4, Disk: 40, Architecture: "x86"}, "3.7900"),
+	priced(hcloud.ServerType{ID: 23, Name: "cpx11", Description: "CPX 11", Cores: 2, Memory: 2, Disk: 40, Architecture: "x86"}, "4.3500"),
+	priced(hcloud.ServerType{ID: 24, Name: "cpx21", Description: "CPX 21", Cores: 3, Memory: 4, Disk: 80, Architecture: "x86"}, "7.5500"),
+	priced(hcloud.ServerType{ID: 25, Name: "cpx31", Description: "CPX 31", Cores: 4, Memory: 8, Disk: 160, Architecture: "x86"}, "13.6000"),
+	priced(hcloud.ServerType{ID: 26, Name: "cpx41", Description: "CPX 41", Cores: 8, Memory: 16, Disk: 240, Architecture: "x86"}, "25.2000"),
+	priced(hcloud.ServerType{ID: 45, Name: "cax11", Description: "CAX11", Cores: 2, Memory: 4, Disk: 40, Architecture: "arm"}, "3.7900"),
+	priced(hcloud.ServerType{ID: 96, Name: "ccx13", Description: "CCX13 Dedicated CPU", Cores: 2, Memory: 8, Disk: 80, Architecture: "x86"}, "12.4900"),
+}
+
+// priced sets the same monthly gross price for a server type in every location.
+func priced(t hcloud.ServerType, monthly string) hcloud.ServerType {
+	for _, loc := range Locations {
+		t.Prices = append(t.Prices, hcloud.ServerTypePrice{Location: loc.Name, PriceMonthly: hcloud.Price{Net: monthly, Gross: monthly}})
+	}
+	return t
+}
+
+type fakeAction struct {
+	action    hcloud.Action
+	pollsLeft int
+	// fail is the error the action ends with, or nil if it succeeds.
+	fail *hcloud.ActionError
+}
+
+// finish moves the action to its final state.
+func (fa *fakeAction) finish() {
+	fa.action.Progress = 100
+	if fa.fail != nil {
+		fa.action.Status = hcloud.ActionStatusError
+		fa.action.Error = fa.fail
+		return
+	}
+	fa.action.Status = hcloud.ActionStatusSuccess
+}
+
+// NewHandler returns a fake API that is not listening anywhere; use it as an
+// http.Handler.
+func NewHandler() *Server {
+	return &Server{
+		nextID:          1,
+		servers:         map[int64]*hcloud.Server{},
+		networks:        map[int64]*hcloud.Network{},
+		placementGroups: map[int64]*hcloud.PlacementGroup{},
+		firewalls:       map[int64]*hcloud.Firewall{},
+		volumes:         map[int64]*hcloud.Volume{},
+		images:          map[int64]*hcloud.Image{},
+		floatingIPs:     map[int64]*hcloud.FloatingIP{},
+		primaryIPs:      map[int64]*hcloud.PrimaryIP{},
+		loadBalancers:   map[int64]*hcloud.LoadBalancer{},
+		sshKeys:         map[int64]*hcloud.SSHKey{},
+		actions:         map[int64]*fakeAction{},
+		unavailable:     map[string]bool{},
+		failing:         map[string]*hcloud.ActionError{},
+	}
+}
+
+// NewServer starts a fake API on a local port. Call Close when done.
+func NewServer() *Server {
+	s := NewHandler()
+	s.httpServer = httptest.NewServer(s)
+	s.URL = s.httpServer.URL
+	return s
+}
+
+// Close shuts down a fake started with NewServer.
+func (s *Server) Close() {
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+// AddNetwork registers a private network and returns its ID.
+func (s *Server) AddNetwork(name, ipRange string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.newID()
+	s.networks[id] = &hcloud.Network{ID: id, Name: name, IPRange: ipRange}
+	return id
+}
+
+// AddPlacementGroup registers a spread placement group and returns its ID.
+func (s *Server) AddPlacementGroup(name string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.newID()
+	s.placementGroups[id] = &hcloud.PlacementGroup{ID: id, Name: name, Type: "spread"}
+	return id
+}
+
+// AddSSHKey registers an SSH key name that servers may reference.
+func (s *Server) AddSSHKey(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.newID()
+	s.sshKeys[id] = &hcloud.SSHKey{ID: id, Name: name}
+}
+
+// AddImage registers an available image of the given type, e.g. a snapshot
+// taken at created, and returns its ID.
+func (s *Server) AddImage(imageType, description string, created time.Time, labels map[string]string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.newID()
+	s.images[id] = &hcloud.Image{ID: id, Type: imageType, Description: description, Status: "available", Created: created, DiskSize: 40, Labels: labels}
+	return id
+}
+
+// SetServerTypeUnavailable marks a server type as out of stock in a location,
+// so creating such a server there fails like it does on the real API.
+func (s *Server) SetServerTypeUnavailable(serverType, location string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unavailable[serverType+"@"+location] = true
+}
+
+// FailActions makes every later action with the given command (e.g.
+// "create_server") end in the error state with message, after being polled
+// ActionPolls times like any other action.
+func (s *Server) FailActions(command, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing[command] = &hcloud.ActionError{Code: "action_failed", Message: message}
+}
+
+// Requests returns the requests received so far, in order, as "<method> <path>"
+// without the query string, e.g. "POST /v1/firewalls".
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Servers returns a snapshot of the servers currently known to the fake.
+func (s *Server) Servers() []hcloud.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []hcloud.Server
+	for _, srv := range s.servers {
+		out = append(out, *srv)
+	}
+	return out
+}
+
+// ServeHTTP routes a request to the matching fake endpoint.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "unable to authenticate")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+
+	switch {
+	case len(segments) == 1 && segments[0] == "servers" && r.Method == http.MethodGet:
+		s.listServers(w, r)
+	case len(segments) == 1 && segments[0] == "servers" && r.Method == http.MethodPost:
+		s.createServer(w, r)
+	case len(segments) == 2 && segments[0] == "servers" && r.Method == http.MethodGet:
+		s.getServer(w, segments[1])
+	case len(segments) == 2 && segments[0] == "servers" && r.Method == http.MethodDelete:
+		s.deleteServer(w, segments[1])
+	case len(segments) == 2 && segments[0] == "servers" && r.Method == http.MethodPut:
+		s.updateServer(w, r, segments[1])
+	case len(segments) == 4 && segments[0] == "servers" && segments[2] == "actions" && segments[3] == "create_image" && r.Method == http.MethodPost:
+		s.createImage(w, r, segments[1])
+	case len(segments) == 4 && segments[0] == "servers" && segments[2] == "actions" && (segments[3] == "poweroff" || segments[3] == "poweron") && r.Method == http.MethodPost:
+		s.powerServer(w, segments[1], segments[3] == "poweron")
+	case len(segments) == 4 && segments[0] == "volumes" && segments[2] == "actions" && (segments[3] == "attach" || segments[3] == "detach") && r.Method == http.MethodPost:
+		s.attachVolume(w, r, segments[1], segments[3] == "attach")
+	case len(segments) >= 1 && segments[0] == "floating_ips":
+		s.serveFloatingIPs(w, r, segments[1:])
+	case len(segments) >= 1 && segments[0] == "primary_ips":
+		s.servePrimaryIPs(w, r, segments[1:])
+	case len(segments) >= 1 && segments[0] == "load_balancers":
+		s.serveLoadBalancers(w, r, segments[1:])
+	case len(segments) == 1 && segments[0] == "images" && r.Method == http.MethodGet:
+		s.listImages(w, r)
+	case len(segments) == 2 && segments[0] == "images" && r.Method == http.MethodDelete:
+		id, _ := strconv.ParseInt(segments[1], 10, 64)
+		if _, ok := s.images[id]; !ok {
+			writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("image %s not found", segments[1]))
+			return
+		}
+		delete(s.images, id)
+		w.WriteHeader(http.StatusNoContent)
+	case len(segments) == 2 && segments[0] == "actions" && r.Method == http.MethodGet:
+		s.getAction(w, segments[1])
+	case len(segments) == 1 && segments[0] == "networks" && r.Method == http.MethodGet:
+		var networks []*hcloud.Network
+		for _, n := range s.networks {
+			if name := r.URL.Query().Get("name"); name == "" || n.Name == name {
+				networks = append(networks, n)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"networks": networks})
+	case len(segments) == 1 && segments[0] == "placement_groups" && r.Method == http.MethodGet:
+		var groups []*hcloud.PlacementGroup
+		for _, pg := range s.placementGroups {
+			if name := r.URL.Query().Get("name"); name == "" || pg.Name == name {
+				groups = append(groups, pg)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"placement_groups": groups})
+	case len(segments) == 1 && segments[0] == "firewalls" && r.Method == http.MethodGet:
+		firewalls := []*hcloud.Firewall{}
+		for _, fw := range s.firewalls {
+			if name := r.URL.Query().Get("name"); name == "" || fw.Name == name {
+				firewalls = append(firewalls, fw)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"firewalls": firewalls})
+	case len(segments) == 1 && segments[0] == "firewalls" && r.Method == http.MethodPost:
+		s.createFirewall(w, r)
+	case len(segments) == 4 && segments[0] == "firewalls" && segments[2] == "actions" && segments[3] == "set_rules" && r.Method == http.MethodPost:
+		s.setFirewallRules(w, r, segments[1])
+	case len(segments) == 1 && segments[0] == "networks" && r.Method == http.MethodPost:
+		s.createNetwork(w, r)
+	case len(segments) == 4 && segments[0] == "networks" && segments[2] == "actions" && segments[3] == "add_subnet" && r.Method == http.MethodPost:
+		s.addSubnet(w, r, segments[1])
+	case len(segments) == 1 && segments[0] == "placement_groups" && r.Method == http.MethodPost:
+		s.createPlacementGroup(w, r)
+	case len(segments) == 1 && segments[0] == "ssh_keys" && r.Method == http.MethodGet:
+		keys := []*hcloud.SSHKey{}
+		for _, key := range s.sshKeys {
+			q := r.URL.Query()
+			if (q.Get("name") == "" || key.Name == q.Get("name")) && (q.Get("fingerprint") == "" || key.Fingerprint == q.Get("fingerprint")) {
+				keys = append(keys, key)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ssh_keys": keys})
+	case len(segments) == 1 && segments[0] == "ssh_keys" && r.Method == http.MethodPost:
+		s.createSSHKey(w, r)
+	case len(segments) == 1 && segments[0] == "volumes" && r.Method == http.MethodGet:
+		volumes := []*hcloud.Volume{}
+		for _, v := range s.volumes {
+			if name := r.URL.Query().Get("name"); name == "" || v.Name == name {
+				volumes = append(volumes, v)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"volumes": volumes})
+	case len(segments) == 1 && segments[0] == "volumes" && r.Method == http.MethodPost:
+		s.createVolume(w, r)
+	case len(segments) == 1 && segments[0] == "locations" && r.Method == http.MethodGet:
+		locations := []hcloud.Location{}
+		for _, loc := range Locations {
+			if name := r.URL.Query().Get("name"); name == "" || loc.Name == name {
+				locations = append(locations, loc)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"locations": locations})
+	case len(segments) == 1 && segments[0] == "server_types" && r.Method == http.MethodGet:
+		serverTypes := []hcloud.ServerType{}
+		for _, st := range ServerTypes {
+			if name := r.URL.Query().Get("name"); name == "" || st.Name == name {
+				serverTypes = append(serverTypes, st)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"server_types": serverTypes})
+	case len(segments) == 1 && segments[0] == "datacenters" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"datacenters": s.datacenters()})
+	default:
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("%s %s is not implemented by the fake API", r.Method, r.URL.Path))
+	}
+}
+
+// listServers filters by name and label selector and paginates like the real
+// API (page and per_page, 25 servers per page by default).
+func (s *Server) listServers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var terms []string
+	if selector := q.Get("label_selector"); selector != "" {
+		terms = strings.Split(selector, ",")
+	}
+	servers := []*hcloud.Server{}
+	for _, srv := range s.servers {
+		if (q.Get("name") == "" || srv.Name == q.Get("name")) && matchLabels(srv.Labels, terms) {
+			servers = append(servers, srv)
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+	start, end := pageBounds(q, len(servers))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"servers": servers[start:end]})
+}
+
+// pageBounds returns the range of a list of n items on the page selected by
+// the page and per_page query parameters, 25 items per page by default like
+// the real API.
+func pageBounds(q url.Values, n int) (start, end int) {
+	page, perPage := 1, 25
+	if p, err := strconv.Atoi(q.Get("page")); err == nil && p > 0 {
+		page = p
+	}
+	if p, err := strconv.Atoi(q.Get("per_page")); err == nil && p > 0 {
+		perPage = p
+	}
+	start = min((page-1)*perPage, n)
+	return start, min(start+perPage, n)
+}
+
+func (s *Server) createServer(w http.ResponseWriter, r *http.Request) {
+	var opts hcloud.ServerCreateOpts
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	if opts.Name == "" || opts.ServerType == "" || opts.Image == "" {
+		writeError(w, http.StatusBadRequest, "invalid_input", "name, server_type and image are required")
+		return
+	}
+	for _, srv := range s.servers {
+		if srv.Name == opts.Name {
+			writeError(w, http.StatusConflict, "uniqueness_error", fmt.Sprintf("server name %q is already used", opts.Name))
+			return
+		}
+	}
+	if imageID, err := strconv.ParseInt(opts.Image, 10, 64); err == nil {
+		if _, ok := s.images[imageID]; !ok {
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("image %d not found", imageID))
+			return
+		}
+	}
+	for _, key := range opts.SSHKeys {
+		if s.sshKeyByName(key) == nil {
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("ssh key %q not found", key))
+			return
+		}
+	}
+	for _, netID := range opts.Networks {
+		if _, ok := s.networks[netID]; !ok {
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("network %d not found", netID))
+			return
+		}
+	}
+	if opts.PlacementGroup != 0 {
+		if _, ok := s.placementGroups[opts.PlacementGroup]; !ok {
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("placement group %d not found", opts.PlacementGroup))
+			return
+		}
+	}
+	for _, volID := range opts.Volumes {
+		v, ok := s.volumes[volID]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("volume %d not found", volID))
+			return
+		}
+		if v.Server != nil {
+			writeError(w, http.StatusConflict, "conflict", fmt.Sprintf("volume %d is already attached", volID))
+			return
+		}
+	}
+	for _, fw := range opts.Firewalls {
+		if _, ok := s.firewalls[fw.Firewall]; !ok {
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("firewall %d not found", fw.Firewall))
+			return
+		}
+	}
+
+	serverType, ok := serverTypeByName(opts.ServerType)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("server type %q not found", opts.ServerType))
+		return
+	}
+	var datacenter *hcloud.Datacenter
+	for _, dc := range s.datacenters() {
+		if dc.Name == opts.Datacenter || (opts.Datacenter == "" && (opts.Location == "" || dc.Location.Name == opts.Location)) {
+			datacenter = &dc
+			break
+		}
+	}
+	if datacenter == nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("datacenter %q / location %q not found", opts.Datacenter, opts.Location))
+		return
+	}
+	if !datacenter.HasAvailable(serverType.ID) {
+		writeError(w, http.StatusPreconditionFailed, "resource_unavailable", fmt.Sprintf("server type %s is unavailable in %s", serverType.Name, datacenter.Name))
+		return
+	}
+	if opts.PublicNet != nil && opts.PublicNet.IPv4 != nil {
+		ip, ok := s.primaryIPs[*opts.PublicNet.IPv4]
+		switch {
+		case !ok || ip.Type != hcloud.PrimaryIPTypeIPv4:
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("primary IPv4 %d not found", *opts.PublicNet.IPv4))
+			return
+		case ip.AssigneeID != nil:
+			writeError(w, http.StatusConflict, "conflict", fmt.Sprintf("primary IP %d is already assigned", ip.ID))
+			return
+		case ip.Datacenter.Name != datacenter.Name:
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("primary IP %d is in datacenter %s, not %s", ip.ID, ip.Datacenter.Name, datacenter.Name))
+			return
+		}
+	}
+
+	id := s.newID()
+	srv := &hcloud.Server{
+		ID:         id,
+		Name:       opts.Name,
+		Status:     "running",
+		ServerType: serverType,
+		Datacenter: *datacenter,
+		Labels:     opts.Labels,
+	}
+	if opts.PublicNet != nil && opts.PublicNet.IPv4 != nil {
+		ip := s.primaryIPs[*opts.PublicNet.IPv4]
+		ip.AssigneeID, ip.AssigneeType = &id, "server"
+		srv.PublicNet.IPv4 = &hcloud.ServerPublicIP{ID: ip.ID, IP: ip.IP}
+	} else if opts.PublicNet == nil || opts.PublicNet.EnableIPv4 {
+		ip := s.newPrimaryIP(hcloud.PrimaryIPTypeIPv4, fmt.Sprintf("203.0.113.%d", id%250+1), *datacenter)
+		ip.AssigneeID, ip.AssigneeType = &id, "server"
+		srv.PublicNet.IPv4 = &hcloud.ServerPublicIP{ID: ip.ID, IP: ip.IP}
+	}
+	if opts.PublicNet == nil || opts.PublicNet.EnableIPv6 {
+		ip := s.newPrimaryIP(hcloud.PrimaryIPTypeIPv6, fmt.Sprintf("2001:db8:%x::/64", id), *datacenter)
+		ip.AssigneeID, ip.AssigneeType = &id, "server"
+		srv.PublicNet.IPv6 = &hcloud.ServerPublicIP{ID: ip.ID, IP: ip.IP}
+	}
+	var nextActions []*hcloud.Action
+	for i, netID := range opts.Networks {
+		srv.PrivateNet = append(srv.PrivateNet, hcloud.ServerPrivateNet{Network: netID, IP: fmt.Sprintf("10.%d.0.%d", i, id%250+2)})
+		nextActions = append(nextActions, s.newAction("attach_to_network"))
+	}
+	if opts.PlacementGroup != 0 {
+		pg := s.placementGroups[opts.PlacementGroup]
+		pg.Servers = append(pg.Servers, id)
+	}
+	for _, fw := range opts.Firewalls {
+		firewall := s.firewalls[fw.Firewall]
+		firewall.AppliedTo = append(firewall.AppliedTo, hcloud.FirewallResource{Type: "server", Server: &hcloud.FirewallResourceServer{ID: id}})
+		nextActions = append(nextActions, s.newAction("apply_firewall"))
+	}
+	for _, volID := range opts.Volumes {
+		serverID := id
+		s.volumes[volID].Server = &serverID
+		nextActions = append(nextActions, s.newAction("attach_volume"))
+	}
+	s.servers[id] = srv
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"server":       srv,
+		"action":       s.newAction("create_server"),
+		"next_actions": nextActions,
+	})
+}
+
+// datacenters returns one datacenter per location. The real API has its own
+// numbering (fsn1-dc14, nbg1-dc3, ...); the fake simply uses "<location>-dc1".
+func (s *Server) datacenters() []hcloud.Datacenter {
+	var out []hcloud.Datacenter
+	for _, loc := range Locations {
+		dc := hcloud.Datacenter{ID: loc.ID, Name: loc.Name + "-dc1", Location: loc}
+		for _, st := range ServerTypes {
+			dc.ServerTypes.Supported = append(dc.ServerTypes.Supported, st.ID)
+			if st.Deprecation == nil && !s.unavailable[st.Name+"@"+loc.Name] {
+				dc.ServerTypes.Available = append(dc.ServerTypes.Available, st.ID)
+			}
+		}
+		out = append(out, dc)
+	}
+	return out
+}
+
+func serverTypeByName(name string) (hcloud.ServerType, bool) {
+	for _, st := range ServerTypes {
+		if st.Name == name {
+			return st, true
+		}
+	}
+	return hcloud.ServerType{}, false
+}
+
+func locationByName(name string) (hcloud.Location, bool) {
+	for _, loc := range Locations {
+		if loc.Name == name {
+			return loc, true
+		}
+	}
+	return hcloud.Location{}, false
+}
+
+func (s *Server) updateServer(w http.ResponseWriter, r *http.Request, rawID string) {
+	id, _ := strconv.ParseInt(rawID, 10, 64)
+	srv, ok := s.servers[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("server %s not found", rawID))
+		return
+	}
+	var opts hcloud.ServerUpdateOpts
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	if opts.Name != "" && opts.Name != srv.Name {
+		for _, other := range s.servers {
+			if other.Name == opts.Name {
+				writeError(w, http.StatusConflict, "uniqueness_error", fmt.Sprintf("server name %q is already used", opts.Name))
+				return
+			}
+		}
+		srv.Name = opts.Name
+	}
+	if opts.Labels != nil {
+		srv.Labels = opts.Labels
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"server": srv})
+}
+
+func (s *Server) powerServer(w http.ResponseWriter, rawID string, on bool) {
+	id, _ := strconv.ParseInt(rawID, 10, 64)
+	srv, ok := s.servers[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("server %s not found", rawID))
+		return
+	}
+	command := "stop_server"
+	srv.Status = "off"
+	if on {
+		command = "start_server"
+		srv.Status = "running"
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"action": s.newAction(command)})
+}
+
+func (s *Server) attachVolume(w http.ResponseWriter, r *http.Request, rawID string, attach bool) {
+	id, _ := strconv.ParseInt(rawID, 10, 64)
+	v, ok := s.volumes[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("volume %s not found", rawID))
+		return
+	}
+	if !attach {
+		v.Server = nil
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"action": s.newAction("detach_volume")})
+		return
+	}
+	var body struct {
+		Server int64 `json:"server"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	if _, ok := s.servers[body.Server]; !ok {
+		writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("server %d not found", body.Server))
+		return
+	}
+	if v.Server != nil {
+		writeError(w, http.StatusConflict, "conflict", fmt.Sprintf("volume %d is already attached", id))
+		return
+	}
+	v.Server = &body.Server
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"action": s.newAction("attach_volume")})
+}
+
+func (s *Server) getServer(w http.ResponseWriter, rawID string) {
+	id, _ := strconv.ParseInt(rawID, 10, 64)
+	srv, ok := s.servers[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("server %s not found", rawID))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"server": srv})
+}
+
+func (s *Server) deleteServer(w http.ResponseWriter, rawID string) {
+	id, _ := strconv.ParseInt(rawID, 10, 64)
+	if _, ok := s.servers[id]; !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("server %s not found", rawID))
+		return
+	}
+	delete(s.servers, id)
+	for ipID, ip := range s.primaryIPs {
+		if ip.AssigneeID != nil && *ip.AssigneeID == id {
+			if ip.AutoDelete {
+				delete(s.primaryIPs, ipID)
+			} else {
+				ip.AssigneeID, ip.AssigneeType = nil, ""
+			}
+		}
+	}
+	for _, ip := range s.floatingIPs {
+		if ip.Server != nil && *ip.Server == id {
+			ip.Server = nil
+		}
+	}
+	for _, v := range s.volumes {
+		if v.Server != nil && *v.Server == id {
+			v.Server = nil
+		}
+	}
+	for _, fw := range s.firewalls {
+		for i, res := range fw.AppliedTo {
+			if res.Server != nil && res.Server.ID == id {
+				fw.AppliedTo = append(fw.AppliedTo[:i], fw.AppliedTo[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, pg := range s.placementGroups {
+		for i, member := range pg.Servers {
+			if member == id {
+				pg.Servers = append(pg.Servers[:i], pg.Servers[i+1:]...)
+				break
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"action": s.newAction("delete_server")})
+}
+
+func (s *Server) createNetwork(w http.ResponseWriter, r *http.Request) {
+	var opts hcloud.NetworkCreateOpts
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	if opts.Name == "" || opts.IPRange == "" {
+		writeError(w, http.StatusBadRequest, "invalid_input", "name and ip_range are required")
+		return
+	}
+	for _, n := range s.networks {
+		if n.Name == opts.Name {
+			writeError(w, http.StatusConflict, "uniqueness_error", fmt.Sprintf("network name %q is already used", opts.Name))
+			return
+		}
+	}
+	id := s.newID()
+	n := &hcloud.Network{ID: id, Name: opts.Name, IPRange: opts.IPRange, Subnets: opts.Subnets, Labels: opts.Labels}
+	s.networks[id] = n
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"network": n})
+}
+
+func (s *Server) addSubnet(w http.ResponseWriter, r *http.Request, rawID string) {
+	id, _ := strconv.ParseInt(rawID, 10, 64)
+	n, ok := s.networks[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("network %s not found", rawID))
+		return
+	}
+	var subnet hcloud.NetworkSubnet
+	if err := json.NewDecoder(r.Body).Decode(&subnet); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	for _, existing := range n.Subnets {
+		if existing.IPRange == subnet.IPRange {
+			writeError(w, http.StatusConflict, "conflict", fmt.Sprintf("subnet %s already exists", subnet.IPRange))
+			return
+		}
+	}
+	n.Subnets = append(n.Subnets, subnet)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"action": s.newAction("add_subnet")})
+}
+
+func (s *Server) createPlacementGroup(w http.ResponseWriter, r *http.Request) {
+	var opts hcloud.PlacementGroupCreateOpts
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	if opts.Name == "" || opts.Type == "" {
+		writeError(w, http.StatusBadRequest, "invalid_input", "name and type are required")
+		return
+	}
+	for _, pg := range s.placementGroups {
+		if pg.Name == opts.Name {
+			writeError(w, http.StatusConflict, "uniqueness_error", fmt.Sprintf("placement group name %q is already used", opts.Name))
+			return
+		}
+	}
+	id := s.newID()
+	pg := &hcloud.PlacementGroup{ID: id, Name: opts.Name, Type: opts.Type, Servers: []int64{}, Labels: opts.Labels}
+	s.placementGroups[id] = pg
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"placement_group": pg, "action": nil})
+}
+
+func (s *Server) createSSHKey(w http.ResponseWriter, r *http.Request) {
+	var opts hcloud.SSHKeyCreateOpts
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	fingerprint, err := hcloud.SSHKeyFingerprint(opts.PublicKey)
+	if opts.Name == "" || err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", "name and a valid public_key are required")
+		return
+	}
+	for _, key := range s.sshKeys {
+		if key.Name == opts.Name || key.Fingerprint == fingerprint {
+			writeError(w, http.StatusConflict, "uniqueness_error", "SSH key with the same name or fingerprint already exists")
+			return
+		}
+	}
+	id := s.newID()
+	key := &hcloud.SSHKey{ID: id, Name: opts.Name, Fingerprint: fingerprint, PublicKey: opts.PublicKey, Labels: opts.Labels}
+	s.sshKeys[id] = key
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"ssh_key": key})
+}
+
+// sshKeyByName returns the SSH key with the given name, or nil. Callers must hold s.mu.
+func (s *Server) sshKeyByName(name string) *hcloud.SSHKey {
+	for _, key := range s.sshKeys {
+		if key.Name == name {
+			return key
+		}
+	}
+	return nil
+}
+
+func (s *Server) createImage(w http.ResponseWriter, r *http.Request, rawID string) {
+	serverID, _ := strconv.ParseInt(rawID, 10, 64)
+	srv, ok := s.servers[serverID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("server %s not found", rawID))
+		return
+	}
+	var opts hcloud.ImageCreateOpts
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	id := s.newID()
+	image := &hcloud.Image{
+		ID:          id,
+		Type:        opts.Type,
+		Description: opts.Description,
+		Status:      "available",
+		Created:     time.Now().UTC(),
+		DiskSize:    40,
+		CreatedFrom: &hcloud.ImageCreatedFrom{ID: srv.ID, Name: srv.Name},
+		Labels:      opts.Labels,
+	}
+	s.images[id] = image
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"image": image, "action": s.newAction("create_image")})
+}
+
+// listImages filters by type and by a label selector of comma-separated
+// key=value terms, the only selector form the mage targets use, and returns
+// the page selected by page and per_page, ordered by ID.
+func (s *Server) listImages(w http.ResponseWriter, r *http.Request) {
+	imageType := r.URL.Query().Get("type")
+	var terms []string
+	if selector := r.URL.Query().Get("label_selector"); selector != "" {
+		terms = strings.Split(selector, ",")
+	}
+	images := []*hcloud.Image{}
+	for _, image := range s.images {
+		if imageType != "" && image.Type != imageType {
+			continue
+		}
+		if matchLabels(image.Labels, terms) {
+			images = append(images, image)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	start, end := pageBounds(r.URL.Query(), len(images))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"images": images[start:end]})
+}
+
+// matchLabels reports whether labels satisfy every key=value term.
+func matchLabels(labels map[string]string, terms []string) bool {
+	for _, term := range terms {
+		key, value, _ := strings.Cut(term, "=")
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) createVolume(w http.ResponseWriter, r *http.Request) {
+	var opts hcloud.VolumeCreateOpts
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	if opts.Name == "" || opts.Size < 10 || opts.Location == "" {
+		writeError(w, http.StatusBadRequest, "invalid_input", "name, location and a size of at least 10 GB are required")
+		return
+	}
+	for _, v := range s.volumes {
+		if v.Name == opts.Name {
+			writeError(w, http.StatusConflict, "uniqueness_error", fmt.Sprintf("volume name %q is already used", opts.Name))
+			return
+		}
+	}
+	id := s.newID()
+	v := &hcloud.Volume{
+		ID:          id,
+		Name:        opts.Name,
+		Size:        opts.Size,
+		Location:    hcloud.Location{Name: opts.Location},
+		LinuxDevice: fmt.Sprintf("/dev/disk/by-id/scsi-0HC_Volume_%d", id),
+		Labels:      opts.Labels,
+	}
+	s.volumes[id] = v
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"volume": v, "action": s.newAction("create_volume")})
+}
+
+func (s *Server) createFirewall(w http.ResponseWriter, r *http.Request) {
+	var opts hcloud.FirewallCreateOpts
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	if opts.Name == "" {
+		writeError(w, http.StatusBadRequest, "invalid_input", "name is required")
+		return
+	}
+	for _, fw := range s.firewalls {
+		if fw.Name == opts.Name {
+			writeError(w, http.StatusConflict, "uniqueness_error", fmt.Sprintf("firewall name %q is already used", opts.Name))
+			return
+		}
+	}
+	id := s.newID()
+	fw := &hcloud.Firewall{ID: id, Name: opts.Name, Labels: opts.Labels, Rules: opts.Rules}
+	s.firewalls[id] = fw
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"firewall": fw,
+		"actions":  []*hcloud.Action{s.newAction("set_firewall_rules")},
+	})
+}
+
+func (s *Server) setFirewallRules(w http.ResponseWriter, r *http.Request, rawID string) {
+	id, _ := strconv.ParseInt(rawID, 10, 64)
+	fw, ok := s.firewalls[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("firewall %s not found", rawID))
+		return
+	}
+	var body struct {
+		Rules []hcloud.FirewallRule `json:"rules"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_input", err.Error())
+		return
+	}
+	fw.Rules = body.Rules
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"actions": []*hcloud.Action{s.newAction("set_firewall_rules")},
+	})
+}
+
+func (s *Server) getAction(w http.ResponseWriter, rawID string) {
+	id, _ := strconv.ParseInt(rawID, 10, 64)
+	fa, ok := s.actions[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("action %s not found", rawID))
+		return
+	}
+	if fa.pollsLeft > 0 {
+		fa.pollsLeft--
+	}
+	if fa.pollsLeft == 0 {
+		fa.finish()
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"action": fa.action})
+}
+
+// newAction records a new action. Callers must hold s.mu.
+func (s *Server) newAction(command string) *hcloud.Action {
+	fa := &fakeAction{
+		action:    hcloud.Action{ID: s.newID(), Command: command, Status: hcloud.ActionStatusRunning},
+		pollsLeft: s.ActionPolls,
+		fail:      s.failing[command],
+	}
+	if fa.pollsLeft == 0 {
+		fa.finish()
+	}
+	s.actions[fa.action.ID] = fa
+	action := fa.action
+	return &action
+}
+
+// newID returns a fresh resource ID. Callers must hold s.mu.
+func (s *Server) newID() int64 {
+	id := s.nextID
+	s.nextID++
+	return id
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]string{"code": code, "message": message},
+	})
+}
@@ -0,0 +1,44 @@
+package hcloud_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"k3s-nixos-configs/internal/hcloud"
+)
+
+func TestListImages(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newTestClient(t)
+	labels := map[string]string{"k3s-nixos/node": "control-1"}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// More snapshots than fit on one page, created out of ID order, so the
+	// newest ones are on the last page.
+	const count = 120
+	for i := 0; i < count; i++ {
+		created := base.Add(time.Duration((i*37)%count) * time.Hour)
+		fake.AddImage(hcloud.ImageTypeSnapshot, fmt.Sprintf("snapshot %d", i), created, labels)
+	}
+	fake.AddImage(hcloud.ImageTypeSnapshot, "other node", base.Add(1000*time.Hour), map[string]string{"k3s-nixos/node": "worker-1"})
+	fake.AddImage("system", "debian-12", base.Add(1000*time.Hour), nil)
+
+	images, err := client.ListImages(ctx, hcloud.ImageTypeSnapshot, "k3s-nixos/node=control-1")
+	if err != nil {
+		t.Fatalf("ListImages: %v", err)
+	}
+	if len(images) != count {
+		t.Fatalf("ListImages returned %d images, want %d", len(images), count)
+	}
+	for i, image := range images {
+		if want := base.Add(time.Duration(count-1-i) * time.Hour); !image.Created.Equal(want) {
+			t.Fatalf("image %d was created %s, want %s (newest first)", i, image.Created, want)
+		}
+	}
+
+	all, err := client.ListImages(ctx, hcloud.ImageTypeSnapshot, "")
+	if err != nil || len(all) != count+1 || all[0].Description != "other node" {
+		t.Errorf("ListImages without selector = %d images, %v, want %d snapshots, newest first", len(all), err, count+1)
+	}
+}
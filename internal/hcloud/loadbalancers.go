@@ -0,0 +1,344 @@
+package hcloud
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Load balancer service protocols, target types and health statuses.
+const (
+	LoadBalancerProtocolTCP = "tcp"
+
+	LoadBalancerTargetTypeLabelSelector = "label_selector"
+	LoadBalancerTargetTypeServer        = "server"
+
+	LoadBalancerHealthStatusHealthy   = "healthy"
+	LoadBalancerHealthStatusUnhealthy = "unhealthy"
+	LoadBalancerHealthStatusUnknown   = "unknown"
+)
+
+// LoadBalancer is a Hetzner Cloud load balancer.
+type LoadBalancer struct {
+	ID               int64                    `json:"id"`
+	Name             string                   `json:"name"`
+	LoadBalancerType LoadBalancerType         `json:"load_balancer_type"`
+	Location         Location                 `json:"location"`
+	PublicNet        LoadBalancerPublicNet    `json:"public_net"`
+	PrivateNet       []LoadBalancerPrivateNet `json:"private_net"`
+	Algorithm        LoadBalancerAlgorithm    `json:"algorithm"`
+	Services         []LoadBalancerService    `json:"services"`
+	Targets          []LoadBalancerTarget     `json:"targets"`
+	Labels           map[string]string        `json:"labels"`
+}
+
+// LoadBalancerType is the size of a load balancer, e.g. lb11.
+type LoadBalancerType struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// LoadBalancerPublicNet holds the public addresses of a load balancer. They are
+// only reachable if Enabled.
+type LoadBalancerPublicNet struct {
+	Enabled bool                 `json:"enabled"`
+	IPv4    LoadBalancerPublicIP `json:"ipv4"`
+	IPv6    LoadBalancerPublicIP `json:"ipv6"`
+}
+
+// LoadBalancerPublicIP is a public address of a load balancer.
+type LoadBalancerPublicIP struct {
+	IP string `json:"ip"`
+}
+
+// LoadBalancerPrivateNet is a load balancer's attachment to a private network.
+type LoadBalancerPrivateNet struct {
+	Network int64  `json:"network"`
+	IP      string `json:"ip"`
+}
+
+// LoadBalancerAlgorithm selects how connections are distributed ("round_robin"
+// or "least_connections").
+type LoadBalancerAlgorithm struct {
+	Type string `json:"type"`
+}
+
+// LoadBalancerService forwards a port of the load balancer to the targets.
+type LoadBalancerService struct {
+	Protocol        string                   `json:"protocol"`
+	ListenPort      int                      `json:"listen_port"`
+	DestinationPort int                      `json:"destination_port"`
+	Proxyprotocol   bool                     `json:"proxyprotocol"`
+	HealthCheck     *LoadBalancerHealthCheck `json:"health_check,omitempty"`
+}
+
+// LoadBalancerHealthCheck decides which targets receive traffic. Interval and
+// Timeout are in seconds.
+type LoadBalancerHealthCheck struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+	Interval int    `json:"interval"`
+	Timeout  int    `json:"timeout"`
+	Retries  int    `json:"retries"`
+}
+
+// LoadBalancerTarget is a target of a load balancer. A label selector target
+// covers every server with matching labels; Targets lists the servers it
+// currently resolves to.
+type LoadBalancerTarget struct {
+	Type          string                           `json:"type"`
+	LabelSelector *LoadBalancerTargetLabelSelector `json:"label_selector,omitempty"`
+	Server        *LoadBalancerTargetServer        `json:"server,omitempty"`
+	UsePrivateIP  bool                             `json:"use_private_ip"`
+	HealthStatus  []LoadBalancerTargetHealthStatus `json:"health_status,omitempty"`
+	Targets       []LoadBalancerTarget             `json:"targets,omitempty"`
+}
+
+// LoadBalancerTargetLabelSelector selects the servers of a label selector target.
+type LoadBalancerTargetLabelSelector struct {
+	Selector string `json:"selector"`
+}
+
+// LoadBalancerTargetServer identifies the server of a server target.
+type LoadBalancerTargetServer struct {
+	ID int64 `json:"id"`
+}
+
+// LoadBalancerTargetHealthStatus is the health of a target for one service.
+type LoadBalancerTargetHealthStatus struct {
+	ListenPort int    `json:"listen_port"`
+	Status     string `json:"status"`
+}
+
+// LoadBalancerCreateOpts are the parameters for creating a load balancer. With
+// Network set, the load balancer is attached to that private network.
+type LoadBalancerCreateOpts struct {
+	Name             string                 `json:"name"`
+	LoadBalancerType string                 `json:"load_balancer_type"`
+	Location         string                 `json:"location,omitempty"`
+	Algorithm        *LoadBalancerAlgorithm `json:"algorithm,omitempty"`
+	Network          int64                  `json:"network,omitempty"`
+	PublicInterface  bool                   `json:"public_interface"`
+	Services         []LoadBalancerService  `json:"services,omitempty"`
+	Targets          []LoadBalancerTarget   `json:"targets,omitempty"`
+	Labels           map[string]string      `json:"labels,omitempty"`
+}
+
+// PrivateIP returns the load balancer's IP in the given network, or "" if it is
+// not attached.
+func (lb *LoadBalancer) PrivateIP(networkID int64) string {
+	for _, net := range lb.PrivateNet {
+		if net.Network == networkID {
+			return net.IP
+		}
+	}
+	return ""
+}
+
+// Service returns the service listening on port, or nil.
+func (lb *LoadBalancer) Service(port int) *LoadBalancerService {
+	for i := range lb.Services {
+		if lb.Services[i].ListenPort == port {
+			return &lb.Services[i]
+		}
+	}
+	return nil
+}
+
+// LabelSelectorTarget returns the label selector target with the given
+// selector, or nil.
+func (lb *LoadBalancer) LabelSelectorTarget(selector string) *LoadBalancerTarget {
+	for i, t := range lb.Targets {
+		if t.Type == LoadBalancerTargetTypeLabelSelector && t.LabelSelector != nil && t.LabelSelector.Selector == selector {
+			return &lb.Targets[i]
+		}
+	}
+	return nil
+}
+
+// target returns the target of the same type selecting the same servers as t,
+// or nil.
+func (lb *LoadBalancer) target(t LoadBalancerTarget) *LoadBalancerTarget {
+	for i, existing := range lb.Targets {
+		switch {
+		case existing.Type != t.Type:
+		case t.LabelSelector != nil && existing.LabelSelector != nil && existing.LabelSelector.Selector == t.LabelSelector.Selector:
+			return &lb.Targets[i]
+		case t.Server != nil && existing.Server != nil && existing.Server.ID == t.Server.ID:
+			return &lb.Targets[i]
+		}
+	}
+	return nil
+}
+
+// GetLoadBalancerByName fetches a load balancer by name. It returns nil and no
+// error if the load balancer does not exist.
+func (c *Client) GetLoadBalancerByName(ctx context.Context, name string) (*LoadBalancer, error) {
+	var resp struct {
+		LoadBalancers []*LoadBalancer `json:"load_balancers"`
+	}
+	if err := c.do(ctx, "GET", "/load_balancers"+nameQuery(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.LoadBalancers) == 0 {
+		return nil, nil
+	}
+	return resp.LoadBalancers[0], nil
+}
+
+// CreateLoadBalancer creates a load balancer and waits for it to be provisioned.
+func (c *Client) CreateLoadBalancer(ctx context.Context, opts LoadBalancerCreateOpts) (*LoadBalancer, error) {
+	var resp struct {
+		LoadBalancer *LoadBalancer `json:"load_balancer"`
+		Action       *Action       `json:"action"`
+	}
+	if err := c.do(ctx, "POST", "/load_balancers", opts, &resp); err != nil {
+		return nil, err
+	}
+	if resp.LoadBalancer == nil && c.DryRun() {
+		// Nothing was created; return a placeholder so callers can continue their plan.
+		return &LoadBalancer{
+			Name:             opts.Name,
+			LoadBalancerType: LoadBalancerType{Name: opts.LoadBalancerType},
+			Location:         Location{Name: opts.Location},
+			PublicNet:        LoadBalancerPublicNet{Enabled: opts.PublicInterface},
+			Services:         opts.Services,
+			Targets:          opts.Targets,
+			Labels:           opts.Labels,
+		}, nil
+	}
+	if resp.LoadBalancer == nil {
+		return nil, fmt.Errorf("hcloud: create response for load balancer %q did not include a load balancer", opts.Name)
+	}
+	if _, err := c.WaitForAction(ctx, resp.Action); err != nil {
+		return nil, fmt.Errorf("hcloud: load balancer %q was created but provisioning failed: %w", opts.Name, err)
+	}
+	return resp.LoadBalancer, nil
+}
+
+// AttachLoadBalancerToNetwork attaches a load balancer to a private network and
+// waits for it.
+func (c *Client) AttachLoadBalancerToNetwork(ctx context.Context, id, networkID int64) error {
+	return c.loadBalancerAction(ctx, id, "attach_to_network", map[string]interface{}{"network": networkID})
+}
+
+// AddLoadBalancerService adds a service to a load balancer and waits for it.
+func (c *Client) AddLoadBalancerService(ctx context.Context, id int64, service LoadBalancerService) error {
+	return c.loadBalancerAction(ctx, id, "add_service", service)
+}
+
+// UpdateLoadBalancerService replaces the service listening on service.ListenPort
+// and waits for it.
+func (c *Client) UpdateLoadBalancerService(ctx context.Context, id int64, service LoadBalancerService) error {
+	return c.loadBalancerAction(ctx, id, "update_service", service)
+}
+
+// AddLoadBalancerTarget adds a target to a load balancer and waits for it.
+func (c *Client) AddLoadBalancerTarget(ctx context.Context, id int64, target LoadBalancerTarget) error {
+	return c.loadBalancerAction(ctx, id, "add_target", target)
+}
+
+// SetLoadBalancerPublicInterface enables or disables the public addresses of a
+// load balancer and waits for it.
+func (c *Client) SetLoadBalancerPublicInterface(ctx context.Context, id int64, enabled bool) error {
+	command := "disable_public_interface"
+	if enabled {
+		command = "enable_public_interface"
+	}
+	return c.loadBalancerAction(ctx, id, command, nil)
+}
+
+// loadBalancerAction runs an action on a load balancer and waits for it.
+func (c *Client) loadBalancerAction(ctx context.Context, id int64, command string, body interface{}) error {
+	var resp struct {
+		Action *Action `json:"action"`
+	}
+	if err := c.do(ctx, "POST", fmt.Sprintf("/load_balancers/%d/actions/%s", id, command), body, &resp); err != nil {
+		return err
+	}
+	_, err := c.WaitForAction(ctx, resp.Action)
+	return err
+}
+
+// LoadBalancerEnsureStatus is what EnsureLoadBalancer did to the load balancer
+// and each of its parts. Services and Targets are in the order of the options.
+type LoadBalancerEnsureStatus struct {
+	LoadBalancer    EnsureStatus
+	Network         EnsureStatus
+	Services        []EnsureStatus
+	Targets         []EnsureStatus
+	PublicInterface EnsureStatus
+}
+
+// EnsureLoadBalancer creates the load balancer opts.Name from opts. If it
+// exists, it is attached to opts.Network, services of opts.Services that are
+// missing or differ are added or replaced, missing targets of opts.Targets are
+// added and the public interface is enabled or disabled as in opts. The type,
+// location and algorithm of an existing load balancer are not changed, nor are
+// existing targets whose UsePrivateIP differs; callers should check them.
+func (c *Client) EnsureLoadBalancer(ctx context.Context, opts LoadBalancerCreateOpts) (*LoadBalancer, *LoadBalancerEnsureStatus, error) {
+	lb, err := c.GetLoadBalancerByName(ctx, opts.Name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up load balancer %s: %w", opts.Name, err)
+	}
+	if lb == nil {
+		if lb, err = c.CreateLoadBalancer(ctx, opts); err != nil {
+			return nil, nil, fmt.Errorf("failed to create load balancer %s: %w", opts.Name, err)
+		}
+		status := &LoadBalancerEnsureStatus{LoadBalancer: EnsureCreated, Network: EnsureCreated, PublicInterface: EnsureCreated}
+		for range opts.Services {
+			status.Services = append(status.Services, EnsureCreated)
+		}
+		for range opts.Targets {
+			status.Targets = append(status.Targets, EnsureCreated)
+		}
+		return lb, status, nil
+	}
+
+	status := &LoadBalancerEnsureStatus{LoadBalancer: EnsureExisted, Network: EnsureExisted, PublicInterface: EnsureExisted}
+	if opts.Network != 0 && lb.PrivateIP(opts.Network) == "" {
+		if err := c.AttachLoadBalancerToNetwork(ctx, lb.ID, opts.Network); err != nil {
+			return nil, nil, fmt.Errorf("failed to attach load balancer %s to network %d: %w", lb.Name, opts.Network, err)
+		}
+		lb.PrivateNet = append(lb.PrivateNet, LoadBalancerPrivateNet{Network: opts.Network})
+		status.Network = EnsureUpdated
+	}
+	for _, service := range opts.Services {
+		existing := lb.Service(service.ListenPort)
+		switch {
+		case existing == nil:
+			if err := c.AddLoadBalancerService(ctx, lb.ID, service); err != nil {
+				return nil, nil, fmt.Errorf("failed to add service on port %d to load balancer %s: %w", service.ListenPort, lb.Name, err)
+			}
+			lb.Services = append(lb.Services, service)
+			status.Services = append(status.Services, EnsureCreated)
+		case !reflect.DeepEqual(*existing, service):
+			if err := c.UpdateLoadBalancerService(ctx, lb.ID, service); err != nil {
+				return nil, nil, fmt.Errorf("failed to update service on port %d of load balancer %s: %w", service.ListenPort, lb.Name, err)
+			}
+			*existing = service
+			status.Services = append(status.Services, EnsureUpdated)
+		default:
+			status.Services = append(status.Services, EnsureExisted)
+		}
+	}
+	for _, target := range opts.Targets {
+		if lb.target(target) != nil {
+			status.Targets = append(status.Targets, EnsureExisted)
+			continue
+		}
+		if err := c.AddLoadBalancerTarget(ctx, lb.ID, target); err != nil {
+			return nil, nil, fmt.Errorf("failed to add %s target to load balancer %s: %w", target.Type, lb.Name, err)
+		}
+		lb.Targets = append(lb.Targets, target)
+		status.Targets = append(status.Targets, EnsureCreated)
+	}
+	if lb.PublicNet.Enabled != opts.PublicInterface {
+		if err := c.SetLoadBalancerPublicInterface(ctx, lb.ID, opts.PublicInterface); err != nil {
+			return nil, nil, fmt.Errorf("failed to change the public interface of load balancer %s: %w", lb.Name, err)
+		}
+		lb.PublicNet.Enabled = opts.PublicInterface
+		status.PublicInterface = EnsureUpdated
+	}
+	return lb, status, nil
+}
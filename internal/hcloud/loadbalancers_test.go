@@ -0,0 +1,130 @@
+package hcloud_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"k3s-nixos-configs/internal/hcloud"
+)
+
+func TestEnsureLoadBalancer(t *testing.T) {
+	service := hcloud.LoadBalancerService{
+		Protocol: hcloud.LoadBalancerProtocolTCP, ListenPort: 6443, DestinationPort: 6443,
+		HealthCheck: &hcloud.LoadBalancerHealthCheck{Protocol: hcloud.LoadBalancerProtocolTCP, Port: 6443, Interval: 15, Timeout: 10, Retries: 3},
+	}
+	drifted := service
+	drifted.HealthCheck = &hcloud.LoadBalancerHealthCheck{Protocol: hcloud.LoadBalancerProtocolTCP, Port: 6443, Interval: 60, Timeout: 10, Retries: 3}
+	target := hcloud.LoadBalancerTarget{
+		Type:          hcloud.LoadBalancerTargetTypeLabelSelector,
+		LabelSelector: &hcloud.LoadBalancerTargetLabelSelector{Selector: "k3s-nixos/role=control"},
+		UsePrivateIP:  true,
+	}
+	const (
+		existed = hcloud.EnsureExisted
+		created = hcloud.EnsureCreated
+		updated = hcloud.EnsureUpdated
+	)
+
+	tests := []struct {
+		name         string
+		existing     *hcloud.LoadBalancerCreateOpts // nil for no load balancer
+		wantStatus   hcloud.LoadBalancerEnsureStatus
+		wantRecorded []string // dry-run requests, %d is the load balancer ID
+	}{
+		{
+			name:         "missing",
+			wantStatus:   hcloud.LoadBalancerEnsureStatus{LoadBalancer: created, Network: created, Services: []hcloud.EnsureStatus{created}, Targets: []hcloud.EnsureStatus{created}, PublicInterface: created},
+			wantRecorded: []string{"POST /load_balancers"},
+		},
+		{
+			name:       "up to date",
+			existing:   &hcloud.LoadBalancerCreateOpts{Services: []hcloud.LoadBalancerService{service}, Targets: []hcloud.LoadBalancerTarget{target}},
+			wantStatus: hcloud.LoadBalancerEnsureStatus{LoadBalancer: existed, Network: existed, Services: []hcloud.EnsureStatus{existed}, Targets: []hcloud.EnsureStatus{existed}, PublicInterface: existed},
+		},
+		{
+			name:         "changed service",
+			existing:     &hcloud.LoadBalancerCreateOpts{Services: []hcloud.LoadBalancerService{drifted}, Targets: []hcloud.LoadBalancerTarget{target}},
+			wantStatus:   hcloud.LoadBalancerEnsureStatus{LoadBalancer: existed, Network: existed, Services: []hcloud.EnsureStatus{updated}, Targets: []hcloud.EnsureStatus{existed}, PublicInterface: existed},
+			wantRecorded: []string{"POST /load_balancers/%d/actions/update_service"},
+		},
+		{
+			name:       "detached without service and target",
+			existing:   &hcloud.LoadBalancerCreateOpts{PublicInterface: true},
+			wantStatus: hcloud.LoadBalancerEnsureStatus{LoadBalancer: existed, Network: updated, Services: []hcloud.EnsureStatus{created}, Targets: []hcloud.EnsureStatus{created}, PublicInterface: updated},
+			wantRecorded: []string{
+				"POST /load_balancers/%d/actions/attach_to_network",
+				"POST /load_balancers/%d/actions/add_service",
+				"POST /load_balancers/%d/actions/add_target",
+				"POST /load_balancers/%d/actions/disable_public_interface",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, fake := newTestClient(t)
+			networkID := fake.AddNetwork("k3s-net", "10.0.0.0/16")
+			opts := hcloud.LoadBalancerCreateOpts{
+				Name: "k3s-api", LoadBalancerType: "lb11", Location: "fsn1", Network: networkID,
+				Services: []hcloud.LoadBalancerService{service},
+				Targets:  []hcloud.LoadBalancerTarget{target},
+			}
+			wantRecorded := tt.wantRecorded
+			if tt.existing != nil {
+				existing := *tt.existing
+				existing.Name, existing.LoadBalancerType, existing.Location = opts.Name, opts.LoadBalancerType, opts.Location
+				if len(existing.Targets) > 0 {
+					existing.Network = networkID
+				}
+				lb, err := client.CreateLoadBalancer(ctx, existing)
+				if err != nil {
+					t.Fatalf("CreateLoadBalancer: %v", err)
+				}
+				wantRecorded = nil
+				for _, path := range tt.wantRecorded {
+					wantRecorded = append(wantRecorded, fmt.Sprintf(path, lb.ID))
+				}
+			}
+
+			var statuses []*hcloud.LoadBalancerEnsureStatus
+			checkEnsure(t, fake, client, overallStatus(&tt.wantStatus), wantRecorded, func(c *hcloud.Client) (hcloud.EnsureStatus, error) {
+				_, status, err := c.EnsureLoadBalancer(ctx, opts)
+				if err != nil {
+					return "", err
+				}
+				statuses = append(statuses, status)
+				return overallStatus(status), nil
+			})
+			for i, run := range []string{"dry run", "ensure"} {
+				if i < len(statuses) && !reflect.DeepEqual(*statuses[i], tt.wantStatus) {
+					t.Errorf("%s status = %+v, want %+v", run, *statuses[i], tt.wantStatus)
+				}
+			}
+
+			lb, err := client.GetLoadBalancerByName(ctx, "k3s-api")
+			if err != nil || lb == nil {
+				t.Fatalf("GetLoadBalancerByName = %v, %v", lb, err)
+			}
+			if lb.PrivateIP(networkID) == "" || !reflect.DeepEqual(lb.Service(6443), &service) || lb.LabelSelectorTarget(target.LabelSelector.Selector) == nil || lb.PublicNet.Enabled {
+				t.Errorf("load balancer = %+v, want it attached to network %d with the service, the target and no public interface", lb, networkID)
+			}
+		})
+	}
+}
+
+// overallStatus sums up what EnsureLoadBalancer did: created, updated if any
+// part changed, or existed.
+func overallStatus(status *hcloud.LoadBalancerEnsureStatus) hcloud.EnsureStatus {
+	if status.LoadBalancer != hcloud.EnsureExisted {
+		return status.LoadBalancer
+	}
+	parts := append([]hcloud.EnsureStatus{status.Network, status.PublicInterface}, status.Services...)
+	for _, part := range append(parts, status.Targets...) {
+		if part != hcloud.EnsureExisted {
+			return hcloud.EnsureUpdated
+		}
+	}
+	return hcloud.EnsureExisted
+}
@@ -0,0 +1,18 @@
+package hcloud
+
+import "context"
+
+// GetLocationByName fetches a location (e.g. "fsn1" or "ash") by name. It
+// returns nil and no error if the location does not exist.
+func (c *Client) GetLocationByName(ctx context.Context, name string) (*Location, error) {
+	var resp struct {
+		Locations []*Location `json:"locations"`
+	}
+	if err := c.do(ctx, "GET", "/locations"+nameQuery(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Locations) == 0 {
+		return nil, nil
+	}
+	return resp.Locations[0], nil
+}
@@ -0,0 +1,194 @@
+package hcloud
+
+import (
+	"context"
+	"fmt"
+)
+
+// Network is a Hetzner Cloud private network.
+type Network struct {
+	ID      int64             `json:"id"`
+	Name    string            `json:"name"`
+	IPRange string            `json:"ip_range"`
+	Subnets []NetworkSubnet   `json:"subnets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// NetworkSubnet is a subnet of a private network.
+type NetworkSubnet struct {
+	Type        string `json:"type"`
+	IPRange     string `json:"ip_range"`
+	NetworkZone string `json:"network_zone"`
+}
+
+// NetworkSubnetTypeCloud is the subnet type for cloud servers.
+const NetworkSubnetTypeCloud = "cloud"
+
+// PlacementGroupTypeSpread places every server of the group on a different
+// physical host. A spread group holds at most PlacementGroupMaxServers servers.
+const PlacementGroupTypeSpread = "spread"
+
+// PlacementGroupMaxServers is the maximum number of servers in a spread placement group.
+const PlacementGroupMaxServers = 10
+
+// HasSubnetInZone reports whether the network has a subnet in the given network zone.
+func (n *Network) HasSubnetInZone(zone string) bool {
+	for _, subnet := range n.Subnets {
+		if subnet.NetworkZone == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// NetworkCreateOpts are the parameters for creating a private network.
+type NetworkCreateOpts struct {
+	Name    string            `json:"name"`
+	IPRange string            `json:"ip_range"`
+	Subnets []NetworkSubnet   `json:"subnets,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// PlacementGroupCreateOpts are the parameters for creating a placement group.
+type PlacementGroupCreateOpts struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// PlacementGroup is a Hetzner Cloud placement group.
+type PlacementGroup struct {
+	ID      int64             `json:"id"`
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Servers []int64           `json:"servers"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// GetNetworkByName fetches a private network by name. It returns nil and no
+// error if the network does not exist.
+func (c *Client) GetNetworkByName(ctx context.Context, name string) (*Network, error) {
+	var resp struct {
+		Networks []*Network `json:"networks"`
+	}
+	if err := c.do(ctx, "GET", "/networks"+nameQuery(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Networks) == 0 {
+		return nil, nil
+	}
+	return resp.Networks[0], nil
+}
+
+// GetPlacementGroupByName fetches a placement group by name. It returns nil
+// and no error if the placement group does not exist.
+func (c *Client) GetPlacementGroupByName(ctx context.Context, name string) (*PlacementGroup, error) {
+	var resp struct {
+		PlacementGroups []*PlacementGroup `json:"placement_groups"`
+	}
+	if err := c.do(ctx, "GET", "/placement_groups"+nameQuery(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.PlacementGroups) == 0 {
+		return nil, nil
+	}
+	return resp.PlacementGroups[0], nil
+}
+
+// CreateNetwork creates a private network with the given subnets.
+func (c *Client) CreateNetwork(ctx context.Context, opts NetworkCreateOpts) (*Network, error) {
+	var resp struct {
+		Network *Network `json:"network"`
+	}
+	if err := c.do(ctx, "POST", "/networks", opts, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Network == nil && c.DryRun() {
+		// Nothing was created; return a placeholder so callers can continue their plan.
+		return &Network{Name: opts.Name, IPRange: opts.IPRange, Subnets: opts.Subnets, Labels: opts.Labels}, nil
+	}
+	if resp.Network == nil {
+		return nil, fmt.Errorf("hcloud: create response for network %q did not include a network", opts.Name)
+	}
+	return resp.Network, nil
+}
+
+// AddSubnet adds a subnet to a private network and waits for the action to finish.
+func (c *Client) AddSubnet(ctx context.Context, networkID int64, subnet NetworkSubnet) error {
+	var resp struct {
+		Action *Action `json:"action"`
+	}
+	if err := c.do(ctx, "POST", fmt.Sprintf("/networks/%d/actions/add_subnet", networkID), subnet, &resp); err != nil {
+		return err
+	}
+	_, err := c.WaitForAction(ctx, resp.Action)
+	return err
+}
+
+// CreatePlacementGroup creates a placement group.
+func (c *Client) CreatePlacementGroup(ctx context.Context, opts PlacementGroupCreateOpts) (*PlacementGroup, error) {
+	var resp struct {
+		PlacementGroup *PlacementGroup `json:"placement_group"`
+		Action         *Action         `json:"action"`
+	}
+	if err := c.do(ctx, "POST", "/placement_groups", opts, &resp); err != nil {
+		return nil, err
+	}
+	if resp.PlacementGroup == nil && c.DryRun() {
+		// Nothing was created; return a placeholder so callers can continue their plan.
+		return &PlacementGroup{Name: opts.Name, Type: opts.Type, Labels: opts.Labels}, nil
+	}
+	if resp.PlacementGroup == nil {
+		return nil, fmt.Errorf("hcloud: create response for placement group %q did not include a placement group", opts.Name)
+	}
+	if _, err := c.WaitForAction(ctx, resp.Action); err != nil {
+		return nil, err
+	}
+	return resp.PlacementGroup, nil
+}
+
+// EnsureNetwork creates the private network opts.Name with opts.Subnets. If
+// the network exists, each subnet of opts.Subnets in a network zone the network
+// has no subnet in is added to it. The IP range and labels of an existing
+// network are not changed.
+func (c *Client) EnsureNetwork(ctx context.Context, opts NetworkCreateOpts) (*Network, EnsureStatus, error) {
+	network, err := c.GetNetworkByName(ctx, opts.Name)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to look up private network %s: %w", opts.Name, err)
+	}
+	if network == nil {
+		if network, err = c.CreateNetwork(ctx, opts); err != nil {
+			return nil, "", fmt.Errorf("failed to create private network %s: %w", opts.Name, err)
+		}
+		return network, EnsureCreated, nil
+	}
+	status := EnsureExisted
+	for _, subnet := range opts.Subnets {
+		if network.HasSubnetInZone(subnet.NetworkZone) {
+			continue
+		}
+		if err := c.AddSubnet(ctx, network.ID, subnet); err != nil {
+			return nil, "", fmt.Errorf("failed to add subnet %s in %s to private network %s (use an IP range not used by another subnet): %w", subnet.IPRange, subnet.NetworkZone, network.Name, err)
+		}
+		network.Subnets = append(network.Subnets, subnet)
+		status = EnsureUpdated
+	}
+	return network, status, nil
+}
+
+// EnsurePlacementGroup creates the placement group opts.Name unless it exists.
+// The type of an existing placement group cannot be changed; callers should
+// check it.
+func (c *Client) EnsurePlacementGroup(ctx context.Context, opts PlacementGroupCreateOpts) (*PlacementGroup, EnsureStatus, error) {
+	placementGroup, err := c.GetPlacementGroupByName(ctx, opts.Name)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to look up placement group %s: %w", opts.Name, err)
+	}
+	if placementGroup != nil {
+		return placementGroup, EnsureExisted, nil
+	}
+	if placementGroup, err = c.CreatePlacementGroup(ctx, opts); err != nil {
+		return nil, "", fmt.Errorf("failed to create placement group %s: %w", opts.Name, err)
+	}
+	return placementGroup, EnsureCreated, nil
+}
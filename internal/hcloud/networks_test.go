@@ -0,0 +1,116 @@
+package hcloud_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k3s-nixos-configs/internal/hcloud"
+)
+
+func TestEnsureNetwork(t *testing.T) {
+	euSubnet := hcloud.NetworkSubnet{Type: hcloud.NetworkSubnetTypeCloud, IPRange: "10.0.1.0/24", NetworkZone: "eu-central"}
+	usSubnet := hcloud.NetworkSubnet{Type: hcloud.NetworkSubnetTypeCloud, IPRange: "10.0.2.0/24", NetworkZone: "us-east"}
+	tests := []struct {
+		name         string
+		existing     []hcloud.NetworkSubnet // nil for no network
+		subnet       hcloud.NetworkSubnet
+		wantStatus   hcloud.EnsureStatus
+		wantRecorded []string
+		wantSubnets  []hcloud.NetworkSubnet
+	}{
+		{
+			name:         "missing",
+			subnet:       euSubnet,
+			wantStatus:   hcloud.EnsureCreated,
+			wantRecorded: []string{"POST /networks"},
+			wantSubnets:  []hcloud.NetworkSubnet{euSubnet},
+		},
+		{
+			name:        "subnet in the zone",
+			existing:    []hcloud.NetworkSubnet{euSubnet},
+			subnet:      hcloud.NetworkSubnet{Type: hcloud.NetworkSubnetTypeCloud, IPRange: "10.0.9.0/24", NetworkZone: "eu-central"},
+			wantStatus:  hcloud.EnsureExisted,
+			wantSubnets: []hcloud.NetworkSubnet{euSubnet},
+		},
+		{
+			name:         "no subnet in the zone",
+			existing:     []hcloud.NetworkSubnet{euSubnet},
+			subnet:       usSubnet,
+			wantStatus:   hcloud.EnsureUpdated,
+			wantRecorded: []string{"POST /networks/1/actions/add_subnet"},
+			wantSubnets:  []hcloud.NetworkSubnet{euSubnet, usSubnet},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, fake := newTestClient(t)
+			if tt.existing != nil {
+				if _, err := client.CreateNetwork(ctx, hcloud.NetworkCreateOpts{Name: "k3s-net", IPRange: "10.0.0.0/16", Subnets: tt.existing}); err != nil {
+					t.Fatalf("CreateNetwork: %v", err)
+				}
+			}
+			opts := hcloud.NetworkCreateOpts{Name: "k3s-net", IPRange: "10.0.0.0/16", Subnets: []hcloud.NetworkSubnet{tt.subnet}}
+			checkEnsure(t, fake, client, tt.wantStatus, tt.wantRecorded, func(c *hcloud.Client) (hcloud.EnsureStatus, error) {
+				_, status, err := c.EnsureNetwork(ctx, opts)
+				return status, err
+			})
+
+			network, err := client.GetNetworkByName(ctx, "k3s-net")
+			if err != nil || network == nil {
+				t.Fatalf("GetNetworkByName = %v, %v", network, err)
+			}
+			if !reflect.DeepEqual(network.Subnets, tt.wantSubnets) {
+				t.Errorf("subnets = %+v, want %+v", network.Subnets, tt.wantSubnets)
+			}
+		})
+	}
+}
+
+func TestEnsureNetworkSubnetConflict(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+	subnet := hcloud.NetworkSubnet{Type: hcloud.NetworkSubnetTypeCloud, IPRange: "10.0.1.0/24", NetworkZone: "eu-central"}
+	if _, err := client.CreateNetwork(ctx, hcloud.NetworkCreateOpts{Name: "k3s-net", IPRange: "10.0.0.0/16", Subnets: []hcloud.NetworkSubnet{subnet}}); err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	// The same range in another zone is refused by the API.
+	subnet.NetworkZone = "us-east"
+	_, _, err := client.EnsureNetwork(ctx, hcloud.NetworkCreateOpts{Name: "k3s-net", IPRange: "10.0.0.0/16", Subnets: []hcloud.NetworkSubnet{subnet}})
+	if err == nil || !strings.Contains(err.Error(), "failed to add subnet 10.0.1.0/24 in us-east to private network k3s-net") {
+		t.Errorf("EnsureNetwork = %v, want an error about the subnet", err)
+	}
+}
+
+func TestEnsurePlacementGroup(t *testing.T) {
+	tests := []struct {
+		name         string
+		existing     bool
+		wantStatus   hcloud.EnsureStatus
+		wantRecorded []string
+	}{
+		{name: "missing", wantStatus: hcloud.EnsureCreated, wantRecorded: []string{"POST /placement_groups"}},
+		{name: "exists", existing: true, wantStatus: hcloud.EnsureExisted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, fake := newTestClient(t)
+			if tt.existing {
+				fake.AddPlacementGroup("k3s-placement-group")
+			}
+			opts := hcloud.PlacementGroupCreateOpts{Name: "k3s-placement-group", Type: hcloud.PlacementGroupTypeSpread}
+			checkEnsure(t, fake, client, tt.wantStatus, tt.wantRecorded, func(c *hcloud.Client) (hcloud.EnsureStatus, error) {
+				_, status, err := c.EnsurePlacementGroup(ctx, opts)
+				return status, err
+			})
+
+			pg, err := client.GetPlacementGroupByName(ctx, "k3s-placement-group")
+			if err != nil || pg == nil || pg.Type != hcloud.PlacementGroupTypeSpread {
+				t.Errorf("GetPlacementGroupByName = %+v, %v, want a spread placement group", pg, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package hcloud
+
+import (
+	"context"
+	"fmt"
+)
+
+// Primary IP types.
+const (
+	PrimaryIPTypeIPv4 = "ipv4"
+	PrimaryIPTypeIPv6 = "ipv6"
+)
+
+// PrimaryIP is the public IPv4 address or IPv6 network of a server. It can be
+// unassigned from a powered-off server and assigned to another powered-off
+// server in the same datacenter. With AutoDelete, it is deleted together with
+// the server it is assigned to.
+type PrimaryIP struct {
+	ID           int64             `json:"id"`
+	Name         string            `json:"name"`
+	Type         string            `json:"type"`
+	IP           string            `json:"ip"`
+	AssigneeID   *int64            `json:"assignee_id"`
+	AssigneeType string            `json:"assignee_type"`
+	AutoDelete   bool              `json:"auto_delete"`
+	Datacenter   Datacenter        `json:"datacenter"`
+	Labels       map[string]string `json:"labels"`
+}
+
+// PrimaryIPUpdateOpts are the parameters for updating a primary IP.
+type PrimaryIPUpdateOpts struct {
+	Name       string            `json:"name,omitempty"`
+	AutoDelete *bool             `json:"auto_delete,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// PrimaryIPCreateOpts are the parameters for creating a primary IP. Without an
+// AssigneeID, Datacenter is required.
+type PrimaryIPCreateOpts struct {
+	Name         string            `json:"name"`
+	Type         string            `json:"type"`
+	AssigneeType string            `json:"assignee_type"`
+	AssigneeID   *int64            `json:"assignee_id,omitempty"`
+	Datacenter   string            `json:"datacenter,omitempty"`
+	AutoDelete   bool              `json:"auto_delete"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+// GetPrimaryIP fetches a primary IP by ID.
+func (c *Client) GetPrimaryIP(ctx context.Context, id int64) (*PrimaryIP, error) {
+	var resp struct {
+		PrimaryIP *PrimaryIP `json:"primary_ip"`
+	}
+	if err := c.do(ctx, "GET", fmt.Sprintf("/primary_ips/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.PrimaryIP, nil
+}
+
+// GetPrimaryIPByName fetches a primary IP by name. It returns nil and no error
+// if the primary IP does not exist.
+func (c *Client) GetPrimaryIPByName(ctx context.Context, name string) (*PrimaryIP, error) {
+	var resp struct {
+		PrimaryIPs []*PrimaryIP `json:"primary_ips"`
+	}
+	if err := c.do(ctx, "GET", "/primary_ips"+nameQuery(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.PrimaryIPs) == 0 {
+		return nil, nil
+	}
+	return resp.PrimaryIPs[0], nil
+}
+
+// CreatePrimaryIP creates a primary IP and waits for it to be assigned if
+// opts.AssigneeID is set.
+func (c *Client) CreatePrimaryIP(ctx context.Context, opts PrimaryIPCreateOpts) (*PrimaryIP, error) {
+	var resp struct {
+		PrimaryIP *PrimaryIP `json:"primary_ip"`
+		Action    *Action    `json:"action"`
+	}
+	if opts.AssigneeType == "" {
+		opts.AssigneeType = "server"
+	}
+	if err := c.do(ctx, "POST", "/primary_ips", opts, &resp); err != nil {
+		return nil, err
+	}
+	if resp.PrimaryIP == nil && c.DryRun() {
+		// Nothing was created; return a placeholder so callers can continue their plan.
+		return &PrimaryIP{Name: opts.Name, Type: opts.Type, AssigneeID: opts.AssigneeID, AutoDelete: opts.AutoDelete, Datacenter: Datacenter{Name: opts.Datacenter}, Labels: opts.Labels}, nil
+	}
+	if resp.PrimaryIP == nil {
+		return nil, fmt.Errorf("hcloud: create response for primary IP %q did not include a primary IP", opts.Name)
+	}
+	if _, err := c.WaitForAction(ctx, resp.Action); err != nil {
+		return nil, fmt.Errorf("hcloud: primary IP %q was created but assigning it failed: %w", opts.Name, err)
+	}
+	return resp.PrimaryIP, nil
+}
+
+// UpdatePrimaryIP changes the name, labels or auto delete setting of a primary IP.
+func (c *Client) UpdatePrimaryIP(ctx context.Context, id int64, opts PrimaryIPUpdateOpts) (*PrimaryIP, error) {
+	var resp struct {
+		PrimaryIP *PrimaryIP `json:"primary_ip"`
+	}
+	if err := c.do(ctx, "PUT", fmt.Sprintf("/primary_ips/%d", id), opts, &resp); err != nil {
+		return nil, err
+	}
+	return resp.PrimaryIP, nil
+}
+
+// AssignPrimaryIP assigns an unassigned primary IP to a powered-off server
+// that has no primary IP of the same type, and waits for it.
+func (c *Client) AssignPrimaryIP(ctx context.Context, id, serverID int64) error {
+	var resp struct {
+		Action *Action `json:"action"`
+	}
+	body := map[string]interface{}{"assignee_id": serverID, "assignee_type": "server"}
+	if err := c.do(ctx, "POST", fmt.Sprintf("/primary_ips/%d/actions/assign", id), body, &resp); err != nil {
+		return err
+	}
+	_, err := c.WaitForAction(ctx, resp.Action)
+	return err
+}
+
+// UnassignPrimaryIP unassigns a primary IP from its powered-off server and waits for it.
+func (c *Client) UnassignPrimaryIP(ctx context.Context, id int64) error {
+	var resp struct {
+		Action *Action `json:"action"`
+	}
+	if err := c.do(ctx, "POST", fmt.Sprintf("/primary_ips/%d/actions/unassign", id), nil, &resp); err != nil {
+		return err
+	}
+	_, err := c.WaitForAction(ctx, resp.Action)
+	return err
+}
+
+// DeletePrimaryIP deletes an unassigned primary IP.
+func (c *Client) DeletePrimaryIP(ctx context.Context, id int64) error {
+	return c.do(ctx, "DELETE", fmt.Sprintf("/primary_ips/%d", id), nil, nil)
+}
+
+// EnsurePrimaryIP makes sure the primary IP opts.Name exists with
+// opts.AutoDelete. If it does not exist and the server opts.AssigneeID already
+// has a primary IP of opts.Type, that one is renamed, so the server keeps its
+// address; otherwise a new primary IP is created from opts. The datacenter and
+// assignee of an existing primary IP are not changed.
+func (c *Client) EnsurePrimaryIP(ctx context.Context, opts PrimaryIPCreateOpts) (*PrimaryIP, EnsureStatus, error) {
+	ip, err := c.GetPrimaryIPByName(ctx, opts.Name)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to look up primary IP %s: %w", opts.Name, err)
+	}
+	update := PrimaryIPUpdateOpts{AutoDelete: &opts.AutoDelete}
+	if ip == nil && opts.AssigneeID != nil {
+		server, err := c.GetServer(ctx, *opts.AssigneeID)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to look up server %d: %w", *opts.AssigneeID, err)
+		}
+		public := server.PublicNet.IPv4
+		if opts.Type == PrimaryIPTypeIPv6 {
+			public = server.PublicNet.IPv6
+		}
+		if public != nil {
+			if ip, err = c.GetPrimaryIP(ctx, public.ID); err != nil {
+				return nil, "", fmt.Errorf("failed to look up the primary IP of server %s: %w", server.Name, err)
+			}
+			update.Name, update.Labels = opts.Name, opts.Labels
+		}
+	}
+	if ip == nil {
+		if ip, err = c.CreatePrimaryIP(ctx, opts); err != nil {
+			return nil, "", fmt.Errorf("failed to create primary IP %s: %w", opts.Name, err)
+		}
+		return ip, EnsureCreated, nil
+	}
+	if update.Name == "" && ip.AutoDelete == opts.AutoDelete {
+		return ip, EnsureExisted, nil
+	}
+	updated, err := c.UpdatePrimaryIP(ctx, ip.ID, update)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to update primary IP %s (%s): %w", opts.Name, ip.IP, err)
+	}
+	if updated == nil {
+		// Nothing was updated; return what the primary IP would look like.
+		updated = ip
+		updated.AutoDelete = opts.AutoDelete
+		if update.Name != "" {
+			updated.Name, updated.Labels = update.Name, update.Labels
+		}
+	}
+	return updated, EnsureUpdated, nil
+}
@@ -0,0 +1,78 @@
+package hcloud_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"k3s-nixos-configs/internal/hcloud"
+)
+
+func TestEnsurePrimaryIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		exists     bool
+		autoDelete bool // of the existing primary IP
+		wantStatus hcloud.EnsureStatus
+		wantUpdate bool // whether the dry run records an update
+	}{
+		{name: "missing", wantStatus: hcloud.EnsureCreated},
+		{name: "kept with its server", exists: true, wantStatus: hcloud.EnsureExisted},
+		{name: "deleted with its server", exists: true, autoDelete: true, wantStatus: hcloud.EnsureUpdated, wantUpdate: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, fake := newTestClient(t)
+			opts := hcloud.PrimaryIPCreateOpts{Name: "k3s-api", Type: hcloud.PrimaryIPTypeIPv4, Datacenter: "fsn1-dc1"}
+			wantRecorded := []string{"POST /primary_ips"}
+			if tt.exists {
+				existingOpts := opts
+				existingOpts.AutoDelete = tt.autoDelete
+				ip, err := client.CreatePrimaryIP(ctx, existingOpts)
+				if err != nil {
+					t.Fatalf("CreatePrimaryIP: %v", err)
+				}
+				wantRecorded = nil
+				if tt.wantUpdate {
+					wantRecorded = []string{fmt.Sprintf("PUT /primary_ips/%d", ip.ID)}
+				}
+			}
+
+			checkEnsure(t, fake, client, tt.wantStatus, wantRecorded, func(c *hcloud.Client) (hcloud.EnsureStatus, error) {
+				_, status, err := c.EnsurePrimaryIP(ctx, opts)
+				return status, err
+			})
+
+			ip, err := client.GetPrimaryIPByName(ctx, "k3s-api")
+			if err != nil || ip == nil || ip.AutoDelete {
+				t.Errorf("GetPrimaryIPByName = %+v, %v, want the primary IP without auto delete", ip, err)
+			}
+		})
+	}
+}
+
+// TestEnsurePrimaryIPKeepsServerAddress checks that the primary IP of the
+// assignee is renamed instead of allocating a new address.
+func TestEnsurePrimaryIPKeepsServerAddress(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newTestClient(t)
+	server, err := client.CreateServerAndWait(ctx, hcloud.ServerCreateOpts{Name: "control-1", ServerType: "cx22", Image: "debian-12", Location: "fsn1"})
+	if err != nil {
+		t.Fatalf("CreateServerAndWait: %v", err)
+	}
+	opts := hcloud.PrimaryIPCreateOpts{Name: "k3s-api", Type: hcloud.PrimaryIPTypeIPv4, AssigneeID: &server.ID, Labels: map[string]string{"cluster": "default"}}
+	wantRecorded := []string{fmt.Sprintf("PUT /primary_ips/%d", server.PublicNet.IPv4.ID)}
+	checkEnsure(t, fake, client, hcloud.EnsureUpdated, wantRecorded, func(c *hcloud.Client) (hcloud.EnsureStatus, error) {
+		_, status, err := c.EnsurePrimaryIP(ctx, opts)
+		return status, err
+	})
+
+	ip, err := client.GetPrimaryIPByName(ctx, "k3s-api")
+	if err != nil || ip == nil {
+		t.Fatalf("GetPrimaryIPByName = %v, %v", ip, err)
+	}
+	if ip.ID != server.PublicNet.IPv4.ID || ip.IP != server.PublicIPv4() || ip.AutoDelete || ip.Labels["cluster"] != "default" {
+		t.Errorf("primary IP = %+v, want the renamed IPv4 %s of %s without auto delete", ip, server.PublicIPv4(), server.Name)
+	}
+}
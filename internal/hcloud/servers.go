@@ -0,0 +1,329 @@
+package hcloud
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Server is a Hetzner Cloud server.
+type Server struct {
+	ID         int64              `json:"id"`
+	Name       string             `json:"name"`
+	Status     string             `json:"status"`
+	PublicNet  ServerPublicNet    `json:"public_net"`
+	PrivateNet []ServerPrivateNet `json:"private_net"`
+	ServerType ServerType         `json:"server_type"`
+	Datacenter Datacenter         `json:"datacenter"`
+	Labels     map[string]string  `json:"labels"`
+}
+
+// ServerPublicNet holds a server's public addresses. IPv4 and IPv6 are the
+// server's primary IPs; FloatingIPs are the IDs of floating IPs assigned to it.
+type ServerPublicNet struct {
+	IPv4        *ServerPublicIP `json:"ipv4"`
+	IPv6        *ServerPublicIP `json:"ipv6"`
+	FloatingIPs []int64         `json:"floating_ips"`
+}
+
+// ServerPublicIP is a public IPv4 address or IPv6 network of a server.
+type ServerPublicIP struct {
+	ID int64  `json:"id"`
+	IP string `json:"ip"`
+}
+
+// ServerPrivateNet is a server's attachment to a private network.
+type ServerPrivateNet struct {
+	Network int64  `json:"network"`
+	IP      string `json:"ip"`
+}
+
+// ServerType is a server plan such as cpx21.
+type ServerType struct {
+	ID           int64   `json:"id"`
+	Name         string  `json:"name"`
+	Description  string  `json:"description,omitempty"`
+	Cores        int     `json:"cores,omitempty"`
+	Memory       float64 `json:"memory,omitempty"`
+	Disk         int     `json:"disk,omitempty"`
+	Architecture string  `json:"architecture,omitempty"`
+	// Deprecation is set once Hetzner announced that the type will no longer be sold.
+	Deprecation *Deprecation `json:"deprecation,omitempty"`
+	// Prices lists the price of the type in every location where it is sold.
+	Prices []ServerTypePrice `json:"prices,omitempty"`
+}
+
+// Deprecation describes when a resource was announced to be deprecated and
+// after which date it can no longer be created.
+type Deprecation struct {
+	Announced        time.Time `json:"announced"`
+	UnavailableAfter time.Time `json:"unavailable_after"`
+}
+
+// ServerTypePrice is the price of a server type in one location. Amounts are
+// decimal strings in the currency of the account (usually EUR).
+type ServerTypePrice struct {
+	Location     string `json:"location"`
+	PriceHourly  Price  `json:"price_hourly"`
+	PriceMonthly Price  `json:"price_monthly"`
+}
+
+// Price is an amount without (Net) and with (Gross) VAT.
+type Price struct {
+	Net   string `json:"net"`
+	Gross string `json:"gross"`
+}
+
+// PriceIn returns the price of the server type in a location, or nil if it is
+// not sold there.
+func (t *ServerType) PriceIn(location string) *ServerTypePrice {
+	for i := range t.Prices {
+		if t.Prices[i].Location == location {
+			return &t.Prices[i]
+		}
+	}
+	return nil
+}
+
+// Datacenter is a datacenter within a location.
+type Datacenter struct {
+	ID          int64                 `json:"id"`
+	Name        string                `json:"name"`
+	Location    Location              `json:"location"`
+	ServerTypes DatacenterServerTypes `json:"server_types"`
+}
+
+// DatacenterServerTypes lists the IDs of the server types a datacenter supports
+// and of those that can currently be created there.
+type DatacenterServerTypes struct {
+	Supported []int64 `json:"supported"`
+	Available []int64 `json:"available"`
+}
+
+// HasAvailable reports whether servers of the given type can currently be created in the datacenter.
+func (d Datacenter) HasAvailable(serverTypeID int64) bool {
+	for _, id := range d.ServerTypes.Available {
+		if id == serverTypeID {
+			return true
+		}
+	}
+	return false
+}
+
+// Location is a Hetzner Cloud location such as ash or fsn1.
+type Location struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	NetworkZone string `json:"network_zone"`
+}
+
+// PublicIPv4 returns the server's public IPv4 address, or "" if it has none.
+func (s *Server) PublicIPv4() string {
+	if s.PublicNet.IPv4 == nil {
+		return ""
+	}
+	return s.PublicNet.IPv4.IP
+}
+
+// PublicIPv6 returns the server's public IPv6 network, or "" if it has none.
+func (s *Server) PublicIPv6() string {
+	if s.PublicNet.IPv6 == nil {
+		return ""
+	}
+	return s.PublicNet.IPv6.IP
+}
+
+// PrivateIP returns the server's IP in the given network, or "" if it is not attached.
+func (s *Server) PrivateIP(networkID int64) string {
+	for _, net := range s.PrivateNet {
+		if net.Network == networkID {
+			return net.IP
+		}
+	}
+	return ""
+}
+
+// ServerCreateOpts are the parameters for creating a server.
+type ServerCreateOpts struct {
+	Name             string                 `json:"name"`
+	ServerType       string                 `json:"server_type"`
+	Image            string                 `json:"image"`
+	Location         string                 `json:"location,omitempty"`
+	Datacenter       string                 `json:"datacenter,omitempty"`
+	SSHKeys          []string               `json:"ssh_keys,omitempty"`
+	Networks         []int64                `json:"networks,omitempty"`
+	PlacementGroup   int64                  `json:"placement_group,omitempty"`
+	Firewalls        []ServerCreateFirewall `json:"firewalls,omitempty"`
+	Volumes          []int64                `json:"volumes,omitempty"`
+	Automount        *bool                  `json:"automount,omitempty"`
+	PublicNet        *ServerCreatePublicNet `json:"public_net,omitempty"`
+	Labels           map[string]string      `json:"labels,omitempty"`
+	StartAfterCreate *bool                  `json:"start_after_create,omitempty"`
+}
+
+// ServerCreatePublicNet controls which public addresses a new server gets.
+// IPv4 and IPv6 assign existing, unassigned primary IPs by ID instead of
+// creating new ones; they must be in the datacenter the server is created in.
+type ServerCreatePublicNet struct {
+	EnableIPv4 bool   `json:"enable_ipv4"`
+	EnableIPv6 bool   `json:"enable_ipv6"`
+	IPv4       *int64 `json:"ipv4,omitempty"`
+	IPv6       *int64 `json:"ipv6,omitempty"`
+}
+
+// ServerCreateResult is the API response to a server create request.
+type ServerCreateResult struct {
+	Server       *Server   `json:"server"`
+	Action       *Action   `json:"action"`
+	NextActions  []*Action `json:"next_actions"`
+	RootPassword string    `json:"root_password"`
+}
+
+// GetServer fetches a server by ID.
+func (c *Client) GetServer(ctx context.Context, id int64) (*Server, error) {
+	var resp struct {
+		Server Server `json:"server"`
+	}
+	if err := c.do(ctx, "GET", fmt.Sprintf("/servers/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Server, nil
+}
+
+// GetServerByName fetches a server by name. It returns nil and no error if no
+// server with that name exists.
+func (c *Client) GetServerByName(ctx context.Context, name string) (*Server, error) {
+	var resp struct {
+		Servers []*Server `json:"servers"`
+	}
+	if err := c.do(ctx, "GET", "/servers"+nameQuery(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Servers) == 0 {
+		return nil, nil
+	}
+	return resp.Servers[0], nil
+}
+
+// ListServers returns all servers of the project matching a label selector
+// such as "k3s-nixos/cluster=default". An empty selector matches all servers.
+func (c *Client) ListServers(ctx context.Context, labelSelector string) ([]*Server, error) {
+	const perPage = 50
+	var servers []*Server
+	for page := 1; ; page++ {
+		query := url.Values{"page": {strconv.Itoa(page)}, "per_page": {strconv.Itoa(perPage)}}
+		if labelSelector != "" {
+			query.Set("label_selector", labelSelector)
+		}
+		var resp struct {
+			Servers []*Server `json:"servers"`
+		}
+		if err := c.do(ctx, "GET", "/servers?"+query.Encode(), nil, &resp); err != nil {
+			return nil, err
+		}
+		servers = append(servers, resp.Servers...)
+		if len(resp.Servers) < perPage {
+			return servers, nil
+		}
+	}
+}
+
+// CreateServer creates a server. The returned actions must be waited on
+// before the server is fully provisioned; see CreateServerAndWait.
+func (c *Client) CreateServer(ctx context.Context, opts ServerCreateOpts) (*ServerCreateResult, error) {
+	var result ServerCreateResult
+	if err := c.do(ctx, "POST", "/servers", opts, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// CreateServerAndWait creates a server, waits for the create action and all
+// follow-up actions (e.g. network attachment) to finish, and returns the
+// server as reported by the API afterwards, including its assigned IPs.
+func (c *Client) CreateServerAndWait(ctx context.Context, opts ServerCreateOpts) (*Server, error) {
+	result, err := c.CreateServer(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if result.Server == nil && c.DryRun() {
+		// Nothing was created; return a placeholder so callers can continue their plan.
+		return &Server{Name: opts.Name, Labels: opts.Labels}, nil
+	}
+	if result.Server == nil {
+		return nil, fmt.Errorf("hcloud: create response for server %q did not include a server", opts.Name)
+	}
+	actions := append([]*Action{result.Action}, result.NextActions...)
+	if err := c.WaitForActions(ctx, actions...); err != nil {
+		return nil, fmt.Errorf("hcloud: server %q was created but provisioning failed: %w", opts.Name, err)
+	}
+	return c.GetServer(ctx, result.Server.ID)
+}
+
+// DeleteServer deletes a server and returns the delete action.
+func (c *Client) DeleteServer(ctx context.Context, id int64) (*Action, error) {
+	var resp struct {
+		Action *Action `json:"action"`
+	}
+	if err := c.do(ctx, "DELETE", fmt.Sprintf("/servers/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Action, nil
+}
+
+// DeleteServerAndWait deletes a server and waits for the deletion to finish.
+func (c *Client) DeleteServerAndWait(ctx context.Context, id int64) error {
+	action, err := c.DeleteServer(ctx, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.WaitForAction(ctx, action)
+	return err
+}
+
+// ServerUpdateOpts are the parameters for renaming or relabelling a server.
+// Labels replace all labels of the server, so pass the current labels when
+// only renaming it.
+type ServerUpdateOpts struct {
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels"`
+}
+
+// UpdateServer renames or relabels a server.
+func (c *Client) UpdateServer(ctx context.Context, id int64, opts ServerUpdateOpts) (*Server, error) {
+	if opts.Labels == nil {
+		opts.Labels = map[string]string{}
+	}
+	var resp struct {
+		Server *Server `json:"server"`
+	}
+	if err := c.do(ctx, "PUT", fmt.Sprintf("/servers/%d", id), opts, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Server, nil
+}
+
+// PowerOffServerAndWait cuts the power of a server (like pulling the plug) and
+// waits until it is off. Primary IPs can only be moved while a server is off.
+func (c *Client) PowerOffServerAndWait(ctx context.Context, id int64) error {
+	return c.serverActionAndWait(ctx, id, "poweroff")
+}
+
+// PowerOnServerAndWait starts a server and waits until it is running.
+func (c *Client) PowerOnServerAndWait(ctx context.Context, id int64) error {
+	return c.serverActionAndWait(ctx, id, "poweron")
+}
+
+// serverActionAndWait runs a server action that takes no parameters and waits for it.
+func (c *Client) serverActionAndWait(ctx context.Context, id int64, action string) error {
+	var resp struct {
+		Action *Action `json:"action"`
+	}
+	if err := c.do(ctx, "POST", fmt.Sprintf("/servers/%d/actions/%s", id, action), nil, &resp); err != nil {
+		return err
+	}
+	_, err := c.WaitForAction(ctx, resp.Action)
+	return err
+}
@@ -0,0 +1,186 @@
+package hcloud_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k3s-nixos-configs/internal/hcloud"
+	"k3s-nixos-configs/internal/hcloud/hcloudtest"
+)
+
+// newTestClient starts a fake API whose actions run for two polls and returns
+// a client polling it without delay.
+func newTestClient(t *testing.T) (*hcloud.Client, *hcloudtest.Server) {
+	t.Helper()
+	fake := hcloudtest.NewServer()
+	fake.ActionPolls = 2
+	t.Cleanup(fake.Close)
+	return hcloud.NewClient("fake-token", hcloud.WithEndpoint(fake.URL+"/v1"), hcloud.WithPollInterval(time.Millisecond)), fake
+}
+
+func TestCreateServerAndWait(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newTestClient(t)
+	networkID := fake.AddNetwork("k3s-net", "10.0.0.0/16")
+
+	srv, err := client.CreateServerAndWait(ctx, hcloud.ServerCreateOpts{
+		Name:       "cpx21-control-1",
+		ServerType: "cpx21",
+		Image:      "debian-12",
+		Location:   "fsn1",
+		Networks:   []int64{networkID},
+		Labels:     map[string]string{"k3s-nixos/role": "control-plane"},
+	})
+	if err != nil {
+		t.Fatalf("CreateServerAndWait: %v", err)
+	}
+	if srv.ID == 0 {
+		t.Errorf("server ID is 0")
+	}
+	if srv.Name != "cpx21-control-1" {
+		t.Errorf("server name = %q, want cpx21-control-1", srv.Name)
+	}
+	if srv.PublicIPv4() == "" {
+		t.Errorf("server has no public IPv4 address")
+	}
+	if srv.PublicIPv6() == "" {
+		t.Errorf("server has no public IPv6 network")
+	}
+	if srv.PrivateIP(networkID) == "" {
+		t.Errorf("server has no IP in network %d", networkID)
+	}
+	if got := srv.Labels["k3s-nixos/role"]; got != "control-plane" {
+		t.Errorf("label k3s-nixos/role = %q, want control-plane", got)
+	}
+
+	byName, err := client.GetServerByName(ctx, "cpx21-control-1")
+	if err != nil {
+		t.Fatalf("GetServerByName: %v", err)
+	}
+	if byName == nil || byName.ID != srv.ID {
+		t.Errorf("GetServerByName returned %+v, want server %d", byName, srv.ID)
+	}
+}
+
+func TestDeleteServerAndWait(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newTestClient(t)
+
+	srv, err := client.CreateServerAndWait(ctx, hcloud.ServerCreateOpts{Name: "worker-1", ServerType: "cx22", Image: "debian-12"})
+	if err != nil {
+		t.Fatalf("CreateServerAndWait: %v", err)
+	}
+	if err := client.DeleteServerAndWait(ctx, srv.ID); err != nil {
+		t.Fatalf("DeleteServerAndWait: %v", err)
+	}
+	if servers := fake.Servers(); len(servers) != 0 {
+		t.Errorf("fake still has %d server(s) after the deletion", len(servers))
+	}
+	if _, err := client.GetServer(ctx, srv.ID); !hcloud.IsNotFound(err) {
+		t.Errorf("GetServer after deletion: got %v, want a not_found error", err)
+	}
+	if err := client.DeleteServerAndWait(ctx, srv.ID); !hcloud.IsNotFound(err) {
+		t.Errorf("deleting twice: got %v, want a not_found error", err)
+	}
+}
+
+func TestCreateServerAndWaitActionFails(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newTestClient(t)
+	fake.FailActions("create_server", "no capacity left in the datacenter")
+
+	_, err := client.CreateServerAndWait(ctx, hcloud.ServerCreateOpts{Name: "worker-1", ServerType: "cx22", Image: "debian-12"})
+	var failed *hcloud.ActionFailedError
+	if !errors.As(err, &failed) {
+		t.Fatalf("CreateServerAndWait: got %v, want an *ActionFailedError", err)
+	}
+	if failed.Action.Command != "create_server" {
+		t.Errorf("failed action command = %q, want create_server", failed.Action.Command)
+	}
+	if failed.Action.Error == nil || failed.Action.Error.Message != "no capacity left in the datacenter" {
+		t.Errorf("failed action error = %+v, want the message from the API", failed.Action.Error)
+	}
+}
+
+func TestWaitForActionCanceled(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := client.WaitForAction(ctx, &hcloud.Action{ID: 1, Command: "create_server", Status: hcloud.ActionStatusRunning})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitForAction: got %v, want context.Canceled", err)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	fake := hcloudtest.NewHandler()
+	fake.SetServerTypeUnavailable("cpx31", "ash")
+	httpServer := httptest.NewServer(fake)
+	defer httpServer.Close()
+	client := hcloud.NewClient("fake-token", hcloud.WithEndpoint(httpServer.URL+"/v1"), hcloud.WithPollInterval(time.Millisecond))
+	ctx := context.Background()
+	if _, err := client.CreateServerAndWait(ctx, hcloud.ServerCreateOpts{Name: "worker-1", ServerType: "cx22", Image: "debian-12"}); err != nil {
+		t.Fatalf("CreateServerAndWait: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		opts       hcloud.ServerCreateOpts
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "unknown server type",
+			opts:       hcloud.ServerCreateOpts{Name: "a", ServerType: "cpx99", Image: "debian-12"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_input",
+		},
+		{
+			name:       "server type out of stock",
+			opts:       hcloud.ServerCreateOpts{Name: "b", ServerType: "cpx31", Image: "debian-12", Location: "ash"},
+			wantStatus: http.StatusPreconditionFailed,
+			wantCode:   "resource_unavailable",
+		},
+		{
+			name:       "missing image",
+			opts:       hcloud.ServerCreateOpts{Name: "c", ServerType: "cx22"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_input",
+		},
+		{
+			name:       "name already used",
+			opts:       hcloud.ServerCreateOpts{Name: "worker-1", ServerType: "cx22", Image: "debian-12"},
+			wantStatus: http.StatusConflict,
+			wantCode:   "uniqueness_error",
+		},
+		{
+			name:       "unknown SSH key",
+			opts:       hcloud.ServerCreateOpts{Name: "d", ServerType: "cx22", Image: "debian-12", SSHKeys: []string{"nobody"}},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_input",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.CreateServerAndWait(ctx, tt.opts)
+			var apiErr *hcloud.Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("got %v, want an *hcloud.Error", err)
+			}
+			if apiErr.StatusCode != tt.wantStatus || apiErr.Code != tt.wantCode {
+				t.Errorf("got HTTP %d %s, want HTTP %d %s", apiErr.StatusCode, apiErr.Code, tt.wantStatus, tt.wantCode)
+			}
+			if apiErr.Message == "" {
+				t.Errorf("error has no message")
+			}
+		})
+	}
+	if len(fake.Servers()) != 1 {
+		t.Errorf("failed requests created %d server(s)", len(fake.Servers())-1)
+	}
+}
@@ -0,0 +1,41 @@
+package hcloud
+
+import "context"
+
+// GetServerTypeByName fetches a server type (e.g. "cpx21") by name. It returns
+// nil and no error if the server type does not exist.
+func (c *Client) GetServerTypeByName(ctx context.Context, name string) (*ServerType, error) {
+	var resp struct {
+		ServerTypes []*ServerType `json:"server_types"`
+	}
+	if err := c.do(ctx, "GET", "/server_types"+nameQuery(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.ServerTypes) == 0 {
+		return nil, nil
+	}
+	return resp.ServerTypes[0], nil
+}
+
+// ListServerTypes returns all server types (Hetzner has fewer than 50, so one page suffices).
+func (c *Client) ListServerTypes(ctx context.Context) ([]*ServerType, error) {
+	var resp struct {
+		ServerTypes []*ServerType `json:"server_types"`
+	}
+	if err := c.do(ctx, "GET", "/server_types?per_page=50", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.ServerTypes, nil
+}
+
+// ListDatacenters returns all datacenters, including which server types are
+// currently available in each.
+func (c *Client) ListDatacenters(ctx context.Context) ([]Datacenter, error) {
+	var resp struct {
+		Datacenters []Datacenter `json:"datacenters"`
+	}
+	if err := c.do(ctx, "GET", "/datacenters", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Datacenters, nil
+}
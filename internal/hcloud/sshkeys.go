@@ -0,0 +1,127 @@
+package hcloud
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SSHKey is a public key stored in the Hetzner Cloud project. Keys are
+// referenced by name when creating servers.
+type SSHKey struct {
+	ID          int64             `json:"id"`
+	Name        string            `json:"name"`
+	Fingerprint string            `json:"fingerprint"`
+	PublicKey   string            `json:"public_key"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// SSHKeyCreateOpts are the parameters for uploading an SSH key.
+type SSHKeyCreateOpts struct {
+	Name      string            `json:"name"`
+	PublicKey string            `json:"public_key"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// DuplicateSSHKeyError is returned by EnsureSSHKey when the public key is
+// already stored under another name. The API refuses to store a key twice.
+type DuplicateSSHKeyError struct {
+	// Name is the name the key is stored under.
+	Name string
+}
+
+func (e *DuplicateSSHKeyError) Error() string {
+	return fmt.Sprintf("hcloud: the SSH public key is already stored as %q", e.Name)
+}
+
+// SSHKeyFingerprint returns the MD5 fingerprint the API reports for an
+// authorized_keys line ("ssh-ed25519 AAAA... comment"), e.g. "b7:2f:...".
+func SSHKeyFingerprint(publicKey string) (string, error) {
+	parts := strings.Fields(publicKey)
+	if len(parts) < 2 {
+		return "", fmt.Errorf("hcloud: %q is not an SSH public key", publicKey)
+	}
+	blob, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("hcloud: SSH public key is not valid base64: %w", err)
+	}
+	sum := md5.Sum(blob)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(hex, ":"), nil
+}
+
+// GetSSHKeyByName fetches an SSH key by name. It returns nil and no error if
+// the key does not exist.
+func (c *Client) GetSSHKeyByName(ctx context.Context, name string) (*SSHKey, error) {
+	return c.getSSHKey(ctx, nameQuery(name))
+}
+
+// GetSSHKeyByFingerprint fetches an SSH key by its MD5 fingerprint. It returns
+// nil and no error if the key does not exist.
+func (c *Client) GetSSHKeyByFingerprint(ctx context.Context, fingerprint string) (*SSHKey, error) {
+	return c.getSSHKey(ctx, "?"+url.Values{"fingerprint": {fingerprint}}.Encode())
+}
+
+func (c *Client) getSSHKey(ctx context.Context, query string) (*SSHKey, error) {
+	var resp struct {
+		SSHKeys []*SSHKey `json:"ssh_keys"`
+	}
+	if err := c.do(ctx, "GET", "/ssh_keys"+query, nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.SSHKeys) == 0 {
+		return nil, nil
+	}
+	return resp.SSHKeys[0], nil
+}
+
+// CreateSSHKey uploads a public key.
+func (c *Client) CreateSSHKey(ctx context.Context, opts SSHKeyCreateOpts) (*SSHKey, error) {
+	var resp struct {
+		SSHKey *SSHKey `json:"ssh_key"`
+	}
+	if err := c.do(ctx, "POST", "/ssh_keys", opts, &resp); err != nil {
+		return nil, err
+	}
+	if resp.SSHKey == nil && c.DryRun() {
+		// Nothing was created; return a placeholder so callers can continue their plan.
+		return &SSHKey{Name: opts.Name, PublicKey: opts.PublicKey, Labels: opts.Labels}, nil
+	}
+	if resp.SSHKey == nil {
+		return nil, fmt.Errorf("hcloud: create response for SSH key %q did not include a key", opts.Name)
+	}
+	return resp.SSHKey, nil
+}
+
+// EnsureSSHKey uploads opts.PublicKey as opts.Name unless a key with that name
+// exists. An existing key is returned as is, even if it is another public key;
+// callers can compare its Fingerprint. If the public key is stored under
+// another name, the error is a *DuplicateSSHKeyError.
+func (c *Client) EnsureSSHKey(ctx context.Context, opts SSHKeyCreateOpts) (*SSHKey, EnsureStatus, error) {
+	sshKey, err := c.GetSSHKeyByName(ctx, opts.Name)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to look up SSH key %s: %w", opts.Name, err)
+	}
+	if sshKey != nil {
+		return sshKey, EnsureExisted, nil
+	}
+	fingerprint, err := SSHKeyFingerprint(opts.PublicKey)
+	if err != nil {
+		return nil, "", err
+	}
+	if other, err := c.GetSSHKeyByFingerprint(ctx, fingerprint); err != nil {
+		return nil, "", fmt.Errorf("failed to look up SSH key by fingerprint %s: %w", fingerprint, err)
+	} else if other != nil {
+		return nil, "", &DuplicateSSHKeyError{Name: other.Name}
+	}
+	if sshKey, err = c.CreateSSHKey(ctx, opts); err != nil {
+		return nil, "", fmt.Errorf("failed to upload SSH key %s: %w", opts.Name, err)
+	}
+	return sshKey, EnsureCreated, nil
+}
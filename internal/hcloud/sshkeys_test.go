@@ -0,0 +1,117 @@
+package hcloud_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"k3s-nixos-configs/internal/hcloud"
+)
+
+// newPublicKey returns a fresh ed25519 key in authorized_keys format.
+func newPublicKey(t *testing.T) string {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blob []byte
+	for _, field := range [][]byte{[]byte("ssh-ed25519"), pub} {
+		blob = binary.BigEndian.AppendUint32(blob, uint32(len(field)))
+		blob = append(blob, field...)
+	}
+	return "ssh-ed25519 " + base64.StdEncoding.EncodeToString(blob) + " admin@laptop"
+}
+
+func TestSSHKeyFingerprint(t *testing.T) {
+	// The fingerprint `ssh-keygen -l -E md5` reports for this key.
+	const key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl user@host"
+	got, err := hcloud.SSHKeyFingerprint(key)
+	if err != nil {
+		t.Fatalf("SSHKeyFingerprint: %v", err)
+	}
+	if want := "65:96:2d:fc:e8:d5:a9:11:64:0c:0f:ea:00:6e:5b:bd"; got != want {
+		t.Errorf("SSHKeyFingerprint = %s, want %s", got, want)
+	}
+	for _, invalid := range []string{"", "ssh-ed25519", "ssh-ed25519 not-base64!"} {
+		if _, err := hcloud.SSHKeyFingerprint(invalid); err == nil {
+			t.Errorf("SSHKeyFingerprint(%q) succeeded, want an error", invalid)
+		}
+	}
+}
+
+func TestEnsureSSHKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		existing     string // name the key is already stored under
+		wantStatus   hcloud.EnsureStatus
+		wantRecorded []string
+	}{
+		{name: "missing", wantStatus: hcloud.EnsureCreated, wantRecorded: []string{"POST /ssh_keys"}},
+		{name: "exists", existing: "admin", wantStatus: hcloud.EnsureExisted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, fake := newTestClient(t)
+			publicKey := newPublicKey(t)
+			if tt.existing != "" {
+				if _, err := client.CreateSSHKey(ctx, hcloud.SSHKeyCreateOpts{Name: tt.existing, PublicKey: publicKey}); err != nil {
+					t.Fatalf("CreateSSHKey: %v", err)
+				}
+			}
+			opts := hcloud.SSHKeyCreateOpts{Name: "admin", PublicKey: publicKey}
+			checkEnsure(t, fake, client, tt.wantStatus, tt.wantRecorded, func(c *hcloud.Client) (hcloud.EnsureStatus, error) {
+				_, status, err := c.EnsureSSHKey(ctx, opts)
+				return status, err
+			})
+
+			fingerprint, _ := hcloud.SSHKeyFingerprint(publicKey)
+			key, err := client.GetSSHKeyByName(ctx, "admin")
+			if err != nil || key == nil || key.Fingerprint != fingerprint {
+				t.Errorf("GetSSHKeyByName = %+v, %v, want the key with fingerprint %s", key, err, fingerprint)
+			}
+		})
+	}
+}
+
+func TestEnsureSSHKeyKeepsOtherKeyOfTheSameName(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newTestClient(t)
+	stored, err := client.CreateSSHKey(ctx, hcloud.SSHKeyCreateOpts{Name: "admin", PublicKey: newPublicKey(t)})
+	if err != nil {
+		t.Fatalf("CreateSSHKey: %v", err)
+	}
+	sent := len(mutatingRequests(fake))
+
+	key, status, err := client.EnsureSSHKey(ctx, hcloud.SSHKeyCreateOpts{Name: "admin", PublicKey: newPublicKey(t)})
+	if err != nil || status != hcloud.EnsureExisted || key.Fingerprint != stored.Fingerprint {
+		t.Errorf("EnsureSSHKey = %+v, %s, %v, want the stored key", key, status, err)
+	}
+	if requests := mutatingRequests(fake)[sent:]; len(requests) != 0 {
+		t.Errorf("EnsureSSHKey sent %q", requests)
+	}
+}
+
+func TestEnsureSSHKeyStoredUnderAnotherName(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newTestClient(t)
+	publicKey := newPublicKey(t)
+	if _, err := client.CreateSSHKey(ctx, hcloud.SSHKeyCreateOpts{Name: "laptop", PublicKey: publicKey}); err != nil {
+		t.Fatalf("CreateSSHKey: %v", err)
+	}
+	sent := len(mutatingRequests(fake))
+
+	_, _, err := client.EnsureSSHKey(ctx, hcloud.SSHKeyCreateOpts{Name: "admin", PublicKey: publicKey})
+	var duplicate *hcloud.DuplicateSSHKeyError
+	if !errors.As(err, &duplicate) || duplicate.Name != "laptop" {
+		t.Errorf("EnsureSSHKey = %v, want a *DuplicateSSHKeyError naming laptop", err)
+	}
+	if requests := mutatingRequests(fake)[sent:]; len(requests) != 0 {
+		t.Errorf("EnsureSSHKey sent %q", requests)
+	}
+}
@@ -0,0 +1,91 @@
+package hcloud
+
+import (
+	"context"
+	"fmt"
+)
+
+// Volume is a Hetzner Cloud block storage volume. Volumes are bound to a
+// location and survive the deletion of the server they are attached to.
+type Volume struct {
+	ID          int64             `json:"id"`
+	Name        string            `json:"name"`
+	Size        int               `json:"size"`
+	Server      *int64            `json:"server"`
+	Location    Location          `json:"location"`
+	LinuxDevice string            `json:"linux_device"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// VolumeCreateOpts are the parameters for creating a detached volume.
+type VolumeCreateOpts struct {
+	Name     string            `json:"name"`
+	Size     int               `json:"size"`
+	Location string            `json:"location"`
+	Format   string            `json:"format,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// GetVolumeByName fetches a volume by name. It returns nil and no error if the
+// volume does not exist.
+func (c *Client) GetVolumeByName(ctx context.Context, name string) (*Volume, error) {
+	var resp struct {
+		Volumes []*Volume `json:"volumes"`
+	}
+	if err := c.do(ctx, "GET", "/volumes"+nameQuery(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Volumes) == 0 {
+		return nil, nil
+	}
+	return resp.Volumes[0], nil
+}
+
+// CreateVolume creates a detached volume and waits for it to be ready.
+func (c *Client) CreateVolume(ctx context.Context, opts VolumeCreateOpts) (*Volume, error) {
+	var resp struct {
+		Volume      *Volume   `json:"volume"`
+		Action      *Action   `json:"action"`
+		NextActions []*Action `json:"next_actions"`
+	}
+	if err := c.do(ctx, "POST", "/volumes", opts, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Volume == nil && c.DryRun() {
+		// Nothing was created; return a placeholder so callers can continue their plan.
+		return &Volume{Name: opts.Name, Size: opts.Size, Location: Location{Name: opts.Location}, Labels: opts.Labels}, nil
+	}
+	if resp.Volume == nil {
+		return nil, fmt.Errorf("hcloud: create response for volume %q did not include a volume", opts.Name)
+	}
+	if err := c.WaitForActions(ctx, append([]*Action{resp.Action}, resp.NextActions...)...); err != nil {
+		return nil, fmt.Errorf("hcloud: volume %q was created but provisioning failed: %w", opts.Name, err)
+	}
+	return resp.Volume, nil
+}
+
+// AttachVolume attaches a detached volume to a server in the same location and
+// waits for it. With automount, the server mounts it under /mnt.
+func (c *Client) AttachVolume(ctx context.Context, volumeID, serverID int64, automount bool) error {
+	var resp struct {
+		Action *Action `json:"action"`
+	}
+	body := map[string]interface{}{"server": serverID, "automount": automount}
+	if err := c.do(ctx, "POST", fmt.Sprintf("/volumes/%d/actions/attach", volumeID), body, &resp); err != nil {
+		return err
+	}
+	_, err := c.WaitForAction(ctx, resp.Action)
+	return err
+}
+
+// DetachVolume detaches a volume from its server and waits for it.
+func (c *Client) DetachVolume(ctx context.Context, volumeID int64) error {
+	var resp struct {
+		Action *Action `json:"action"`
+	}
+	if err := c.do(ctx, "POST", fmt.Sprintf("/volumes/%d/actions/detach", volumeID), nil, &resp); err != nil {
+		return err
+	}
+	_, err := c.WaitForAction(ctx, resp.Action)
+	return err
+}
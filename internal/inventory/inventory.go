@@ -0,0 +1,275 @@
+// Package inventory describes the machines defined in machines.nix.
+//
+// The flake exposes an `inventory` output with one entry per machine (see
+// flake.nix). The mage targets evaluate it once with `nix eval --json` and use
+// the parsed Inventory instead of evaluating deploy.nodes.<name> per node.
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Node types used in machines.nix.
+const (
+	NodeTypeControlInit = "control-init"
+	NodeTypeControlJoin = "control-join"
+	NodeTypeWorker      = "worker"
+)
+
+// Node is a machine from machines.nix.
+type Node struct {
+	Name        string `json:"name"`
+	NodeType    string `json:"nodeType"`
+	Location    string `json:"location"`
+	SSHHostname string `json:"sshHostname"`
+	SSHUser     string `json:"sshUser"`
+	// SSHJumpHost is the bastion SSH connections to the node are tunnelled through: the
+	// name of another node, or user@host[:port]. Empty for a direct connection.
+	SSHJumpHost string `json:"sshJumpHost"`
+	Protected   bool   `json:"protected"`
+	// Hetzner holds the Hetzner Cloud server parameters from the machine's `hetzner`
+	// block, or nil if it has none.
+	Hetzner *HetznerSpec `json:"hetzner,omitempty"`
+}
+
+// Location values used in machines.nix.
+const (
+	LocationHetzner = "hetzner"
+	LocationLocal   = "local"
+)
+
+// HetznerSpec describes the Hetzner Cloud server of a machine, from the
+// `hetzner` block in machines.nix:
+//
+//	hetzner = {
+//	  serverType = "cpx21";
+//	  location = "fsn1";
+//	  image = "debian-12";
+//	  ipv4 = true;
+//	  ipv6 = true;
+//	  labels = { role = "control"; };
+//	  volumes = [ { name = "control-1-data"; size = 20; format = "ext4"; automount = true; } ];
+//	};
+//
+// Every field is optional; unset fields fall back to the defaults from the
+// environment (see WithDefaults).
+type HetznerSpec struct {
+	ServerType string            `json:"serverType,omitempty"`
+	Location   string            `json:"location,omitempty"`
+	Image      string            `json:"image,omitempty"`
+	IPv4       *bool             `json:"ipv4,omitempty"`
+	IPv6       *bool             `json:"ipv6,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Volumes    []HetznerVolume   `json:"volumes,omitempty"`
+}
+
+// HetznerVolume is a block storage volume attached to a machine's server. Volumes
+// outlive the server, so they are reattached when it is recreated.
+type HetznerVolume struct {
+	Name string `json:"name"`
+	// Size is the size in GB, used when the volume is created.
+	Size int `json:"size"`
+	// Format is the filesystem ("ext4" or "xfs") created on a new volume, or "" for none.
+	Format string `json:"format,omitempty"`
+	// Automount mounts the volume on the server (only effective on the installer image).
+	Automount bool `json:"automount,omitempty"`
+}
+
+// WithDefaults returns a copy of s with every unset field taken from defaults.
+func (s *HetznerSpec) WithDefaults(defaults HetznerSpec) HetznerSpec {
+	out := defaults
+	if s == nil {
+		return out
+	}
+	if s.ServerType != "" {
+		out.ServerType = s.ServerType
+	}
+	if s.Location != "" {
+		out.Location = s.Location
+	}
+	if s.Image != "" {
+		out.Image = s.Image
+	}
+	if s.IPv4 != nil {
+		out.IPv4 = s.IPv4
+	}
+	if s.IPv6 != nil {
+		out.IPv6 = s.IPv6
+	}
+	if len(s.Labels) > 0 {
+		out.Labels = map[string]string{}
+		for k, v := range defaults.Labels {
+			out.Labels[k] = v
+		}
+		for k, v := range s.Labels {
+			out.Labels[k] = v
+		}
+	}
+	if len(s.Volumes) > 0 {
+		out.Volumes = s.Volumes
+	}
+	return out
+}
+
+// IsControlPlane reports whether the node runs the k3s server.
+func (n Node) IsControlPlane() bool {
+	return n.NodeType == NodeTypeControlInit || n.NodeType == NodeTypeControlJoin
+}
+
+// Inventory is the set of machines, sorted by name.
+type Inventory struct {
+	Nodes []Node
+}
+
+// Parse decodes the JSON produced by `nix eval --json .#inventory`.
+func Parse(data []byte) (*Inventory, error) {
+	var raw map[string]Node
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("inventory: failed to parse: %w", err)
+	}
+	inv := &Inventory{}
+	for name, node := range raw {
+		node.Name = name
+		inv.Nodes = append(inv.Nodes, node)
+	}
+	sort.Slice(inv.Nodes, func(i, j int) bool { return inv.Nodes[i].Name < inv.Nodes[j].Name })
+	return inv, nil
+}
+
+// Get returns the node with the given name.
+func (inv *Inventory) Get(name string) (Node, error) {
+	for _, node := range inv.Nodes {
+		if node.Name == name {
+			return node, nil
+		}
+	}
+	return Node{}, fmt.Errorf("machine '%s' is not defined in machines.nix (known: %s)", name, strings.Join(inv.Names(), ", "))
+}
+
+// ControlPlanes returns the nodes that run the k3s server.
+func (inv *Inventory) ControlPlanes() []Node {
+	var nodes []Node
+	for _, node := range inv.Nodes {
+		if node.IsControlPlane() {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// ControlInit returns the node that initializes the cluster (--cluster-init), if any.
+func (inv *Inventory) ControlInit() (Node, bool) {
+	for _, node := range inv.Nodes {
+		if node.NodeType == NodeTypeControlInit {
+			return node, true
+		}
+	}
+	return Node{}, false
+}
+
+// Select returns the nodes matching selector, a comma-separated list of
+// alternatives, each of which is
+//
+//   - "all" (or "*"), matching every node;
+//   - nodeType=<type>, e.g. nodeType=worker, or "control-plane" for both
+//     control plane node types;
+//   - location=<location>, e.g. location=hetzner;
+//   - a node name, which may be a glob (path.Match), e.g. cpx21-*.
+//
+// A node matching any alternative is selected, in inventory order. Every
+// alternative must match at least one node, so a typo is not silently skipped.
+func (inv *Inventory) Select(selector string) ([]Node, error) {
+	selected := map[string]bool{}
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		match, err := selectorTerm(term)
+		if err != nil {
+			return nil, err
+		}
+		matched := false
+		for _, node := range inv.Nodes {
+			if match(node) {
+				selected[node.Name], matched = true, true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("selector '%s' matches no machine in machines.nix (known: %s)", term, strings.Join(inv.Names(), ", "))
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("empty selector, use a node name, nodeType=<type>, location=<location> or all")
+	}
+	var nodes []Node
+	for _, node := range inv.Nodes {
+		if selected[node.Name] {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+// selectorTerm returns the match function of one alternative of a selector.
+func selectorTerm(term string) (func(Node) bool, error) {
+	key, value, ok := strings.Cut(term, "=")
+	switch {
+	case term == "all" || term == "*":
+		return func(Node) bool { return true }, nil
+	case term == "control-plane":
+		return Node.IsControlPlane, nil
+	case !ok:
+		if _, err := path.Match(term, ""); err != nil {
+			return nil, fmt.Errorf("invalid node name pattern '%s': %w", term, err)
+		}
+		return func(n Node) bool {
+			matched, _ := path.Match(term, n.Name)
+			return matched
+		}, nil
+	case key == "nodeType":
+		return func(n Node) bool { return n.NodeType == value }, nil
+	case key == "location":
+		return func(n Node) bool { return n.Location == value }, nil
+	}
+	return nil, fmt.Errorf("unknown selector key '%s' in '%s', use nodeType or location", key, term)
+}
+
+// Names returns the names of all nodes.
+func (inv *Inventory) Names() []string {
+	names := make([]string, 0, len(inv.Nodes))
+	for _, node := range inv.Nodes {
+		names = append(names, node.Name)
+	}
+	return names
+}
+
+// WriteTable writes the inventory as an aligned text table.
+func (inv *Inventory) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tNODE TYPE\tLOCATION\tSSH USER\tSSH HOSTNAME\tPROTECTED")
+	for _, node := range inv.Nodes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%t\n", node.Name, node.NodeType, node.Location, orDash(node.SSHUser), orDash(node.SSHHostname), node.Protected)
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes the inventory as an indented JSON array.
+func (inv *Inventory) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(inv.Nodes)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,221 @@
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const inventoryJSON = `{
+  "cpx21-control-1": {"nodeType": "control-init", "location": "hetzner", "sshHostname": "203.0.113.9", "sshUser": "root"},
+  "cpx21-control-2": {"nodeType": "control-join", "location": "hetzner", "sshHostname": "203.0.113.10", "sshUser": "root"},
+  "hetzner-worker-alpha": {"nodeType": "worker", "location": "hetzner", "sshHostname": "203.0.113.11", "sshUser": "root"},
+  "thinkcenter-1": {"nodeType": "worker", "location": "local", "sshHostname": "192.168.1.20", "sshUser": "admin"}
+}`
+
+// flakeJSON is `nix eval --json .#inventory` output, with the fields flake.nix
+// sets for every machine.
+const flakeJSON = `{
+  "thinkcenter-1": {
+    "hetzner": null,
+    "location": "local",
+    "nodeType": "worker",
+    "protected": false,
+    "sshHostname": "",
+    "sshJumpHost": "cpx21-control-1",
+    "sshUser": "admin"
+  },
+  "cpx21-control-1": {
+    "hetzner": {
+      "ipv6": false,
+      "labels": {"role": "control"},
+      "location": "fsn1",
+      "serverType": "cpx21",
+      "volumes": [{"automount": true, "format": "ext4", "name": "control-1-data", "size": 20}]
+    },
+    "location": "hetzner",
+    "nodeType": "control-init",
+    "protected": true,
+    "sshHostname": "203.0.113.9",
+    "sshJumpHost": "",
+    "sshUser": "root"
+  }
+}`
+
+func TestParse(t *testing.T) {
+	inv, err := Parse([]byte(flakeJSON))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	ipv6 := false
+	want := []Node{
+		{
+			Name:        "cpx21-control-1",
+			NodeType:    NodeTypeControlInit,
+			Location:    LocationHetzner,
+			SSHHostname: "203.0.113.9",
+			SSHUser:     "root",
+			Protected:   true,
+			Hetzner: &HetznerSpec{
+				ServerType: "cpx21",
+				Location:   "fsn1",
+				IPv6:       &ipv6,
+				Labels:     map[string]string{"role": "control"},
+				Volumes:    []HetznerVolume{{Name: "control-1-data", Size: 20, Format: "ext4", Automount: true}},
+			},
+		},
+		{
+			Name:        "thinkcenter-1",
+			NodeType:    NodeTypeWorker,
+			Location:    LocationLocal,
+			SSHUser:     "admin",
+			SSHJumpHost: "cpx21-control-1",
+		},
+	}
+	if !reflect.DeepEqual(inv.Nodes, want) {
+		t.Errorf("Parse() nodes =\n%+v\nwant\n%+v", inv.Nodes, want)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, data := range []string{"", "[]", `{"a": {"protected": "yes"}}`} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", data)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	inv, err := Parse([]byte(inventoryJSON))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if node, err := inv.Get("cpx21-control-2"); err != nil || node.NodeType != NodeTypeControlJoin {
+		t.Errorf("Get(cpx21-control-2) = %+v, %v", node, err)
+	}
+	_, err = inv.Get("cpx21-control-3")
+	if err == nil || !strings.Contains(err.Error(), "known: cpx21-control-1, cpx21-control-2, hetzner-worker-alpha, thinkcenter-1") {
+		t.Errorf("Get(cpx21-control-3) = %v, want an error listing the known machines", err)
+	}
+	if init, ok := inv.ControlInit(); !ok || init.Name != "cpx21-control-1" {
+		t.Errorf("ControlInit() = %+v, %v, want cpx21-control-1", init, ok)
+	}
+	if got := len(inv.ControlPlanes()); got != 2 {
+		t.Errorf("ControlPlanes() returned %d nodes, want 2", got)
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	inv, err := Parse([]byte(flakeJSON))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := inv.WriteTable(&buf); err != nil {
+		t.Fatalf("WriteTable: %v", err)
+	}
+	want := `NAME             NODE TYPE     LOCATION  SSH USER  SSH HOSTNAME  PROTECTED
+cpx21-control-1  control-init  hetzner   root      203.0.113.9   true
+thinkcenter-1    worker        local     admin     -             false
+`
+	if buf.String() != want {
+		t.Errorf("WriteTable() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	inv, err := Parse([]byte(flakeJSON))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := inv.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	var nodes []Node
+	if err := json.Unmarshal(buf.Bytes(), &nodes); err != nil {
+		t.Fatalf("WriteJSON output is not a JSON array of nodes: %v\n%s", err, buf.String())
+	}
+	if !reflect.DeepEqual(nodes, inv.Nodes) {
+		t.Errorf("WriteJSON round trip = %+v, want %+v", nodes, inv.Nodes)
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	yes, no := true, false
+	defaults := HetznerSpec{ServerType: "cpx21", Location: "ash", Image: "debian-12", IPv4: &yes, IPv6: &yes, Labels: map[string]string{"env": "prod", "role": "node"}}
+	tests := []struct {
+		name string
+		spec *HetznerSpec
+		want HetznerSpec
+	}{
+		{name: "no hetzner block", spec: nil, want: defaults},
+		{name: "empty hetzner block", spec: &HetznerSpec{}, want: defaults},
+		{
+			name: "overrides",
+			spec: &HetznerSpec{ServerType: "cax11", IPv6: &no, Labels: map[string]string{"role": "control"}},
+			want: HetznerSpec{ServerType: "cax11", Location: "ash", Image: "debian-12", IPv4: &yes, IPv6: &no, Labels: map[string]string{"env": "prod", "role": "control"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.spec.WithDefaults(defaults); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WithDefaults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	inv, err := Parse([]byte(inventoryJSON))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	tests := []struct {
+		selector string
+		want     []string
+		wantErr  string
+	}{
+		{selector: "all", want: []string{"cpx21-control-1", "cpx21-control-2", "hetzner-worker-alpha", "thinkcenter-1"}},
+		{selector: "*", want: []string{"cpx21-control-1", "cpx21-control-2", "hetzner-worker-alpha", "thinkcenter-1"}},
+		{selector: "thinkcenter-1", want: []string{"thinkcenter-1"}},
+		{selector: "cpx21-*", want: []string{"cpx21-control-1", "cpx21-control-2"}},
+		{selector: "control-plane", want: []string{"cpx21-control-1", "cpx21-control-2"}},
+		{selector: "nodeType=worker", want: []string{"hetzner-worker-alpha", "thinkcenter-1"}},
+		{selector: "nodeType=control-join", want: []string{"cpx21-control-2"}},
+		{selector: "location=local", want: []string{"thinkcenter-1"}},
+		// Alternatives are OR-ed, deduplicated and returned in inventory order.
+		{selector: "thinkcenter-1,control-plane", want: []string{"cpx21-control-1", "cpx21-control-2", "thinkcenter-1"}},
+		{selector: "location=hetzner, nodeType=worker", want: []string{"cpx21-control-1", "cpx21-control-2", "hetzner-worker-alpha", "thinkcenter-1"}},
+		{selector: "cpx21-control-1,,cpx21-control-1", want: []string{"cpx21-control-1"}},
+		{selector: "thinkcenter-2", wantErr: "selector 'thinkcenter-2' matches no machine"},
+		{selector: "control-plane,nodeType=wroker", wantErr: "selector 'nodeType=wroker' matches no machine"},
+		{selector: "role=worker", wantErr: "unknown selector key 'role'"},
+		{selector: "cpx21-[", wantErr: "invalid node name pattern"},
+		{selector: "", wantErr: "empty selector"},
+		{selector: " , ", wantErr: "empty selector"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			nodes, err := inv.Select(tt.selector)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Select(%q) = %v, want an error containing %q", tt.selector, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Select(%q): %v", tt.selector, err)
+			}
+			var names []string
+			for _, node := range nodes {
+				names = append(names, node.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("Select(%q) = %v, want %v", tt.selector, names, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Package kubeconfig reads, rewrites and merges kubeconfig files.
+//
+// k3s writes /etc/rancher/k3s/k3s.yaml with a server of https://127.0.0.1:6443
+// and cluster, user and context all named "default". This package rewrites
+// such a file so it is usable from a workstation and merges it into an
+// existing kubeconfig, replacing only the entries with the same names.
+// Fields it does not know about are preserved.
+package kubeconfig
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a kubeconfig file.
+type Config struct {
+	APIVersion     string                 `yaml:"apiVersion"`
+	Kind           string                 `yaml:"kind"`
+	CurrentContext string                 `yaml:"current-context"`
+	Clusters       []NamedCluster         `yaml:"clusters"`
+	Contexts       []NamedContext         `yaml:"contexts"`
+	Users          []NamedUser            `yaml:"users"`
+	Extra          map[string]interface{} `yaml:",inline"`
+}
+
+// NamedCluster is an entry of the clusters list.
+type NamedCluster struct {
+	Name    string                 `yaml:"name"`
+	Cluster map[string]interface{} `yaml:"cluster"`
+}
+
+// NamedContext is an entry of the contexts list.
+type NamedContext struct {
+	Name    string                 `yaml:"name"`
+	Context map[string]interface{} `yaml:"context"`
+}
+
+// NamedUser is an entry of the users list.
+type NamedUser struct {
+	Name string                 `yaml:"name"`
+	User map[string]interface{} `yaml:"user"`
+}
+
+// Parse decodes a kubeconfig.
+func Parse(data []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("kubeconfig: failed to parse: %w", err)
+	}
+	return &cfg, nil
+}
+
+// Load reads a kubeconfig from path. A missing file yields an empty Config.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Config{APIVersion: "v1", Kind: "Config"}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kubeconfig: failed to read %s: %w", path, err)
+	}
+	return Parse(data)
+}
+
+// Marshal encodes the kubeconfig as YAML with the two-space indentation kubectl uses.
+func (c *Config) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Write atomically writes the kubeconfig to path with mode 0600, creating the
+// parent directory if needed.
+func (c *Config) Write(path string) error {
+	data, err := c.Marshal()
+	if err != nil {
+		return fmt.Errorf("kubeconfig: failed to encode: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("kubeconfig: failed to create directory for %s: %w", path, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".kubeconfig-*")
+	if err != nil {
+		return fmt.Errorf("kubeconfig: failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("kubeconfig: failed to set permissions: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("kubeconfig: failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("kubeconfig: failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("kubeconfig: failed to replace %s: %w", path, err)
+	}
+	return nil
+}
+
+// SetServer sets the API server URL of every cluster in the kubeconfig.
+func (c *Config) SetServer(server string) {
+	for i := range c.Clusters {
+		if c.Clusters[i].Cluster == nil {
+			c.Clusters[i].Cluster = map[string]interface{}{}
+		}
+		c.Clusters[i].Cluster["server"] = server
+	}
+}
+
+// Rename gives the cluster, user and context of a single-cluster kubeconfig
+// (such as k3s.yaml) the same name and updates all references to them.
+func (c *Config) Rename(name string) error {
+	if len(c.Clusters) != 1 || len(c.Users) != 1 || len(c.Contexts) != 1 {
+		return fmt.Errorf("kubeconfig: expected exactly one cluster, user and context, got %d, %d and %d",
+			len(c.Clusters), len(c.Users), len(c.Contexts))
+	}
+	c.Clusters[0].Name = name
+	c.Users[0].Name = name
+	c.Contexts[0].Name = name
+	if c.Contexts[0].Context == nil {
+		c.Contexts[0].Context = map[string]interface{}{}
+	}
+	c.Contexts[0].Context["cluster"] = name
+	c.Contexts[0].Context["user"] = name
+	c.CurrentContext = name
+	return nil
+}
+
+// Merge copies the clusters, users and contexts of src into c. Entries in c
+// with the same name as an entry in src are replaced; all others are kept.
+// The current context of c is left alone; set CurrentContext to switch to one
+// of the merged contexts.
+func (c *Config) Merge(src *Config) {
+	if c.APIVersion == "" {
+		c.APIVersion = "v1"
+	}
+	if c.Kind == "" {
+		c.Kind = "Config"
+	}
+	for _, cluster := range src.Clusters {
+		c.Clusters = upsert(c.Clusters, cluster, func(e NamedCluster) string { return e.Name })
+	}
+	for _, user := range src.Users {
+		c.Users = upsert(c.Users, user, func(e NamedUser) string { return e.Name })
+	}
+	for _, ctx := range src.Contexts {
+		c.Contexts = upsert(c.Contexts, ctx, func(e NamedContext) string { return e.Name })
+	}
+}
+
+// upsert replaces the entry of list with the same name as entry, or appends it.
+func upsert[T any](list []T, entry T, name func(T) string) []T {
+	for i := range list {
+		if name(list[i]) == name(entry) {
+			list[i] = entry
+			return list
+		}
+	}
+	return append(list, entry)
+}
@@ -0,0 +1,206 @@
+package kubeconfig
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// k3sYAML is the shape of /etc/rancher/k3s/k3s.yaml.
+const k3sYAML = `apiVersion: v1
+kind: Config
+current-context: default
+clusters:
+- name: default
+  cluster:
+    certificate-authority-data: Q0EK
+    server: https://127.0.0.1:6443
+contexts:
+- name: default
+  context:
+    cluster: default
+    user: default
+users:
+- name: default
+  user:
+    client-certificate-data: Q0VSVAo=
+    client-key-data: S0VZCg==
+preferences: {}
+`
+
+// existingYAML is a workstation kubeconfig with another cluster and a stale
+// entry for k3s-cluster.
+const existingYAML = `apiVersion: v1
+kind: Config
+current-context: work
+clusters:
+- name: work
+  cluster:
+    server: https://work.example.com:6443
+- name: k3s-cluster
+  cluster:
+    server: https://10.0.0.9:6443
+contexts:
+- name: work
+  context:
+    cluster: work
+    user: work
+    namespace: apps
+- name: k3s-cluster
+  context:
+    cluster: k3s-cluster
+    user: k3s-cluster
+users:
+- name: work
+  user:
+    token: work-token
+- name: k3s-cluster
+  user:
+    client-key-data: T0xECg==
+`
+
+func mustParse(t *testing.T, data string) *Config {
+	t.Helper()
+	cfg, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return cfg
+}
+
+func fetched(t *testing.T, server, name string) *Config {
+	t.Helper()
+	cfg := mustParse(t, k3sYAML)
+	cfg.SetServer(server)
+	if err := cfg.Rename(name); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	return cfg
+}
+
+func TestRename(t *testing.T) {
+	cfg := fetched(t, "https://100.64.0.1:6443", "k3s-cluster")
+
+	if got := cfg.Clusters[0].Name; got != "k3s-cluster" {
+		t.Errorf("cluster name = %q, want k3s-cluster", got)
+	}
+	if got := cfg.Users[0].Name; got != "k3s-cluster" {
+		t.Errorf("user name = %q, want k3s-cluster", got)
+	}
+	want := map[string]interface{}{"cluster": "k3s-cluster", "user": "k3s-cluster"}
+	if got := cfg.Contexts[0]; got.Name != "k3s-cluster" || !reflect.DeepEqual(got.Context, want) {
+		t.Errorf("context = %+v, want k3s-cluster referencing %v", got, want)
+	}
+	if cfg.CurrentContext != "k3s-cluster" {
+		t.Errorf("current context = %q, want k3s-cluster", cfg.CurrentContext)
+	}
+	if got := cfg.Clusters[0].Cluster["server"]; got != "https://100.64.0.1:6443" {
+		t.Errorf("server = %v, want https://100.64.0.1:6443", got)
+	}
+	if got := cfg.Clusters[0].Cluster["certificate-authority-data"]; got != "Q0EK" {
+		t.Errorf("certificate-authority-data = %v, want it kept", got)
+	}
+}
+
+func TestRenameRejectsMultipleClusters(t *testing.T) {
+	if err := mustParse(t, existingYAML).Rename("k3s-cluster"); err == nil {
+		t.Errorf("Rename of a kubeconfig with two clusters succeeded, want an error")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name         string
+		existing     string
+		wantClusters []string
+		wantCurrent  string
+	}{
+		{
+			name:         "empty kubeconfig",
+			existing:     "",
+			wantClusters: []string{"k3s-cluster"},
+			wantCurrent:  "",
+		},
+		{
+			name:         "replaces existing entry and keeps others",
+			existing:     existingYAML,
+			wantClusters: []string{"work", "k3s-cluster"},
+			wantCurrent:  "work",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mustParse(t, tt.existing)
+			cfg.Merge(fetched(t, "https://203.0.113.10:6443", "k3s-cluster"))
+
+			if cfg.APIVersion != "v1" || cfg.Kind != "Config" {
+				t.Errorf("apiVersion/kind = %q/%q, want v1/Config", cfg.APIVersion, cfg.Kind)
+			}
+			var clusters []string
+			for _, c := range cfg.Clusters {
+				clusters = append(clusters, c.Name)
+			}
+			if !reflect.DeepEqual(clusters, tt.wantClusters) {
+				t.Errorf("clusters = %v, want %v", clusters, tt.wantClusters)
+			}
+			if len(cfg.Users) != len(tt.wantClusters) || len(cfg.Contexts) != len(tt.wantClusters) {
+				t.Errorf("got %d users and %d contexts, want %d of each", len(cfg.Users), len(cfg.Contexts), len(tt.wantClusters))
+			}
+			if cfg.CurrentContext != tt.wantCurrent {
+				t.Errorf("current context = %q, want %q (Merge must not switch it)", cfg.CurrentContext, tt.wantCurrent)
+			}
+			for _, c := range cfg.Clusters {
+				if c.Name == "k3s-cluster" && c.Cluster["server"] != "https://203.0.113.10:6443" {
+					t.Errorf("k3s-cluster server = %v, want the rewritten server", c.Cluster["server"])
+				}
+			}
+			for _, u := range cfg.Users {
+				if u.Name == "k3s-cluster" && u.User["client-key-data"] != "S0VZCg==" {
+					t.Errorf("k3s-cluster user was not replaced: %v", u.User)
+				}
+			}
+		})
+	}
+}
+
+func TestMergePreservesOtherContexts(t *testing.T) {
+	cfg := mustParse(t, existingYAML)
+	cfg.Merge(fetched(t, "https://203.0.113.10:6443", "k3s-cluster"))
+
+	work := cfg.Contexts[0]
+	want := map[string]interface{}{"cluster": "work", "user": "work", "namespace": "apps"}
+	if work.Name != "work" || !reflect.DeepEqual(work.Context, want) {
+		t.Errorf("work context = %+v, want it unchanged", work)
+	}
+	if got := cfg.Clusters[0].Cluster["server"]; got != "https://work.example.com:6443" {
+		t.Errorf("work server = %v, want it unchanged", got)
+	}
+	if got := cfg.Users[0].User["token"]; got != "work-token" {
+		t.Errorf("work user token = %v, want it unchanged", got)
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kube", "config")
+	cfg := mustParse(t, existingYAML)
+	cfg.Merge(fetched(t, "https://203.0.113.10:6443", "k3s-cluster"))
+	cfg.CurrentContext = "k3s-cluster"
+	if err := cfg.Write(path); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, cfg) {
+		t.Errorf("loaded kubeconfig differs from the written one:\n got %+v\nwant %+v", loaded, cfg)
+	}
+}
@@ -0,0 +1,168 @@
+// Package runner is the single place where the mage targets execute commands
+// and write files.
+//
+// The Exec runner does the work. The DryRunner prints what would be done
+// (exact argv, environment variable names, file paths) and records it
+// instead, so destructive targets can be previewed. Read-only commands that a
+// plan depends on, such as `nix eval`, go through Query/QueryV and are
+// executed by both runners.
+package runner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/magefile/mage/sh"
+)
+
+// Runner executes commands and file writes.
+type Runner interface {
+	// Run runs a command, printing its output only in mage verbose mode.
+	Run(cmd string, args ...string) error
+	// RunV runs a command, streaming its output to stdout.
+	RunV(cmd string, args ...string) error
+	// RunWithV runs a command with extra environment variables, streaming its output.
+	RunWithV(env map[string]string, cmd string, args ...string) error
+	// Output runs a command with side effects and returns its stdout.
+	Output(cmd string, args ...string) (string, error)
+	// Query runs a read-only command and returns its stdout. It is executed even in dry-run mode.
+	Query(cmd string, args ...string) (string, error)
+	// QueryV runs a read-only command, streaming its output. It is executed even in dry-run mode.
+	QueryV(cmd string, args ...string) error
+	// WriteFile writes data to path.
+	WriteFile(path string, data []byte, perm os.FileMode) error
+	// MkdirAll creates a directory and its parents.
+	MkdirAll(path string, perm os.FileMode) error
+	// Record notes an action performed outside the runner (e.g. an API call). In
+	// dry-run mode it is printed and recorded; otherwise it is ignored.
+	Record(format string, args ...interface{})
+	// DryRun reports whether actions are recorded instead of executed.
+	DryRun() bool
+}
+
+// Exec is a Runner that executes everything.
+type Exec struct{}
+
+var _ Runner = Exec{}
+
+func (Exec) Run(cmd string, args ...string) error  { return sh.Run(cmd, args...) }
+func (Exec) RunV(cmd string, args ...string) error { return sh.RunV(cmd, args...) }
+func (Exec) RunWithV(env map[string]string, cmd string, args ...string) error {
+	return sh.RunWithV(env, cmd, args...)
+}
+func (Exec) Output(cmd string, args ...string) (string, error) { return sh.Output(cmd, args...) }
+func (Exec) Query(cmd string, args ...string) (string, error)  { return sh.Output(cmd, args...) }
+func (Exec) QueryV(cmd string, args ...string) error           { return sh.RunV(cmd, args...) }
+func (Exec) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(path, data, perm)
+}
+func (Exec) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (Exec) Record(format string, args ...interface{})    {}
+func (Exec) DryRun() bool                                 { return false }
+
+// DryRunner is a Runner that prints and records actions instead of executing them.
+type DryRunner struct {
+	// Out receives a line per recorded action. Defaults to os.Stdout.
+	Out io.Writer
+
+	mu    sync.Mutex
+	steps []string
+}
+
+var _ Runner = (*DryRunner)(nil)
+
+// NewDryRunner returns a DryRunner printing to stdout.
+func NewDryRunner() *DryRunner {
+	return &DryRunner{Out: os.Stdout}
+}
+
+func (d *DryRunner) Run(cmd string, args ...string) error {
+	d.Record("run: %s", FormatCommand(cmd, args...))
+	return nil
+}
+
+func (d *DryRunner) RunV(cmd string, args ...string) error {
+	return d.Run(cmd, args...)
+}
+
+func (d *DryRunner) RunWithV(env map[string]string, cmd string, args ...string) error {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Only the variable names are shown; values are usually secrets.
+	d.Record("run (with env %s): %s", strings.Join(names, ","), FormatCommand(cmd, args...))
+	return nil
+}
+
+func (d *DryRunner) Output(cmd string, args ...string) (string, error) {
+	return "", d.Run(cmd, args...)
+}
+
+func (d *DryRunner) Query(cmd string, args ...string) (string, error) {
+	return sh.Output(cmd, args...)
+}
+
+func (d *DryRunner) QueryV(cmd string, args ...string) error {
+	return sh.RunV(cmd, args...)
+}
+
+func (d *DryRunner) WriteFile(path string, data []byte, perm os.FileMode) error {
+	d.Record("write file: %s (%d bytes, mode %#o)", path, len(data), perm)
+	return nil
+}
+
+func (d *DryRunner) MkdirAll(path string, perm os.FileMode) error {
+	d.Record("create directory: %s (mode %#o)", path, perm)
+	return nil
+}
+
+func (d *DryRunner) Record(format string, args ...interface{}) {
+	step := fmt.Sprintf(format, args...)
+	d.mu.Lock()
+	d.steps = append(d.steps, step)
+	d.mu.Unlock()
+
+	out := d.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	fmt.Fprintf(out, "DRY-RUN: would %s\n", step)
+}
+
+func (d *DryRunner) DryRun() bool { return true }
+
+// Steps returns the actions recorded so far, in order.
+func (d *DryRunner) Steps() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.steps...)
+}
+
+// FormatCommand renders a command line with shell quoting, so it can be copied
+// into a terminal.
+func FormatCommand(cmd string, args ...string) string {
+	parts := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{cmd}, args...) {
+		parts = append(parts, shellQuote(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+// shellQuote quotes s for a POSIX shell if it contains special characters.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=@,+%#", r))
+	}) == -1 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,176 @@
+package runner
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDryRunnerRecords(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "executed")
+	tests := []struct {
+		name string
+		call func(d *DryRunner) error
+		want string
+	}{
+		{
+			name: "Run",
+			call: func(d *DryRunner) error { return d.Run("touch", marker) },
+			want: "run: touch " + marker,
+		},
+		{
+			name: "RunV",
+			call: func(d *DryRunner) error { return d.RunV("sh", "-c", "touch "+marker) },
+			want: "run: sh -c 'touch " + marker + "'",
+		},
+		{
+			name: "RunWithV shows only variable names",
+			call: func(d *DryRunner) error {
+				return d.RunWithV(map[string]string{"SSHPASS": "hunter2", "A_TOKEN": "s3cret"}, "touch", marker)
+			},
+			want: "run (with env A_TOKEN,SSHPASS): touch " + marker,
+		},
+		{
+			name: "Output",
+			call: func(d *DryRunner) error {
+				out, err := d.Output("touch", marker)
+				if out != "" {
+					t.Errorf("Output = %q, want no output", out)
+				}
+				return err
+			},
+			want: "run: touch " + marker,
+		},
+		{
+			name: "WriteFile",
+			call: func(d *DryRunner) error { return d.WriteFile(marker, []byte("secret"), 0600) },
+			want: "write file: " + marker + " (6 bytes, mode 0600)",
+		},
+		{
+			name: "MkdirAll",
+			call: func(d *DryRunner) error { return d.MkdirAll(marker, 0755) },
+			want: "create directory: " + marker + " (mode 0755)",
+		},
+		{
+			name: "Record",
+			call: func(d *DryRunner) error {
+				d.Record("delete server %s (ID %d)", "worker-1", 42)
+				return nil
+			},
+			want: "delete server worker-1 (ID 42)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			d := &DryRunner{Out: &out}
+			if err := tt.call(d); err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if _, err := os.Stat(marker); !os.IsNotExist(err) {
+				t.Fatalf("%s was executed in dry-run mode", tt.name)
+			}
+			if got := d.Steps(); !reflect.DeepEqual(got, []string{tt.want}) {
+				t.Errorf("Steps() = %q, want %q", got, []string{tt.want})
+			}
+			if got, want := out.String(), "DRY-RUN: would "+tt.want+"\n"; got != want {
+				t.Errorf("output = %q, want %q", got, want)
+			}
+			for _, secret := range []string{"hunter2", "s3cret"} {
+				if strings.Contains(out.String(), secret) {
+					t.Errorf("output contains the value %q", secret)
+				}
+			}
+		})
+	}
+}
+
+func TestDryRunnerQueries(t *testing.T) {
+	var out bytes.Buffer
+	d := &DryRunner{Out: &out}
+	if !d.DryRun() {
+		t.Errorf("DryRun() = false")
+	}
+
+	got, err := d.Query("echo", "read-only")
+	if err != nil || got != "read-only" {
+		t.Errorf("Query = %q, %v, want the command's output", got, err)
+	}
+	marker := filepath.Join(t.TempDir(), "queried")
+	if err := d.QueryV("touch", marker); err != nil {
+		t.Fatalf("QueryV: %v", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("QueryV did not run the command: %v", err)
+	}
+	if _, err := d.Query("false"); err == nil {
+		t.Errorf("Query of a failing command succeeded")
+	}
+	if steps := d.Steps(); len(steps) != 0 || out.Len() != 0 {
+		t.Errorf("queries were recorded: %q, output %q", steps, out.String())
+	}
+}
+
+func TestExec(t *testing.T) {
+	var e Runner = Exec{}
+	if e.DryRun() {
+		t.Errorf("DryRun() = true")
+	}
+	marker := filepath.Join(t.TempDir(), "dir", "executed")
+	if err := e.MkdirAll(filepath.Dir(marker), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := e.Run("touch", marker); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Run did not run the command: %v", err)
+	}
+}
+
+func TestFormatCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "plain", args: []string{"nix", "eval", "--json", ".#inventory"}, want: "nix eval --json .#inventory"},
+		{name: "safe punctuation", args: []string{"ssh", "-p", "22", "root@203.0.113.10:22", "a=b,c+d%e"}, want: "ssh -p 22 root@203.0.113.10:22 a=b,c+d%e"},
+		{name: "empty argument", args: []string{"echo", ""}, want: "echo ''"},
+		{name: "spaces", args: []string{"cd", "/srv/my flake"}, want: "cd '/srv/my flake'"},
+		{name: "single quotes", args: []string{"echo", "it's"}, want: `echo 'it'\''s'`},
+		{name: "double quotes", args: []string{"echo", `say "hi"`}, want: `echo 'say "hi"'`},
+		{name: "dollar and backticks", args: []string{"echo", "$HOME", "`id`", "$(id)"}, want: "echo '$HOME' '`id`' '$(id)'"},
+		{name: "shell operators", args: []string{"echo", "a;b", "a&&b", "a|b", "a>b", "*"}, want: "echo 'a;b' 'a&&b' 'a|b' 'a>b' '*'"},
+		{name: "tilde and newline", args: []string{"echo", "~", "a\nb"}, want: "echo '~' 'a\nb'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := FormatCommand(tt.args[0], tt.args[1:]...)
+			if got != tt.want {
+				t.Errorf("FormatCommand(%q) = %s, want %s", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestFormatCommandShellRoundTrip checks that a shell given the formatted
+// command sees exactly the original arguments, as the remote shell does when
+// Rebuild runs `cd <MAGE_REBUILD_FLAKE_PATH> && ...` over SSH.
+func TestFormatCommandShellRoundTrip(t *testing.T) {
+	args := []string{"/srv/my flake", "it's", `"quoted"`, "$HOME", "`id`", "$(id)", "a;b", "", "~", "back\\slash", "a\nb"}
+	script := FormatCommand("printf", append([]string{`%s\0`}, args...)...)
+	out, err := exec.Command("sh", "-c", script).Output()
+	if err != nil {
+		t.Fatalf("sh -c %s: %v", script, err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	if !reflect.DeepEqual(got, args) {
+		t.Errorf("shell saw %q, want %q", got, args)
+	}
+}
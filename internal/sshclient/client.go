@@ -0,0 +1,496 @@
+// Package sshclient runs commands on the nodes over SSH, using
+// golang.org/x/crypto/ssh instead of the ssh binary.
+//
+// Host keys are pinned in a known_hosts file kept with the project (see
+// KnownHosts): a host whose key is not recorded is refused unless it was
+// passed to Client.AcceptNew, which the installation targets do for the
+// machines they (re)install, and a host presenting a different key than the
+// recorded one is always refused. nixos-anywhere runs with --copy-host-keys,
+// so the key recorded before an installation stays valid afterwards.
+//
+// Authentication uses a private key file and/or the keys of a running
+// ssh-agent. Every command returns a Result with its output, exit status and
+// duration.
+package sshclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// DefaultConnectTimeout bounds the TCP connection and SSH handshake if
+// Config.ConnectTimeout is zero.
+const DefaultConnectTimeout = 10 * time.Second
+
+// Config configures a Client.
+type Config struct {
+	// KeyFile is the private key to authenticate with. It may be empty if
+	// AgentSocket is set.
+	KeyFile string
+	// AgentSocket is the ssh-agent socket (usually $SSH_AUTH_SOCK) whose keys
+	// are tried after KeyFile. Empty disables the agent.
+	AgentSocket string
+	// KnownHosts is the known_hosts file host keys are checked against and
+	// recorded in. It is created when the first key is recorded.
+	KnownHosts string
+	// ConnectTimeout bounds the TCP connection and SSH handshake.
+	ConnectTimeout time.Duration
+	// DryRun keeps KnownHosts unchanged: keys of hosts passed to AcceptNew are
+	// accepted for the lifetime of the Client but not recorded.
+	DryRun bool
+}
+
+// Client runs commands on nodes. It opens a new connection per command and is
+// safe for concurrent use.
+type Client struct {
+	cfg        Config
+	knownHosts KnownHosts
+	signers    []ssh.Signer
+	agentConn  net.Conn
+
+	mu        sync.Mutex
+	routes    map[string]Route
+	acceptNew map[string]bool
+	accepted  map[string]ssh.PublicKey // keys accepted but not recorded (DryRun)
+}
+
+// New returns a Client authenticating with the key file and/or agent of cfg.
+// It fails if neither yields a usable key.
+func New(cfg Config) (*Client, error) {
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = DefaultConnectTimeout
+	}
+	c := &Client{
+		cfg:        cfg,
+		knownHosts: KnownHosts{Path: cfg.KnownHosts},
+		routes:     map[string]Route{},
+		acceptNew:  map[string]bool{},
+		accepted:   map[string]ssh.PublicKey{},
+	}
+
+	// Either source of keys may fail as long as the other one provides a key.
+	var errs []error
+	if cfg.KeyFile != "" {
+		if signer, err := loadKeyFile(cfg.KeyFile); err != nil {
+			errs = append(errs, err)
+		} else {
+			c.signers = append(c.signers, signer)
+		}
+	}
+	if cfg.AgentSocket != "" {
+		if err := c.addAgentKeys(cfg.AgentSocket); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(c.signers) == 0 {
+		if len(errs) == 0 {
+			return nil, errors.New("ssh: no private key file given and no keys in ssh-agent")
+		}
+		return nil, errors.Join(errs...)
+	}
+	return c, nil
+}
+
+// addAgentKeys adds the keys of the ssh-agent listening on socket. The
+// connection stays open until Close, the agent signs on every login.
+func (c *Client) addAgentKeys(socket string) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("ssh: failed to connect to ssh-agent at %s: %w", socket, err)
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("ssh: failed to list the keys of ssh-agent: %w", err)
+	}
+	c.agentConn = conn
+	c.signers = append(c.signers, signers...)
+	return nil
+}
+
+// loadKeyFile reads an unencrypted private key. Encrypted keys have to be
+// added to ssh-agent instead.
+func loadKeyFile(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: failed to read private key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var passphraseErr *ssh.PassphraseMissingError
+	if errors.As(err, &passphraseErr) {
+		return nil, fmt.Errorf("ssh: private key %s is encrypted; add it to ssh-agent (ssh-add %s) instead", path, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ssh: failed to parse private key %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// Close releases the ssh-agent connection.
+func (c *Client) Close() error {
+	if c.agentConn != nil {
+		return c.agentConn.Close()
+	}
+	return nil
+}
+
+// KeyFile returns the private key file the Client authenticates with, or "" if
+// it only uses ssh-agent.
+func (c *Client) KeyFile() string {
+	return c.cfg.KeyFile
+}
+
+// KnownHosts returns the known_hosts file of the Client.
+func (c *Client) KnownHosts() KnownHosts {
+	return c.knownHosts
+}
+
+// AcceptNew makes the Client accept and record the key of host (a hostname or
+// IP address without port, or a HostKeyAlias) if none is recorded yet. A
+// recorded key is still enforced.
+func (c *Client) AcceptNew(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.acceptNew[stripPort(host)] = true
+}
+
+// Command is a command to run on a node.
+type Command struct {
+	// Target is user@host, where host may include a port (host:port or
+	// [ipv6]:port). The user defaults to root.
+	Target string
+	// Command is run by the user's login shell.
+	Command string
+	// Stdin, if set, is copied to the command's standard input.
+	Stdin io.Reader
+	// Stdout and Stderr, if set, receive the command's output as it arrives.
+	// Stdout is then not kept in the Result; stderr always is.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Result is the outcome of a command.
+type Result struct {
+	Target  string
+	Command string
+	// Stdout is the command's standard output, unless it was streamed to
+	// Command.Stdout.
+	Stdout string
+	Stderr string
+	// ExitCode is the exit status, or -1 if the command did not run to
+	// completion (connection failure, signal, cancellation).
+	ExitCode int
+	Duration time.Duration
+}
+
+// Output returns Stdout without its trailing newline.
+func (r *Result) Output() string {
+	return strings.TrimSuffix(r.Stdout, "\n")
+}
+
+// ExitError is returned when a command exits with a non-zero status.
+type ExitError struct {
+	Result *Result
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("ssh: '%s' on %s exited with status %d", e.Result.Command, e.Result.Target, e.Result.ExitCode)
+	if stderr := strings.TrimSpace(e.Result.Stderr); stderr != "" {
+		lines := strings.Split(stderr, "\n")
+		msg += ": " + lines[len(lines)-1]
+	}
+	return msg
+}
+
+// Run runs command on target and returns its result; see Exec.
+func (c *Client) Run(ctx context.Context, target, command string) (*Result, error) {
+	return c.Exec(ctx, Command{Target: target, Command: command})
+}
+
+// Exec runs cmd. The Result is returned even if the command failed; the error
+// is an *ExitError for a non-zero exit status, and describes the connection or
+// host key problem otherwise. Cancelling ctx closes the connection.
+func (c *Client) Exec(ctx context.Context, cmd Command) (*Result, error) {
+	start := time.Now()
+	res := &Result{Target: cmd.Target, Command: cmd.Command, ExitCode: -1}
+	defer func() { res.Duration = time.Since(start) }()
+
+	client, err := c.dial(ctx, cmd.Target)
+	if err != nil {
+		return res, err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return res, fmt.Errorf("ssh: failed to open a session on %s: %w", cmd.Target, err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdin = cmd.Stdin
+	session.Stdout = &stdout
+	if cmd.Stdout != nil {
+		session.Stdout = cmd.Stdout
+	}
+	session.Stderr = &stderr
+	if cmd.Stderr != nil {
+		session.Stderr = io.MultiWriter(&stderr, cmd.Stderr)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- session.Run(cmd.Command) }()
+	select {
+	case <-ctx.Done():
+		client.Close()
+		<-done
+		err = ctx.Err()
+	case err = <-done:
+	}
+	res.Stdout, res.Stderr = stdout.String(), stderr.String()
+
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		res.ExitCode = 0
+		return res, nil
+	case errors.As(err, &exitErr) && exitErr.Signal() == "":
+		res.ExitCode = exitErr.ExitStatus()
+		return res, &ExitError{Result: res}
+	default:
+		return res, fmt.Errorf("ssh: '%s' on %s failed: %w", cmd.Command, cmd.Target, err)
+	}
+}
+
+// Route tells the Client how to reach a host.
+type Route struct {
+	// HostKeyAlias is the name the host key is pinned under instead of the
+	// address, like OpenSSH's HostKeyAlias. Nodes use their name, so the pin
+	// survives a change of address.
+	HostKeyAlias string
+	// Jump is the target (user@host) of a bastion the connection is tunnelled
+	// through, like OpenSSH's ProxyJump. The bastion's own route applies.
+	Jump string
+}
+
+// maxJumps bounds chains of jump hosts, which also catches loops.
+const maxJumps = 3
+
+// SetRoute sets how connections to host (a hostname or IP address, with an
+// optional port that defaults to 22) are made.
+func (c *Client) SetRoute(host string, route Route) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes[Addr(host)] = route
+}
+
+// Route returns the route of host, see SetRoute.
+func (c *Client) Route(host string) Route {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.routes[Addr(host)]
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// HostKeyName returns the name the host key of target is pinned under in the
+// known_hosts file: its HostKeyAlias, or its host:port.
+func (c *Client) HostKeyName(target string) string {
+	_, addr := splitTarget(target)
+	if alias := c.Route(addr).HostKeyAlias; alias != "" {
+		return net.JoinHostPort(alias, "22")
+	}
+	return addr
+}
+
+// dial connects and authenticates to target, checking the host key.
+func (c *Client) dial(ctx context.Context, target string) (*ssh.Client, error) {
+	return c.dialDepth(ctx, target, 0)
+}
+
+func (c *Client) dialDepth(ctx context.Context, target string, depth int) (*ssh.Client, error) {
+	user, addr := splitTarget(target)
+	host, _, _ := net.SplitHostPort(addr)
+	route := c.Route(addr)
+	name := c.HostKeyName(target)
+
+	conn, jump, err := c.connect(ctx, addr, route, depth)
+	if err != nil {
+		return nil, err
+	}
+	closeAll := func() {
+		conn.Close()
+		if jump != nil {
+			jump.Close()
+		}
+	}
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(c.signers...)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return c.checkHostKey([]string{host, route.HostKeyAlias}, name, addr, key)
+		},
+		// Prefer the recorded key types, or the server may offer another type
+		// and fail the check.
+		HostKeyAlgorithms: c.knownHosts.Algorithms(name),
+	}
+	// The handshake has no context of its own; bound it like the connection.
+	timer := time.AfterFunc(c.cfg.ConnectTimeout, closeAll)
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	timer.Stop()
+	if err != nil {
+		closeAll()
+		// Host key errors say all there is to say.
+		var unknown *UnknownHostError
+		var mismatch *HostKeyMismatchError
+		if errors.As(err, &unknown) {
+			return nil, unknown
+		}
+		if errors.As(err, &mismatch) {
+			return nil, mismatch
+		}
+		return nil, fmt.Errorf("ssh: handshake with %s failed: %w", target, err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	if jump != nil {
+		go func() {
+			client.Wait()
+			jump.Close()
+		}()
+	}
+	return client, nil
+}
+
+// connect opens a connection to addr, directly or through the jump host of
+// route. The jump client, if any, must be closed with the connection.
+func (c *Client) connect(ctx context.Context, addr string, route Route, depth int) (net.Conn, *ssh.Client, error) {
+	if route.Jump == "" {
+		dialer := net.Dialer{Timeout: c.cfg.ConnectTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ssh: failed to connect to %s: %w", addr, err)
+		}
+		return conn, nil, nil
+	}
+	if depth >= maxJumps {
+		return nil, nil, fmt.Errorf("ssh: more than %d jump hosts on the way to %s, check the routes for a loop", maxJumps, addr)
+	}
+	jump, err := c.dialDepth(ctx, route.Jump, depth+1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ssh: failed to connect to jump host %s: %w", route.Jump, err)
+	}
+	conn, err := jump.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		jump.Close()
+		return nil, nil, fmt.Errorf("ssh: jump host %s failed to connect to %s: %w", route.Jump, addr, err)
+	}
+	return conn, jump, nil
+}
+
+// checkHostKey verifies the key of the host connected at addr against the
+// known_hosts entry name, recording it if none exists and one of hosts was
+// passed to AcceptNew.
+func (c *Client) checkHostKey(hosts []string, name, addr string, key ssh.PublicKey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Errors name an aliased host by its alias, and where it was reached.
+	display, via := addr, ""
+	if name != addr {
+		display, via = strings.TrimSuffix(name, ":22"), addr
+	}
+	if accepted, ok := c.accepted[name]; ok {
+		if bytes.Equal(accepted.Marshal(), key.Marshal()) {
+			return nil
+		}
+		return &HostKeyMismatchError{Addr: display, Via: via, Key: key, Want: []ssh.PublicKey{accepted}, File: c.knownHosts.Path}
+	}
+	err := c.knownHosts.Check(name, key)
+	var unknown *UnknownHostError
+	var mismatch *HostKeyMismatchError
+	switch {
+	case errors.As(err, &mismatch):
+		mismatch.Addr, mismatch.Via = display, via
+		return mismatch
+	case !errors.As(err, &unknown):
+		return err
+	}
+	unknown.Addr, unknown.Via = display, via
+	accept := false
+	for _, host := range hosts {
+		accept = accept || (host != "" && c.acceptNew[host])
+	}
+	if !accept {
+		return unknown
+	}
+	if c.cfg.DryRun {
+		c.accepted[name] = key
+		return nil
+	}
+	return c.knownHosts.Add(name, key)
+}
+
+// HostKey connects to target and returns the host key it presents, without
+// checking or recording it and without authenticating. Jump hosts are used
+// and checked as usual.
+func (c *Client) HostKey(ctx context.Context, target string) (ssh.PublicKey, error) {
+	_, addr := splitTarget(target)
+	conn, jump, err := c.connect(ctx, addr, c.Route(addr), 0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if jump != nil {
+		defer jump.Close()
+	}
+	timer := time.AfterFunc(c.cfg.ConnectTimeout, func() { conn.Close() })
+	defer timer.Stop()
+
+	var hostKey ssh.PublicKey
+	errGotKey := errors.New("got host key")
+	_, _, _, err = ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User: "root",
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errGotKey
+		},
+		HostKeyAlgorithms: c.knownHosts.Algorithms(c.HostKeyName(target)),
+	})
+	if hostKey == nil {
+		return nil, fmt.Errorf("ssh: handshake with %s failed: %w", addr, err)
+	}
+	return hostKey, nil
+}
+
+// Addr returns the host:port a target (user@host) connects to.
+func Addr(target string) string {
+	_, addr := splitTarget(target)
+	return addr
+}
+
+// splitTarget splits user@host into the user (default root) and host:port
+// (default port 22).
+func splitTarget(target string) (user, addr string) {
+	user, host, ok := strings.Cut(target, "@")
+	if !ok {
+		user, host = "root", target
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return user, host
+	}
+	return user, net.JoinHostPort(strings.Trim(host, "[]"), "22")
+}
@@ -0,0 +1,195 @@
+package sshclient
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KnownHosts is a known_hosts file in OpenSSH format. Entries are written with
+// one plain (unhashed) host per line, so they can be reviewed and removed.
+type KnownHosts struct {
+	Path string
+}
+
+// UnknownHostError is returned when no key is recorded for a host.
+type UnknownHostError struct {
+	// Addr is the known_hosts name of the host: host:port or its HostKeyAlias.
+	Addr string
+	// Via is the address connected to, if Addr is a HostKeyAlias.
+	Via  string
+	Key  ssh.PublicKey
+	File string
+}
+
+func (e *UnknownHostError) Error() string {
+	return fmt.Sprintf("ssh: host key of %s%s is not in %s (it presented %s %s)", e.Addr, via(e.Via), e.File, e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+}
+
+// HostKeyMismatchError is returned when a host presents a key other than the
+// recorded ones. Either the machine was reinstalled without its host keys or
+// the connection is being intercepted.
+type HostKeyMismatchError struct {
+	Addr string
+	Via  string
+	Key  ssh.PublicKey
+	Want []ssh.PublicKey
+	File string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	var want []string
+	for _, key := range e.Want {
+		want = append(want, key.Type()+" "+ssh.FingerprintSHA256(key))
+	}
+	return fmt.Sprintf("ssh: HOST KEY MISMATCH for %s%s: it presented %s %s, but %s records %s", e.Addr, via(e.Via), e.Key.Type(), ssh.FingerprintSHA256(e.Key), e.File, strings.Join(want, ", "))
+}
+
+func via(addr string) string {
+	if addr == "" {
+		return ""
+	}
+	return " (at " + addr + ")"
+}
+
+// Check verifies that key is recorded for addr (host:port). It returns an
+// *UnknownHostError if nothing is recorded for addr and a *HostKeyMismatchError
+// if other keys are.
+func (k KnownHosts) Check(addr string, key ssh.PublicKey) error {
+	want, err := k.Lookup(addr)
+	if err != nil {
+		return err
+	}
+	if len(want) == 0 {
+		return &UnknownHostError{Addr: addr, Key: key, File: k.Path}
+	}
+	for _, w := range want {
+		if bytes.Equal(w.Marshal(), key.Marshal()) {
+			return nil
+		}
+	}
+	return &HostKeyMismatchError{Addr: addr, Key: key, Want: want, File: k.Path}
+}
+
+// Lookup returns the keys recorded for addr (host:port). A missing file has
+// no keys.
+func (k KnownHosts) Lookup(addr string) ([]ssh.PublicKey, error) {
+	if _, err := os.Stat(k.Path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	callback, err := knownhosts.New(k.Path)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: failed to read %s: %w", k.Path, err)
+	}
+	// The knownhosts package only reports the recorded keys when a check
+	// fails, so check a key that cannot be recorded.
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil, err
+	}
+	err = callback(addr, remoteAddr(addr), probe)
+	var keyErr *knownhosts.KeyError
+	var revokedErr *knownhosts.RevokedError
+	switch {
+	case errors.As(err, &keyErr):
+		keys := make([]ssh.PublicKey, 0, len(keyErr.Want))
+		for _, known := range keyErr.Want {
+			keys = append(keys, known.Key)
+		}
+		return keys, nil
+	case errors.As(err, &revokedErr):
+		return nil, fmt.Errorf("ssh: %s: %w", k.Path, err)
+	case err != nil:
+		return nil, fmt.Errorf("ssh: failed to look up %s in %s: %w", addr, k.Path, err)
+	}
+	return nil, nil
+}
+
+// Algorithms returns the host key algorithms matching the keys recorded for
+// addr, or nil (any algorithm) if none are recorded.
+func (k KnownHosts) Algorithms(addr string) []string {
+	keys, err := k.Lookup(addr)
+	if err != nil {
+		return nil
+	}
+	var algorithms []string
+	for _, key := range keys {
+		if key.Type() == ssh.KeyAlgoRSA {
+			// RSA keys are used with SHA-2 signatures by current servers.
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, key.Type())
+	}
+	return algorithms
+}
+
+// Add records key for addr (host:port), creating the file if needed.
+func (k KnownHosts) Add(addr string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(k.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("ssh: failed to record the host key of %s: %w", addr, err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(addr)}, key)); err != nil {
+		return fmt.Errorf("ssh: failed to record the host key of %s: %w", addr, err)
+	}
+	return nil
+}
+
+// Remove deletes the lines recording keys for host (a hostname or IP, or
+// host:port) and returns how many were removed. Hashed entries are not
+// matched.
+func (k KnownHosts) Remove(host string) (int, error) {
+	data, err := os.ReadFile(k.Path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ssh: failed to read %s: %w", k.Path, err)
+	}
+	target := knownhosts.Normalize(host)
+	var kept []string
+	removed := 0
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		if _, hosts, _, _, _, err := ssh.ParseKnownHosts([]byte(line)); err == nil && containsHost(hosts, target) {
+			removed++
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	if err := os.WriteFile(k.Path, []byte(strings.Join(kept, "")), 0644); err != nil {
+		return 0, fmt.Errorf("ssh: failed to write %s: %w", k.Path, err)
+	}
+	return removed, nil
+}
+
+func containsHost(hosts []string, target string) bool {
+	for _, h := range hosts {
+		if knownhosts.Normalize(h) == target {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns a net.Addr for addr; the knownhosts callback requires a
+// TCP address but only matches on the host name it is given.
+func remoteAddr(addr string) net.Addr {
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: portNum}
+}
@@ -0,0 +1,161 @@
+package sshclient
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKnownHostsCheck(t *testing.T) {
+	k := KnownHosts{Path: filepath.Join(t.TempDir(), "known_hosts")}
+	pinned, other := newHostKey(t), newHostKey(t)
+	for _, addr := range []string{"203.0.113.10:22", "127.0.0.1:2222", "cpx21-control-1:22"} {
+		if err := k.Add(addr, pinned); err != nil {
+			t.Fatalf("Add(%s): %v", addr, err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		addr         string
+		key          ssh.PublicKey
+		wantUnknown  bool
+		wantMismatch bool
+	}{
+		{name: "pinned key", addr: "203.0.113.10:22", key: pinned},
+		{name: "pinned key on another port", addr: "127.0.0.1:2222", key: pinned},
+		{name: "pinned under an alias", addr: "cpx21-control-1:22", key: pinned},
+		{name: "other key", addr: "203.0.113.10:22", key: other, wantMismatch: true},
+		{name: "unknown host", addr: "203.0.113.11:22", key: pinned, wantUnknown: true},
+		{name: "same host on another port", addr: "203.0.113.10:2222", key: pinned, wantUnknown: true},
+		{name: "port pinned only for 2222", addr: "127.0.0.1:22", key: pinned, wantUnknown: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := k.Check(tt.addr, tt.key)
+			var unknown *UnknownHostError
+			var mismatch *HostKeyMismatchError
+			switch {
+			case tt.wantUnknown:
+				if !errors.As(err, &unknown) {
+					t.Fatalf("Check = %v, want an *UnknownHostError", err)
+				}
+				if unknown.Addr != tt.addr || unknown.File != k.Path {
+					t.Errorf("UnknownHostError = %+v, want Addr %s and File %s", unknown, tt.addr, k.Path)
+				}
+			case tt.wantMismatch:
+				if !errors.As(err, &mismatch) {
+					t.Fatalf("Check = %v, want a *HostKeyMismatchError", err)
+				}
+				if len(mismatch.Want) != 1 || string(mismatch.Want[0].Marshal()) != string(pinned.Marshal()) {
+					t.Errorf("HostKeyMismatchError.Want = %v, want the pinned key", mismatch.Want)
+				}
+				if !strings.Contains(err.Error(), ssh.FingerprintSHA256(pinned)) || !strings.Contains(err.Error(), ssh.FingerprintSHA256(other)) {
+					t.Errorf("error does not show both fingerprints: %v", err)
+				}
+			case err != nil:
+				t.Errorf("Check = %v, want no error", err)
+			}
+		})
+	}
+}
+
+func TestKnownHostsMissingFile(t *testing.T) {
+	k := KnownHosts{Path: filepath.Join(t.TempDir(), "known_hosts")}
+	keys, err := k.Lookup("203.0.113.10:22")
+	if err != nil || keys != nil {
+		t.Errorf("Lookup on a missing file = %v, %v, want no keys and no error", keys, err)
+	}
+	var unknown *UnknownHostError
+	if err := k.Check("203.0.113.10:22", newHostKey(t)); !errors.As(err, &unknown) {
+		t.Errorf("Check on a missing file = %v, want an *UnknownHostError", err)
+	}
+	if n, err := k.Remove("203.0.113.10"); n != 0 || err != nil {
+		t.Errorf("Remove on a missing file = %d, %v, want 0 and no error", n, err)
+	}
+}
+
+func TestKnownHostsRemove(t *testing.T) {
+	key := newHostKey(t)
+	tests := []struct {
+		name        string
+		remove      string
+		wantRemoved int
+		wantKept    []string
+	}{
+		{name: "host on port 22", remove: "203.0.113.10", wantRemoved: 2, wantKept: []string{"127.0.0.1:2222", "cpx21-control-1:22", "203.0.113.11:22"}},
+		{name: "host:port", remove: "127.0.0.1:2222", wantRemoved: 1, wantKept: []string{"203.0.113.10:22", "cpx21-control-1:22", "203.0.113.11:22"}},
+		{name: "alias", remove: "cpx21-control-1", wantRemoved: 1, wantKept: []string{"203.0.113.10:22", "127.0.0.1:2222", "203.0.113.11:22"}},
+		{name: "not pinned", remove: "198.51.100.1", wantRemoved: 0, wantKept: []string{"203.0.113.10:22", "127.0.0.1:2222", "cpx21-control-1:22", "203.0.113.11:22"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := KnownHosts{Path: filepath.Join(t.TempDir(), "known_hosts")}
+			// A host with two keys, e.g. ed25519 and rsa, has two lines.
+			for _, addr := range []string{"203.0.113.10:22", "203.0.113.10:22", "127.0.0.1:2222", "cpx21-control-1:22", "203.0.113.11:22"} {
+				if err := k.Add(addr, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Comments survive removals.
+			f, err := os.OpenFile(k.Path, os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString("# pinned by mage trustHostKey\n")
+			f.Close()
+
+			n, err := k.Remove(tt.remove)
+			if err != nil {
+				t.Fatalf("Remove(%s): %v", tt.remove, err)
+			}
+			if n != tt.wantRemoved {
+				t.Errorf("Remove(%s) removed %d lines, want %d", tt.remove, n, tt.wantRemoved)
+			}
+			if keys, _ := k.Lookup(Addr(tt.remove)); len(keys) != 0 {
+				t.Errorf("%s is still pinned after Remove", tt.remove)
+			}
+			for _, addr := range tt.wantKept {
+				if err := k.Check(addr, key); err != nil {
+					t.Errorf("%s is no longer pinned: %v", addr, err)
+				}
+			}
+			data, _ := os.ReadFile(k.Path)
+			if !strings.Contains(string(data), "# pinned by mage trustHostKey\n") {
+				t.Errorf("Remove dropped the comment:\n%s", data)
+			}
+		})
+	}
+}
+
+func TestKnownHostsAlgorithms(t *testing.T) {
+	k := KnownHosts{Path: filepath.Join(t.TempDir(), "known_hosts")}
+	if got := k.Algorithms("203.0.113.10:22"); got != nil {
+		t.Errorf("Algorithms of an unpinned host = %v, want nil", got)
+	}
+	if err := k.Add("203.0.113.10:22", newHostKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	if got := k.Algorithms("203.0.113.10:22"); len(got) != 1 || got[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("Algorithms = %v, want [%s]", got, ssh.KeyAlgoED25519)
+	}
+}
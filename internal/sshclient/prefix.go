@@ -0,0 +1,53 @@
+package sshclient
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// PrefixWriter writes each line of what is written to it to W, prefixed with
+// Prefix, so the output of commands running on several nodes at once can be
+// told apart. Writers sharing Mu never interleave within a line. Call Flush
+// when done to write an unterminated last line.
+type PrefixWriter struct {
+	W      io.Writer
+	Prefix string
+	Mu     *sync.Mutex
+
+	buf []byte
+}
+
+// Write writes the complete lines in p and buffers the rest.
+func (w *PrefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := w.writeLine(w.buf[:i+1]); err != nil {
+			return len(p), err
+		}
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// Flush writes a buffered unterminated line, adding the newline.
+func (w *PrefixWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := append(w.buf, '\n')
+	w.buf = nil
+	return w.writeLine(line)
+}
+
+func (w *PrefixWriter) writeLine(line []byte) error {
+	if w.Mu != nil {
+		w.Mu.Lock()
+		defer w.Mu.Unlock()
+	}
+	_, err := w.W.Write(append([]byte(w.Prefix), line...))
+	return err
+}
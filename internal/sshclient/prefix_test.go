@@ -0,0 +1,71 @@
+package sshclient
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{name: "one line", writes: []string{"hello\n"}, want: "[a] hello\n"},
+		{name: "several lines in one write", writes: []string{"one\ntwo\n"}, want: "[a] one\n[a] two\n"},
+		{name: "line split across writes", writes: []string{"hel", "lo\nwor", "ld\n"}, want: "[a] hello\n[a] world\n"},
+		{name: "unterminated last line", writes: []string{"done\npartial"}, want: "[a] done\n[a] partial\n"},
+		{name: "empty lines", writes: []string{"\n\n"}, want: "[a] \n[a] \n"},
+		{name: "nothing", writes: nil, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := &PrefixWriter{W: &out, Prefix: "[a] "}
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", s, n, err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("output = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixWriterConcurrent(t *testing.T) {
+	var out bytes.Buffer
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := &PrefixWriter{W: &out, Prefix: fmt.Sprintf("[node-%d] ", i), Mu: &mu}
+			for j := 0; j < 100; j++ {
+				// Write each line in two parts, so unsynchronised writers would interleave.
+				fmt.Fprintf(w, "line %d of ", j)
+				fmt.Fprintf(w, "node-%d\n", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 800 {
+		t.Fatalf("got %d lines, want 800", len(lines))
+	}
+	for _, line := range lines {
+		var node, j, suffix int
+		if _, err := fmt.Sscanf(line, "[node-%d] line %d of node-%d", &node, &j, &suffix); err != nil || node != suffix {
+			t.Fatalf("interleaved line %q", line)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Package tailscale looks up machines in the tailnet, from the output of
+// `tailscale status --json` or the same status served by tailscaled's local
+// API. The mage targets use it to reach nodes by their Tailscale address,
+// which stays the same when a node's public IP changes and works for
+// machines behind NAT.
+package tailscale
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultSocket is the local API socket of tailscaled on Linux.
+const DefaultSocket = "/var/run/tailscale/tailscaled.sock"
+
+// Status is the part of the tailnet status the mage targets use.
+type Status struct {
+	// BackendState is "Running" when this machine is connected to the tailnet.
+	BackendState string `json:"BackendState"`
+	// MagicDNSSuffix is the tailnet's domain, e.g. "tail1234.ts.net".
+	MagicDNSSuffix string           `json:"MagicDNSSuffix"`
+	Self           *Peer            `json:"Self"`
+	Peer           map[string]*Peer `json:"Peer"`
+}
+
+// Peer is a machine in the tailnet.
+type Peer struct {
+	// HostName is the machine's hostname, the node name for NixOS nodes.
+	HostName string `json:"HostName"`
+	// DNSName is the MagicDNS name with a trailing dot, e.g. "cpx21-control-1.tail1234.ts.net.".
+	DNSName      string   `json:"DNSName"`
+	TailscaleIPs []string `json:"TailscaleIPs"`
+	Online       bool     `json:"Online"`
+}
+
+// ParseStatus decodes the output of `tailscale status --json`.
+func ParseStatus(data []byte) (*Status, error) {
+	var status Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("tailscale: failed to parse status: %w", err)
+	}
+	return &status, nil
+}
+
+// LocalAPIStatus fetches the status from the local API of tailscaled at
+// socket, for machines where the tailscale CLI is not installed.
+func LocalAPIStatus(ctx context.Context, socket string) (*Status, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}}
+	// The host is ignored by tailscaled but checked by it to block browsers.
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://local-tailscaled.sock/localapi/v0/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("tailscale: failed to query the local API at %s: %w", socket, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("tailscale: failed to read the local API status: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tailscale: local API returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return ParseStatus(data)
+}
+
+// Running reports whether this machine is connected to the tailnet.
+func (s *Status) Running() bool {
+	return s.BackendState == "Running"
+}
+
+// Find returns the machine whose hostname or first MagicDNS label is name
+// (case-insensitively), preferring an online one, or nil. A recreated node
+// can be listed twice until the offline machine expires from the tailnet.
+func (s *Status) Find(name string) *Peer {
+	var found *Peer
+	candidates := []*Peer{s.Self}
+	for _, peer := range s.Peer {
+		candidates = append(candidates, peer)
+	}
+	for _, peer := range candidates {
+		if peer == nil || !peer.matches(name) {
+			continue
+		}
+		if peer.Online {
+			return peer
+		}
+		found = peer
+	}
+	return found
+}
+
+func (p *Peer) matches(name string) bool {
+	label, _, _ := strings.Cut(p.DNSName, ".")
+	return strings.EqualFold(p.HostName, name) || strings.EqualFold(label, name)
+}
+
+// IPv4 returns the machine's Tailscale IPv4 address (100.64.0.0/10), or "".
+func (p *Peer) IPv4() string {
+	for _, ip := range p.TailscaleIPs {
+		if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() != nil {
+			return ip
+		}
+	}
+	return ""
+}
+
+// MagicDNSName returns the machine's MagicDNS name without the trailing dot.
+func (p *Peer) MagicDNSName() string {
+	return strings.TrimSuffix(p.DNSName, ".")
+}
@@ -0,0 +1,179 @@
+package tailscale
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// statusJSON is trimmed `tailscale status --json` output of an admin laptop in
+// a tailnet with a recreated worker that is still listed with its old machine.
+const statusJSON = `{
+  "Version": "1.66.4",
+  "BackendState": "Running",
+  "TailscaleIPs": ["100.101.102.103", "fd7a:115c:a1e0::1"],
+  "MagicDNSSuffix": "tail1234.ts.net",
+  "Self": {
+    "ID": "n1",
+    "HostName": "laptop",
+    "DNSName": "laptop.tail1234.ts.net.",
+    "OS": "linux",
+    "TailscaleIPs": ["100.101.102.103", "fd7a:115c:a1e0::1"],
+    "Online": true
+  },
+  "Peer": {
+    "nodekey:aaa": {
+      "ID": "n2",
+      "HostName": "cpx21-control-1",
+      "DNSName": "cpx21-control-1.tail1234.ts.net.",
+      "OS": "linux",
+      "TailscaleIPs": ["fd7a:115c:a1e0::2", "100.64.0.2"],
+      "Online": true
+    },
+    "nodekey:bbb": {
+      "ID": "n3",
+      "HostName": "hetzner-worker-alpha",
+      "DNSName": "hetzner-worker-alpha.tail1234.ts.net.",
+      "OS": "linux",
+      "TailscaleIPs": ["100.64.0.3", "fd7a:115c:a1e0::3"],
+      "Online": false
+    },
+    "nodekey:ccc": {
+      "ID": "n4",
+      "HostName": "hetzner-worker-alpha",
+      "DNSName": "hetzner-worker-alpha-1.tail1234.ts.net.",
+      "OS": "linux",
+      "TailscaleIPs": ["100.64.0.4", "fd7a:115c:a1e0::4"],
+      "Online": true
+    },
+    "nodekey:ddd": {
+      "ID": "n5",
+      "HostName": "localhost",
+      "DNSName": "thinkcenter-1.tail1234.ts.net.",
+      "OS": "linux",
+      "TailscaleIPs": ["fd7a:115c:a1e0::5"],
+      "Online": true
+    }
+  }
+}`
+
+func TestParseStatus(t *testing.T) {
+	status, err := ParseStatus([]byte(statusJSON))
+	if err != nil {
+		t.Fatalf("ParseStatus: %v", err)
+	}
+	if !status.Running() || status.MagicDNSSuffix != "tail1234.ts.net" || len(status.Peer) != 4 {
+		t.Errorf("ParseStatus = %+v", status)
+	}
+	if status.Self == nil || status.Self.HostName != "laptop" || status.Self.IPv4() != "100.101.102.103" {
+		t.Errorf("Self = %+v", status.Self)
+	}
+
+	stopped, err := ParseStatus([]byte(`{"BackendState": "Stopped", "Self": null, "Peer": null}`))
+	if err != nil || stopped.Running() {
+		t.Errorf("ParseStatus of a stopped tailscaled = %+v, %v, want not running", stopped, err)
+	}
+	if _, err := ParseStatus([]byte("tailscale: not logged in")); err == nil {
+		t.Errorf("ParseStatus of plain text succeeded")
+	}
+}
+
+func TestFind(t *testing.T) {
+	status, err := ParseStatus([]byte(statusJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		wantDNSName string // "" for not found
+		wantIPv4    string
+	}{
+		{name: "cpx21-control-1", wantDNSName: "cpx21-control-1.tail1234.ts.net", wantIPv4: "100.64.0.2"},
+		{name: "CPX21-Control-1", wantDNSName: "cpx21-control-1.tail1234.ts.net", wantIPv4: "100.64.0.2"},
+		{name: "laptop", wantDNSName: "laptop.tail1234.ts.net", wantIPv4: "100.101.102.103"},
+		// The online machine wins over the offline one it replaced.
+		{name: "hetzner-worker-alpha", wantDNSName: "hetzner-worker-alpha-1.tail1234.ts.net", wantIPv4: "100.64.0.4"},
+		// Found by its MagicDNS name when the hostname is not the node name.
+		{name: "thinkcenter-1", wantDNSName: "thinkcenter-1.tail1234.ts.net"},
+		{name: "cpx21-control"},
+		{name: "tail1234"},
+		{name: "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := status.Find(tt.name)
+			if tt.wantDNSName == "" {
+				if peer != nil {
+					t.Errorf("Find(%q) = %+v, want nil", tt.name, peer)
+				}
+				return
+			}
+			if peer == nil {
+				t.Fatalf("Find(%q) = nil, want %s", tt.name, tt.wantDNSName)
+			}
+			if peer.MagicDNSName() != tt.wantDNSName || peer.IPv4() != tt.wantIPv4 {
+				t.Errorf("Find(%q) = %s %q, want %s %q", tt.name, peer.MagicDNSName(), peer.IPv4(), tt.wantDNSName, tt.wantIPv4)
+			}
+		})
+	}
+}
+
+func TestFindOfflineOnly(t *testing.T) {
+	status, err := ParseStatus([]byte(`{"BackendState": "Running", "Peer": {"nodekey:a": {"HostName": "worker-1", "DNSName": "worker-1.tail1234.ts.net.", "Online": false}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer := status.Find("worker-1"); peer == nil || peer.Online {
+		t.Errorf("Find = %+v, want the offline machine", peer)
+	}
+}
+
+// serveLocalAPI serves handler on a unix socket like tailscaled and returns
+// the socket path.
+func serveLocalAPI(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "tailscaled.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return socket
+}
+
+func TestLocalAPIStatus(t *testing.T) {
+	socket := serveLocalAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/localapi/v0/status" || r.Host != "local-tailscaled.sock" {
+			http.Error(w, "unexpected request "+r.Host+r.URL.Path, http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(statusJSON))
+	})
+	status, err := LocalAPIStatus(context.Background(), socket)
+	if err != nil {
+		t.Fatalf("LocalAPIStatus: %v", err)
+	}
+	if peer := status.Find("cpx21-control-1"); peer == nil || peer.IPv4() != "100.64.0.2" {
+		t.Errorf("Find(cpx21-control-1) = %+v", peer)
+	}
+}
+
+func TestLocalAPIStatusErrors(t *testing.T) {
+	socket := serveLocalAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "access denied", http.StatusForbidden)
+	})
+	_, err := LocalAPIStatus(context.Background(), socket)
+	if err == nil || !strings.Contains(err.Error(), "403 Forbidden: access denied") {
+		t.Errorf("LocalAPIStatus = %v, want the local API error", err)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.sock")
+	if _, err := LocalAPIStatus(context.Background(), missing); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("LocalAPIStatus without tailscaled = %v, want an error naming the socket", err)
+	}
+}
@@ -0,0 +1,54 @@
+package wait
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// dialTimeout bounds a single connection attempt made by a probe.
+const dialTimeout = 5 * time.Second
+
+// TCP returns a check that succeeds once a TCP connection to addr (host:port)
+// can be established.
+func TCP(addr string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		dialer := net.Dialer{Timeout: dialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// SSHBanner returns a check that succeeds once the server at addr answers
+// with an SSH protocol identification line ("SSH-2.0-..."). This catches
+// hosts where the port is open but sshd is not yet serving.
+func SSHBanner(addr string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		dialer := net.Dialer{Timeout: dialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(dialTimeout))
+		reader := bufio.NewReader(conn)
+		// Servers may send other lines before the identification string (RFC 4253, 4.2).
+		for i := 0; i < 10; i++ {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return fmt.Errorf("reading SSH banner from %s: %w", addr, err)
+			}
+			if strings.HasPrefix(line, "SSH-") {
+				return nil
+			}
+		}
+		return fmt.Errorf("no SSH banner received from %s", addr)
+	}
+}
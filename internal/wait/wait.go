@@ -0,0 +1,115 @@
+// Package wait polls readiness probes with a timeout and exponential backoff.
+//
+// It replaces fixed sleeps in the mage targets: a freshly created or re-imaged
+// node is brought up through a sequence of stages (SSH port open, SSH
+// handshake, NixOS booted, k3s API up, k3s ready) and each stage is polled
+// until it succeeds or its own timeout expires. When a stage times out, the
+// returned *StageError names the stage and the last probe error.
+package wait
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Backoff controls the delay between probe attempts. The delay starts at
+// Initial and is multiplied by Factor after every failed attempt, up to Max.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Factor  float64
+}
+
+// DefaultBackoff is used by stages that do not set their own Backoff.
+var DefaultBackoff = Backoff{Initial: 2 * time.Second, Max: 15 * time.Second, Factor: 1.5}
+
+// next returns the delay that follows d.
+func (b Backoff) next(d time.Duration) time.Duration {
+	factor := b.Factor
+	if factor < 1 {
+		factor = 1
+	}
+	d = time.Duration(float64(d) * factor)
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// Stage is a single readiness probe.
+type Stage struct {
+	// Name identifies the stage in progress output and errors, e.g. "ssh-port".
+	Name string
+	// Timeout bounds how long the stage is polled. Zero means no limit beyond ctx.
+	Timeout time.Duration
+	// Backoff controls the delay between attempts. The zero value means DefaultBackoff.
+	Backoff Backoff
+	// Check returns nil once the stage is satisfied.
+	Check func(ctx context.Context) error
+	// OnRetry, if set, is called after every failed attempt.
+	OnRetry func(attempt int, err error)
+}
+
+// StageError reports a stage that did not succeed before its timeout.
+type StageError struct {
+	Stage    string
+	Timeout  time.Duration
+	Attempts int
+	Err      error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("wait stage %q timed out after %s (%d attempts): %v", e.Stage, e.Timeout, e.Attempts, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Run polls the stage until Check succeeds, the stage timeout expires, or ctx
+// is cancelled.
+func (s Stage) Run(ctx context.Context) error {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	backoff := s.Backoff
+	if backoff.Initial <= 0 {
+		backoff = DefaultBackoff
+	}
+
+	delay := backoff.Initial
+	for attempt := 1; ; attempt++ {
+		err := s.Check(ctx)
+		if err == nil {
+			return nil
+		}
+		if s.OnRetry != nil {
+			s.OnRetry(attempt, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return &StageError{Stage: s.Name, Timeout: s.Timeout, Attempts: attempt, Err: err}
+			}
+			return fmt.Errorf("wait stage %q: %w", s.Name, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay = backoff.next(delay)
+	}
+}
+
+// Sequence runs the stages in order and stops at the first one that fails.
+func Sequence(ctx context.Context, stages ...Stage) error {
+	for _, stage := range stages {
+		if err := stage.Run(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
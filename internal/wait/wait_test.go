@@ -0,0 +1,193 @@
+package wait
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errNotReady = errors.New("connection refused")
+
+func TestStageTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	var retries int
+	stage := Stage{
+		Name:    "k3s-readyz",
+		Timeout: timeout,
+		Backoff: Backoff{Initial: 5 * time.Millisecond, Max: 20 * time.Millisecond, Factor: 2},
+		Check:   func(ctx context.Context) error { return errNotReady },
+		OnRetry: func(attempt int, err error) { retries = attempt },
+	}
+
+	start := time.Now()
+	err := stage.Run(context.Background())
+	elapsed := time.Since(start)
+
+	var stageErr *StageError
+	if !errors.As(err, &stageErr) {
+		t.Fatalf("Run = %v, want a *StageError", err)
+	}
+	if stageErr.Stage != "k3s-readyz" || stageErr.Timeout != timeout {
+		t.Errorf("StageError = %+v, want stage k3s-readyz and timeout %s", stageErr, timeout)
+	}
+	if !strings.Contains(err.Error(), `"k3s-readyz"`) || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("error %q does not name the stage and the last probe error", err)
+	}
+	if !errors.Is(err, errNotReady) {
+		t.Errorf("error does not wrap the probe error")
+	}
+	if stageErr.Attempts < 3 || stageErr.Attempts != retries {
+		t.Errorf("Attempts = %d, OnRetry saw %d; want the same and at least 3", stageErr.Attempts, retries)
+	}
+	if elapsed < timeout || elapsed > timeout+time.Second {
+		t.Errorf("Run returned after %s, want about %s", elapsed, timeout)
+	}
+}
+
+func TestStageSucceedsAfterRetries(t *testing.T) {
+	attempts := 0
+	stage := Stage{
+		Name:    "ssh-port",
+		Timeout: 5 * time.Second,
+		Backoff: Backoff{Initial: time.Millisecond, Factor: 1},
+		Check: func(ctx context.Context) error {
+			attempts++
+			if attempts < 3 {
+				return errNotReady
+			}
+			return nil
+		},
+	}
+	if err := stage.Run(context.Background()); err != nil {
+		t.Fatalf("Run = %v, want success", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Check ran %d times, want 3", attempts)
+	}
+}
+
+func TestStageCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stage := Stage{
+		Name:    "nixos-system",
+		Backoff: Backoff{Initial: time.Millisecond},
+		Check: func(context.Context) error {
+			cancel()
+			return errNotReady
+		},
+	}
+	err := stage.Run(ctx)
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		t.Errorf("Run after cancellation = %v, want no *StageError", err)
+	}
+	if !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "nixos-system") {
+		t.Errorf("Run = %v, want context.Canceled naming the stage", err)
+	}
+}
+
+func TestSequenceStopsAtFailingStage(t *testing.T) {
+	var ran []string
+	stage := func(name string, err error) Stage {
+		return Stage{
+			Name:    name,
+			Timeout: 20 * time.Millisecond,
+			Backoff: Backoff{Initial: 5 * time.Millisecond},
+			Check: func(context.Context) error {
+				ran = append(ran, name)
+				return err
+			},
+		}
+	}
+	err := Sequence(context.Background(), stage("ssh-port", nil), stage("ssh-handshake", errNotReady), stage("k3s-api", nil))
+
+	var stageErr *StageError
+	if !errors.As(err, &stageErr) || stageErr.Stage != "ssh-handshake" {
+		t.Fatalf("Sequence = %v, want a *StageError for ssh-handshake", err)
+	}
+	for _, name := range ran {
+		if name == "k3s-api" {
+			t.Errorf("stage k3s-api ran after ssh-handshake failed")
+		}
+	}
+}
+
+func TestBackoffNext(t *testing.T) {
+	tests := []struct {
+		backoff Backoff
+		d       time.Duration
+		want    time.Duration
+	}{
+		{Backoff{Factor: 2, Max: time.Second}, 100 * time.Millisecond, 200 * time.Millisecond},
+		{Backoff{Factor: 2, Max: time.Second}, 800 * time.Millisecond, time.Second},
+		{Backoff{Factor: 1.5}, 2 * time.Second, 3 * time.Second},
+		{Backoff{Factor: 0.5, Max: time.Second}, 100 * time.Millisecond, 100 * time.Millisecond},
+		{Backoff{}, time.Second, time.Second},
+	}
+	for _, tt := range tests {
+		if got := tt.backoff.next(tt.d); got != tt.want {
+			t.Errorf("%+v.next(%s) = %s, want %s", tt.backoff, tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	if err := TCP(addr)(context.Background()); err != nil {
+		t.Errorf("TCP(%s) on a listening port = %v", addr, err)
+	}
+	l.Close()
+	if err := TCP(addr)(context.Background()); err == nil {
+		t.Errorf("TCP(%s) on a closed port succeeded", addr)
+	}
+}
+
+func TestSSHBanner(t *testing.T) {
+	tests := []struct {
+		name    string
+		greet   string
+		wantErr bool
+	}{
+		{name: "sshd", greet: "SSH-2.0-OpenSSH_9.6\r\n"},
+		{name: "lines before the identification", greet: "starting up\r\nSSH-2.0-OpenSSH_9.6\r\n"},
+		{name: "not ssh", greet: "HTTP/1.1 400 Bad Request\r\n\r\n", wantErr: true},
+		{name: "closes immediately", greet: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(tt.greet))
+				conn.Close()
+			}()
+			err = SSHBanner(l.Addr().String())(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SSHBanner = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
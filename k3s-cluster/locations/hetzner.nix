@@ -30,6 +30,12 @@
         DHCP = "ipv4";
         IPv6AcceptRA = true;
       };
+      # Hetzner routes a floating IP to the server it is assigned to, but the server has to
+      # configure it. Only the control-init node holds the control plane floating IP; the
+      # other control planes must still reach it on join.
+      address = lib.optional (
+        (specialArgs.hetznerControlPlaneFloatingIP or false) && (specialArgs.isFirstControlPlane or false)
+      ) "${specialArgs.k3sControlPlaneAddr}/32";
     };
     "20-private" =
       lib.mkIf (specialArgs.hetznerPrivateInterface != null && specialArgs.hetznerPrivateInterface != "")
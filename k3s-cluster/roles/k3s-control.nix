@@ -60,6 +60,7 @@ in
         "--node-ip=${nodeIp}" # Use this node's own IP (private or Tailscale)
         "--advertise-address=${nodeIp}" # Advertise this node's IP
         "--bind-address=0.0.0.0" # Listen on all interfaces
+        "--tls-san=${specialArgs.k3sControlPlaneAddr}" # The API certificate must be valid for the shared endpoint (e.g. a floating IP)
         "--kubelet-arg=cloud-provider=external" # For Hetzner CCM
         "--disable-cloud-controller" # We install CCM separately via Flux
         "--disable=servicelb,traefik,local-storage" # Disable built-ins we replace
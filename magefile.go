@@ -4,71 +4,84 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"k3s-nixos-configs/internal/config"     // Typed configuration from .env and the environment
+	"k3s-nixos-configs/internal/diagnose"   // Diagnostic bundles of nodes
+	"k3s-nixos-configs/internal/envlint"    // Checks .env.example against the variables the code reads
+	"k3s-nixos-configs/internal/hcloud"     // Typed Hetzner Cloud API client
+	"k3s-nixos-configs/internal/inventory"  // Machines defined in machines.nix
+	"k3s-nixos-configs/internal/kubeconfig" // Kubeconfig rewriting and merging
+	"k3s-nixos-configs/internal/runner"     // Command execution with dry-run support
+	"k3s-nixos-configs/internal/sshclient"  // SSH to the nodes with pinned host keys
+	"k3s-nixos-configs/internal/tailscale"  // Node addresses in the tailnet
+	"k3s-nixos-configs/internal/wait"       // Readiness probes with timeout and backoff
 
-	"github.com/joho/godotenv"    // For loading .env files
 	"github.com/magefile/mage/mg" // mg contains helper functions for Mage
-	"github.com/magefile/mage/sh" // sh allows running shell commands
+	"golang.org/x/crypto/ssh"     // Host key fingerprints
 )
 
 // -----------------------------------------------------------------------------
 // Configuration Variables (Edit these if needed)
 // -----------------------------------------------------------------------------
 
-// criticalEnvVars lists environment variables that should be explicitly checked and exported from .env.
-// This list is for informational/safety purposes in the init() function.
-var criticalEnvVars = []string{
-	"AGE_PRIVATE_KEY",
-	"K3S_TOKEN",
-	"TAILSCALE_AUTH_KEY",
-	"HCLOUD_TOKEN",
-	"GITHUB_TOKEN",
-}
+// cfg is the effective configuration, loaded once from .env and the process environment
+// in init(). See internal/config for every supported variable and its default.
+var cfg *config.Config
 
-// defaultSSHKey is the path to the SSH private key used for connecting to nodes.
-// This is used by the RecreateNode function if the MAGE_SSH_KEY env var is not set.
-// It's recommended to set MAGE_SSH_KEY in your .env file.
-var defaultSSHKey = "~/.ssh/id_rsa"
+// run executes every command and file write made by the targets. init() replaces it with
+// a dry-run runner when MAGE_DRY_RUN is set, so destructive targets only print their plan.
+var run runner.Runner = runner.Exec{}
 
 // -----------------------------------------------------------------------------
 // Initialization
 // -----------------------------------------------------------------------------
 
 func init() {
-	// Load .env file if it exists. This makes environment variables available.
-	err := godotenv.Load()
+	// Load .env file if it exists. This makes environment variables available to
+	// subprocesses (e.g. `nix eval --impure`) as well as to cfg.
+	// MAGE_CLUSTER selects the cluster and with it the .env file, so it can only come
+	// from the environment.
+	cluster, err := config.ParseCluster(os.Getenv("MAGE_CLUSTER"))
 	if err != nil {
-		fmt.Println("INFO: .env file not found or failed to load, using existing environment variables")
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+	cfg, err = config.LoadCluster(cluster)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+	if cfg.EnvFile() == "" {
+		fmt.Println("INFO: .env file not found, using existing environment variables")
 	} else {
-		fmt.Println("INFO: .env file loaded successfully")
-		// Note: godotenv.Load() automatically sets environment variables.
-		// The criticalEnvVars list and loop below are primarily for logging
-		// which variables were successfully exported from the .env file.
-
-		// Read all variables from .env file to check which critical ones were set
-		envMap, readErr := godotenv.Read()
-		if readErr != nil {
-			fmt.Println("ERROR: Failed to read .env file:", readErr)
-			// Continue execution as existing env vars might be sufficient
-		} else {
-			for _, envVar := range criticalEnvVars {
-				if _, exists := envMap[envVar]; exists {
-					// Check if it was actually loaded (os.Getenv) as init() runs before main
-					// and env vars from .env are set by godotenv.Load().
-					if os.Getenv(envVar) != "" {
-						fmt.Printf("INFO: Critical variable %s found in .env\n", envVar)
-					} else {
-						fmt.Printf("WARNING: Critical variable %s found in .env but not set in environment?\n", envVar)
-					}
-				} else {
-					fmt.Printf("WARNING: Critical variable %s not found in .env\n", envVar)
-				}
-			}
-		}
+		fmt.Printf("INFO: %s file loaded successfully\n", cfg.EnvFile())
+	}
+	if cluster.Name != "" {
+		fmt.Printf("INFO: Using %s\n", cluster.Describe())
+	}
+
+	// Enable dry-run mode before any target runs.
+	if cfg.DryRun {
+		run = runner.NewDryRunner()
+		fmt.Println("INFO: MAGE_DRY_RUN is set, commands, API changes and file writes will be printed instead of executed")
+	}
+
+	for _, envVar := range cfg.MissingCritical() {
+		fmt.Printf("WARNING: Critical variable %s is not set in .env or the environment\n", envVar)
 	}
 }
 
@@ -87,19 +100,40 @@ var Default = CheckFlake
 func CheckFlake() error {
 	fmt.Println("INFO: Checking Nix flake...")
 	// --show-trace is useful for debugging evaluation errors
-	return sh.RunV("nix", "flake", "check", "--show-trace")
+	return run.QueryV("nix", "flake", "check", "--show-trace")
 }
 
 // UpdateFlake runs `nix flake update` to update all flake inputs.
 func UpdateFlake() error {
 	fmt.Println("INFO: Updating flake inputs...")
-	return sh.RunV("nix", "flake", "update")
+	return run.RunV("nix", "flake", "update")
 }
 
 // ShowFlake runs `nix flake show`.
 func ShowFlake() error {
 	fmt.Println("INFO: Showing flake outputs...")
-	return sh.RunV("nix", "flake", "show")
+	return run.QueryV("nix", "flake", "show")
+}
+
+// Inventory lists every machine defined in machines.nix with its node type, location and
+// deploy target, evaluated from the flake's `inventory` output.
+// Usage: mage inventory
+func Inventory() error {
+	inv, err := loadInventory()
+	if err != nil {
+		return err
+	}
+	return inv.WriteTable(os.Stdout)
+}
+
+// InventoryJSON prints the machine inventory as JSON, for use in scripts.
+// Usage: mage inventoryJSON
+func InventoryJSON() error {
+	inv, err := loadInventory()
+	if err != nil {
+		return err
+	}
+	return inv.WriteJSON(os.Stdout)
 }
 
 // Deploy deploys a given NixOS configuration to its target host using deploy-rs.
@@ -107,30 +141,129 @@ func ShowFlake() error {
 // Usage: mage deploy <flakeConfigName>
 // Example: mage deploy cpx21-control-1
 func Deploy(flakeConfigName string) error {
+	fmt.Printf("INFO: Active %s\n", cfg.Cluster().Describe())
+	// Refuse to build a configuration from placeholder values before evaluating anything
+	if err := validateNodeConfig("deploy", flakeConfigName); err != nil {
+		return err
+	}
 	mg.SerialDeps(CheckFlake) // Ensure flake is valid before deploying
 
 	fmt.Printf("INFO: Deploying NixOS configuration '%s' via deploy-rs...\n", flakeConfigName)
 	// deploy-rs reads the target host and user from the flake's deploy.nodes.<name> attribute.
-	return sh.RunV("deploy-rs", ".#"+flakeConfigName)
+	return run.RunV("deploy-rs", ".#"+flakeConfigName)
 }
 
-// Rebuild performs a nixos-rebuild switch on a target node.
-// This requires the flake source to be present and up-to-date on the target machine.
+// Rebuild modes, as understood by switch-to-configuration and nixos-rebuild.
+const (
+	rebuildModeSwitch      = "switch"       // activate now and make it the boot default
+	rebuildModeBoot        = "boot"         // make it the boot default without activating it
+	rebuildModeTest        = "test"         // activate now, but boot the previous system
+	rebuildModeDryActivate = "dry-activate" // print what activating would change
+)
+
+// Rebuild updates a node to its current NixOS configuration from this checkout. The
+// system is built locally (or on the Nix builders in MAGE_REBUILD_BUILDERS), its closure
+// is copied to the node with `nix copy` and activated with switch-to-configuration, so the
+// node needs neither the repository nor .env. MAGE_REBUILD_MODE selects switch (default),
+// boot, test or dry-activate.
+// With MAGE_REBUILD_FLAKE_PATH set, the node instead pulls the flake at that path with git
+// and runs nixos-rebuild itself, as Rebuild used to.
+// The node is reached at its Tailscale, machines.nix or Hetzner address (see resolveNode),
+// and its SSH host key must be pinned (see TrustHostKey). `nix copy` needs the SSH user to
+// be root or a trusted user of the node's Nix daemon.
 // Usage: mage rebuild <flakeConfigName>
 // Example: mage rebuild cpx21-control-1
-func Rebuild(flakeConfigName string) error {
-	// Get target host and user from the flake configuration
-	targetHostVal, err := getFlakeDeployTarget(flakeConfigName)
+// Example: MAGE_REBUILD_MODE=boot mage rebuild cpx21-control-1
+func Rebuild(ctx context.Context, flakeConfigName string) error {
+	mode := cfg.RebuildMode
+	switch mode {
+	case rebuildModeSwitch, rebuildModeBoot, rebuildModeTest, rebuildModeDryActivate:
+	default:
+		return fmt.Errorf("ERROR: unknown MAGE_REBUILD_MODE '%s', use %s, %s, %s or %s", mode, rebuildModeSwitch, rebuildModeBoot, rebuildModeTest, rebuildModeDryActivate)
+	}
+	node, err := getNode(flakeConfigName)
+	if err != nil {
+		return err
+	}
+	sshClient, err := newSSHClient()
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	addr, err := resolveNode(ctx, sshClient, node, true)
 	if err != nil {
-		return fmt.Errorf("failed to get deploy target from flake for '%s': %w", flakeConfigName, err)
+		return err
 	}
+	targetHostVal := addr.Target
 
-	fmt.Printf("INFO: Rebuilding NixOS configuration '%s' on %s...\n", flakeConfigName, targetHostVal)
-	fmt.Println("IMPORTANT: This assumes your flake source (e.g., from git) is up-to-date on the target machine if it pulls from there.")
-	// You might need to adjust the path to your flake on the remote machine.
-	// Example assumes it's cloned in /root/k3s-nixos-configs
-	cmd := fmt.Sprintf("ssh %s 'cd /root/k3s-nixos && git pull && nixos-rebuild switch --flake .#%s'", targetHostVal, flakeConfigName)
-	return sh.RunV("bash", "-c", cmd)
+	if cfg.RebuildFlakePath != "" {
+		fmt.Printf("INFO: Rebuilding NixOS configuration '%s' on %s from the flake at %s (%s)...\n", flakeConfigName, targetHostVal, cfg.RebuildFlakePath, mode)
+		fmt.Println("IMPORTANT: This assumes the flake and its machines.nix and .env are set up on the target machine.")
+		command := fmt.Sprintf("%s && git pull && sudo nixos-rebuild %s --flake .#%s", runner.FormatCommand("cd", cfg.RebuildFlakePath), mode, flakeConfigName)
+		res, err := sshStream(ctx, sshClient, targetHostVal, command)
+		if err != nil {
+			return fmt.Errorf("rebuilding '%s' on %s failed: %w", flakeConfigName, targetHostVal, err)
+		}
+		if !run.DryRun() {
+			fmt.Printf("INFO: Rebuilt '%s' on %s in %s\n", flakeConfigName, targetHostVal, res.Duration.Round(time.Second))
+		}
+		return nil
+	}
+
+	// Refuse to build a configuration from placeholder values
+	if err := validateNodeConfig("rebuild", flakeConfigName); err != nil {
+		return err
+	}
+
+	// 1. Build
+	start := time.Now()
+	buildArgs := []string{"build", "--impure", "--no-link", "--print-out-paths", "--show-trace"}
+	if cfg.RebuildBuilders != "" {
+		fmt.Printf("INFO: Building on %s\n", cfg.RebuildBuilders)
+		// Build nothing locally, only fetch the result.
+		buildArgs = append(buildArgs, "--max-jobs", "0", "--builders", cfg.RebuildBuilders)
+	}
+	buildArgs = append(buildArgs, fmt.Sprintf(".#nixosConfigurations.%s.config.system.build.toplevel", flakeConfigName))
+	fmt.Printf("INFO: Building the NixOS system of '%s'...\n", flakeConfigName)
+	out, err := run.Output("nix", buildArgs...)
+	if err != nil {
+		return fmt.Errorf("building the NixOS system of '%s' failed: %w", flakeConfigName, err)
+	}
+	toplevel := strings.TrimSpace(out)
+	if run.DryRun() {
+		toplevel = "<toplevel of " + flakeConfigName + ">"
+	} else if !strings.HasPrefix(toplevel, "/nix/store/") {
+		return fmt.Errorf("ERROR: nix build printed '%s' instead of a store path", toplevel)
+	} else {
+		fmt.Printf("INFO: Built %s in %s\n", toplevel, time.Since(start).Round(time.Second))
+	}
+
+	// 2. Copy the closure
+	start = time.Now()
+	if err := nixCopy(sshClient, targetHostVal, toplevel); err != nil {
+		return fmt.Errorf("copying the NixOS system of '%s' to %s failed: %w", flakeConfigName, targetHostVal, err)
+	}
+	if !run.DryRun() {
+		fmt.Printf("INFO: Copied the closure to %s in %s\n", targetHostVal, time.Since(start).Round(time.Second))
+	}
+
+	// 3. Activate. The new system only becomes the boot default with switch and boot.
+	// switch-to-configuration runs as a transient unit like in nixos-rebuild, so it finishes
+	// even if the activation restarts the network and drops this connection.
+	var command string
+	if mode == rebuildModeSwitch || mode == rebuildModeBoot {
+		command = fmt.Sprintf("sudo nix-env -p /nix/var/nix/profiles/system --set %s && ", toplevel)
+	}
+	command += fmt.Sprintf("sudo systemd-run --collect --no-ask-password --pipe --quiet --service-type=exec --unit=nixos-rebuild-switch-to-configuration --wait %s/bin/switch-to-configuration %s", toplevel, mode)
+	fmt.Printf("INFO: Activating the new system of '%s' on %s (%s)...\n", flakeConfigName, targetHostVal, mode)
+	res, err := sshStream(ctx, sshClient, targetHostVal, command)
+	if err != nil {
+		return fmt.Errorf("activating the new system of '%s' on %s failed: %w", flakeConfigName, targetHostVal, err)
+	}
+	if !run.DryRun() {
+		fmt.Printf("INFO: Rebuilt '%s' on %s (%s) in %s\n", flakeConfigName, targetHostVal, mode, res.Duration.Round(time.Second))
+	}
+	return nil
 }
 
 // RecreateNode redeploys a node using nixos-anywhere.
@@ -138,42 +271,82 @@ func Rebuild(flakeConfigName string) error {
 // It also generates hardware config using nixos-facter and deploys secrets.
 // Usage: mage recreateNode <flakeConfigName>
 // Example: mage recreateNode cpx21-control-1
-func RecreateNode(flakeConfigName string) error {
-	// Get target host and user from the flake configuration
-	targetHostVal, err := getFlakeDeployTarget(flakeConfigName)
+func RecreateNode(ctx context.Context, flakeConfigName string) error {
+	// Refuse to install a configuration built from placeholder values
+	if err := validateNodeConfig("recreateNode", flakeConfigName, "AGE_PRIVATE_KEY"); err != nil {
+		return err
+	}
+
+	node, err := getNode(flakeConfigName)
+	if err != nil {
+		return err
+	}
+	sshClient, err := newSSHClient()
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	// The installer kexecs into a system that is not on the tailnet, so the whole
+	// reinstall uses the node's machines.nix or Hetzner address.
+	addr, err := resolveNode(ctx, sshClient, node, false)
 	if err != nil {
-		return fmt.Errorf("failed to get deploy target from flake for '%s': %w", flakeConfigName, err)
+		return err
+	}
+	targetHostVal, targetIP := addr.Target, addr.Host
+
+	// The k3s probe only trusts a pinned host key; installNixOS pins a new one after the
+	// confirmation.
+	if err := guardDestructive("wipe and reinstall", flakeConfigName, func() bool {
+		_, err := sshQuery(ctx, sshClient, targetHostVal, "systemctl is-active --quiet k3s")
+		return err == nil
+	}); err != nil {
+		return err
 	}
 
-	// Extract user and host for nixos-anywhere, assuming format user@host
-	parts := strings.SplitN(targetHostVal, "@", 2)
-	if len(parts) != 2 {
-		return fmt.Errorf("ERROR: deploy target '%s' for '%s' is not in user@host format", targetHostVal, flakeConfigName)
+	if err := installNixOS(ctx, flakeConfigName, targetHostVal, sshClient, nil); err != nil {
+		return err
 	}
-	targetUser := parts[0]
-	targetIP := parts[1] // This might be an IP or hostname resolvable by SSH
 
-	// Get SSH key path, prioritizing MAGE_SSH_KEY env var
-	sshKey := os.Getenv("MAGE_SSH_KEY")
-	if sshKey == "" {
-		sshKey = defaultSSHKey // Fallback to default if env var is not set
-		fmt.Printf("INFO: MAGE_SSH_KEY environment variable not set, using default: %s\n", sshKey)
+	if !node.IsControlPlane() {
+		fmt.Printf("INFO: Node '%s' is not a control plane node, skipping the k3s readiness check and kubeconfig fetch.\n", flakeConfigName)
+		fmt.Printf("INFO: Node '%s' recreated and configured. Tailscale and K3s should be setting up.\n", flakeConfigName)
+		return nil
 	}
 
-	// Expand ~ to home directory if present
-	if strings.HasPrefix(sshKey, "~/") {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return fmt.Errorf("failed to get home directory: %w", err)
-		}
-		sshKey = filepath.Join(home, sshKey[2:])
+	fmt.Println("INFO: Waiting for the k3s API server to become ready...")
+	if err := waitForK3s(ctx, targetIP, targetHostVal, sshClient); err != nil {
+		// The node itself is installed; k3s may still converge (e.g. waiting on secrets).
+		fmt.Printf("WARNING: k3s on '%s' is not ready yet: %v\n", flakeConfigName, err)
 	}
 
-	// Verify SSH key exists (optional but good practice)
-	if _, err := os.Stat(sshKey); os.IsNotExist(err) {
-		return fmt.Errorf("ERROR: SSH key not found at %s", sshKey)
+	fmt.Println("INFO: Attempting to fetch the K3s kubeconfig from the server...")
+	if err := fetchKubeconfig(ctx, targetHostVal, sshClient); err != nil {
+		// Don't return an error here, as the node might still be setting up K3s.
+		// The user can run `mage fetchKubeconfig` later.
+		fmt.Printf("WARNING: Failed to fetch kubeconfig from %s, run 'mage fetchKubeconfig %s' once K3s is up: %v\n", targetHostVal, flakeConfigName, err)
+	}
+
+	fmt.Printf("INFO: Node '%s' recreated and configured. Tailscale and K3s should be setting up.\n", flakeConfigName)
+	return nil
+}
+
+// installNixOS installs the NixOS configuration flakeConfigName on targetHostVal (user@host)
+// with nixos-anywhere and waits for the machine to reboot into it. The AGE key is copied to
+// /etc/sops/age/key.txt on the target, and extraFiles (keyed by absolute path without the
+// leading slash) are copied into the installed system as well. Callers confirm the install
+// with guardDestructive first. The SSH host key of the target is pinned right before
+// nixos-anywhere runs if it was not yet; --copy-host-keys keeps it valid after the install.
+// The route of the target's host registered with sshClient (see resolveNode) is used by
+// nixos-anywhere too.
+func installNixOS(ctx context.Context, flakeConfigName, targetHostVal string, sshClient *sshclient.Client, extraFiles map[string][]byte) error {
+	// Extract user and host for nixos-anywhere, assuming format user@host
+	parts := strings.SplitN(targetHostVal, "@", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("ERROR: deploy target '%s' for '%s' is not in user@host format", targetHostVal, flakeConfigName)
 	}
-	fmt.Printf("INFO: Using SSH key: %s\n", sshKey)
+	targetUser := parts[0]
+	targetIP := parts[1] // This might be an IP or hostname resolvable by SSH
+	route := sshClient.Route(targetIP)
 
 	// Create a temporary directory to store the AGE key locally before copying
 	tempDir, err := os.MkdirTemp("", "nixos-anywhere-age-key")
@@ -184,15 +357,15 @@ func RecreateNode(flakeConfigName string) error {
 
 	// Create the directory structure for the AGE key within the temp dir
 	ageKeyDir := filepath.Join(tempDir, "etc", "sops", "age")
-	if err := os.MkdirAll(ageKeyDir, 0700); err != nil {
+	if err := run.MkdirAll(ageKeyDir, 0700); err != nil {
 		return fmt.Errorf("failed to create AGE key directory: %w", err)
 	}
 
-	// Get the AGE key from environment
-	ageKey := os.Getenv("AGE_PRIVATE_KEY")
-	if ageKey == "" {
-		return fmt.Errorf("AGE_PRIVATE_KEY environment variable is not set")
+	// Get the AGE key from the configuration
+	if err := cfg.Require("installing NixOS", "AGE_PRIVATE_KEY"); err != nil {
+		return err
 	}
+	ageKey := cfg.AgePrivateKey
 
 	// Ensure the AGE key has the correct format (should start with AGE-SECRET-KEY-)
 	if !strings.HasPrefix(ageKey, "AGE-SECRET-KEY-") {
@@ -201,12 +374,23 @@ func RecreateNode(flakeConfigName string) error {
 
 	// Write the AGE key to a file in the temporary directory
 	ageKeyPath := filepath.Join(ageKeyDir, "key.txt")
-	if err := os.WriteFile(ageKeyPath, []byte(ageKey), 0600); err != nil {
+	if err := run.WriteFile(ageKeyPath, []byte(ageKey), 0600); err != nil {
 		return fmt.Errorf("failed to write AGE key: %w", err)
 	}
 
 	fmt.Printf("INFO: AGE key written to temporary path %s for deployment\n", ageKeyPath)
 
+	// Any other files for the installed system, e.g. the k3s node password of a replaced server
+	for path, data := range extraFiles {
+		dest := filepath.Join(tempDir, path)
+		if err := run.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", path, err)
+		}
+		if err := run.WriteFile(dest, data, 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+
 	// Run nixos-anywhere to deploy NixOS to the target machine.
 	// It will use disko based on the flake config.
 	// It will generate hardware config using nixos-facter and save the report to /tmp/facter.json on target.
@@ -222,188 +406,632 @@ func RecreateNode(flakeConfigName string) error {
 		"--extra-files", tempDir, // Copy the local tempDir (containing AGE key) to the target
 		"--substitute-on-destination", // Enable substitutes on the destination
 		"--copy-host-keys",            // Copy existing SSH host keys to maintain SSH identity
-		"-i", sshKey,                  // Specify the SSH identity file
-		targetUser + "@" + targetIP, // The target host
 	}
+	if sshClient.KeyFile() != "" {
+		nixosAnywhereArgs = append(nixosAnywhereArgs, "-i", sshClient.KeyFile()) // Specify the SSH identity file; ssh-agent is used otherwise
+	}
+	if route.Jump != "" {
+		proxyCommand, err := sshProxyCommand(sshClient, route.Jump)
+		if err != nil {
+			return err
+		}
+		nixosAnywhereArgs = append(nixosAnywhereArgs, "--ssh-option", "ProxyCommand="+proxyCommand) // Tunnel through the jump host
+	}
+	nixosAnywhereArgs = append(nixosAnywhereArgs, targetUser+"@"+targetIP) // The target host
 
 	fmt.Printf("INFO: Running nixos-anywhere with args: %v\n", nixosAnywhereArgs)
 
+	// This is the machine's first install, or a reinstall keeping its host keys: record its
+	// key if none is pinned yet. Callers have confirmed the install by now.
+	sshClient.AcceptNew(targetIP)
+
 	// nixos-anywhere handles SSH connection and remote command execution.
 	// We don't need to manually set SSH environment variables here.
-	err = sh.RunV(nixosAnywhereArgs[0], nixosAnywhereArgs[1:]...)
-	if err != nil {
+	if err := run.RunV(nixosAnywhereArgs[0], nixosAnywhereArgs[1:]...); err != nil {
 		return fmt.Errorf("nixos-anywhere deployment failed: %w", err)
 	}
 
-	fmt.Printf("INFO: Waiting for %s to reboot and become available...\n", targetIP)
-	// Add a sleep or a more sophisticated check for server availability here
-	sh.Run("sleep", "30") // Basic wait, adjust as needed
-
-	fmt.Println("INFO: Attempting to copy K3s configuration file from the server...")
+	fmt.Printf("INFO: Waiting for %s to reboot into the installed NixOS system...\n", targetIP)
+	if err := waitForNixOS(ctx, targetIP, targetHostVal, sshClient, flakeConfigName); err != nil {
+		return fmt.Errorf("node '%s' did not come back after installation: %w", flakeConfigName, err)
+	}
+	return nil
+}
 
-	// Build SSH command arguments to fetch the k3s.yaml
-	// We need to connect as the root user on the *newly installed* system.
-	// The targetHostVal from the flake config should be the correct address.
-	sshFetchArgs := []string{
-		"ssh",
-		"-i", sshKey, // Use the same SSH key
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=/dev/null",
-		targetHostVal,                        // Connect to the target host from flake config
-		"sudo cat /etc/rancher/k3s/k3s.yaml", // Command to run on target
+// FetchKubeconfig fetches /etc/rancher/k3s/k3s.yaml from a control plane node and merges it
+// into your kubeconfig ($KUBECONFIG, or ~/.kube/config).
+// The server address is rewritten to K3S_CONTROL_PLANE_ADDR, or to the node's Tailscale IP if that
+// is not set, and the cluster, user and context are renamed to K3S_CLUSTER_NAME (default k3s-cluster).
+// Other contexts in the kubeconfig are left untouched. The fetched context becomes the current
+// context unless MAGE_KUBECONFIG_USE_CONTEXT=false. The node is reached like by Rebuild.
+// Usage: mage fetchKubeconfig <flakeConfigName>
+// Example: mage fetchKubeconfig cpx21-control-1
+func FetchKubeconfig(ctx context.Context, flakeConfigName string) error {
+	node, err := getNode(flakeConfigName)
+	if err != nil {
+		return err
+	}
+	sshClient, err := newSSHClient()
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	addr, err := resolveNode(ctx, sshClient, node, true)
+	if err != nil {
+		return err
 	}
+	return fetchKubeconfig(ctx, addr.Target, sshClient)
+}
 
-	// Execute SSH command
-	k3sConfigContent, err := sh.Output(sshFetchArgs[0], sshFetchArgs[1:]...)
+// TrustHostKey pins the SSH host key of a node in the known_hosts file of the cluster
+// (known_hosts, known_hosts.<MAGE_CLUSTER>, or MAGE_SSH_KNOWN_HOSTS), after printing its
+// fingerprint. Installations pin the key by themselves; use this for nodes installed before
+// host keys were pinned. If a different key is pinned, e.g. because the machine was
+// reinstalled without its host keys, replacing it has to be confirmed like a destructive target.
+// The key is pinned under the node's name, whichever address it is reached at (see Rebuild).
+// Usage: mage trustHostKey <flakeConfigName>
+// Example: mage trustHostKey thinkcenter-1
+func TrustHostKey(ctx context.Context, flakeConfigName string) error {
+	node, err := getNode(flakeConfigName)
 	if err != nil {
-		fmt.Printf("WARNING: Failed to copy k3s.yaml from %s. This might be expected if K3s isn't fully up yet or if this is not a control plane node: %v\n", targetHostVal, err)
-		// Don't return an error here, as the node might still be setting up K3s.
-		// The user can try fetching the kubeconfig manually later.
-	} else {
-		// Create directory if it doesn't exist
-		if err := os.MkdirAll(filepath.Dir(kubeconfigPath), 0755); err != nil {
-			return fmt.Errorf("failed to create kubeconfig directory: %w", err)
-		}
+		return err
+	}
+	sshClient, err := newSSHClient()
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	nodeAddr, err := resolveNode(ctx, sshClient, node, true)
+	if err != nil {
+		return err
+	}
 
-		if err := os.WriteFile(kubeconfigPath, []byte(k3sConfigContent), 0600); err != nil {
-			return fmt.Errorf("failed to write kubeconfig: %w", err)
+	addr := sshClient.HostKeyName(nodeAddr.Target)
+	key, err := sshClient.HostKey(ctx, nodeAddr.Target)
+	if err != nil {
+		return err
+	}
+	knownHosts := sshClient.KnownHosts()
+	fmt.Printf("INFO: %s presents host key %s %s\n", sshclient.Addr(nodeAddr.Target), key.Type(), ssh.FingerprintSHA256(key))
+
+	var unknown *sshclient.UnknownHostError
+	var mismatch *sshclient.HostKeyMismatchError
+	switch err := knownHosts.Check(addr, key); {
+	case err == nil:
+		fmt.Printf("INFO: The key is already pinned in %s.\n", knownHosts.Path)
+		return nil
+	case errors.As(err, &mismatch):
+		fmt.Printf("WARNING: %v\n", err)
+		fmt.Println("WARNING: Only replace the pinned key if you know the machine was reinstalled without its host keys.")
+		if err := confirmDestructive("replace the pinned SSH host key of", flakeConfigName); err != nil {
+			return err
 		}
-
-		fmt.Printf("INFO: K3s config copied to %s\n", kubeconfigPath)
-		fmt.Printf("INFO: To use it, run: export KUBECONFIG=%s\n", kubeconfigPath)
+	case !errors.As(err, &unknown):
+		return err
 	}
 
-	fmt.Printf("INFO: Node '%s' recreated and configured. Tailscale and K3s should be setting up.\n", flakeConfigName)
+	if run.DryRun() {
+		run.Record("pin host key %s of %s in %s", ssh.FingerprintSHA256(key), addr, knownHosts.Path)
+		return nil
+	}
+	if _, err := knownHosts.Remove(addr); err != nil {
+		return err
+	}
+	if err := knownHosts.Add(addr, key); err != nil {
+		return err
+	}
+	fmt.Printf("INFO: Pinned the host key of %s in %s. Commit it so others verify the same key.\n", flakeConfigName, knownHosts.Path)
 	return nil
 }
 
-// RecreateServer recreates a Hetzner Cloud server with the specified properties.
-// Usage: mage recreateServer <serverName> <ipv4Enabled (true/false)>
-// Example: mage recreateServer cpx21-control-1 true
-func RecreateServer(serverName string, ipv4Enabled string) error {
-	mg.SerialDeps(CheckFlake) // Ensure flake is valid before recreating the server
+// Exec runs a shell command on every node matching selector, in parallel, printing each
+// output line prefixed with the node's name. The selector is a comma-separated list of node
+// names (globs allowed), nodeType=<type>, location=<location>, control-plane or all; a node
+// matching any of them is selected. Nodes are reached like by Rebuild. At most
+// MAGE_EXEC_CONCURRENCY (default 5) nodes run the command at once, each for at most
+// MAGE_EXEC_TIMEOUT (default 5m). A summary follows, and the target fails if the command
+// failed, timed out or could not be started on any node.
+// Usage: mage exec <selector> <command>
+// Example: mage exec nodeType=worker "systemctl is-active k3s-agent"
+// Example: mage exec control-plane,thinkcenter-1 "journalctl -u k3s -n 20 --no-pager"
+func Exec(ctx context.Context, selector, command string) error {
+	inv, err := loadInventory()
+	if err != nil {
+		return err
+	}
+	nodes, err := inv.Select(selector)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	if cfg.ExecConcurrency < 1 {
+		return fmt.Errorf("ERROR: MAGE_EXEC_CONCURRENCY must be at least 1, got %d", cfg.ExecConcurrency)
+	}
+	sshClient, err := newSSHClient()
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+
+	// Resolve all nodes first; a node without an address fails like one whose command fails.
+	results := make([]execResult, len(nodes))
+	width := 0
+	for i, node := range nodes {
+		results[i].node = node.Name
+		width = max(width, len(node.Name))
+		addr, err := resolveNode(ctx, sshClient, node, true)
+		if err != nil {
+			results[i].err = err
+			continue
+		}
+		results[i].target = addr.Target
+	}
 
-	// Get required environment variables
-	hcloudToken := os.Getenv("HCLOUD_TOKEN")
-	if hcloudToken == "" {
-		return fmt.Errorf("ERROR: HCLOUD_TOKEN environment variable must be set")
+	fmt.Printf("INFO: Running '%s' on %d node(s), %d at a time...\n", command, len(nodes), cfg.ExecConcurrency)
+	var outputMu sync.Mutex
+	slots := make(chan struct{}, cfg.ExecConcurrency)
+	var wg sync.WaitGroup
+	for i := range results {
+		res := &results[i]
+		if res.err != nil {
+			continue
+		}
+		if run.DryRun() {
+			run.Record("run on %s (%s) over SSH: %s", res.node, res.target, command)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			prefix := fmt.Sprintf("[%-*s] ", width, res.node)
+			stdout := &sshclient.PrefixWriter{W: os.Stdout, Prefix: prefix, Mu: &outputMu}
+			stderr := &sshclient.PrefixWriter{W: os.Stderr, Prefix: prefix, Mu: &outputMu}
+			hostCtx, cancel := context.WithTimeout(ctx, cfg.ExecTimeout)
+			defer cancel()
+			r, err := sshClient.Exec(hostCtx, sshclient.Command{Target: res.target, Command: command, Stdout: stdout, Stderr: stderr})
+			stdout.Flush()
+			stderr.Flush()
+			res.exitCode, res.duration = r.ExitCode, r.Duration
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("timed out after %s", cfg.ExecTimeout)
+			}
+			res.err = sshHint(err)
+		}()
 	}
+	wg.Wait()
+	// Also in dry-run mode, so nodes that could not be resolved are not hidden.
+	return printExecSummary(command, results)
+}
 
-	sshKeyName := os.Getenv("HETZNER_SSH_KEY_NAME")
-	if sshKeyName == "" {
-		return fmt.Errorf("ERROR: HETZNER_SSH_KEY_NAME environment variable must be set")
+// Diagnose collects what is needed to find out why a node fails to join the cluster into
+// diagnostics/<node>-<timestamp>.tar.gz: the journals of k3s, k3s-agent, infisical-agent,
+// sops-nix and tailscaled, the state of those units, Tailscale status, networkd state and
+// addresses, the disk layout, whether the k3s token and Tailscale key files exist, and
+// whether the node reaches K3S_CONTROL_PLANE_ADDR. Secrets (the secret values from .env and
+// anything shaped like a token or key) are redacted before anything is written. A summary
+// of detected common failures is printed and included as summary.txt.
+// Usage: mage diagnose <flakeConfigName>
+// Example: mage diagnose hetzner-worker-alpha
+func Diagnose(ctx context.Context, flakeConfigName string) error {
+	node, err := getNode(flakeConfigName)
+	if err != nil {
+		return err
+	}
+	sshClient, err := newSSHClient()
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	addr, err := resolveNode(ctx, sshClient, node, true)
+	if err != nil {
+		return err
+	}
+	// Fail early, instead of once per command, if the node cannot be reached.
+	if _, err := sshQuery(ctx, sshClient, addr.Target, "true"); err != nil {
+		return fmt.Errorf("cannot collect diagnostics from '%s': %w", flakeConfigName, err)
 	}
 
-	privateNetName := os.Getenv("PRIVATE_NETWORK_NAME")
-	if privateNetName == "" {
-		return fmt.Errorf("ERROR: PRIVATE_NETWORK_NAME environment variable must be set")
+	var cpHost, cpPort string
+	if cfg.K3sControlPlaneAddr != "" {
+		cpHost, cpPort = cfg.K3sControlPlaneAddr, strconv.Itoa(k3sAPIPort)
+	} else {
+		fmt.Println("INFO: K3S_CONTROL_PLANE_ADDR not set, skipping the control plane reachability check")
 	}
 
-	placementGroupName := os.Getenv("PLACEMENT_GROUP_NAME")
-	if placementGroupName == "" {
-		return fmt.Errorf("ERROR: PLACEMENT_GROUP_NAME environment variable must be set")
+	redactor := diagnose.NewRedactor(cfg.Secrets()...)
+	outputs := map[string]string{}
+	var files []diagnose.File
+	fmt.Printf("INFO: Collecting diagnostics from '%s'...\n", flakeConfigName)
+	for _, item := range diagnose.Items(cpHost, cpPort) {
+		res, err := sshQuery(ctx, sshClient, addr.Target, item.Command)
+		var exitErr *sshclient.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			return fmt.Errorf("collecting %s from '%s' failed: %w", item.File, flakeConfigName, err)
+		}
+		output := res.Stdout + res.Stderr
+		if err != nil {
+			output += fmt.Sprintf("\n# exit status %d\n", res.ExitCode)
+		}
+		outputs[item.File] = output
+		files = append(files, diagnose.File{Name: item.File, Data: []byte("$ " + item.Command + "\n" + redactor.Redact(output))})
 	}
 
-	// Get optional environment variables with defaults
-	hetznerLocation := os.Getenv("HETZNER_LOCATION")
-	if hetznerLocation == "" {
-		hetznerLocation = "ash"
-		fmt.Printf("INFO: HETZNER_LOCATION not set, defaulting to %s\n", hetznerLocation)
+	findings := diagnose.Analyze(outputs, node.IsControlPlane())
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "Diagnostics of %s (%s, reached at %s) collected %s\n", flakeConfigName, node.NodeType, addr.Target, time.Now().UTC().Format(time.RFC3339))
+	if len(findings) == 0 {
+		summary.WriteString("No common failure detected.\n")
 	}
+	for _, finding := range findings {
+		fmt.Fprintf(&summary, "- %s\n", finding)
+	}
+	files = append([]diagnose.File{{Name: "summary.txt", Data: []byte(redactor.Redact(summary.String()))}}, files...)
 
-	imageName := os.Getenv("HETZNER_IMAGE_NAME")
-	if imageName == "" {
-		imageName = "debian-12" // Default to a common installer image
-		fmt.Printf("INFO: HETZNER_IMAGE_NAME not set, defaulting to %s\n", imageName)
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s-%s", flakeConfigName, now.Format("20060102T150405Z"))
+	var tarball bytes.Buffer
+	if err := diagnose.WriteTarball(&tarball, name, now, files); err != nil {
+		return err
+	}
+	path := filepath.Join("diagnostics", name+".tar.gz")
+	if err := run.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	if err := run.WriteFile(path, tarball.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
 	}
 
-	serverType := os.Getenv("CONTROL_PLANE_VM_TYPE") // Assuming this is for control planes
-	// You might want to add logic to select server type based on flakeConfigName if needed
-	if serverType == "" {
-		serverType = "cpx21"
-		fmt.Printf("INFO: CONTROL_PLANE_VM_TYPE not set, defaulting to %s\n", serverType)
+	if len(findings) == 0 {
+		fmt.Println("INFO: No common failure detected.")
+	}
+	for _, finding := range findings {
+		fmt.Printf("WARNING: %s\n", finding)
 	}
+	if !run.DryRun() {
+		fmt.Printf("INFO: Wrote the diagnostics of '%s' to %s. Check it for secrets before sharing it.\n", flakeConfigName, path)
+	}
+	return nil
+}
 
-	// Construct datacenter name from location
-	datacenterName := fmt.Sprintf("%s-dc1", hetznerLocation)
+// RecreateServer recreates a Hetzner Cloud server with the specified properties.
+// It talks to the Hetzner Cloud API directly (see internal/hcloud) using HCLOUD_TOKEN.
+// Set HCLOUD_ENDPOINT to point it at a different API, e.g. the fake from cmd/hcloud-fake.
+// The server type, location, image, public IPs, labels and volumes come from the machine's
+// hetzner block in machines.nix, falling back to the .env defaults.
+// Usage: mage recreateServer <serverName>
+// Example: mage recreateServer cpx21-control-1
+func RecreateServer(ctx context.Context, serverName string) error {
+	node, err := getNode(serverName)
+	if err != nil {
+		return err
+	}
+	_, err = recreateServer(ctx, serverName, node)
+	return err
+}
 
-	// Convert ipv4Enabled string to boolean
-	var enableIPv4 bool
-	if ipv4Enabled == "" {
-		// Check environment variable if parameter not provided
-		enableIPv4Env := os.Getenv("HETZNER_DEFAULT_ENABLE_IPV4")
-		if strings.ToLower(enableIPv4Env) == "true" {
-			enableIPv4 = true
-		} else {
-			enableIPv4 = false
+// RestoreServerSnapshot recreates a Hetzner Cloud server from the newest snapshot taken by
+// recreateServer (see MAGE_SNAPSHOT_BEFORE_DELETE), e.g. after a recreation failed once the
+// old server was already deleted. The server type, location and other parameters come
+// from machines.nix as for recreateServer; only the image is replaced by the snapshot.
+// The restored server boots the snapshotted system, so no NixOS install is needed.
+// Usage: mage restoreServerSnapshot <serverName>
+// Example: mage restoreServerSnapshot cpx21-control-1
+func RestoreServerSnapshot(ctx context.Context, serverName string) error {
+	node, err := getNode(serverName)
+	if err != nil {
+		return err
+	}
+	client, err := newHcloudClient()
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := client.ListImages(ctx, hcloud.ImageTypeSnapshot, snapshotSelector(node.Name))
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots of %s: %w", node.Name, err)
+	}
+	var latest *hcloud.Image
+	for _, snapshot := range snapshots {
+		if snapshot.Status == "available" {
+			latest = snapshot
+			break
 		}
-	} else if strings.ToLower(ipv4Enabled) == "true" {
-		enableIPv4 = true
-	} else if strings.ToLower(ipv4Enabled) == "false" {
-		enableIPv4 = false
-	} else {
-		return fmt.Errorf("ERROR: ipv4Enabled must be either 'true' or 'false'")
 	}
+	if latest == nil {
+		return fmt.Errorf("ERROR: no snapshots of '%s' in %s found (they are taken by recreateServer with MAGE_SNAPSHOT_BEFORE_DELETE=true)", node.Name, cfg.Cluster().Describe())
+	}
+	fmt.Printf("INFO: Restoring %s from snapshot %d (%s, taken %s).\n", serverName, latest.ID, latest.Description, latest.Created.Format(time.RFC3339))
+
+	hetzner := inventory.HetznerSpec{}
+	if node.Hetzner != nil {
+		hetzner = *node.Hetzner
+	}
+	hetzner.Image = strconv.FormatInt(latest.ID, 10)
+	node.Hetzner = &hetzner
 
-	fmt.Printf("INFO: Recreating server %s with IPv4 enabled: %t...\n", serverName, enableIPv4)
+	_, err = recreateServer(ctx, serverName, node)
+	return err
+}
 
-	// 1. Delete the existing server
-	fmt.Println("INFO: Deleting existing server...")
-	// Use --ignore-not-found to avoid error if server doesn't exist
-	err := sh.RunV("hcloud", "server", "delete", serverName, "--force", "--ignore-not-found")
+// EnsureFirewall creates the Hetzner Cloud firewall named by FIREWALL_NAME, or updates its
+// rules if they differ from the desired ones:
+//   - SSH (22/tcp) only from ADMIN_PUBLIC_IP (comma-separated IPs or CIDRs);
+//   - Tailscale (41641/udp) from anywhere, so nodes can establish direct connections;
+//   - the k3s API (6443/tcp) only from PRIVATE_NETWORK_IP_RANGE and the tailnet.
+//
+// Everything else is dropped. recreateServer runs this and attaches the firewall when it
+// creates a server, so new servers are never exposed.
+// Usage: mage ensureFirewall
+func EnsureFirewall(ctx context.Context) error {
+	client, err := newHcloudClient()
 	if err != nil {
-		return fmt.Errorf("failed to delete server: %w", err)
+		return err
 	}
-	fmt.Printf("INFO: Server %s deleted (or did not exist).\n", serverName)
+	_, _, err = ensureFirewall(ctx, client)
+	return err
+}
 
-	// 2. Create a new server with the same properties
-	fmt.Println("INFO: Creating new server...")
+// EnsureInfra creates the shared Hetzner Cloud resources that servers are created with, if
+// they are missing, and reports which already existed and which were created:
+//   - the private network PRIVATE_NETWORK_NAME (PRIVATE_NETWORK_IP_RANGE) with a subnet
+//     (PRIVATE_SUBNET_IP_RANGE) in the network zone of HETZNER_LOCATION (recreateServer uses
+//     the location of the machine);
+//   - the spread placement group PLACEMENT_GROUP_NAME;
+//   - the SSH key HETZNER_SSH_KEY_NAME, uploaded from ADMIN_SSH_PUBLIC_KEY;
+//   - the firewall FIREWALL_NAME, if set (see EnsureFirewall).
+//
+// It is safe to run repeatedly. recreateServer runs it before creating a server.
+// Usage: mage ensureInfra
+func EnsureInfra(ctx context.Context) error {
+	client, err := newHcloudClient()
+	if err != nil {
+		return err
+	}
+	_, err = ensureInfra(ctx, client, cfg.HetznerLocation)
+	return err
+}
 
-	var createArgs []string
-	createArgs = append(createArgs, "server", "create", serverName)
-	createArgs = append(createArgs, "--server-type", serverType)
-	createArgs = append(createArgs, "--image", imageName)
-	createArgs = append(createArgs, "--datacenter", datacenterName)
-	createArgs = append(createArgs, "--ssh-key", sshKeyName)
-	createArgs = append(createArgs, "--network", privateNetName)
-	createArgs = append(createArgs, "--placement-group", placementGroupName)
+// EnsureLoadBalancer creates or updates the Hetzner Cloud load balancer LOAD_BALANCER_NAME in
+// front of the k3s API, so workers and kubeconfigs have one endpoint for all control plane
+// nodes that keeps working when one of them is down:
+//   - of type LOAD_BALANCER_TYPE in HETZNER_LOCATION, attached to the private network;
+//   - a TCP service forwarding 6443 to 6443, with a TCP health check on 6443, so only
+//     control planes whose API server is up receive connections;
+//   - a label selector target for the servers labelled k3s-nixos/role=control-plane in the
+//     cluster, reached over their private IPs. recreateServer and replaceServer label the
+//     control plane servers they create; existing control plane servers from machines.nix
+//     are labelled here;
+//   - a public interface only if LOAD_BALANCER_PUBLIC=true. Hetzner Cloud firewalls do not
+//     apply to load balancers, so a public load balancer exposes the k3s API to everyone.
+//
+// Settings that drifted are corrected. It is safe to run repeatedly. Finally, it prints the
+// health of each target and the address to use as K3S_CONTROL_PLANE_ADDR.
+// Usage: mage ensureLoadBalancer
+func EnsureLoadBalancer(ctx context.Context) error {
+	client, err := newHcloudClient()
+	if err != nil {
+		return err
+	}
+	infra, err := ensureInfra(ctx, client, cfg.HetznerLocation)
+	if err != nil {
+		return err
+	}
+	if err := labelControlPlaneServers(ctx, client); err != nil {
+		return err
+	}
+	lb, err := ensureLoadBalancer(ctx, client, infra.Network)
+	if err != nil {
+		return err
+	}
+	if run.DryRun() {
+		fmt.Printf("INFO: Dry run: load balancer %s was not actually changed.\n", cfg.LoadBalancerName)
+		return nil
+	}
+	return printLoadBalancerStatus(ctx, client, lb, infra.Network)
+}
 
-	if enableIPv4 {
-		createArgs = append(createArgs, "--enable-ipv4")
+// AllocateControlPlaneIP allocates a Hetzner Cloud IPv4 for the control plane endpoint, so
+// K3S_CONTROL_PLANE_ADDR stays the same when the control-init node is recreated. kind is:
+//   - "primary": a primary IP. If the control-init server exists, its current public IPv4 is
+//     kept instead of allocating a new one, so the current endpoint keeps working. Otherwise
+//     a new one is allocated in a datacenter of the node's location. recreateServer creates
+//     the node with it; nothing has to be configured on the node, but the node is always
+//     created in the datacenter of the IP.
+//   - "floating": a floating IP homed in the node's location. It is assigned to the
+//     control-init server right away if it exists, and again by recreateServer after
+//     creating it. The node has to configure the address itself: set
+//     HETZNER_CONTROL_PLANE_FLOATING_IP=true.
+//
+// The IP is named HETZNER_CONTROL_PLANE_IP_NAME and is not deleted with its server. Set
+// K3S_CONTROL_PLANE_ADDR to the printed address. If the IP already exists, it is printed;
+// an existing floating IP is assigned to the control-init server if it is not, and auto
+// delete is disabled for an existing primary IP.
+// Usage: mage allocateControlPlaneIP <primary|floating>
+// Example: mage allocateControlPlaneIP floating
+func AllocateControlPlaneIP(ctx context.Context, kind string) error {
+	if kind != controlPlaneIPPrimary && kind != controlPlaneIPFloating {
+		return fmt.Errorf("ERROR: unknown control plane IP kind '%s', use '%s' or '%s'", kind, controlPlaneIPPrimary, controlPlaneIPFloating)
+	}
+	client, err := newHcloudClient()
+	if err != nil {
+		return err
+	}
+	existing, err := getControlPlaneIP(ctx, client)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Kind() != kind {
+		fmt.Printf("INFO: The control plane IP already exists: %s\n", existing)
+		printControlPlaneAddrHint(existing)
+		return nil
 	}
 
-	// The HCLOUD_TOKEN environment variable will be used automatically by the hcloud CLI
+	inv, err := loadInventory()
+	if err != nil {
+		return err
+	}
+	node, ok := inv.ControlInit()
+	if !ok || node.Location != inventory.LocationHetzner {
+		return fmt.Errorf("ERROR: machines.nix defines no %s node on Hetzner Cloud to allocate the control plane IP for", inventory.NodeTypeControlInit)
+	}
+	spec := serverSpec(node)
+	server, err := client.GetServerByName(ctx, node.Name)
+	if err != nil {
+		return fmt.Errorf("failed to look up server %s: %w", node.Name, err)
+	}
+	labels := map[string]string{labelCluster: cfg.Cluster().String()}
+
+	ip := &controlPlaneIP{}
+	var status hcloud.EnsureStatus
+	if kind == controlPlaneIPFloating {
+		opts := hcloud.FloatingIPCreateOpts{
+			Type:         hcloud.PrimaryIPTypeIPv4,
+			Name:         cfg.ControlPlaneIPName,
+			Description:  fmt.Sprintf("k3s control plane endpoint of cluster %s", cfg.Cluster()),
+			HomeLocation: spec.Location,
+			Labels:       labels,
+		}
+		if server != nil {
+			opts.HomeLocation, opts.Server = "", &server.ID
+		}
+		if ip.Floating, status, err = client.EnsureFloatingIP(ctx, opts); err != nil {
+			return err
+		}
+	} else {
+		opts := hcloud.PrimaryIPCreateOpts{Name: cfg.ControlPlaneIPName, Type: hcloud.PrimaryIPTypeIPv4, Labels: labels}
+		switch {
+		case existing != nil:
+		case server != nil && server.PublicNet.IPv4 != nil:
+			// Keep the server's current address and make it outlive the server.
+			opts.AssigneeID = &server.ID
+		default:
+			// Pick a datacenter in which the node's server type can currently be created.
+			st, err := client.GetServerTypeByName(ctx, spec.ServerType)
+			if err != nil {
+				return fmt.Errorf("failed to look up server type %s: %w", spec.ServerType, err)
+			}
+			if st == nil {
+				return fmt.Errorf("ERROR: server type %s of %s does not exist", spec.ServerType, node.Name)
+			}
+			if opts.Datacenter, err = checkServerTypeAvailable(ctx, client, st, spec.Location, ""); err != nil {
+				return fmt.Errorf("ERROR: cannot pick a datacenter for the control plane IP: %w", err)
+			}
+			if server != nil {
+				fmt.Printf("WARNING: %s has no public IPv4; it gets the control plane IP when it is recreated with recreateServer\n", server.Name)
+			}
+		}
+		if ip.Primary, status, err = client.EnsurePrimaryIP(ctx, opts); err != nil {
+			return err
+		}
+	}
 
-	err = sh.RunV("hcloud", createArgs...)
+	switch {
+	case status == hcloud.EnsureExisted:
+		fmt.Printf("INFO: The control plane IP already exists: %s\n", ip)
+	case client.DryRun() && status == hcloud.EnsureCreated:
+		fmt.Printf("INFO: The control plane IP %s would be allocated.\n", cfg.ControlPlaneIPName)
+	case status == hcloud.EnsureCreated:
+		fmt.Printf("INFO: Allocated the control plane IP: %s\n", ip)
+	case ip.Floating != nil:
+		fmt.Printf("INFO: %s %s.\n", ip, wasOrWouldBe(client, "assigned to "+server.Name))
+	default:
+		fmt.Printf("INFO: %s %s, so it is kept when its server is deleted.\n", ip, wasOrWouldBe(client, "updated"))
+	}
+	if client.DryRun() && status != hcloud.EnsureExisted {
+		return nil
+	}
+	printControlPlaneAddrHint(ip)
+	return nil
+}
 
+// ReleaseControlPlaneIP deletes the control plane IP allocated by AllocateControlPlaneIP
+// (destructive: the address goes back to Hetzner and every worker and kubeconfig using it
+// breaks). A primary IP that is still assigned to a server is refused; it is deleted with
+// the server if you re-enable its auto delete in the Hetzner Cloud Console.
+// Usage: mage releaseControlPlaneIP
+func ReleaseControlPlaneIP(ctx context.Context) error {
+	client, err := newHcloudClient()
 	if err != nil {
-		return fmt.Errorf("failed to create server: %w", err)
+		return err
 	}
-
-	fmt.Printf("INFO: Server %s recreated successfully.\n", serverName)
+	ip, err := getControlPlaneIP(ctx, client)
+	if err != nil {
+		return err
+	}
+	if ip == nil {
+		fmt.Printf("INFO: No control plane IP named %s exists, nothing to do.\n", cfg.ControlPlaneIPName)
+		return nil
+	}
+	if ip.Primary != nil && ip.Primary.AssigneeID != nil {
+		return fmt.Errorf("ERROR: refusing to release %s because it is assigned to server %d; a primary IP can only be deleted once it is unassigned", ip, *ip.Primary.AssigneeID)
+	}
+	if err := confirmDestructive("release the control plane IP", cfg.ControlPlaneIPName); err != nil {
+		return err
+	}
+	if ip.Primary != nil {
+		err = client.DeletePrimaryIP(ctx, ip.Primary.ID)
+	} else {
+		err = client.DeleteFloatingIP(ctx, ip.Floating.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", ip, err)
+	}
+	if run.DryRun() {
+		fmt.Printf("INFO: Dry run: %s was not actually released.\n", ip)
+		return nil
+	}
+	fmt.Printf("INFO: Released %s. Update K3S_CONTROL_PLANE_ADDR before deploying nodes again.\n", ip)
 	return nil
 }
 
 // DeleteAndRedeployServer deletes an existing server, recreates it, and then deploys NixOS to it.
 // This combines RecreateServer and RecreateNode into a single operation.
-// Usage: mage deleteAndRedeployServer <serverName> <flakeConfigName> <ipv4Enabled (optional)>
-// Example: mage deleteAndRedeployServer cpx21-control-1 cpx21-control-1 true
-func DeleteAndRedeployServer(serverName string, flakeConfigName string, ipv4Enabled string) error {
+// The server parameters come from the hetzner block of flakeConfigName in machines.nix.
+// The node is down until the installation finishes; ReplaceServer avoids that.
+// Usage: mage deleteAndRedeployServer <serverName> <flakeConfigName>
+// Example: mage deleteAndRedeployServer cpx21-control-1 cpx21-control-1
+func DeleteAndRedeployServer(ctx context.Context, serverName string, flakeConfigName string) error {
 	fmt.Printf("INFO: Starting complete redeployment of server %s with flake config %s\n", serverName, flakeConfigName)
 
+	node, err := getNode(flakeConfigName)
+	if err != nil {
+		return err
+	}
+
 	// Step 1: Recreate the server (deletes and creates)
-	if err := RecreateServer(serverName, ipv4Enabled); err != nil {
+	server, err := recreateServer(ctx, serverName, node)
+	if err != nil {
 		return fmt.Errorf("failed to recreate server: %w", err)
 	}
+	fmt.Printf("INFO: New server %s has public IPv4 %q and public IPv6 %q\n", serverName, server.PublicIPv4(), server.PublicIPv6())
 
 	// Wait for the server to boot up and become available for SSH
 	fmt.Println("INFO: Waiting for server to be fully up and SSHable...")
-	// A simple sleep might not be enough. Consider a loop with ssh checks.
-	sh.Run("sleep", "60") // Increased wait time, adjust as needed
+	sshClient, err := newSSHClient()
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	addr, err := resolveNode(ctx, sshClient, node, false)
+	if err != nil {
+		return err
+	}
+	targetHostVal, targetIP := addr.Target, addr.Host
+	if !run.DryRun() && addr.Jump == "" && net.ParseIP(targetIP) != nil && !serverHasAddress(server, targetIP) {
+		fmt.Printf("WARNING: Deploy target %s for '%s' does not match the new server's public IPs. Update its sshHostname if the IP changed.\n", targetIP, flakeConfigName)
+	}
+	// recreateServer asked for confirmation before deleting the old server and forgot its
+	// host key; pin the new server's one.
+	sshClient.AcceptNew(targetIP)
+	if err := waitForSSH(ctx, targetIP, targetHostVal, sshClient); err != nil {
+		return fmt.Errorf("server %s did not become reachable over SSH: %w", serverName, err)
+	}
 
 	// Step 2: Deploy NixOS to the server using nixos-anywhere
 	// Note: RecreateNode will get the SSH details from the flake config for flakeConfigName
-	if err := RecreateNode(flakeConfigName); err != nil {
+	if err := RecreateNode(ctx, flakeConfigName); err != nil {
 		return fmt.Errorf("failed to deploy NixOS to server: %w", err)
 	}
 
@@ -412,20 +1040,73 @@ func DeleteAndRedeployServer(serverName string, flakeConfigName string, ipv4Enab
 	return nil
 }
 
-// DecryptSecrets decrypts the sops.secrets.yaml file and prints its content.
+// ReplaceServer replaces a Hetzner Cloud server without taking it down first, unlike
+// DeleteAndRedeployServer which deletes it before the new one is installed:
+//  1. a new server is created as <serverName>-next with the parameters from machines.nix;
+//  2. NixOS is installed on it with nixos-anywhere. The old machine's k3s node password is
+//     copied over, so k3s accepts the new machine under the same node name;
+//  3. mage waits for k3s to run on the new server and for the node to be Ready;
+//  4. the old server is snapshotted (with MAGE_SNAPSHOT_BEFORE_DELETE), powered off and
+//     deleted. Its floating IPs, primary IPs and volumes move to the new server, which is
+//     renamed to serverName and given the labels from machines.nix.
+//
+// Until step 4 the old server is untouched, so a failure only leaves <serverName>-next to
+// delete. The control-init node cannot be replaced this way, because it starts k3s with
+// --cluster-init and would form a new cluster.
+// Usage: mage replaceServer <serverName> <flakeConfigName>
+// Example: mage replaceServer cpx21-control-2 cpx21-control-2
+func ReplaceServer(ctx context.Context, serverName string, flakeConfigName string) error {
+	node, err := getNode(flakeConfigName)
+	if err != nil {
+		return err
+	}
+	return replaceServer(ctx, serverName, node)
+}
+
+// Config prints the effective configuration: every variable mage reads, its value (secrets
+// masked) and whether it came from .env, the environment or a default.
+// Usage: mage config
+func Config() error {
+	return cfg.Print(os.Stdout)
+}
+
+// EnvLint reports drift between the environment variables the project reads and
+// .env.example / .env: variables read by magefile.go, the internal packages or a getEnv
+// call in the Nix files but not documented in .env.example, variables documented (or set
+// in .env) but never read, and documented variables missing from .env.
+// It fails if any drift is found, so it can run in CI.
+// Usage: mage envLint
+func EnvLint() error {
+	envFile := cfg.Cluster().EnvFile()
+	report, err := envlint.Run(".", ".env.example", envFile)
+	if err != nil {
+		return err
+	}
+	if err := report.Write(os.Stdout, ".env.example", envFile); err != nil {
+		return err
+	}
+	if !report.Clean() {
+		return fmt.Errorf("ERROR: found %d undocumented, %d unused and %d missing environment variables",
+			len(report.Undocumented), len(report.Unused), len(report.Missing))
+	}
+	fmt.Printf("INFO: .env.example is in sync with the %d variables read by the project\n", len(report.Referenced))
+	return nil
+}
+
+// DecryptSecrets decrypts the sops secrets file of the active cluster (sops.secrets.yaml,
+// or sops.secrets.<cluster>.yaml with MAGE_CLUSTER) and prints its content.
 // Requires the AGE_PRIVATE_KEY environment variable to be set.
 // Usage: mage DecryptSecrets
 func DecryptSecrets() error {
-	fmt.Println("INFO: Decrypting sops.secrets.yaml...")
+	sopsFile := cfg.Cluster().SopsFile()
+	fmt.Printf("INFO: Decrypting %s...\n", sopsFile)
 
 	// The init() function should have loaded AGE_PRIVATE_KEY from .env
-	ageKey := os.Getenv("AGE_PRIVATE_KEY")
-	if ageKey == "" {
-		// Check again, in case init() didn't run or .env was missing the key
-		fmt.Println("ERROR: AGE_PRIVATE_KEY environment variable is not set.")
+	if err := cfg.Require("decryptSecrets", "AGE_PRIVATE_KEY"); err != nil {
 		fmt.Println("Please ensure it is defined in your .env file and you have run 'direnv allow' or manually exported it.")
-		return fmt.Errorf("AGE_PRIVATE_KEY not set")
+		return err
 	}
+	ageKey := cfg.AgePrivateKey
 
 	// sops expects the key in SOPS_AGE_KEY, so we set it for the sops command.
 	env := map[string]string{
@@ -433,9 +1114,9 @@ func DecryptSecrets() error {
 	}
 
 	// Run the sops decrypt command
-	err := sh.RunWithV(env, "sops", "--decrypt", "sops.secrets.yaml")
+	err := run.RunWithV(env, "sops", "--decrypt", sopsFile)
 	if err != nil {
-		return fmt.Errorf("failed to decrypt sops.secrets.yaml: %w", err)
+		return fmt.Errorf("failed to decrypt %s: %w", sopsFile, err)
 	}
 
 	fmt.Println("INFO: Decryption complete.")
@@ -451,37 +1132,2434 @@ var Check = CheckFlake
 // Helper Functions
 // -----------------------------------------------------------------------------
 
-// getFlakeDeployTarget evaluates the flake to get the deploy.nodes.<name>.sshHostname
-// and sshUser attributes and returns them in user@host format.
-func getFlakeDeployTarget(flakeConfigName string) (string, error) {
-	// Evaluate the deploy.nodes.<name> attribute from the flake
+// cachedInventory holds the flake inventory once loadInventory has evaluated it, so targets
+// that need several nodes (or call each other) evaluate the flake only once per mage run.
+var cachedInventory *inventory.Inventory
+
+// loadInventory evaluates the flake's `inventory` output, which describes every machine in
+// machines.nix, and caches the result for the rest of the mage run.
+func loadInventory() (*inventory.Inventory, error) {
+	if cachedInventory != nil {
+		return cachedInventory, nil
+	}
+
 	// We need --impure because the flake uses getEnv
 	// We need --json to easily parse the result
 	// We need --show-trace for debugging evaluation errors
-	flakeAttrPath := fmt.Sprintf(".#deploy.nodes.%s", flakeConfigName)
-	fmt.Printf("INFO: Evaluating flake attribute '%s' to get deploy target...\n", flakeAttrPath)
+	flakeAttrPath := ".#inventory"
+	fmt.Printf("INFO: Evaluating flake attribute '%s' to get the machine inventory...\n", flakeAttrPath)
 
-	// Use sh.Output to capture the JSON output
-	jsonOutput, err := sh.Output("nix", "eval", "--json", "--impure", "--show-trace", flakeAttrPath)
+	// Use run.Query to capture the JSON output; evaluation is read-only, so it also runs in dry-run mode
+	jsonOutput, err := run.Query("nix", "eval", "--json", "--impure", "--show-trace", flakeAttrPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to evaluate flake attribute '%s': %w", flakeAttrPath, err)
+		return nil, fmt.Errorf("failed to evaluate flake attribute '%s': %w", flakeAttrPath, err)
 	}
 
-	// Parse the JSON output
-	var deployConfig struct {
-		SSHHostname string `json:"sshHostname"`
-		SSHUser     string `json:"sshUser"`
-	}
-	err = json.Unmarshal([]byte(jsonOutput), &deployConfig)
+	inv, err := inventory.Parse([]byte(jsonOutput))
 	if err != nil {
-		return "", fmt.Errorf("failed to parse JSON output from nix eval: %w", err)
+		return nil, fmt.Errorf("failed to parse JSON output from nix eval: %w", err)
 	}
+	cachedInventory = inv
+	return inv, nil
+}
 
-	if deployConfig.SSHHostname == "" || deployConfig.SSHUser == "" {
-		return "", fmt.Errorf("deploy target (sshHostname or sshUser) is empty for '%s'. Ensure it's defined in machines.nix and corresponding environment variables are set in .env", flakeConfigName)
+// getNode returns the inventory entry for the machine named flakeConfigName.
+func getNode(flakeConfigName string) (inventory.Node, error) {
+	inv, err := loadInventory()
+	if err != nil {
+		return inventory.Node{}, err
 	}
+	return inv.Get(flakeConfigName)
+}
+
+// Sources of a node's SSH address, listed in MAGE_SSH_ADDRESS_ORDER.
+const (
+	addressSourceTailscale = "tailscale" // the node's Tailscale IP, if it is online in the tailnet
+	addressSourceMachines  = "machines"  // deploy.sshHostname in machines.nix
+	addressSourceHetzner   = "hetzner"   // the public IP of the node's Hetzner Cloud server
+)
 
-	return fmt.Sprintf("%s@%s", deployConfig.SSHUser, deployConfig.SSHHostname), nil
+// nodeAddress is where resolveNode found a node.
+type nodeAddress struct {
+	Target string // user@host
+	Host   string
+	Source string // one of the addressSource constants
+	Jump   string // user@host of the bastion the connection goes through, or ""
+}
+
+// resolveNode looks up the SSH address of node from the sources in MAGE_SSH_ADDRESS_ORDER
+// (default tailscale,machines,hetzner), using the first that has one:
+//   - tailscale: the node's Tailscale IPv4, if this machine and the node are online in the
+//     tailnet. It does not change when a server is recreated and reaches machines behind NAT.
+//     Skipped if allowTailscale is false, e.g. for the NixOS installer, which is not on the
+//     tailnet.
+//   - machines: deploy.sshHostname in machines.nix.
+//   - hetzner: the public IP of the Hetzner Cloud server named like the node, if HCLOUD_TOKEN
+//     is set.
+//
+// The user is deploy.sshUser, or root. Unless the address is a Tailscale one, the connection
+// is tunnelled through the node's sshJumpHost or MAGE_SSH_JUMP_HOST, if set: a node name
+// (resolved the same way) or user@host[:port]. The route is registered with sshClient, which
+// pins the host key under the node's name, so it stays valid whichever address is used.
+func resolveNode(ctx context.Context, sshClient *sshclient.Client, node inventory.Node, allowTailscale bool) (nodeAddress, error) {
+	return resolveNodeVia(ctx, sshClient, node, allowTailscale, map[string]bool{})
+}
+
+func resolveNodeVia(ctx context.Context, sshClient *sshclient.Client, node inventory.Node, allowTailscale bool, seen map[string]bool) (nodeAddress, error) {
+	if seen[node.Name] {
+		return nodeAddress{}, fmt.Errorf("ERROR: the jump hosts of '%s' form a loop", node.Name)
+	}
+	seen[node.Name] = true
+
+	user := node.SSHUser
+	if user == "" {
+		user = "root"
+	}
+	addr := nodeAddress{}
+	var tried []string
+	for _, source := range strings.Split(cfg.SSHAddressOrder, ",") {
+		source = strings.TrimSpace(source)
+		var host string
+		var err error
+		switch source {
+		case addressSourceTailscale:
+			if !allowTailscale {
+				continue
+			}
+			host, err = tailscaleAddress(ctx, node.Name)
+		case addressSourceMachines:
+			if config.IsPlaceholder(node.SSHHostname) {
+				err = fmt.Errorf("sshHostname '%s' is a placeholder", node.SSHHostname)
+			} else {
+				host = node.SSHHostname
+			}
+		case addressSourceHetzner:
+			host, err = hetznerAddress(ctx, node)
+		case "":
+			continue
+		default:
+			return nodeAddress{}, fmt.Errorf("ERROR: unknown address source '%s' in MAGE_SSH_ADDRESS_ORDER, use %s, %s or %s", source, addressSourceTailscale, addressSourceMachines, addressSourceHetzner)
+		}
+		if err != nil {
+			tried = append(tried, fmt.Sprintf("%s: %v", source, err))
+			continue
+		}
+		if host != "" {
+			addr = nodeAddress{Target: user + "@" + host, Host: host, Source: source}
+			break
+		}
+		tried = append(tried, source+": none set")
+	}
+	if addr.Target == "" {
+		return nodeAddress{}, fmt.Errorf("ERROR: found no SSH address for '%s' (MAGE_SSH_ADDRESS_ORDER=%s): %s. Set its sshHostname in machines.nix", node.Name, cfg.SSHAddressOrder, strings.Join(tried, "; "))
+	}
+
+	// The tailnet reaches the node directly.
+	jump := node.SSHJumpHost
+	if jump == "" {
+		jump = cfg.SSHJumpHost
+	}
+	if addr.Source != addressSourceTailscale && jump != "" && jump != node.Name {
+		inv, err := loadInventory()
+		if err != nil {
+			return nodeAddress{}, err
+		}
+		if bastion, err := inv.Get(jump); err != nil {
+			addr.Jump = jump // user@host[:port]
+		} else {
+			bastionAddr, err := resolveNodeVia(ctx, sshClient, bastion, true, seen)
+			if err != nil {
+				return nodeAddress{}, fmt.Errorf("failed to resolve jump host '%s' of '%s': %w", jump, node.Name, err)
+			}
+			addr.Jump = bastionAddr.Target
+		}
+	}
+
+	if err := routeHost(sshClient, addr.Host, node.Name, addr.Jump); err != nil {
+		return nodeAddress{}, err
+	}
+	// Keys pinned before they were pinned by node name are under the sshHostname.
+	if node.SSHHostname != "" {
+		if err := adoptHostKey(sshClient, node.SSHHostname, node.Name); err != nil {
+			fmt.Printf("WARNING: %v\n", err)
+		}
+	}
+	via := ""
+	if addr.Jump != "" {
+		via = " via " + addr.Jump
+	}
+	fmt.Printf("INFO: Reaching '%s' at %s (%s)%s\n", node.Name, addr.Target, addr.Source, via)
+	return addr, nil
+}
+
+// routeHost makes sshClient pin the host key of host under alias and tunnel connections to
+// it through jump (user@host, or "" for none).
+func routeHost(sshClient *sshclient.Client, host, alias, jump string) error {
+	if jump != "" && sshclient.Addr(jump) == sshclient.Addr(host) {
+		return fmt.Errorf("ERROR: %s cannot be its own jump host", host)
+	}
+	sshClient.SetRoute(host, sshclient.Route{HostKeyAlias: alias, Jump: jump})
+	return nil
+}
+
+// adoptHostKey pins the host keys pinned for host under alias as well, if none are pinned
+// for alias yet.
+func adoptHostKey(sshClient *sshclient.Client, host, alias string) error {
+	knownHosts := sshClient.KnownHosts()
+	pinned, err := knownHosts.Lookup(sshclient.Addr(alias))
+	if err != nil || len(pinned) > 0 {
+		return err
+	}
+	keys, err := knownHosts.Lookup(sshclient.Addr(host))
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	if run.DryRun() {
+		run.Record("pin the SSH host key of %s for %s in %s", host, alias, knownHosts.Path)
+		return nil
+	}
+	for _, key := range keys {
+		if err := knownHosts.Add(sshclient.Addr(alias), key); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("INFO: Pinned the SSH host key of %s under the node name %s in %s\n", host, alias, knownHosts.Path)
+	return nil
+}
+
+// tailscaleStatusCache holds the tailnet status for the rest of the mage run, once loaded.
+var (
+	tailscaleStatusCache *tailscale.Status
+	tailscaleStatusErr   error
+)
+
+// tailscaleAddress returns the Tailscale IPv4 of the machine named name if it is online in
+// the tailnet, or "" if it is not in the tailnet. The status comes from `tailscale status
+// --json`, or from the local API of tailscaled if the CLI is not installed.
+func tailscaleAddress(ctx context.Context, name string) (string, error) {
+	if tailscaleStatusCache == nil && tailscaleStatusErr == nil {
+		var status *tailscale.Status
+		out, err := run.Query("tailscale", "status", "--json")
+		if err == nil {
+			status, err = tailscale.ParseStatus([]byte(out))
+		} else {
+			var apiErr error
+			if status, apiErr = tailscale.LocalAPIStatus(ctx, tailscale.DefaultSocket); apiErr != nil {
+				err = fmt.Errorf("%v; %w", err, apiErr)
+			} else {
+				err = nil
+			}
+		}
+		if err == nil && !status.Running() {
+			err = fmt.Errorf("this machine is not connected to the tailnet (state %s)", status.BackendState)
+		}
+		tailscaleStatusCache, tailscaleStatusErr = status, err
+	}
+	if tailscaleStatusErr != nil {
+		return "", tailscaleStatusErr
+	}
+	peer := tailscaleStatusCache.Find(name)
+	if peer == nil {
+		return "", nil
+	}
+	if !peer.Online {
+		return "", fmt.Errorf("%s is offline", peer.MagicDNSName())
+	}
+	if peer.IPv4() != "" {
+		fmt.Printf("INFO: '%s' is %s (%s) in the tailnet\n", name, peer.MagicDNSName(), peer.IPv4())
+	}
+	return peer.IPv4(), nil
+}
+
+// hetznerAddress returns the public IP of the Hetzner Cloud server of node, or "" if it has
+// none. Only Hetzner nodes are looked up, and only if HCLOUD_TOKEN is set.
+func hetznerAddress(ctx context.Context, node inventory.Node) (string, error) {
+	if node.Location != inventory.LocationHetzner || cfg.HcloudToken == "" {
+		return "", nil
+	}
+	client, err := newHcloudClient()
+	if err != nil {
+		return "", err
+	}
+	server, err := client.GetServerByName(ctx, node.Name)
+	if err != nil || server == nil {
+		return "", err
+	}
+	return serverSSHHost(server), nil
+}
+
+// nodeConfigVars are the variables baked into a node's NixOS configuration by flake.nix.
+// flake.nix falls back to placeholder values for the first two, so they must be set.
+var nodeConfigVars = []string{
+	"ADMIN_SSH_PUBLIC_KEY",
+	"K3S_CONTROL_PLANE_ADDR",
+	"K3S_TOKEN",
+	"TAILSCALE_AUTH_KEY",
+	"AGE_PRIVATE_KEY",
+}
+
+// validateNodeConfig checks the configuration before a node is deployed or installed:
+// ADMIN_SSH_PUBLIC_KEY, K3S_CONTROL_PLANE_ADDR and the extra required variables must be
+// set, none of nodeConfigVars may be a placeholder from .env.example or malformed, and
+// the node's SSH hostname and user from machines.nix must not be placeholders either.
+func validateNodeConfig(purpose, flakeConfigName string, required ...string) error {
+	required = append([]string{"ADMIN_SSH_PUBLIC_KEY", "K3S_CONTROL_PLANE_ADDR"}, required...)
+	if err := cfg.Require(purpose, required...); err != nil {
+		return err
+	}
+	if err := cfg.Validate(nodeConfigVars...); err != nil {
+		return err
+	}
+
+	node, err := getNode(flakeConfigName)
+	if err != nil {
+		return err
+	}
+	if config.IsPlaceholder(node.SSHHostname) || config.IsPlaceholder(node.SSHUser) {
+		return fmt.Errorf("ERROR: the SSH hostname or user of '%s' is still a placeholder ('%s@%s'), set its *_SSH_HOSTNAME and *_SSH_USER variables in .env", flakeConfigName, node.SSHUser, node.SSHHostname)
+	}
+	return nil
+}
+
+// confirmedTargets records the names already confirmed during this mage run, so composite
+// targets such as DeleteAndRedeployServer only ask once.
+var confirmedTargets = map[string]bool{}
+
+// guardDestructive runs the safety checks before a destructive action on the machine or
+// server called name:
+//   - protected nodes (`protected = true;` in machines.nix, or listed in MAGE_PROTECTED_NODES)
+//     are refused unless MAGE_ALLOW_PROTECTED lists the name;
+//   - the only control-init node is refused outright while it is live and the inventory
+//     defines no other control plane, since destroying it destroys the cluster;
+//   - the user must type the name to confirm, unless MAGE_YES=1.
+//
+// isLive reports whether the machine currently exists or runs k3s; it is only called for
+// the last-control-plane check.
+func guardDestructive(action, name string, isLive func() bool) error {
+	// Always say which cluster is about to be changed, even when the action is refused or no prompt follows.
+	fmt.Printf("INFO: Active %s\n", cfg.Cluster().Describe())
+	var node *inventory.Node
+	inv, err := loadInventory()
+	if err != nil {
+		fmt.Printf("WARNING: Could not load the machine inventory, only MAGE_PROTECTED_NODES is checked: %v\n", err)
+	} else if n, err := inv.Get(name); err == nil {
+		node = &n
+	}
+
+	protected := listContains(cfg.ProtectedNodes, name) || (node != nil && node.Protected)
+	if protected {
+		if !listContains(cfg.AllowProtected, name) {
+			return fmt.Errorf("ERROR: refusing to %s '%s' because it is protected. Set MAGE_ALLOW_PROTECTED=%s to override", action, name, name)
+		}
+		fmt.Printf("WARNING: '%s' is protected, continuing because MAGE_ALLOW_PROTECTED includes it\n", name)
+	}
+
+	if node != nil && node.NodeType == inventory.NodeTypeControlInit {
+		otherControlPlanes := 0
+		for _, cp := range inv.ControlPlanes() {
+			if cp.Name != name {
+				otherControlPlanes++
+			}
+		}
+		if otherControlPlanes == 0 && isLive() {
+			return fmt.Errorf("ERROR: refusing to %s '%s' because it is the only control plane of the cluster and is still running. Add another control plane node first", action, name)
+		}
+	}
+
+	return confirmDestructive(action, name)
+}
+
+// confirmDestructive asks the user to type name before a destructive action. MAGE_YES=1
+// skips the prompt for automation; in dry-run mode nothing is destroyed, so no prompt is shown.
+func confirmDestructive(action, name string) error {
+	if confirmedTargets[name] {
+		return nil
+	}
+	if run.DryRun() {
+		run.Record("ask for confirmation to %s '%s'", action, name)
+		return nil
+	}
+	if cfg.Yes {
+		fmt.Printf("INFO: MAGE_YES is set, not asking for confirmation to %s '%s'\n", action, name)
+		confirmedTargets[name] = true
+		return nil
+	}
+
+	fmt.Printf("WARNING: This will %s '%s' in cluster '%s'. This cannot be undone.\n", action, name, cfg.Cluster())
+	fmt.Printf("Type the name '%s' to confirm: ", name)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return fmt.Errorf("ERROR: no confirmation received (set MAGE_YES=1 to skip the prompt in automation): %w", err)
+	}
+	if strings.TrimSpace(answer) != name {
+		return fmt.Errorf("ERROR: confirmation did not match '%s', aborting", name)
+	}
+	confirmedTargets[name] = true
+	return nil
+}
+
+// listContains reports whether the comma- or space-separated list contains name.
+func listContains(list, name string) bool {
+	for _, item := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newHcloudClient returns a Hetzner Cloud API client authenticated with HCLOUD_TOKEN.
+// HCLOUD_ENDPOINT overrides the API URL (the hcloud CLI honours the same variable).
+func newHcloudClient() (*hcloud.Client, error) {
+	if err := cfg.Require("the Hetzner Cloud API", "HCLOUD_TOKEN"); err != nil {
+		return nil, err
+	}
+	// A custom endpoint (e.g. cmd/hcloud-fake) accepts any token, so only the placeholder
+	// check applies there.
+	if err := cfg.Validate("HCLOUD_TOKEN"); err != nil && (cfg.HcloudEndpoint == "" || config.IsPlaceholder(cfg.HcloudToken)) {
+		return nil, err
+	}
+
+	var opts []hcloud.ClientOption
+	if cfg.HcloudEndpoint != "" {
+		fmt.Printf("INFO: Using Hetzner Cloud API endpoint %s\n", cfg.HcloudEndpoint)
+		opts = append(opts, hcloud.WithEndpoint(cfg.HcloudEndpoint))
+	}
+	if run.DryRun() {
+		opts = append(opts, hcloud.WithDryRun(func(method, path string, body []byte) {
+			if len(body) > 0 {
+				run.Record("call Hetzner Cloud API: %s %s %s", method, path, body)
+			} else {
+				run.Record("call Hetzner Cloud API: %s %s", method, path)
+			}
+		}))
+	}
+	return hcloud.NewClient(cfg.HcloudToken, opts...), nil
+}
+
+// tailnetRanges are the address ranges Tailscale assigns to nodes (CGNAT IPv4 and the
+// Tailscale ULA IPv6 prefix).
+var tailnetRanges = []string{"100.64.0.0/10", "fd7a:115c:a1e0::/48"}
+
+// anyIP matches all IPv4 and IPv6 addresses in a firewall rule.
+var anyIP = []string{"0.0.0.0/0", "::/0"}
+
+// desiredFirewallRules returns the inbound rules of the cluster firewall (see EnsureFirewall).
+func desiredFirewallRules() ([]hcloud.FirewallRule, error) {
+	if err := cfg.Require("the firewall", "ADMIN_PUBLIC_IP"); err != nil {
+		return nil, err
+	}
+	adminCIDRs, err := parseCIDRList(cfg.AdminPublicIP)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: invalid ADMIN_PUBLIC_IP: %w", err)
+	}
+	privateCIDRs, err := parseCIDRList(cfg.PrivateNetworkIPRange)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: invalid PRIVATE_NETWORK_IP_RANGE: %w", err)
+	}
+
+	return []hcloud.FirewallRule{
+		{
+			Direction:   hcloud.FirewallRuleDirectionIn,
+			Protocol:    hcloud.FirewallRuleProtocolTCP,
+			Port:        "22",
+			SourceIPs:   adminCIDRs,
+			Description: "SSH from the admin IP",
+		},
+		{
+			Direction:   hcloud.FirewallRuleDirectionIn,
+			Protocol:    hcloud.FirewallRuleProtocolUDP,
+			Port:        "41641",
+			SourceIPs:   anyIP,
+			Description: "Tailscale direct connections",
+		},
+		{
+			Direction:   hcloud.FirewallRuleDirectionIn,
+			Protocol:    hcloud.FirewallRuleProtocolTCP,
+			Port:        "6443",
+			SourceIPs:   append(privateCIDRs, tailnetRanges...),
+			Description: "k3s API from the private network and the tailnet",
+		},
+	}, nil
+}
+
+// parseCIDRList parses a comma- or space-separated list of IPs and CIDRs into CIDRs in the
+// canonical form the Hetzner API expects. A bare IP becomes a /32 (or /128 for IPv6).
+func parseCIDRList(list string) ([]string, error) {
+	var cidrs []string
+	for _, item := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if ip := net.ParseIP(item); ip != nil {
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not an IP address or CIDR", item)
+		}
+		cidrs = append(cidrs, ipNet.String())
+	}
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no IP addresses given")
+	}
+	return cidrs, nil
+}
+
+// ensureFirewall creates the FIREWALL_NAME firewall or reconciles its rules. It returns the
+// firewall and whether it existed, was created or was updated.
+func ensureFirewall(ctx context.Context, client *hcloud.Client) (*hcloud.Firewall, hcloud.EnsureStatus, error) {
+	if err := cfg.Require("ensureFirewall", "FIREWALL_NAME"); err != nil {
+		return nil, "", err
+	}
+	rules, err := desiredFirewallRules()
+	if err != nil {
+		return nil, "", err
+	}
+
+	firewall, status, err := client.EnsureFirewall(ctx, hcloud.FirewallCreateOpts{Name: cfg.FirewallName, Rules: rules})
+	if err != nil {
+		return nil, "", err
+	}
+	switch {
+	case status == hcloud.EnsureExisted:
+		fmt.Printf("INFO: Firewall %s (ID %d) already has the desired rules.\n", firewall.Name, firewall.ID)
+	case client.DryRun() && status == hcloud.EnsureCreated:
+		fmt.Printf("INFO: Firewall %s does not exist and would be created.\n", firewall.Name)
+	case client.DryRun():
+		fmt.Printf("INFO: Firewall %s (ID %d) rules differ from the desired rules and would be updated.\n", firewall.Name, firewall.ID)
+	case status == hcloud.EnsureCreated:
+		fmt.Printf("INFO: Firewall %s created (ID %d).\n", firewall.Name, firewall.ID)
+	default:
+		fmt.Printf("INFO: Firewall %s (ID %d) rules differed from the desired rules and were updated.\n", firewall.Name, firewall.ID)
+	}
+	return firewall, status, nil
+}
+
+// hetznerInfra holds the shared Hetzner Cloud resources that servers are created with.
+type hetznerInfra struct {
+	Network        *hcloud.Network
+	PlacementGroup *hcloud.PlacementGroup
+	SSHKey         *hcloud.SSHKey
+	Firewall       *hcloud.Firewall // nil if FIREWALL_NAME is not set
+}
+
+// cachedInfra holds the results of ensureInfra by location, so it runs at most once per
+// location and mage run.
+var cachedInfra = map[string]*hetznerInfra{}
+
+// ensureInfra makes sure the shared resources exist (see EnsureInfra), creating the missing
+// ones, prints a summary of what existed and what was created, and returns them.
+func ensureInfra(ctx context.Context, client *hcloud.Client, locationName string) (*hetznerInfra, error) {
+	if infra, ok := cachedInfra[locationName]; ok {
+		return infra, nil
+	}
+	if err := cfg.Require("ensureInfra", "HETZNER_SSH_KEY_NAME"); err != nil {
+		return nil, err
+	}
+
+	type row struct {
+		kind, name string
+		status     hcloud.EnsureStatus
+	}
+	var summary []row
+	infra := &hetznerInfra{}
+
+	// 1. Private network with a subnet in the network zone of the location
+	location, err := client.GetLocationByName(ctx, locationName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up location %s: %w", locationName, err)
+	}
+	if location == nil {
+		return nil, fmt.Errorf("ERROR: '%s' is not a Hetzner Cloud location (e.g. fsn1, nbg1, hel1, ash, hil, sin)", locationName)
+	}
+	subnet := hcloud.NetworkSubnet{
+		Type:        hcloud.NetworkSubnetTypeCloud,
+		IPRange:     cfg.PrivateSubnetIPRange,
+		NetworkZone: location.NetworkZone,
+	}
+
+	network, status, err := client.EnsureNetwork(ctx, hcloud.NetworkCreateOpts{
+		Name:    cfg.PrivateNetworkName,
+		IPRange: cfg.PrivateNetworkIPRange,
+		Subnets: []hcloud.NetworkSubnet{subnet},
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case hcloud.EnsureCreated:
+		fmt.Printf("INFO: Private network %s %s with subnet %s in %s.\n", network.Name, wasOrWouldBe(client, "created"), subnet.IPRange, subnet.NetworkZone)
+	case hcloud.EnsureUpdated:
+		fmt.Printf("INFO: Subnet %s in network zone %s %s to private network %s.\n", subnet.IPRange, subnet.NetworkZone, wasOrWouldBe(client, "added"), network.Name)
+	}
+	infra.Network = network
+	summary = append(summary, row{"network", cfg.PrivateNetworkName, status})
+
+	// 2. Spread placement group
+	placementGroup, status, err := client.EnsurePlacementGroup(ctx, hcloud.PlacementGroupCreateOpts{
+		Name: cfg.PlacementGroupName,
+		Type: hcloud.PlacementGroupTypeSpread,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if status == hcloud.EnsureCreated {
+		fmt.Printf("INFO: Placement group %s %s.\n", placementGroup.Name, wasOrWouldBe(client, "created"))
+	} else if placementGroup.Type != hcloud.PlacementGroupTypeSpread {
+		fmt.Printf("WARNING: Placement group %s has type '%s', not '%s'\n", placementGroup.Name, placementGroup.Type, hcloud.PlacementGroupTypeSpread)
+	}
+	infra.PlacementGroup = placementGroup
+	summary = append(summary, row{"placement group", cfg.PlacementGroupName, status})
+
+	// 3. Admin SSH key, uploaded from ADMIN_SSH_PUBLIC_KEY
+	sshKey, status, err := ensureSSHKey(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	infra.SSHKey = sshKey
+	summary = append(summary, row{"ssh key", cfg.HetznerSSHKeyName, status})
+
+	// 4. Firewall, if configured
+	if cfg.FirewallName != "" {
+		firewall, status, err := ensureFirewall(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		infra.Firewall = firewall
+		summary = append(summary, row{"firewall", cfg.FirewallName, status})
+	} else {
+		fmt.Println("WARNING: FIREWALL_NAME is not set, new servers will not be protected by a Hetzner Cloud firewall")
+	}
+
+	fmt.Println("INFO: Hetzner Cloud infrastructure:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  RESOURCE\tNAME\tSTATUS")
+	for _, r := range summary {
+		if client.DryRun() && r.status != hcloud.EnsureExisted {
+			r.status = "would be " + r.status
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", r.kind, r.name, r.status)
+	}
+	tw.Flush()
+
+	cachedInfra[locationName] = infra
+	return infra, nil
+}
+
+// ensureSSHKey uploads ADMIN_SSH_PUBLIC_KEY as HETZNER_SSH_KEY_NAME unless a key with that
+// name exists. The API refuses to store the same key twice, so if it was uploaded under
+// another name, the error says which name to use instead.
+func ensureSSHKey(ctx context.Context, client *hcloud.Client) (*hcloud.SSHKey, hcloud.EnsureStatus, error) {
+	if cfg.AdminSSHPublicKey == "" {
+		// Without a public key to upload, the key must already exist.
+		sshKey, err := client.GetSSHKeyByName(ctx, cfg.HetznerSSHKeyName)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to look up SSH key %s: %w", cfg.HetznerSSHKeyName, err)
+		}
+		if sshKey == nil {
+			return nil, "", cfg.Require("uploading the SSH key "+cfg.HetznerSSHKeyName, "ADMIN_SSH_PUBLIC_KEY")
+		}
+		return sshKey, hcloud.EnsureExisted, nil
+	}
+	if err := cfg.Validate("ADMIN_SSH_PUBLIC_KEY"); err != nil {
+		return nil, "", err
+	}
+	fingerprint, err := hcloud.SSHKeyFingerprint(cfg.AdminSSHPublicKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sshKey, status, err := client.EnsureSSHKey(ctx, hcloud.SSHKeyCreateOpts{Name: cfg.HetznerSSHKeyName, PublicKey: cfg.AdminSSHPublicKey})
+	var duplicate *hcloud.DuplicateSSHKeyError
+	if errors.As(err, &duplicate) {
+		return nil, "", fmt.Errorf("ERROR: ADMIN_SSH_PUBLIC_KEY is already uploaded to Hetzner Cloud as '%s', set HETZNER_SSH_KEY_NAME=%s", duplicate.Name, duplicate.Name)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if status == hcloud.EnsureCreated {
+		fmt.Printf("INFO: SSH key %s %s from ADMIN_SSH_PUBLIC_KEY.\n", sshKey.Name, wasOrWouldBe(client, "uploaded"))
+	} else if sshKey.Fingerprint != fingerprint {
+		fmt.Printf("WARNING: SSH key %s in Hetzner Cloud is not ADMIN_SSH_PUBLIC_KEY (fingerprint %s, expected %s)\n", sshKey.Name, sshKey.Fingerprint, fingerprint)
+	}
+	return sshKey, status, nil
+}
+
+// wasOrWouldBe returns "was <participle>", or "would be <participle>" with a dry-run client.
+func wasOrWouldBe(client *hcloud.Client, participle string) string {
+	if client.DryRun() {
+		return "would be " + participle
+	}
+	return "was " + participle
+}
+
+// recreateServer deletes the Hetzner Cloud server named serverName (if it exists) and
+// creates it again. It returns the new server as reported by the API once all of its
+// provisioning actions have finished, so callers can use its assigned IPs.
+func recreateServer(ctx context.Context, serverName string, node inventory.Node) (*hcloud.Server, error) {
+	if node.Location != inventory.LocationHetzner {
+		return nil, fmt.Errorf("ERROR: machine '%s' has location '%s' in machines.nix, only '%s' machines run on Hetzner Cloud", node.Name, node.Location, inventory.LocationHetzner)
+	}
+
+	mg.SerialDeps(CheckFlake) // Ensure flake is valid before recreating the server
+
+	client, err := newHcloudClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// Check required configuration; the network, placement group and SSH key are created
+	// by ensureInfra below if they are missing.
+	if err := cfg.Require("recreateServer", "HETZNER_SSH_KEY_NAME"); err != nil {
+		return nil, err
+	}
+
+	// Server parameters come from the machine's hetzner block, with .env defaults
+	spec := serverSpec(node)
+	printServerSpec(node, spec)
+
+	fmt.Printf("INFO: Recreating server %s...\n", serverName)
+
+	existing, err := findServer(ctx, client, serverName, node)
+	if err != nil {
+		return nil, err
+	}
+
+	// The control-init node gets the control plane IP, if one was allocated, so the
+	// endpoint survives the recreation.
+	var endpoint *controlPlaneIP
+	if node.NodeType == inventory.NodeTypeControlInit {
+		if endpoint, err = getControlPlaneIP(ctx, client); err != nil {
+			return nil, err
+		}
+	}
+
+	// The server is created by location and the API picks a datacenter in it. Check that
+	// Hetzner will accept it before asking to delete the old one.
+	if err := preflightServer(ctx, client, serverName, spec, existing, endpoint); err != nil {
+		return nil, err
+	}
+	if err := guardDestructive("delete and recreate the server", serverName, func() bool { return existing != nil }); err != nil {
+		return nil, err
+	}
+	// Make sure the network, placement group, SSH key and firewall exist before anything is
+	// deleted. The create API takes IDs for networks, placement groups and firewalls.
+	infra, err := ensureInfra(ctx, client, spec.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes, automount, err := ensureVolumes(ctx, client, spec, existing)
+	if err != nil {
+		return nil, err
+	}
+	// Optionally snapshot the old server, so it can be restored with restoreServerSnapshot if
+	// creating the new one fails after the old one is gone.
+	if existing != nil && cfg.SnapshotBeforeDelete {
+		if _, err := snapshotServer(ctx, client, node.Name, existing); err != nil {
+			return nil, fmt.Errorf("failed to snapshot server %s before deleting it (unset MAGE_SNAPSHOT_BEFORE_DELETE to skip): %w", serverName, err)
+		}
+	}
+
+	// A primary IP with auto delete would be deleted together with the old server.
+	if endpoint != nil && endpoint.Primary != nil && endpoint.Primary.AutoDelete {
+		fmt.Printf("INFO: Disabling auto delete of %s, so it is kept when %s is deleted...\n", endpoint, serverName)
+		autoDelete := false
+		if _, err := client.UpdatePrimaryIP(ctx, endpoint.Primary.ID, hcloud.PrimaryIPUpdateOpts{AutoDelete: &autoDelete}); err != nil {
+			return nil, fmt.Errorf("failed to disable auto delete of %s: %w", endpoint, err)
+		}
+	}
+
+	// 1. Delete the existing server
+	fmt.Println("INFO: Deleting existing server...")
+	if existing != nil {
+		fmt.Printf("INFO: Found server %s (ID %d), deleting and waiting for the action to finish...\n", serverName, existing.ID)
+		if err := client.DeleteServerAndWait(ctx, existing.ID); err != nil {
+			return nil, fmt.Errorf("failed to delete server: %w", err)
+		}
+	}
+	fmt.Printf("INFO: Server %s deleted (or did not exist).\n", serverName)
+
+	// 2. Create a new server with the same properties
+	fmt.Println("INFO: Creating new server...")
+	opts := serverCreateOpts(serverName, spec, infra)
+	opts.Volumes, opts.Automount = volumes, automount
+	if endpoint != nil && endpoint.Primary != nil {
+		// A primary IP can only be used by servers in its datacenter.
+		fmt.Printf("INFO: Creating the server with %s\n", endpoint)
+		opts.Location, opts.Datacenter = "", endpoint.Primary.Datacenter.Name
+		opts.PublicNet.EnableIPv4, opts.PublicNet.IPv4 = true, &endpoint.Primary.ID
+	}
+	server, err := client.CreateServerAndWait(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create server: %w", err)
+	}
+	if endpoint != nil && endpoint.Floating != nil {
+		fmt.Printf("INFO: Assigning %s to %s...\n", endpoint, serverName)
+		if err := client.AssignFloatingIP(ctx, endpoint.Floating.ID, server.ID); err != nil {
+			return nil, fmt.Errorf("server %s was created, but assigning %s failed (assign it in the Hetzner Cloud Console): %w", serverName, endpoint, err)
+		}
+	}
+	// The new server has new SSH host keys, unless it was restored from a snapshot (whose
+	// image is an ID). Forget the pinned ones, so the installation pins the new keys.
+	if _, err := strconv.ParseInt(spec.Image, 10, 64); err != nil {
+		if err := forgetHostKeys(node.Name, server.PublicIPv4(), node.SSHHostname); err != nil {
+			fmt.Printf("WARNING: %v\n", err)
+		}
+	}
+
+	if run.DryRun() {
+		fmt.Printf("INFO: Dry run: server %s was not actually recreated.\n", serverName)
+		return server, nil
+	}
+
+	fmt.Printf("INFO: Server %s recreated successfully (ID %d).\n", serverName, server.ID)
+	fmt.Printf("INFO:   Public IPv4:  %s\n", valueOrNone(server.PublicIPv4()))
+	fmt.Printf("INFO:   Public IPv6:  %s\n", valueOrNone(server.PublicIPv6()))
+	fmt.Printf("INFO:   Private IP (%s): %s\n", infra.Network.Name, valueOrNone(server.PrivateIP(infra.Network.ID)))
+	if endpoint != nil {
+		fmt.Printf("INFO:   Control plane IP: %s\n", endpoint.Address())
+	}
+
+	// Prune only now that the new server exists; it may have been created from one of them.
+	if err := pruneSnapshots(ctx, client, node.Name, cfg.SnapshotRetention); err != nil {
+		fmt.Printf("WARNING: Failed to prune old snapshots of %s: %v\n", node.Name, err)
+	}
+	return server, nil
+}
+
+// Labels set on the snapshots taken by recreateServer, next to labelCluster.
+// restoreServerSnapshot and pruneSnapshots find a node's snapshots by node and cluster.
+const (
+	snapshotLabelNode    = "k3s-nixos/node"
+	snapshotLabelCreated = "k3s-nixos/created"
+)
+
+// snapshotSelector returns the label selector matching the snapshots of a node in the
+// active cluster.
+func snapshotSelector(nodeName string) string {
+	return fmt.Sprintf("%s=%s,%s=%s", snapshotLabelNode, nodeName, labelCluster, cfg.Cluster())
+}
+
+// snapshotServer takes a snapshot of server, labelled with the node name, the cluster and
+// a timestamp, and waits for it to finish. This can take several minutes for large disks.
+func snapshotServer(ctx context.Context, client *hcloud.Client, nodeName string, server *hcloud.Server) (*hcloud.Image, error) {
+	now := time.Now().UTC()
+	fmt.Printf("INFO: Taking a snapshot of server %s (ID %d) before deleting it, this can take a few minutes...\n", server.Name, server.ID)
+	image, err := client.CreateServerImage(ctx, server.ID, hcloud.ImageCreateOpts{
+		Type:        hcloud.ImageTypeSnapshot,
+		Description: fmt.Sprintf("%s before recreateServer at %s", nodeName, now.Format(time.RFC3339)),
+		Labels: map[string]string{
+			snapshotLabelNode: nodeName,
+			labelCluster:      cfg.Cluster().String(),
+			// Label values cannot contain ':', so use the basic ISO 8601 format.
+			snapshotLabelCreated: now.Format("20060102T150405Z"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !client.DryRun() {
+		fmt.Printf("INFO: Snapshot %d of %s created.\n", image.ID, server.Name)
+	}
+	return image, nil
+}
+
+// pruneSnapshots deletes all but the newest keep snapshots of a node. keep <= 0 keeps all.
+func pruneSnapshots(ctx context.Context, client *hcloud.Client, nodeName string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	snapshots, err := client.ListImages(ctx, hcloud.ImageTypeSnapshot, snapshotSelector(nodeName))
+	if err != nil {
+		return err
+	}
+	for _, old := range snapshots[min(keep, len(snapshots)):] {
+		fmt.Printf("INFO: Deleting snapshot %d of %s from %s (MAGE_SNAPSHOT_RETENTION=%d)...\n", old.ID, nodeName, old.Created.Format(time.RFC3339), keep)
+		if err := client.DeleteImage(ctx, old.ID); err != nil {
+			return fmt.Errorf("failed to delete snapshot %d: %w", old.ID, err)
+		}
+	}
+	return nil
+}
+
+// printServerSpec prints the server parameters of a machine and where they came from.
+func printServerSpec(node inventory.Node, spec inventory.HetznerSpec) {
+	source := ".env defaults"
+	if node.Hetzner != nil {
+		source = "the hetzner block of '" + node.Name + "' in machines.nix, .env defaults for unset fields"
+	}
+	fmt.Printf("INFO: Server parameters (from %s):\n", source)
+	fmt.Printf("INFO:   Server type: %s\n", spec.ServerType)
+	fmt.Printf("INFO:   Location:    %s\n", spec.Location)
+	fmt.Printf("INFO:   Image:       %s\n", spec.Image)
+	fmt.Printf("INFO:   IPv4 / IPv6: %t / %t\n", *spec.IPv4, *spec.IPv6)
+	for _, v := range spec.Volumes {
+		fmt.Printf("INFO:   Volume:      %s (%d GB)\n", v.Name, v.Size)
+	}
+}
+
+// serverCreateOpts returns the parameters for creating a server named name from spec,
+// attached to the shared network, placement group and firewall, and labelled with
+// spec.Labels plus the git revision. Volumes are left to the caller.
+func serverCreateOpts(name string, spec inventory.HetznerSpec, infra *hetznerInfra) hcloud.ServerCreateOpts {
+	var firewalls []hcloud.ServerCreateFirewall
+	if infra.Firewall != nil {
+		// Attached at creation time, so the new server is protected from its first boot.
+		firewalls = append(firewalls, hcloud.ServerCreateFirewall{Firewall: infra.Firewall.ID})
+	}
+	labels := map[string]string{labelGitRev: gitRevision()}
+	for k, v := range spec.Labels {
+		labels[k] = v
+	}
+	return hcloud.ServerCreateOpts{
+		Name:           name,
+		ServerType:     spec.ServerType,
+		Image:          spec.Image,
+		Location:       spec.Location,
+		SSHKeys:        []string{infra.SSHKey.Name},
+		Networks:       []int64{infra.Network.ID},
+		PlacementGroup: infra.PlacementGroup.ID,
+		Firewalls:      firewalls,
+		PublicNet: &hcloud.ServerCreatePublicNet{
+			EnableIPv4: *spec.IPv4,
+			EnableIPv6: *spec.IPv6,
+		},
+		Labels: labels,
+	}
+}
+
+// k3sAPIPort is the port of the k3s API server.
+const k3sAPIPort = 6443
+
+// k3sAPIService returns the load balancer service for the k3s API: plain TCP, so TLS is
+// terminated by the API servers, with a TCP health check.
+func k3sAPIService() hcloud.LoadBalancerService {
+	return hcloud.LoadBalancerService{
+		Protocol:        hcloud.LoadBalancerProtocolTCP,
+		ListenPort:      k3sAPIPort,
+		DestinationPort: k3sAPIPort,
+		HealthCheck: &hcloud.LoadBalancerHealthCheck{
+			Protocol: hcloud.LoadBalancerProtocolTCP,
+			Port:     k3sAPIPort,
+			Interval: 15,
+			Timeout:  10,
+			Retries:  3,
+		},
+	}
+}
+
+// ensureLoadBalancer creates the k3s API load balancer, or corrects its network attachment,
+// service, target and public interface (see EnsureLoadBalancer), and prints what it did.
+func ensureLoadBalancer(ctx context.Context, client *hcloud.Client, network *hcloud.Network) (*hcloud.LoadBalancer, error) {
+	type row struct {
+		kind, name string
+		status     hcloud.EnsureStatus
+	}
+	service := k3sAPIService()
+	target := hcloud.LoadBalancerTarget{
+		Type:          hcloud.LoadBalancerTargetTypeLabelSelector,
+		LabelSelector: &hcloud.LoadBalancerTargetLabelSelector{Selector: controlPlaneSelector()},
+		UsePrivateIP:  true,
+	}
+	serviceName := fmt.Sprintf("tcp %d -> %d", service.ListenPort, service.DestinationPort)
+	publicName := "disabled"
+	if cfg.LoadBalancerPublic {
+		publicName = "enabled"
+	}
+
+	lb, status, err := client.EnsureLoadBalancer(ctx, hcloud.LoadBalancerCreateOpts{
+		Name:             cfg.LoadBalancerName,
+		LoadBalancerType: cfg.LoadBalancerType,
+		Location:         cfg.HetznerLocation,
+		Algorithm:        &hcloud.LoadBalancerAlgorithm{Type: "round_robin"},
+		Network:          network.ID,
+		PublicInterface:  cfg.LoadBalancerPublic,
+		Services:         []hcloud.LoadBalancerService{service},
+		Targets:          []hcloud.LoadBalancerTarget{target},
+		Labels:           map[string]string{labelCluster: cfg.Cluster().String()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if status.LoadBalancer == hcloud.EnsureExisted && lb.Location.Name != cfg.HetznerLocation {
+		fmt.Printf("WARNING: Load balancer %s is in %s, not HETZNER_LOCATION %s; it is not moved\n", lb.Name, lb.Location.Name, cfg.HetznerLocation)
+	}
+	if existing := lb.LabelSelectorTarget(target.LabelSelector.Selector); existing != nil && !existing.UsePrivateIP {
+		fmt.Printf("WARNING: Target %s of load balancer %s uses public IPs; remove it in the Hetzner Cloud Console and run this again to use the private network\n", target.LabelSelector.Selector, lb.Name)
+	}
+	summary := []row{
+		{"load balancer", lb.Name, status.LoadBalancer},
+		{"network", network.Name, status.Network},
+		{"service", serviceName, status.Services[0]},
+		{"target", target.LabelSelector.Selector, status.Targets[0]},
+		{"public interface", publicName, status.PublicInterface},
+	}
+
+	fmt.Println("INFO: k3s API load balancer:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  RESOURCE\tNAME\tSTATUS")
+	for _, r := range summary {
+		if client.DryRun() && r.status != hcloud.EnsureExisted {
+			r.status = "would be " + r.status
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", r.kind, r.name, r.status)
+	}
+	tw.Flush()
+	return lb, nil
+}
+
+// labelControlPlaneServers adds serverLabels to the existing servers of the control plane
+// nodes in machines.nix that lack them, e.g. servers created before the labels were
+// introduced, so the load balancer targets them. Servers findServer refuses are skipped
+// with a warning; unlabelled servers must be listed in MAGE_ADOPT_SERVERS.
+func labelControlPlaneServers(ctx context.Context, client *hcloud.Client) error {
+	inv, err := loadInventory()
+	if err != nil {
+		return err
+	}
+	for _, node := range inv.ControlPlanes() {
+		if node.Location != inventory.LocationHetzner {
+			continue
+		}
+		server, err := findServer(ctx, client, node.Name, node)
+		if err != nil {
+			fmt.Printf("WARNING: Not labelling server %s. %s\n", node.Name, strings.TrimPrefix(err.Error(), "ERROR: "))
+			continue
+		}
+		if server == nil {
+			continue
+		}
+		labels := map[string]string{}
+		missing := false
+		for k, v := range server.Labels {
+			labels[k] = v
+		}
+		for k, v := range serverLabels(node) {
+			if labels[k] != v {
+				labels[k], missing = v, true
+			}
+		}
+		if !missing {
+			continue
+		}
+		fmt.Printf("INFO: Labelling control plane server %s with %s...\n", server.Name, controlPlaneSelector())
+		if _, err := client.UpdateServer(ctx, server.ID, hcloud.ServerUpdateOpts{Labels: labels}); err != nil {
+			return fmt.Errorf("failed to label server %s: %w", server.Name, err)
+		}
+	}
+	return nil
+}
+
+// printLoadBalancerStatus prints the health of the servers behind the load balancer and the
+// address to use as K3S_CONTROL_PLANE_ADDR.
+func printLoadBalancerStatus(ctx context.Context, client *hcloud.Client, lb *hcloud.LoadBalancer, network *hcloud.Network) error {
+	// Fetch it again, the target only lists the matching servers once it exists.
+	lb, err := client.GetLoadBalancerByName(ctx, lb.Name)
+	if err != nil {
+		return fmt.Errorf("failed to look up load balancer %s: %w", cfg.LoadBalancerName, err)
+	}
+	if lb == nil {
+		return fmt.Errorf("ERROR: load balancer %s disappeared", cfg.LoadBalancerName)
+	}
+	servers, err := client.ListServers(ctx, controlPlaneSelector())
+	if err != nil {
+		return fmt.Errorf("failed to list control plane servers: %w", err)
+	}
+	names := map[int64]string{}
+	for _, server := range servers {
+		names[server.ID] = server.Name
+	}
+
+	healthy := 0
+	fmt.Printf("INFO: Targets of load balancer %s:\n", lb.Name)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  SERVER\tHEALTH")
+	if target := lb.LabelSelectorTarget(controlPlaneSelector()); target != nil {
+		for _, t := range target.Targets {
+			if t.Server == nil {
+				continue
+			}
+			health := hcloud.LoadBalancerHealthStatusUnknown
+			for _, h := range t.HealthStatus {
+				if h.ListenPort == k3sAPIPort {
+					health = h.Status
+				}
+			}
+			if health == hcloud.LoadBalancerHealthStatusHealthy {
+				healthy++
+			}
+			name := names[t.Server.ID]
+			if name == "" {
+				name = fmt.Sprintf("server %d", t.Server.ID)
+			}
+			fmt.Fprintf(tw, "  %s\t%s\n", name, health)
+		}
+	}
+	tw.Flush()
+	if healthy == 0 {
+		fmt.Printf("WARNING: No control plane is healthy behind load balancer %s yet (new targets take a few health checks)\n", lb.Name)
+	}
+
+	privateIP := lb.PrivateIP(network.ID)
+	fmt.Printf("INFO: Load balancer %s private IP (%s): %s\n", lb.Name, network.Name, valueOrNone(privateIP))
+	if lb.PublicNet.Enabled {
+		fmt.Printf("INFO: Load balancer %s public IPv4: %s, IPv6: %s\n", lb.Name, valueOrNone(lb.PublicNet.IPv4.IP), valueOrNone(lb.PublicNet.IPv6.IP))
+	}
+	if privateIP != "" && cfg.K3sControlPlaneAddr != privateIP {
+		fmt.Printf("INFO: To use it as the control plane endpoint, set K3S_CONTROL_PLANE_ADDR=%s in %s and redeploy the nodes.\n", privateIP, cfg.Cluster().EnvFile())
+	}
+	return nil
+}
+
+// Kinds of control plane IP, see AllocateControlPlaneIP.
+const (
+	controlPlaneIPPrimary  = "primary"
+	controlPlaneIPFloating = "floating"
+)
+
+// controlPlaneIP is the IP allocated for the control plane endpoint by AllocateControlPlaneIP:
+// exactly one of Primary and Floating is set.
+type controlPlaneIP struct {
+	Primary  *hcloud.PrimaryIP
+	Floating *hcloud.FloatingIP
+}
+
+// Kind returns controlPlaneIPPrimary or controlPlaneIPFloating.
+func (ip *controlPlaneIP) Kind() string {
+	if ip.Primary != nil {
+		return controlPlaneIPPrimary
+	}
+	return controlPlaneIPFloating
+}
+
+// Address returns the IPv4 address.
+func (ip *controlPlaneIP) Address() string {
+	if ip.Primary != nil {
+		return ip.Primary.IP
+	}
+	return ip.Floating.IP
+}
+
+// String describes the IP for log messages.
+func (ip *controlPlaneIP) String() string {
+	if ip.Primary != nil {
+		return fmt.Sprintf("%s IP %s (%s, datacenter %s)", controlPlaneIPPrimary, ip.Primary.Name, ip.Primary.IP, ip.Primary.Datacenter.Name)
+	}
+	return fmt.Sprintf("%s IP %s (%s, home location %s)", controlPlaneIPFloating, ip.Floating.Name, ip.Floating.IP, ip.Floating.HomeLocation.Name)
+}
+
+// getControlPlaneIP looks up the primary or floating IP named HETZNER_CONTROL_PLANE_IP_NAME.
+// It returns nil and no error if neither exists.
+func getControlPlaneIP(ctx context.Context, client *hcloud.Client) (*controlPlaneIP, error) {
+	primary, err := client.GetPrimaryIPByName(ctx, cfg.ControlPlaneIPName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up primary IP %s: %w", cfg.ControlPlaneIPName, err)
+	}
+	floating, err := client.GetFloatingIPByName(ctx, cfg.ControlPlaneIPName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up floating IP %s: %w", cfg.ControlPlaneIPName, err)
+	}
+	switch {
+	case primary != nil && floating != nil:
+		return nil, fmt.Errorf("ERROR: both a primary IP and a floating IP are named %s, delete one of them or set HETZNER_CONTROL_PLANE_IP_NAME", cfg.ControlPlaneIPName)
+	case primary != nil:
+		return &controlPlaneIP{Primary: primary}, nil
+	case floating != nil:
+		return &controlPlaneIP{Floating: floating}, nil
+	}
+	return nil, nil
+}
+
+// printControlPlaneAddrHint tells the user to point K3S_CONTROL_PLANE_ADDR at the control
+// plane IP, unless it already does.
+func printControlPlaneAddrHint(ip *controlPlaneIP) {
+	if cfg.K3sControlPlaneAddr == ip.Address() {
+		fmt.Printf("INFO: K3S_CONTROL_PLANE_ADDR already is %s.\n", ip.Address())
+		return
+	}
+	fmt.Printf("INFO: Set K3S_CONTROL_PLANE_ADDR=%s in %s, then redeploy the nodes.\n", ip.Address(), cfg.Cluster().EnvFile())
+	if ip.Floating != nil && !cfg.ControlPlaneFloatingIP {
+		fmt.Printf("INFO: Also set HETZNER_CONTROL_PLANE_FLOATING_IP=true, so the %s node configures the floating IP.\n", inventory.NodeTypeControlInit)
+	}
+}
+
+// replacementSuffix is appended to a server's name while its replacement is being installed.
+const replacementSuffix = "-next"
+
+// replacementLabel marks a server created by replaceServer with the name of the server it
+// replaces, until the swap relabels it.
+const replacementLabel = "k3s-nixos/replaces"
+
+// replaceServer implements ReplaceServer; see there for the steps.
+func replaceServer(ctx context.Context, serverName string, node inventory.Node) error {
+	if node.Location != inventory.LocationHetzner {
+		return fmt.Errorf("ERROR: machine '%s' has location '%s' in machines.nix, only '%s' machines run on Hetzner Cloud", node.Name, node.Location, inventory.LocationHetzner)
+	}
+	if node.NodeType == inventory.NodeTypeControlInit {
+		return fmt.Errorf("ERROR: '%s' is the %s node, which starts k3s with --cluster-init; a replacement would form a new cluster instead of joining the existing one. Use deleteAndRedeployServer instead", node.Name, inventory.NodeTypeControlInit)
+	}
+	// Refuse to install a configuration built from placeholder values
+	if err := validateNodeConfig("replaceServer", node.Name, "AGE_PRIVATE_KEY"); err != nil {
+		return err
+	}
+
+	mg.SerialDeps(CheckFlake) // Ensure flake is valid before creating anything
+
+	client, err := newHcloudClient()
+	if err != nil {
+		return err
+	}
+	if err := cfg.Require("replaceServer", "HETZNER_SSH_KEY_NAME"); err != nil {
+		return err
+	}
+	spec := serverSpec(node)
+	printServerSpec(node, spec)
+	sshClient, err := newSSHClient()
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	oldAddr, err := resolveNode(ctx, sshClient, node, true)
+	if err != nil {
+		return err
+	}
+	oldTarget := oldAddr.Target
+	targetUser, _, _ := strings.Cut(oldTarget, "@")
+
+	old, err := findServer(ctx, client, serverName, node)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return fmt.Errorf("ERROR: server %s does not exist, so there is nothing to replace. Use deleteAndRedeployServer to create it", serverName)
+	}
+	tempName := serverName + replacementSuffix
+	if leftover, err := client.GetServerByName(ctx, tempName); err != nil {
+		return fmt.Errorf("failed to look up server %s: %w", tempName, err)
+	} else if leftover != nil {
+		return fmt.Errorf("ERROR: server %s already exists, probably left over from an interrupted replacement. Delete it first", tempName)
+	}
+	// The old server still exists while the replacement is created.
+	if err := preflightServer(ctx, client, tempName, spec, nil, nil); err != nil {
+		return err
+	}
+	if err := guardDestructive("replace the server", serverName, func() bool { return true }); err != nil {
+		return err
+	}
+	infra, err := ensureInfra(ctx, client, spec.Location)
+	if err != nil {
+		return err
+	}
+	// Volumes stay attached to the old server until the swap.
+	volumes, automount, err := ensureVolumes(ctx, client, spec, old)
+	if err != nil {
+		return err
+	}
+
+	// k3s only accepts a machine under an existing node name if it presents the node's password.
+	extraFiles := map[string][]byte{}
+	res, err := sshQuery(ctx, sshClient, oldTarget, "sudo cat /etc/rancher/node/password")
+	if err != nil || res.Output() == "" {
+		fmt.Printf("WARNING: Could not read the k3s node password of %s (%v). k3s will reject the new machine until the secret %s.node-password.k3s in kube-system is deleted.\n", oldTarget, err, node.Name)
+	} else {
+		extraFiles["etc/rancher/node/password"] = []byte(res.Output() + "\n")
+	}
+
+	// 1. Create the replacement next to the old server
+	fmt.Printf("INFO: Creating replacement server %s...\n", tempName)
+	opts := serverCreateOpts(tempName, spec, infra)
+	labels := opts.Labels // set by swapServer once the replacement is renamed
+	opts.Labels = map[string]string{replacementLabel: serverName}
+	for k, v := range labels {
+		opts.Labels[k] = v
+	}
+	replacement, err := client.CreateServerAndWait(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to create replacement server %s (%s is untouched): %w", tempName, serverName, err)
+	}
+	newHost := serverSSHHost(replacement)
+	if newHost == "" && run.DryRun() {
+		newHost = "<" + tempName + " IP>"
+	} else if newHost == "" {
+		return fmt.Errorf("ERROR: replacement server %s has no public IP to install NixOS over", tempName)
+	}
+	newTarget := targetUser + "@" + newHost
+	// The replacement's host key is pinned under its own name until it takes over the node's.
+	// It is reached like the old server, but never over the tailnet: the installer is not on it.
+	jump := oldAddr.Jump
+	if oldAddr.Source == addressSourceTailscale {
+		jump = ""
+	}
+	if err := routeHost(sshClient, newHost, tempName, jump); err != nil {
+		return err
+	}
+	// A new server has new host keys; forget any pinned for a previous server of that name.
+	if err := forgetHostKeys(tempName, newHost); err != nil {
+		fmt.Printf("WARNING: %v\n", err)
+	}
+
+	// 2. Install NixOS and 3. wait for the k3s node
+	failed := func(step string, err error) error {
+		return fmt.Errorf("%s on %s failed; %s is untouched, delete %s before retrying: %w", step, tempName, serverName, tempName, err)
+	}
+	if err := installNixOS(ctx, node.Name, newTarget, sshClient, extraFiles); err != nil {
+		return failed("installing NixOS", err)
+	}
+	kubectlTarget := newTarget
+	if node.IsControlPlane() {
+		if err := waitForK3s(ctx, newHost, newTarget, sshClient); err != nil {
+			return failed("waiting for the k3s API", err)
+		}
+	} else if kubectlTarget, err = controlPlaneTarget(ctx, sshClient, node.Name); err != nil {
+		return err
+	}
+	fmt.Printf("INFO: Waiting for node %s to become Ready on %s...\n", node.Name, tempName)
+	if err := waitForK3sNode(ctx, kubectlTarget, newTarget, node.Name, sshClient); err != nil {
+		return failed("waiting for the k3s node", err)
+	}
+
+	// 4. Retire the old server
+	server, err := swapServer(ctx, client, node.Name, old, replacement, volumes, automount, labels)
+	if err != nil {
+		return fmt.Errorf("failed to swap %s for %s: %w", serverName, tempName, err)
+	}
+	if run.DryRun() {
+		fmt.Printf("INFO: Dry run: server %s was not actually replaced.\n", serverName)
+		return nil
+	}
+
+	fmt.Printf("INFO: Server %s replaced (ID %d).\n", serverName, server.ID)
+	fmt.Printf("INFO:   Public IPv4:  %s\n", valueOrNone(server.PublicIPv4()))
+	fmt.Printf("INFO:   Public IPv6:  %s\n", valueOrNone(server.PublicIPv6()))
+	fmt.Printf("INFO:   Private IP (%s): %s\n", infra.Network.Name, valueOrNone(server.PrivateIP(infra.Network.ID)))
+	// The node's name now stands for the replacement, whose key was pinned under tempName.
+	if err := repinHostKey(tempName, node.Name); err != nil {
+		return err
+	}
+	// The old address may have been the old server's; look the node up again.
+	addr, err := resolveNode(ctx, sshClient, node, false)
+	if err != nil {
+		return err
+	}
+	if addr.Jump == "" && net.ParseIP(addr.Host) != nil && !serverHasAddress(server, addr.Host) {
+		fmt.Printf("WARNING: Deploy target %s for '%s' does not match the new server's IPs. Update its sshHostname in machines.nix.\n", addr.Host, node.Name)
+		return nil
+	}
+	if err := waitForNixOS(ctx, addr.Host, addr.Target, sshClient, node.Name); err != nil {
+		return fmt.Errorf("server %s is not reachable at %s after the swap: %w", serverName, addr.Target, err)
+	}
+	if node.IsControlPlane() {
+		if err := fetchKubeconfig(ctx, addr.Target, sshClient); err != nil {
+			fmt.Printf("WARNING: Failed to fetch kubeconfig from %s, run 'mage fetchKubeconfig %s' later: %v\n", addr.Target, node.Name, err)
+		}
+	}
+	return nil
+}
+
+// swapServer retires old in favour of replacement: it snapshots old if
+// MAGE_SNAPSHOT_BEFORE_DELETE is set, moves its floating IPs, powers it off, moves its primary
+// IPs (if both servers are in the same datacenter, as Hetzner requires), deletes it,
+// attaches the volumes to replacement and finally renames replacement to old's name with
+// labels. It returns replacement as reported by the API afterwards.
+func swapServer(ctx context.Context, client *hcloud.Client, nodeName string, old, replacement *hcloud.Server, volumes []int64, automount *bool, labels map[string]string) (*hcloud.Server, error) {
+	if cfg.SnapshotBeforeDelete {
+		if _, err := snapshotServer(ctx, client, nodeName, old); err != nil {
+			return nil, fmt.Errorf("failed to snapshot %s before deleting it (unset MAGE_SNAPSHOT_BEFORE_DELETE to skip): %w", old.Name, err)
+		}
+	}
+
+	// Floating IPs can be reassigned while both servers are running.
+	for _, id := range old.PublicNet.FloatingIPs {
+		fmt.Printf("INFO: Moving floating IP %d from %s to %s...\n", id, old.Name, replacement.Name)
+		if err := client.AssignFloatingIP(ctx, id, replacement.ID); err != nil {
+			return nil, fmt.Errorf("failed to move floating IP %d: %w", id, err)
+		}
+	}
+
+	fmt.Printf("INFO: Powering off %s (ID %d)...\n", old.Name, old.ID)
+	if err := client.PowerOffServerAndWait(ctx, old.ID); err != nil {
+		return nil, fmt.Errorf("failed to power off %s: %w", old.Name, err)
+	}
+
+	// Primary IPs can only move between powered-off servers in the same datacenter. Take
+	// them off the old server, without letting its deletion delete them.
+	var primaryIPs []*hcloud.PrimaryIP
+	var oldPublic []*hcloud.ServerPublicIP
+	for _, public := range []*hcloud.ServerPublicIP{old.PublicNet.IPv4, old.PublicNet.IPv6} {
+		if public != nil {
+			oldPublic = append(oldPublic, public)
+		}
+	}
+	if len(oldPublic) > 0 && old.Datacenter.Name != replacement.Datacenter.Name && !client.DryRun() {
+		fmt.Printf("WARNING: %s is in datacenter %s but %s in %s, so its primary IPs cannot be moved and the public IPs change.\n", old.Name, old.Datacenter.Name, replacement.Name, replacement.Datacenter.Name)
+		oldPublic = nil
+	}
+	for _, public := range oldPublic {
+		ip, err := client.GetPrimaryIP(ctx, public.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up primary IP %s: %w", public.IP, err)
+		}
+		if ip.AutoDelete {
+			keep := false
+			if _, err := client.UpdatePrimaryIP(ctx, ip.ID, hcloud.PrimaryIPUpdateOpts{AutoDelete: &keep}); err != nil {
+				return nil, fmt.Errorf("failed to disable auto delete of primary IP %s: %w", ip.IP, err)
+			}
+		}
+		if err := client.UnassignPrimaryIP(ctx, ip.ID); err != nil {
+			return nil, fmt.Errorf("failed to unassign primary IP %s from %s: %w", ip.IP, old.Name, err)
+		}
+		primaryIPs = append(primaryIPs, ip)
+	}
+
+	fmt.Printf("INFO: Deleting %s (ID %d)...\n", old.Name, old.ID)
+	if err := client.DeleteServerAndWait(ctx, old.ID); err != nil {
+		return nil, fmt.Errorf("failed to delete %s: %w", old.Name, err)
+	}
+
+	if len(primaryIPs) > 0 {
+		fmt.Printf("INFO: Powering off %s to move the primary IPs...\n", replacement.Name)
+		if err := client.PowerOffServerAndWait(ctx, replacement.ID); err != nil {
+			return nil, fmt.Errorf("failed to power off %s: %w", replacement.Name, err)
+		}
+		for _, ip := range primaryIPs {
+			// The replacement got its own primary IP of each type when it was created.
+			own := replacement.PublicNet.IPv4
+			if ip.Type == hcloud.PrimaryIPTypeIPv6 {
+				own = replacement.PublicNet.IPv6
+			}
+			if own != nil {
+				if err := client.UnassignPrimaryIP(ctx, own.ID); err != nil {
+					return nil, fmt.Errorf("failed to unassign primary IP %s from %s: %w", own.IP, replacement.Name, err)
+				}
+				if err := client.DeletePrimaryIP(ctx, own.ID); err != nil {
+					return nil, fmt.Errorf("failed to delete primary IP %s: %w", own.IP, err)
+				}
+			}
+			if err := client.AssignPrimaryIP(ctx, ip.ID, replacement.ID); err != nil {
+				return nil, fmt.Errorf("failed to assign primary IP %s to %s: %w", ip.IP, replacement.Name, err)
+			}
+			if ip.AutoDelete {
+				if _, err := client.UpdatePrimaryIP(ctx, ip.ID, hcloud.PrimaryIPUpdateOpts{AutoDelete: &ip.AutoDelete}); err != nil {
+					fmt.Printf("WARNING: Failed to re-enable auto delete of primary IP %s: %v\n", ip.IP, err)
+				}
+			}
+			fmt.Printf("INFO: Moved primary IP %s to %s.\n", ip.IP, replacement.Name)
+		}
+		if err := client.PowerOnServerAndWait(ctx, replacement.ID); err != nil {
+			return nil, fmt.Errorf("failed to power on %s: %w", replacement.Name, err)
+		}
+	}
+
+	for _, id := range volumes {
+		fmt.Printf("INFO: Attaching volume %d to %s...\n", id, replacement.Name)
+		if err := client.AttachVolume(ctx, id, replacement.ID, automount != nil && *automount); err != nil {
+			return nil, fmt.Errorf("failed to attach volume %d to %s: %w", id, replacement.Name, err)
+		}
+	}
+
+	fmt.Printf("INFO: Renaming %s to %s...\n", replacement.Name, old.Name)
+	if _, err := client.UpdateServer(ctx, replacement.ID, hcloud.ServerUpdateOpts{Name: old.Name, Labels: labels}); err != nil {
+		return nil, fmt.Errorf("failed to rename %s to %s: %w", replacement.Name, old.Name, err)
+	}
+	if client.DryRun() {
+		return replacement, nil
+	}
+	return client.GetServer(ctx, replacement.ID)
+}
+
+// serverSSHHost returns the address to reach a server over SSH: its public IPv4, or
+// else the first address of its public IPv6 network (where Hetzner configures the server).
+func serverSSHHost(server *hcloud.Server) string {
+	if ip := server.PublicIPv4(); ip != "" {
+		return ip
+	}
+	if ip, _, err := net.ParseCIDR(server.PublicIPv6()); err == nil {
+		ip[len(ip)-1] = 1
+		return ip.String()
+	}
+	return ""
+}
+
+// controlPlaneTarget returns the SSH target (user@host) of a control plane node other than
+// exclude, to run kubectl on.
+func controlPlaneTarget(ctx context.Context, sshClient *sshclient.Client, exclude string) (string, error) {
+	inv, err := loadInventory()
+	if err != nil {
+		return "", err
+	}
+	for _, cp := range inv.ControlPlanes() {
+		if cp.Name == exclude {
+			continue
+		}
+		if addr, err := resolveNode(ctx, sshClient, cp, true); err == nil {
+			return addr.Target, nil
+		}
+	}
+	return "", fmt.Errorf("ERROR: machines.nix defines no other control plane node with an SSH address to check the node status from")
+}
+
+// Preflight check results.
+const (
+	preflightOK      = "ok"
+	preflightWarning = "warning"
+	preflightSkipped = "skipped"
+	preflightFailed  = "FAILED"
+)
+
+// preflightCheck is the result of one preflight check.
+type preflightCheck struct {
+	name, status, detail string
+}
+
+// preflightServer checks, before anything is deleted, that Hetzner will accept creating
+// serverName from spec, so a rejected create cannot leave the machine deleted:
+//   - the server type exists, is not deprecated, and is sold and currently available in the
+//     location (Hetzner regularly runs out of some types in a location);
+//   - the project stays within HCLOUD_SERVER_LIMIT. The API does not expose the project's
+//     limits, so this is only checked if it is set (see Limits in the Hetzner Cloud Console);
+//   - the private network has a subnet in the network zone of the location;
+//   - the placement group has room (a spread group holds at most 10 servers);
+//   - the SSH key exists.
+//
+// It runs before the confirmation and before ensureInfra, so it only reads: a missing
+// shared resource is reported as skipped, since ensureInfra creates it before anything is
+// deleted.
+//
+// replaced is the server that is deleted before the new one is created, or nil. It frees a
+// slot in the server limit and the placement group. endpoint is the control plane IP the
+// new server gets, or nil: a primary IP must be unassigned or assigned to replaced and pins
+// the server to its datacenter, a floating IP must be in the network zone of the location.
+// Every check runs and is printed; the error lists all that failed.
+func preflightServer(ctx context.Context, client *hcloud.Client, serverName string, spec inventory.HetznerSpec, replaced *hcloud.Server, endpoint *controlPlaneIP) error {
+	var checks []preflightCheck
+	add := func(name, status, format string, args ...interface{}) {
+		checks = append(checks, preflightCheck{name, status, fmt.Sprintf(format, args...)})
+	}
+	// pending reports a shared resource that ensureInfra still has to create or complete; it
+	// runs after the confirmation, before anything is deleted.
+	pending := func(name, format string, args ...interface{}) {
+		add(name, preflightSkipped, format+" (ensureInfra fixes this before anything is deleted)", args...)
+	}
+
+	// Server type, price and availability
+	st, err := client.GetServerTypeByName(ctx, spec.ServerType)
+	if err != nil {
+		return fmt.Errorf("failed to look up server type %s: %w", spec.ServerType, err)
+	}
+	switch {
+	case st == nil:
+		add("server type", preflightFailed, "%s does not exist", spec.ServerType)
+	case st.Deprecation != nil && time.Now().After(st.Deprecation.UnavailableAfter):
+		add("server type", preflightFailed, "%s is deprecated and cannot be created since %s", st.Name, st.Deprecation.UnavailableAfter.Format("2006-01-02"))
+	case st.Deprecation != nil:
+		add("server type", preflightWarning, "%s is deprecated and cannot be created after %s", st.Name, st.Deprecation.UnavailableAfter.Format("2006-01-02"))
+	default:
+		add("server type", preflightOK, "%s (%d vCPU, %g GB RAM, %d GB disk)", st.Name, st.Cores, st.Memory, st.Disk)
+	}
+	location, err := client.GetLocationByName(ctx, spec.Location)
+	if err != nil {
+		return fmt.Errorf("failed to look up location %s: %w", spec.Location, err)
+	}
+	if location == nil {
+		add("location", preflightFailed, "%s does not exist (e.g. fsn1, nbg1, hel1, ash, hil)", spec.Location)
+	}
+	if st != nil && location != nil {
+		if price := st.PriceIn(location.Name); price == nil {
+			add("price", preflightFailed, "%s is not sold in %s", st.Name, location.Name)
+		} else {
+			add("price", preflightOK, "EUR %s/month in %s (gross)", price.PriceMonthly.Gross, location.Name)
+		}
+		pinned := ""
+		if endpoint != nil && endpoint.Primary != nil {
+			pinned = endpoint.Primary.Datacenter.Name
+		}
+		if datacenter, err := checkServerTypeAvailable(ctx, client, st, location.Name, pinned); err != nil {
+			add("availability", preflightFailed, "%v", err)
+		} else {
+			add("availability", preflightOK, "available in datacenter %s", datacenter)
+		}
+	}
+
+	// Control plane IP
+	if endpoint != nil {
+		switch {
+		case endpoint.Primary != nil && endpoint.Primary.Datacenter.Location.Name != spec.Location:
+			add("control plane ip", preflightFailed, "%s is not in location %s; set the hetzner location of %s to %s", endpoint, spec.Location, serverName, endpoint.Primary.Datacenter.Location.Name)
+		case endpoint.Primary != nil && endpoint.Primary.AssigneeID != nil && (replaced == nil || *endpoint.Primary.AssigneeID != replaced.ID):
+			add("control plane ip", preflightFailed, "%s is assigned to server %d", endpoint, *endpoint.Primary.AssigneeID)
+		case endpoint.Floating != nil && location != nil && endpoint.Floating.HomeLocation.NetworkZone != location.NetworkZone:
+			add("control plane ip", preflightFailed, "%s is in network zone %s, not %s", endpoint, endpoint.Floating.HomeLocation.NetworkZone, location.NetworkZone)
+		case cfg.K3sControlPlaneAddr != endpoint.Address():
+			add("control plane ip", preflightWarning, "%s, but K3S_CONTROL_PLANE_ADDR is %s", endpoint, valueOrNone(cfg.K3sControlPlaneAddr))
+		case endpoint.Floating != nil && !cfg.ControlPlaneFloatingIP:
+			add("control plane ip", preflightWarning, "%s, but HETZNER_CONTROL_PLANE_FLOATING_IP is not set, so the node does not configure it", endpoint)
+		default:
+			add("control plane ip", preflightOK, "%s", endpoint)
+		}
+	}
+
+	// Project server limit
+	if cfg.HcloudServerLimit <= 0 {
+		add("server limit", preflightSkipped, "set HCLOUD_SERVER_LIMIT to check it")
+	} else {
+		servers, err := client.ListServers(ctx, "")
+		if err != nil {
+			return fmt.Errorf("failed to list servers: %w", err)
+		}
+		after := len(servers) + 1
+		if replaced != nil {
+			after--
+		}
+		status := preflightOK
+		if after > cfg.HcloudServerLimit {
+			status = preflightFailed
+		}
+		add("server limit", status, "%d of %d servers after creating %s", after, cfg.HcloudServerLimit, serverName)
+	}
+
+	// Shared resources, as created by ensureInfra
+	network, err := client.GetNetworkByName(ctx, cfg.PrivateNetworkName)
+	if err != nil {
+		return fmt.Errorf("failed to look up network %s: %w", cfg.PrivateNetworkName, err)
+	}
+	switch {
+	case network == nil:
+		pending("network", "%s does not exist", cfg.PrivateNetworkName)
+	case location != nil && !network.HasSubnetInZone(location.NetworkZone):
+		pending("network", "%s has no subnet in network zone %s", network.Name, location.NetworkZone)
+	default:
+		add("network", preflightOK, "%s", network.Name)
+	}
+
+	pg, err := client.GetPlacementGroupByName(ctx, cfg.PlacementGroupName)
+	if err != nil {
+		return fmt.Errorf("failed to look up placement group %s: %w", cfg.PlacementGroupName, err)
+	}
+	if pg == nil {
+		pending("placement group", "%s does not exist", cfg.PlacementGroupName)
+	} else {
+		members := len(pg.Servers) + 1
+		if replaced != nil && containsID(pg.Servers, replaced.ID) {
+			members--
+		}
+		status := preflightOK
+		if members > hcloud.PlacementGroupMaxServers {
+			status = preflightFailed
+		}
+		add("placement group", status, "%s: %d of %d servers after creating %s", pg.Name, members, hcloud.PlacementGroupMaxServers, serverName)
+	}
+
+	sshKey, err := client.GetSSHKeyByName(ctx, cfg.HetznerSSHKeyName)
+	if err != nil {
+		return fmt.Errorf("failed to look up SSH key %s: %w", cfg.HetznerSSHKeyName, err)
+	}
+	if sshKey == nil {
+		pending("ssh key", "%s does not exist", cfg.HetznerSSHKeyName)
+	} else {
+		add("ssh key", preflightOK, "%s", sshKey.Name)
+	}
+
+	fmt.Printf("INFO: Preflight checks for %s:\n", serverName)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	var failed []string
+	for _, c := range checks {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", c.name, c.status, c.detail)
+		if c.status == preflightFailed {
+			failed = append(failed, c.name+": "+c.detail)
+		}
+	}
+	tw.Flush()
+	if len(failed) > 0 {
+		return fmt.Errorf("ERROR: preflight checks failed, nothing was deleted:\n  - %s", strings.Join(failed, "\n  - "))
+	}
+	return nil
+}
+
+// containsID reports whether ids contains id.
+func containsID(ids []int64, id int64) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+// checkServerTypeAvailable returns the datacenter of the location in which servers of type
+// st can currently be created, only considering datacenter if it is set. Otherwise the
+// error lists the types that are available there.
+func checkServerTypeAvailable(ctx context.Context, client *hcloud.Client, st *hcloud.ServerType, location, datacenter string) (string, error) {
+	datacenters, err := client.ListDatacenters(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list datacenters: %w", err)
+	}
+
+	available := map[int64]bool{}
+	for _, dc := range datacenters {
+		if dc.Location.Name != location || (datacenter != "" && dc.Name != datacenter) {
+			continue
+		}
+		if dc.HasAvailable(st.ID) {
+			return dc.Name, nil
+		}
+		for _, id := range dc.ServerTypes.Available {
+			available[id] = true
+		}
+	}
+
+	serverTypes, err := client.ListServerTypes(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list server types: %w", err)
+	}
+	var names []string
+	for _, t := range serverTypes {
+		if available[t.ID] {
+			names = append(names, t.Name)
+		}
+	}
+	sort.Strings(names)
+	where := location
+	if datacenter != "" {
+		where = datacenter
+	}
+	return "", fmt.Errorf("%s is currently unavailable in %s; available there: %s", st.Name, where, valueOrNone(strings.Join(names, ", ")))
+}
+
+// Labels set on the servers created by recreateServer and replaceServer (see serverSpec).
+// labelCluster is also set on the snapshots, IPs and load balancer of the cluster.
+const (
+	labelCluster     = "k3s-nixos/cluster"
+	labelRole        = "k3s-nixos/role"
+	labelNodeType    = "k3s-nixos/node-type"
+	labelFlakeConfig = "k3s-nixos/flake-config"
+	// labelGitRev is the commit of this repository a server was created from. It is only
+	// set at creation time (see serverCreateOpts), so existing servers keep the revision
+	// they were installed with.
+	labelGitRev = "k3s-nixos/git-rev"
+	// roleControlPlane is the labelRole of control plane nodes; the k3s API load balancer
+	// targets them by it (see EnsureLoadBalancer).
+	roleControlPlane = "control-plane"
+)
+
+// serverSpec returns the Hetzner Cloud server parameters of a machine: its hetzner block
+// from machines.nix, with unset fields taken from CONTROL_PLANE_VM_TYPE or WORKER_VM_TYPE,
+// HETZNER_LOCATION, HETZNER_IMAGE_NAME and HETZNER_DEFAULT_ENABLE_IPV4. IPv6 defaults to on.
+// The labels of the hetzner block are added to serverLabels.
+func serverSpec(node inventory.Node) inventory.HetznerSpec {
+	serverType := cfg.ControlPlaneVMType
+	if !node.IsControlPlane() {
+		serverType = cfg.WorkerVMType
+	}
+	enableIPv4, enableIPv6 := cfg.DefaultEnableIPv4, true
+	return node.Hetzner.WithDefaults(inventory.HetznerSpec{
+		ServerType: serverType,
+		Location:   cfg.HetznerLocation,
+		Image:      cfg.HetznerImageName,
+		IPv4:       &enableIPv4,
+		IPv6:       &enableIPv6,
+		Labels:     serverLabels(node),
+	})
+}
+
+// serverLabels returns the labels every server of node gets, before the labels from its
+// hetzner block: the cluster, the node type, the nixosConfigurations entry it is installed
+// from, and the control plane role for control plane nodes. findServer checks the cluster
+// and flake config labels before a server is deleted.
+func serverLabels(node inventory.Node) map[string]string {
+	labels := map[string]string{
+		labelCluster:     cfg.Cluster().String(),
+		labelNodeType:    node.NodeType,
+		labelFlakeConfig: node.Name,
+	}
+	if node.IsControlPlane() {
+		labels[labelRole] = roleControlPlane
+	}
+	return labels
+}
+
+// gitRevisionCache holds the result of gitRevision for the rest of the mage run.
+var gitRevisionCache string
+
+// gitRevision returns the abbreviated commit of this checkout, with a "-dirty" suffix if it
+// has uncommitted changes, or "unknown" if git is unavailable. It is a valid label value.
+func gitRevision() string {
+	if gitRevisionCache != "" {
+		return gitRevisionCache
+	}
+	gitRevisionCache = "unknown"
+	rev, err := run.Query("git", "rev-parse", "--short=12", "HEAD")
+	if err != nil || strings.TrimSpace(rev) == "" {
+		fmt.Printf("WARNING: Could not determine the git revision, labelling servers with %s=unknown: %v\n", labelGitRev, err)
+		return gitRevisionCache
+	}
+	gitRevisionCache = strings.TrimSpace(rev)
+	if status, err := run.Query("git", "status", "--porcelain"); err == nil && strings.TrimSpace(status) != "" {
+		gitRevisionCache += "-dirty"
+	}
+	return gitRevisionCache
+}
+
+// findServer returns the server of node: the server labelled with the active cluster and
+// node.Name as its flake config (see serverLabels), whatever it is named. Replacements
+// still being installed by replaceServer are skipped. It is an error if several servers
+// carry the labels.
+// Servers created before the labels were introduced are found by serverName instead, but a
+// server of that name whose labels show it belongs to another cluster or machine is refused,
+// so a server that merely shares the name is never deleted. A server without any of the
+// labels (e.g. created by hand) is only accepted if MAGE_ADOPT_SERVERS lists its name.
+// It returns nil and no error if the server does not exist.
+func findServer(ctx context.Context, client *hcloud.Client, serverName string, node inventory.Node) (*hcloud.Server, error) {
+	selector := fmt.Sprintf("%s=%s,%s=%s", labelCluster, cfg.Cluster(), labelFlakeConfig, node.Name)
+	labelled, err := client.ListServers(ctx, selector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list servers matching %s: %w", selector, err)
+	}
+	var matches []string
+	var found *hcloud.Server
+	for _, server := range labelled {
+		if replaces, ok := server.Labels[replacementLabel]; ok {
+			fmt.Printf("INFO: Ignoring server %s (ID %d), an unfinished replacement of %s.\n", server.Name, server.ID, replaces)
+			continue
+		}
+		found = server
+		matches = append(matches, fmt.Sprintf("%s (ID %d)", server.Name, server.ID))
+	}
+	switch {
+	case len(matches) > 1:
+		return nil, fmt.Errorf("ERROR: %d servers are labelled %s: %s. Delete or relabel all but one of them", len(matches), selector, strings.Join(matches, ", "))
+	case found != nil:
+		if found.Name != serverName {
+			fmt.Printf("INFO: Server of '%s' is %s (ID %d), found by its labels.\n", node.Name, found.Name, found.ID)
+		}
+		return found, nil
+	}
+
+	// No labelled server: look for a legacy server by name.
+	server, err := client.GetServerByName(ctx, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up server %s: %w", serverName, err)
+	}
+	if server == nil {
+		return nil, nil
+	}
+	if replaces, ok := server.Labels[replacementLabel]; ok {
+		return nil, fmt.Errorf("ERROR: server %s (ID %d) is an unfinished replacement of %s, refusing to touch it. Delete it first", server.Name, server.ID, replaces)
+	}
+	want := map[string]string{labelCluster: cfg.Cluster().String(), labelFlakeConfig: node.Name}
+	var missing []string
+	for _, k := range []string{labelCluster, labelFlakeConfig} {
+		got, ok := server.Labels[k]
+		if !ok {
+			missing = append(missing, k)
+			continue
+		}
+		if got != want[k] {
+			return nil, fmt.Errorf("ERROR: server %s (ID %d) has label %s=%s, expected %s. It is not the server of '%s' in cluster '%s', refusing to touch it", server.Name, server.ID, k, got, want[k], node.Name, cfg.Cluster())
+		}
+	}
+	switch {
+	case len(missing) == len(want) && !listContains(cfg.AdoptServers, server.Name):
+		return nil, fmt.Errorf("ERROR: server %s (ID %d) has no %s or %s label, so it may not belong to this cluster. Add it to MAGE_ADOPT_SERVERS if it is the server of '%s'", server.Name, server.ID, labelCluster, labelFlakeConfig, node.Name)
+	case len(missing) == len(want):
+		fmt.Printf("WARNING: Server %s (ID %d) has no k3s-nixos labels; adopting it because MAGE_ADOPT_SERVERS lists it.\n", server.Name, server.ID)
+	default:
+		fmt.Printf("WARNING: Server %s (ID %d) has no %s label; accepting it based on its other labels.\n", server.Name, server.ID, strings.Join(missing, ", "))
+	}
+	return server, nil
+}
+
+// controlPlaneSelector returns the label selector matching the control plane servers of
+// the active cluster.
+func controlPlaneSelector() string {
+	return fmt.Sprintf("%s=%s,%s=%s", labelCluster, cfg.Cluster(), labelRole, roleControlPlane)
+}
+
+// ensureVolumes creates the volumes of spec that do not exist yet and returns the IDs of
+// all of them, to attach to the new server, and whether any should be automounted. It
+// fails if a volume is in another location or attached to a server other than existing
+// (the server about to be deleted, which releases its volumes).
+func ensureVolumes(ctx context.Context, client *hcloud.Client, spec inventory.HetznerSpec, existing *hcloud.Server) ([]int64, *bool, error) {
+	var ids []int64
+	var automount *bool
+	for _, v := range spec.Volumes {
+		if v.Automount {
+			enabled := true
+			automount = &enabled
+		}
+		volume, err := client.GetVolumeByName(ctx, v.Name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to look up volume %s: %w", v.Name, err)
+		}
+		if volume == nil {
+			fmt.Printf("INFO: Volume %s does not exist, creating it (%d GB in %s)...\n", v.Name, v.Size, spec.Location)
+			volume, err = client.CreateVolume(ctx, hcloud.VolumeCreateOpts{
+				Name:     v.Name,
+				Size:     v.Size,
+				Location: spec.Location,
+				Format:   v.Format,
+				Labels:   spec.Labels,
+			})
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to create volume %s: %w", v.Name, err)
+			}
+		} else {
+			if volume.Location.Name != spec.Location {
+				return nil, nil, fmt.Errorf("ERROR: volume %s is in location %s, but the server is created in %s", v.Name, volume.Location.Name, spec.Location)
+			}
+			if volume.Server != nil && (existing == nil || *volume.Server != existing.ID) {
+				return nil, nil, fmt.Errorf("ERROR: volume %s is attached to another server (ID %d)", v.Name, *volume.Server)
+			}
+			fmt.Printf("INFO: Volume %s (ID %d) exists and will be reattached.\n", volume.Name, volume.ID)
+		}
+		ids = append(ids, volume.ID)
+	}
+	return ids, automount, nil
+}
+
+// Readiness stage names. Each stage's timeout is configurable with MAGE_WAIT_<STAGE>_TIMEOUT
+// (e.g. MAGE_WAIT_SSH_PORT_TIMEOUT=10m); the delay between attempts starts at
+// MAGE_WAIT_BACKOFF and grows up to MAGE_WAIT_MAX_BACKOFF.
+const (
+	waitStageSSHPort      = "ssh-port"
+	waitStageSSHHandshake = "ssh-handshake"
+	waitStageNixOSSystem  = "nixos-system"
+	waitStageK3sAPI       = "k3s-api"
+	waitStageK3sReadyz    = "k3s-readyz"
+	waitStageK3sNodeReady = "k3s-node-ready"
+)
+
+// newWaitStage builds a readiness stage with its timeout and backoff taken from the
+// configuration, printing progress after every failed attempt.
+func newWaitStage(name string, check func(ctx context.Context) error) wait.Stage {
+	timeout := map[string]time.Duration{
+		waitStageSSHPort:      cfg.WaitSSHPortTimeout,
+		waitStageSSHHandshake: cfg.WaitSSHHandshakeTimeout,
+		waitStageNixOSSystem:  cfg.WaitNixOSSystemTimeout,
+		waitStageK3sAPI:       cfg.WaitK3sAPITimeout,
+		waitStageK3sReadyz:    cfg.WaitK3sReadyzTimeout,
+		waitStageK3sNodeReady: cfg.WaitK3sNodeReadyTimeout,
+	}[name]
+	backoff := wait.DefaultBackoff
+	backoff.Initial = cfg.WaitBackoff
+	backoff.Max = cfg.WaitMaxBackoff
+
+	if run.DryRun() {
+		run.Record("wait for stage '%s' (timeout %s)", name, timeout)
+		check = func(ctx context.Context) error { return nil }
+	} else {
+		fmt.Printf("INFO: Waiting for stage '%s' (timeout %s)...\n", name, timeout)
+	}
+	return wait.Stage{
+		Name:    name,
+		Timeout: timeout,
+		Backoff: backoff,
+		Check:   check,
+		OnRetry: func(attempt int, err error) {
+			fmt.Printf("INFO:   [%s] attempt %d not ready yet: %v\n", name, attempt, err)
+		},
+	}
+}
+
+// sshCommandCheck returns a wait check that runs command on target (user@host) over
+// SSH in batch mode and succeeds if it exits zero.
+func sshCommandCheck(sshClient *sshclient.Client, target, command string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := sshRun(ctx, sshClient, target, command)
+		return err
+	}
+}
+
+// waitForSSH waits until host accepts TCP connections on port 22 and target
+// (user@host) completes an SSH handshake and login with sshClient. The port and banner
+// probes are skipped for hosts behind a jump host, which this machine cannot reach directly.
+func waitForSSH(ctx context.Context, host, target string, sshClient *sshclient.Client) error {
+	addr := net.JoinHostPort(host, "22")
+	direct := sshClient.Route(host).Jump == ""
+	if direct {
+		if err := newWaitStage(waitStageSSHPort, wait.TCP(addr)).Run(ctx); err != nil {
+			return err
+		}
+	}
+	if err := newWaitStage(waitStageSSHHandshake, func(ctx context.Context) error {
+		if direct {
+			if err := wait.SSHBanner(addr)(ctx); err != nil {
+				return err
+			}
+		}
+		return sshCommandCheck(sshClient, target, "true")(ctx)
+	}).Run(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// waitForNixOS waits until target has rebooted into the installed NixOS system for
+// flakeConfigName. The hostname check distinguishes the installed system from the
+// NixOS installer that nixos-anywhere kexecs into, which also has /run/current-system.
+func waitForNixOS(ctx context.Context, host, target string, sshClient *sshclient.Client, flakeConfigName string) error {
+	if err := waitForSSH(ctx, host, target, sshClient); err != nil {
+		return err
+	}
+	command := fmt.Sprintf("test -e /run/current-system && test \"$(cat /proc/sys/kernel/hostname)\" = %q", flakeConfigName)
+	return newWaitStage(waitStageNixOSSystem, sshCommandCheck(sshClient, target, command)).Run(ctx)
+}
+
+// waitForK3s waits until the k3s API server on host accepts connections on port 6443
+// and reports ready on /readyz. The readiness check runs on the node itself because
+// the API server does not serve /readyz to anonymous clients. Behind a jump host, the
+// port is checked from the node as well.
+func waitForK3s(ctx context.Context, host, target string, sshClient *sshclient.Client) error {
+	portCheck := wait.TCP(net.JoinHostPort(host, "6443"))
+	if sshClient.Route(host).Jump != "" {
+		portCheck = sshCommandCheck(sshClient, target, "bash -c 'exec 3<>/dev/tcp/127.0.0.1/6443'")
+	}
+	if err := newWaitStage(waitStageK3sAPI, portCheck).Run(ctx); err != nil {
+		return err
+	}
+	return newWaitStage(waitStageK3sReadyz, sshCommandCheck(sshClient, target, "sudo k3s kubectl get --raw=/readyz")).Run(ctx)
+}
+
+// waitForK3sNode waits until the Kubernetes node nodeName reports Ready, as seen by the
+// API server on kubectlTarget, and its boot ID is the one of nodeTarget. The boot ID check
+// matters when nodeTarget replaces a machine with the same node name: the old machine keeps
+// the node Ready until it is retired, but only the kubelet on nodeTarget reports its boot ID.
+func waitForK3sNode(ctx context.Context, kubectlTarget, nodeTarget, nodeName string, sshClient *sshclient.Client) error {
+	status := fmt.Sprintf(`sudo k3s kubectl get node %s -o jsonpath='{.status.nodeInfo.bootID} {.status.conditions[?(@.type=="Ready")].status}'`, nodeName)
+	return newWaitStage(waitStageK3sNodeReady, func(ctx context.Context) error {
+		res, err := sshRun(ctx, sshClient, nodeTarget, "cat /proc/sys/kernel/random/boot_id")
+		if err != nil {
+			return err
+		}
+		bootID := strings.TrimSpace(res.Stdout)
+		if res, err = sshRun(ctx, sshClient, kubectlTarget, status); err != nil {
+			return err
+		}
+		if run.DryRun() {
+			return nil
+		}
+		nodeBootID, ready, _ := strings.Cut(strings.TrimSpace(res.Stdout), " ")
+		switch {
+		case nodeBootID != bootID:
+			return fmt.Errorf("node %s reports boot ID '%s', not the boot ID '%s' of %s; the kubelet on %s has not registered yet", nodeName, nodeBootID, bootID, nodeTarget, nodeTarget)
+		case ready != "True":
+			return fmt.Errorf("node %s is not Ready yet", nodeName)
+		}
+		return nil
+	}).Run(ctx)
+}
+
+// newSSHClient returns the SSH client used to connect to nodes. It authenticates with the
+// private key MAGE_SSH_KEY (default ~/.ssh/id_rsa, with ~ expanded) and the keys of the
+// ssh-agent at $SSH_AUTH_SOCK; a missing default key is fine if the agent is running. Host
+// keys are checked against knownHostsFile. Close it when done.
+func newSSHClient() (*sshclient.Client, error) {
+	sshKey := cfg.SSHKey
+	if !cfg.IsSet("MAGE_SSH_KEY") {
+		fmt.Printf("INFO: MAGE_SSH_KEY environment variable not set, using default: %s\n", sshKey)
+	}
+	sshKey, err := expandHome(sshKey)
+	if err != nil {
+		return nil, err
+	}
+	agentSocket := os.Getenv("SSH_AUTH_SOCK")
+
+	// Verify SSH key exists (optional but good practice)
+	if _, err := os.Stat(sshKey); os.IsNotExist(err) {
+		if cfg.IsSet("MAGE_SSH_KEY") || agentSocket == "" {
+			return nil, fmt.Errorf("ERROR: SSH key not found at %s", sshKey)
+		}
+		fmt.Printf("INFO: SSH key %s not found, using the keys of ssh-agent\n", sshKey)
+		sshKey = ""
+	} else {
+		fmt.Printf("INFO: Using SSH key: %s\n", sshKey)
+	}
+
+	knownHosts, err := knownHostsFile()
+	if err != nil {
+		return nil, err
+	}
+	client, err := sshclient.New(sshclient.Config{
+		KeyFile:     sshKey,
+		AgentSocket: agentSocket,
+		KnownHosts:  knownHosts,
+		DryRun:      run.DryRun(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: no usable SSH key: %w", err)
+	}
+	return client, nil
+}
+
+// knownHostsFile returns the known_hosts file pinning the SSH host keys of the nodes:
+// MAGE_SSH_KNOWN_HOSTS, or the cluster's known_hosts file next to its machines file.
+func knownHostsFile() (string, error) {
+	if cfg.SSHKnownHosts != "" {
+		return expandHome(cfg.SSHKnownHosts)
+	}
+	return cfg.Cluster().KnownHostsFile(), nil
+}
+
+// expandHome expands a leading ~/ in path to the home directory.
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(home, path[2:]), nil
+}
+
+// execResult is the outcome of Exec on one node.
+type execResult struct {
+	node, target string
+	exitCode     int
+	duration     time.Duration
+	err          error
+}
+
+// printExecSummary prints a table of the outcome of Exec on every node and returns an error
+// naming the nodes where the command failed. In dry-run mode only nodes that could not be
+// resolved fail.
+func printExecSummary(command string, results []execResult) error {
+	fmt.Printf("INFO: Summary of '%s':\n", command)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tTARGET\tSTATUS\tDURATION")
+	var failed []string
+	for _, res := range results {
+		status := "ok"
+		var exitErr *sshclient.ExitError
+		switch {
+		case errors.As(res.err, &exitErr):
+			status = fmt.Sprintf("exit %d", res.exitCode)
+		case res.err != nil:
+			status = "error: " + res.err.Error()
+		case run.DryRun():
+			status = "dry-run"
+		}
+		if res.err != nil {
+			failed = append(failed, res.node)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", res.node, valueOrNone(res.target), status, res.duration.Round(time.Millisecond))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("ERROR: '%s' failed on %d of %d node(s): %s", command, len(failed), len(results), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// sshProxyCommand returns an OpenSSH ProxyCommand tunnelling through jump (user@host) with
+// the same key and pinned host key as sshClient, for tools that run ssh themselves.
+func sshProxyCommand(sshClient *sshclient.Client, jump string) (string, error) {
+	host, port, _ := net.SplitHostPort(sshclient.Addr(jump))
+	route := sshClient.Route(sshclient.Addr(jump))
+	if route.Jump != "" {
+		return "", fmt.Errorf("ERROR: jump host %s is itself reached through %s; tools running ssh can only use one jump host", jump, route.Jump)
+	}
+	knownHosts, err := filepath.Abs(sshClient.KnownHosts().Path)
+	if err != nil {
+		return "", err
+	}
+	args := []string{"-o", "UserKnownHostsFile=" + knownHosts, "-o", "StrictHostKeyChecking=yes", "-p", port}
+	if route.HostKeyAlias != "" {
+		args = append(args, "-o", "HostKeyAlias="+route.HostKeyAlias)
+	}
+	if sshClient.KeyFile() != "" {
+		args = append(args, "-i", sshClient.KeyFile())
+	}
+	user, _, ok := strings.Cut(jump, "@")
+	if !ok {
+		user = "root"
+	}
+	args = append(args, "-W", "%h:%p", user+"@"+host)
+	return runner.FormatCommand("ssh", args...), nil
+}
+
+// nixCopy copies the closure of storePath to target (user@host) with `nix copy`, letting
+// the target substitute paths from its binary caches. ssh is given a config that connects
+// like sshClient: with its key, the pinned host key and through its jump host.
+func nixCopy(sshClient *sshclient.Client, target, storePath string) error {
+	user, _, ok := strings.Cut(target, "@")
+	if !ok {
+		user = "root"
+	}
+	host, port, _ := net.SplitHostPort(sshclient.Addr(target))
+	knownHosts, err := filepath.Abs(sshClient.KnownHosts().Path)
+	if err != nil {
+		return err
+	}
+	lines := []string{
+		"Host " + host,
+		"  Port " + port,
+		"  UserKnownHostsFile " + knownHosts,
+		"  StrictHostKeyChecking yes",
+		"  BatchMode yes",
+	}
+	route := sshClient.Route(sshclient.Addr(target))
+	if route.HostKeyAlias != "" {
+		lines = append(lines, "  HostKeyAlias "+route.HostKeyAlias)
+	}
+	if sshClient.KeyFile() != "" {
+		lines = append(lines, "  IdentityFile "+sshClient.KeyFile())
+	}
+	if route.Jump != "" {
+		proxyCommand, err := sshProxyCommand(sshClient, route.Jump)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, "  ProxyCommand "+proxyCommand)
+	}
+
+	tempDir, err := os.MkdirTemp("", "mage-nix-copy")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory for the ssh config: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+	sshConfig := filepath.Join(tempDir, "ssh_config")
+	if err := os.WriteFile(sshConfig, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write the ssh config: %w", err)
+	}
+	// Store URLs have no port; it comes from the ssh config.
+	storeHost := host
+	if strings.Contains(host, ":") {
+		storeHost = "[" + host + "]"
+	}
+	return run.RunWithV(map[string]string{"NIX_SSHOPTS": "-F " + sshConfig},
+		"nix", "copy", "--substitute-on-destination", "--to", "ssh-ng://"+user+"@"+storeHost, storePath)
+}
+
+// forgetHostKeys removes the pinned SSH host keys of hosts (empty ones are skipped), e.g.
+// because the server behind them was recreated.
+func forgetHostKeys(hosts ...string) error {
+	path, err := knownHostsFile()
+	if err != nil {
+		return err
+	}
+	knownHosts := sshclient.KnownHosts{Path: path}
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		if run.DryRun() {
+			run.Record("forget the pinned SSH host key of %s in %s", host, path)
+			continue
+		}
+		removed, err := knownHosts.Remove(host)
+		if err != nil {
+			return fmt.Errorf("failed to forget the SSH host key of %s: %w", host, err)
+		}
+		if removed > 0 {
+			fmt.Printf("INFO: Forgot the pinned SSH host key of %s in %s\n", host, path)
+		}
+	}
+	return nil
+}
+
+// repinHostKey pins the SSH host keys pinned for from under to as well, replacing those of
+// to, when the address to now reaches the machine that was reachable at from.
+func repinHostKey(from, to string) error {
+	if from == to {
+		return nil
+	}
+	path, err := knownHostsFile()
+	if err != nil {
+		return err
+	}
+	if run.DryRun() {
+		run.Record("pin the SSH host key of %s for %s in %s", from, to, path)
+		return nil
+	}
+	knownHosts := sshclient.KnownHosts{Path: path}
+	keys, err := knownHosts.Lookup(sshclient.Addr(from))
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("ERROR: no SSH host key of %s is pinned in %s, so none can be pinned for %s", from, path, to)
+	}
+	if _, err := knownHosts.Remove(to); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := knownHosts.Add(sshclient.Addr(to), key); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("INFO: Pinned the SSH host key of %s for %s in %s\n", from, to, path)
+	return nil
+}
+
+// serverHasAddress reports whether host is one of the server's public or private
+// addresses (or lies in its public IPv6 network).
+func serverHasAddress(server *hcloud.Server, host string) bool {
+	if host == server.PublicIPv4() {
+		return true
+	}
+	for _, privateNet := range server.PrivateNet {
+		if host == privateNet.IP {
+			return true
+		}
+	}
+	if _, ipv6Net, err := net.ParseCIDR(server.PublicIPv6()); err == nil {
+		return ipv6Net.Contains(net.ParseIP(host))
+	}
+	return false
+}
+
+// fetchKubeconfig copies k3s.yaml from target (user@host), points it at the control plane
+// address reachable from this machine, renames its entries to the cluster name and merges
+// it into the local kubeconfig.
+func fetchKubeconfig(ctx context.Context, target string, sshClient *sshclient.Client) error {
+	// K3S_CONTROL_PLANE_ADDR becomes the server of the kubeconfig, so a placeholder or a
+	// malformed value must not end up there.
+	if err := cfg.Validate("K3S_CONTROL_PLANE_ADDR"); err != nil {
+		return err
+	}
+	if run.DryRun() {
+		path, err := kubeconfigPath()
+		if err != nil {
+			return err
+		}
+		run.Record("fetch /etc/rancher/k3s/k3s.yaml from %s and merge it into %s", target, path)
+		return nil
+	}
+
+	// We need to connect as the root user on the *newly installed* system.
+	res, err := sshRun(ctx, sshClient, target, "sudo cat /etc/rancher/k3s/k3s.yaml")
+	if err != nil {
+		return fmt.Errorf("failed to read k3s.yaml: %w", err)
+	}
+	fetched, err := kubeconfig.Parse([]byte(res.Stdout))
+	if err != nil {
+		return err
+	}
+
+	server, err := controlPlaneServerURL(ctx, target, sshClient)
+	if err != nil {
+		return err
+	}
+	clusterName := cfg.K3sClusterName
+	if !cfg.IsSet("K3S_CLUSTER_NAME") {
+		fmt.Printf("INFO: K3S_CLUSTER_NAME not set, defaulting to %s\n", clusterName)
+	}
+	fetched.SetServer(server)
+	if err := fetched.Rename(clusterName); err != nil {
+		return err
+	}
+
+	path, err := kubeconfigPath()
+	if err != nil {
+		return err
+	}
+	merged, err := kubeconfig.Load(path)
+	if err != nil {
+		return err
+	}
+	merged.Merge(fetched)
+	if cfg.KubeconfigUseContext {
+		merged.CurrentContext = clusterName
+	}
+	if err := merged.Write(path); err != nil {
+		return err
+	}
+
+	if cfg.KubeconfigUseContext {
+		fmt.Printf("INFO: Merged context '%s' (server %s) into %s and made it the current context (set MAGE_KUBECONFIG_USE_CONTEXT=false to keep the current one)\n", clusterName, server, path)
+	} else {
+		fmt.Printf("INFO: Merged context '%s' (server %s) into %s, the current context is still '%s'\n", clusterName, server, path, valueOrNone(merged.CurrentContext))
+	}
+	fmt.Printf("INFO: To use it, run: kubectl --context %s get nodes\n", clusterName)
+	return nil
+}
+
+// controlPlaneServerURL returns the API server URL to put into a fetched kubeconfig:
+// K3S_CONTROL_PLANE_ADDR if set, otherwise the Tailscale IPv4 address of the node at target.
+func controlPlaneServerURL(ctx context.Context, target string, sshClient *sshclient.Client) (string, error) {
+	if cfg.K3sControlPlaneAddr != "" {
+		return k3sServerURL(cfg.K3sControlPlaneAddr), nil
+	}
+	fmt.Println("INFO: K3S_CONTROL_PLANE_ADDR not set, using the node's Tailscale IP")
+	res, err := sshRun(ctx, sshClient, target, "tailscale ip -4")
+	if err != nil {
+		return "", fmt.Errorf("K3S_CONTROL_PLANE_ADDR is not set and the node's Tailscale IP could not be determined: %w", err)
+	}
+	// `tailscale ip -4` prints one address per line; the first is the node's own.
+	return k3sServerURL(strings.TrimSpace(strings.SplitN(res.Stdout, "\n", 2)[0])), nil
+}
+
+// k3sServerURL returns the URL of the k3s API on host, a bare hostname or IP address like
+// K3S_CONTROL_PLANE_ADDR, the same way the NixOS roles build it.
+func k3sServerURL(host string) string {
+	return "https://" + net.JoinHostPort(host, strconv.Itoa(k3sAPIPort))
+}
+
+// kubeconfigPath returns the kubeconfig to merge into: the first entry of $KUBECONFIG,
+// or ~/.kube/config.
+func kubeconfigPath() (string, error) {
+	if cfg.Kubeconfig != "" {
+		return filepath.SplitList(cfg.Kubeconfig)[0], nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(home, ".kube", "config"), nil
+}
+
+// sshRun runs command on target (user@host) over SSH and returns its result, which is
+// also returned when the command fails. In dry-run mode the command is only recorded.
+func sshRun(ctx context.Context, sshClient *sshclient.Client, target, command string) (*sshclient.Result, error) {
+	if run.DryRun() {
+		run.Record("run on %s over SSH: %s", target, command)
+		return &sshclient.Result{Target: target, Command: command}, nil
+	}
+	res, err := sshClient.Run(ctx, target, command)
+	return res, sshHint(err)
+}
+
+// sshQuery runs a read-only command on target (user@host) over SSH and returns its
+// result. Unlike sshRun it also runs in dry-run mode.
+func sshQuery(ctx context.Context, sshClient *sshclient.Client, target, command string) (*sshclient.Result, error) {
+	res, err := sshClient.Run(ctx, target, command)
+	return res, sshHint(err)
+}
+
+// sshStream runs command on target (user@host) over SSH like sshRun, printing its output
+// as it arrives.
+func sshStream(ctx context.Context, sshClient *sshclient.Client, target, command string) (*sshclient.Result, error) {
+	if run.DryRun() {
+		return sshRun(ctx, sshClient, target, command)
+	}
+	res, err := sshClient.Exec(ctx, sshclient.Command{Target: target, Command: command, Stdout: os.Stdout, Stderr: os.Stderr})
+	return res, sshHint(err)
+}
+
+// sshHint adds what to do to a host key error.
+func sshHint(err error) error {
+	var unknown *sshclient.UnknownHostError
+	var mismatch *sshclient.HostKeyMismatchError
+	switch {
+	case errors.As(err, &unknown):
+		return fmt.Errorf("%w. Check the fingerprint and pin it with 'mage trustHostKey <node>'", err)
+	case errors.As(err, &mismatch):
+		return fmt.Errorf("%w. The connection may be intercepted; if the machine was reinstalled without its host keys, replace the pinned key with 'mage trustHostKey <node>'", err)
+	}
+	return err
+}
+
+// valueOrNone returns s, or "<none>" if s is empty, for printing optional values.
+func valueOrNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
 }
 
 // getDir is a helper to get the directory of a path. Not directly used by user targets.
@@ -492,8 +3570,8 @@ func getDir(path string) string {
 // DeployControlNode is a convenience function to deploy the thinkcenter-1 node.
 // It's an alias for `mage recreateNode thinkcenter-1`.
 // Usage: mage DeployControlNode
-func DeployControlNode() error {
+func DeployControlNode(ctx context.Context) error {
 	fmt.Println("INFO: Deploying self-hosted control node (thinkcenter-1)...")
 	// Call RecreateNode with the specific configuration name
-	return RecreateNode("thinkcenter-1")
+	return RecreateNode(ctx, "thinkcenter-1")
 }